@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AgentAuth protects the agent API. Every request must carry a token signed with the
+// shared secret also configured in the vms-manager and the other server agents.
+// TLS is optional, when a client CA is configured clients must present a certificate
+// signed by it (mTLS). The same credentials are used to call other server agents
+type AgentAuth struct {
+	secret          []byte
+	serverTlsConfig *tls.Config
+	client          *http.Client
+	// Paths whose bodies are too big to buffer, they're checked while the handler reads them
+	streamedPaths []string
+}
+
+func (auth *AgentAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(auth.secret) > 0 {
+			if err := verifyAgentRequest(auth.secret, r, auth.isStreamedPath(r.URL.Path)); err != nil {
+				log.Printf("Rejected %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+				writeResponse(w, http.StatusUnauthorized, ApiError{Error: err.Error()})
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (auth *AgentAuth) isStreamedPath(path string) bool {
+	for _, prefix := range auth.streamedPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client returns the HTTP client to call other server agents with
+func (auth *AgentAuth) Client() *http.Client {
+	return auth.client
+}
+
+// ListenAndServe serves the agent API, streamedPaths are the path prefixes of the endpoints that read
+// big bodies, e.g. the files of the VMs being migrated
+func (auth *AgentAuth) ListenAndServe(listenAddr string, handler http.Handler, streamedPaths ...string) error {
+	auth.streamedPaths = streamedPaths
+
+	if auth.serverTlsConfig == nil {
+		return http.ListenAndServe(listenAddr, auth.middleware(handler))
+	}
+
+	server := &http.Server{
+		Addr:      listenAddr,
+		Handler:   auth.middleware(handler),
+		TLSConfig: auth.serverTlsConfig,
+	}
+
+	// The certificates are already loaded in the TLS config
+	return server.ListenAndServeTLS("", "")
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caPem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, logAndReturnError("Error reading CA file: ", err.Error())
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return nil, logAndReturnError("Error parsing CA file: ", "no PEM certificates found in "+caFile)
+	}
+
+	return pool, nil
+}
+
+// NewAgentAuth builds the agent credentials. certFile and keyFile enable TLS,
+// clientCaFile additionally requires client certificates and caFile is used
+// to verify other server agents when calling them
+func NewAgentAuth(secret string, certFile string, keyFile string, clientCaFile string, caFile string) (*AgentAuth, error) {
+	auth := &AgentAuth{secret: []byte(secret)}
+
+	if secret == "" {
+		log.Println("WARNING: AGENT_AUTH_SECRET is not set, the agent API won't check who is calling it")
+	}
+
+	clientTlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, logAndReturnError("Error loading TLS certificate: ", err.Error())
+		}
+
+		auth.serverTlsConfig = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{certificate},
+		}
+		// Other server agents authenticate this one by the same certificate
+		clientTlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	if clientCaFile != "" {
+		if auth.serverTlsConfig == nil {
+			return nil, logAndReturnError("Error configuring mTLS: ", "TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+
+		pool, err := loadCertPool(clientCaFile)
+		if err != nil {
+			return nil, err
+		}
+
+		auth.serverTlsConfig.ClientCAs = pool
+		auth.serverTlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		clientTlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = clientTlsConfig
+
+	var roundTripper http.RoundTripper = transport
+	if secret != "" {
+		roundTripper = &agentTokenTransport{secret: auth.secret, base: transport}
+	}
+
+	auth.client = &http.Client{Transport: roundTripper}
+
+	return auth, nil
+}
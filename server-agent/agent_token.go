@@ -0,0 +1,165 @@
+package main
+
+// The vms manager signs and verifies the requests between them with a copy of this file made by
+// go generate (see its agent_client.go), changes go here and the copy is generated again
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signed tokens older or newer than this are rejected, it bounds replays of captured requests
+const AGENT_TOKEN_MAX_CLOCK_SKEW = 60 * time.Second
+const AGENT_TOKEN_SCHEME = "AgentToken "
+
+// SHA-256 of the request body, covered by the token so it can't be replayed with another body
+const AGENT_BODY_HASH_HEADER = "X-Agent-Body-Sha256"
+
+// Bodies up to this size are checked before the request is handled, bigger ones are only
+// accepted by streamed endpoints, which fail when they reach the end of a body that doesn't match
+const AGENT_SIGNED_BODY_MAX_BUFFER = 16 << 20
+
+var ErrAgentBodyMismatch = errors.New("request body doesn't match the agent token")
+
+type agentTokenTransport struct {
+	secret []byte
+	base   http.RoundTripper
+}
+
+func (t *agentTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the original request
+	req = req.Clone(req.Context())
+	if err := signAgentRequest(t.secret, req, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// signAgentRequest sets the body hash and the token of a request. Streamed bodies, which
+// can't be read twice, must come with the body hash header already set
+func signAgentRequest(secret []byte, req *http.Request, now time.Time) error {
+	bodyHash := req.Header.Get(AGENT_BODY_HASH_HEADER)
+	if bodyHash == "" {
+		body := []byte{}
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return fmt.Errorf("can't sign the streamed body of %s %s without its hash", req.Method, req.URL.Path)
+			}
+
+			reader, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+
+			if body, err = io.ReadAll(reader); err != nil {
+				return err
+			}
+		}
+
+		bodyHash = hashAgentBody(body)
+		req.Header.Set(AGENT_BODY_HASH_HEADER, bodyHash)
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := agentTokenSignature(secret, req.Method, req.URL.Path, req.URL.RawQuery, bodyHash, timestamp)
+	req.Header.Set("Authorization", AGENT_TOKEN_SCHEME+timestamp+"."+signature)
+
+	return nil
+}
+
+// verifyAgentRequest checks the token of a request and that its body is the signed one. When streamed
+// is set big bodies are checked while they're read and the last read fails if they don't match
+func verifyAgentRequest(secret []byte, r *http.Request, streamed bool) error {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, AGENT_TOKEN_SCHEME) {
+		return fmt.Errorf("missing agent token")
+	}
+
+	timestamp, signature, found := strings.Cut(strings.TrimPrefix(header, AGENT_TOKEN_SCHEME), ".")
+	if !found {
+		return fmt.Errorf("malformed agent token")
+	}
+
+	unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed agent token")
+	}
+
+	skew := time.Since(time.Unix(unixTime, 0))
+	if skew > AGENT_TOKEN_MAX_CLOCK_SKEW || skew < -AGENT_TOKEN_MAX_CLOCK_SKEW {
+		return fmt.Errorf("expired agent token")
+	}
+
+	bodyHash := r.Header.Get(AGENT_BODY_HASH_HEADER)
+	expected := agentTokenSignature(secret, r.Method, r.URL.Path, r.URL.RawQuery, bodyHash, timestamp)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("invalid agent token")
+	}
+
+	if streamed && (r.ContentLength < 0 || r.ContentLength > AGENT_SIGNED_BODY_MAX_BUFFER) {
+		r.Body = &verifiedBodyReader{body: r.Body, hash: sha256.New(), expected: bodyHash}
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, AGENT_SIGNED_BODY_MAX_BUFFER+1))
+	if err != nil {
+		return fmt.Errorf("error reading request body: %w", err)
+	}
+
+	if len(body) > AGENT_SIGNED_BODY_MAX_BUFFER {
+		return fmt.Errorf("request body is bigger than %d bytes", AGENT_SIGNED_BODY_MAX_BUFFER)
+	}
+
+	if !hmac.Equal([]byte(hashAgentBody(body)), []byte(bodyHash)) {
+		return ErrAgentBodyMismatch
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	return nil
+}
+
+func agentTokenSignature(secret []byte, method string, path string, query string, bodyHash string, timestamp string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + query + "\n" + bodyHash + "\n" + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func hashAgentBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifiedBodyReader hashes a streamed body while it's read, reaching its end fails if it isn't the signed one
+type verifiedBodyReader struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (v *verifiedBodyReader) Read(p []byte) (int, error) {
+	n, err := v.body.Read(p)
+	v.hash.Write(p[:n])
+
+	if err == io.EOF && !hmac.Equal([]byte(hex.EncodeToString(v.hash.Sum(nil))), []byte(v.expected)) {
+		return n, ErrAgentBodyMismatch
+	}
+
+	return n, err
+}
+
+func (v *verifiedBodyReader) Close() error {
+	return v.body.Close()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAgentSecret = []byte("test-secret")
+
+// signedRequest returns the request a server would receive after a client signed it
+func signedRequest(t *testing.T, method string, target string, body string) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest(method, "http://agent"+target, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signAgentRequest(testAgentSecret, req, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	received := httptest.NewRequest(method, target, strings.NewReader(body))
+	received.Header = req.Header
+	return received
+}
+
+func TestVerifyAgentRequest(t *testing.T) {
+	r := signedRequest(t, http.MethodPost, "/instances/start?force=true", `{"instanceId":"a"}`)
+
+	if err := verifyAgentRequest(testAgentSecret, r, false); err != nil {
+		t.Fatalf("expected the request to be valid, got %v", err)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil || string(body) != `{"instanceId":"a"}` {
+		t.Fatalf("expected the body to be readable after verifying it, got %q (%v)", body, err)
+	}
+}
+
+func TestVerifyAgentRequestRejectsChangedQuery(t *testing.T) {
+	r := signedRequest(t, http.MethodPost, "/instances/start?force=true", `{}`)
+	r.URL.RawQuery = "force=false"
+
+	if err := verifyAgentRequest(testAgentSecret, r, false); err == nil {
+		t.Fatal("expected a request with another query to be rejected")
+	}
+}
+
+func TestVerifyAgentRequestRejectsChangedBody(t *testing.T) {
+	r := signedRequest(t, http.MethodPost, "/instances/start", `{"instanceId":"a"}`)
+	r.Body = io.NopCloser(strings.NewReader(`{"instanceId":"b"}`))
+
+	if err := verifyAgentRequest(testAgentSecret, r, false); !errors.Is(err, ErrAgentBodyMismatch) {
+		t.Fatalf("expected ErrAgentBodyMismatch, got %v", err)
+	}
+}
+
+func TestVerifyAgentRequestStreamedBody(t *testing.T) {
+	r := signedRequest(t, http.MethodPut, "/vms/receive/vm/disk.qcow2", "disk contents")
+	r.ContentLength = -1
+	r.Body = io.NopCloser(strings.NewReader("other contents"))
+
+	// The token is valid, the body is only known not to match once it's read
+	if err := verifyAgentRequest(testAgentSecret, r, true); err != nil {
+		t.Fatalf("expected the token to be valid, got %v", err)
+	}
+
+	if _, err := io.Copy(io.Discard, r.Body); !errors.Is(err, ErrAgentBodyMismatch) {
+		t.Fatalf("expected ErrAgentBodyMismatch reading the body, got %v", err)
+	}
+}
+
+func TestSignAgentRequestRequiresHashOfStreamedBody(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPut, "http://agent/vms/receive/vm/disk.qcow2", io.NopCloser(strings.NewReader("disk")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signAgentRequest(testAgentSecret, req, time.Now()); err == nil {
+		t.Fatal("expected signing a streamed body without its hash to fail")
+	}
+}
+
+// The vms manager copy must be generated again when the scheme changes
+func TestVmsManagerAgentTokenIsUpToDate(t *testing.T) {
+	source, err := os.ReadFile("agent_token.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generated, err := os.ReadFile("../vms-manager/agent_token.go")
+	if err != nil {
+		t.Skipf("vms manager sources not available: %v", err)
+	}
+
+	header := "// Code generated from ../server-agent/agent_token.go by go generate. DO NOT EDIT.\n\n"
+	if string(generated) != header+string(source) {
+		t.Fatal("../vms-manager/agent_token.go is out of date, run go generate in the vms manager")
+	}
+}
@@ -9,18 +9,29 @@ import (
 type apiFunc func(w http.ResponseWriter, r *http.Request) error
 
 type ApiServer struct {
-	listenAddr                  string
-	serverAgent                 ServerAgent
-	listBaseImagesEndpoint      string
-	defineTemplateEndpoint      string
-	createInstanceEndpoint      string
-	deleteVmEndpoint            string
-	startInstanceEndpoint       string
-	stopInstanceEndpoint        string
-	restartInstanceEndpoint     string
-	listInstancesStatusEndpoint string
-	getResourceStatusEndpoint   string
-	isAliveEndpoint             string
+	listenAddr                   string
+	auth                         *AgentAuth
+	serverAgent                  ServerAgent
+	listBaseImagesEndpoint       string
+	defineTemplateEndpoint       string
+	createInstanceEndpoint       string
+	deleteVmEndpoint             string
+	startInstanceEndpoint        string
+	stopInstanceEndpoint         string
+	restartInstanceEndpoint      string
+	listInstancesStatusEndpoint  string
+	listVmDisksEndpoint          string
+	getResourceStatusEndpoint    string
+	isAliveEndpoint              string
+	migrateInstanceEndpoint      string
+	receiveVmFileEndpoint        string
+	importInstanceEndpoint       string
+	setupInstanceNetworkEndpoint string
+	createSnapshotEndpoint       string
+	listSnapshotsEndpoint        string
+	revertSnapshotEndpoint       string
+	deleteSnapshotEndpoint       string
+	instanceConsoleEndpoint      string
 }
 
 type ApiError struct {
@@ -117,6 +128,15 @@ func (server *ApiServer) handleListInstancesStatus(w http.ResponseWriter, r *htt
 	return writeResponse(w, http.StatusOK, statuses)
 }
 
+func (server *ApiServer) handleListVmDisks(w http.ResponseWriter, r *http.Request) error {
+	disks, err := server.serverAgent.ListVmDisks()
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, disks)
+}
+
 func (server *ApiServer) handleGetResourceStatus(w http.ResponseWriter, r *http.Request) error {
 	status, err := server.serverAgent.GetResourceStatus()
 	if err != nil {
@@ -126,6 +146,99 @@ func (server *ApiServer) handleGetResourceStatus(w http.ResponseWriter, r *http.
 	return writeResponse(w, http.StatusOK, status)
 }
 
+func (server *ApiServer) handleMigrateInstance(w http.ResponseWriter, r *http.Request) error {
+	var request MigrateInstanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.serverAgent.MigrateInstance(request); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleReceiveVmFile(w http.ResponseWriter, r *http.Request) error {
+	vmId := r.PathValue("vmId")
+	fileName := r.PathValue("fileName")
+
+	if err := server.serverAgent.ReceiveVmFile(vmId, fileName, r.Body); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleImportInstance(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+
+	if err := server.serverAgent.ImportInstance(instanceId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleSetupInstanceNetwork(w http.ResponseWriter, r *http.Request) error {
+	var request SetupInstanceNetworkRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.serverAgent.SetupInstanceNetwork(request); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleCreateSnapshot(w http.ResponseWriter, r *http.Request) error {
+	var request CreateSnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.serverAgent.CreateSnapshot(request); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleListSnapshots(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+
+	snapshots, err := server.serverAgent.ListSnapshots(instanceId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, snapshots)
+}
+
+func (server *ApiServer) handleRevertSnapshot(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+	snapshotId := r.PathValue("snapshotId")
+
+	if err := server.serverAgent.RevertSnapshot(instanceId, snapshotId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleDeleteSnapshot(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+	snapshotId := r.PathValue("snapshotId")
+
+	if err := server.serverAgent.DeleteSnapshot(instanceId, snapshotId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
 func (server *ApiServer) handleIsAlive(w http.ResponseWriter, r *http.Request) error {
 	return writeResponse(w, http.StatusOK, nil)
 }
@@ -150,8 +263,32 @@ func createHttpHandler(fn apiFunc) http.HandlerFunc {
 	}
 }
 
+func (server *ApiServer) handleInstanceConsole(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+
+	// Connect to the VNC server before upgrading so errors can still be answered as HTTP
+	vnc, err := server.serverAgent.OpenInstanceConsole(instanceId)
+	if err != nil {
+		return err
+	}
+
+	ws, err := consoleUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		vnc.Close()
+		// The upgrader already answered the request
+		log.Printf("Error upgrading console connection: %v", err)
+		return nil
+	}
+
+	proxyConsole(ws, vnc)
+	log.Printf("Console of instance '%s' closed", instanceId)
+
+	return nil
+}
+
 func NewApiServer(
 	listenAddr string,
+	auth *AgentAuth,
 	serverAgent ServerAgent,
 	listBaseImagesEndpoint string,
 	defineTemplateEndpoint string,
@@ -163,20 +300,41 @@ func NewApiServer(
 	listInstancesStatusEndpoint string,
 	getResourceStatusEndpoint string,
 	isAliveEndpoint string,
+	migrateInstanceEndpoint string,
+	receiveVmFileEndpoint string,
+	importInstanceEndpoint string,
+	setupInstanceNetworkEndpoint string,
+	createSnapshotEndpoint string,
+	listSnapshotsEndpoint string,
+	revertSnapshotEndpoint string,
+	deleteSnapshotEndpoint string,
+	instanceConsoleEndpoint string,
+	listVmDisksEndpoint string,
 ) *ApiServer {
 	return &ApiServer{
-		listenAddr:                  listenAddr,
-		serverAgent:                 serverAgent,
-		listBaseImagesEndpoint:      listBaseImagesEndpoint,
-		defineTemplateEndpoint:      defineTemplateEndpoint,
-		createInstanceEndpoint:      createInstanceEndpoint,
-		deleteVmEndpoint:            deleteVmEndpoint,
-		startInstanceEndpoint:       startInstanceEndpoint,
-		stopInstanceEndpoint:        stopInstanceEndpoint,
-		restartInstanceEndpoint:     restartInstanceEndpoint,
-		listInstancesStatusEndpoint: listInstancesStatusEndpoint,
-		getResourceStatusEndpoint:   getResourceStatusEndpoint,
-		isAliveEndpoint:             isAliveEndpoint,
+		listenAddr:                   listenAddr,
+		auth:                         auth,
+		serverAgent:                  serverAgent,
+		listBaseImagesEndpoint:       listBaseImagesEndpoint,
+		defineTemplateEndpoint:       defineTemplateEndpoint,
+		createInstanceEndpoint:       createInstanceEndpoint,
+		deleteVmEndpoint:             deleteVmEndpoint,
+		startInstanceEndpoint:        startInstanceEndpoint,
+		stopInstanceEndpoint:         stopInstanceEndpoint,
+		restartInstanceEndpoint:      restartInstanceEndpoint,
+		listInstancesStatusEndpoint:  listInstancesStatusEndpoint,
+		getResourceStatusEndpoint:    getResourceStatusEndpoint,
+		isAliveEndpoint:              isAliveEndpoint,
+		migrateInstanceEndpoint:      migrateInstanceEndpoint,
+		receiveVmFileEndpoint:        receiveVmFileEndpoint,
+		importInstanceEndpoint:       importInstanceEndpoint,
+		setupInstanceNetworkEndpoint: setupInstanceNetworkEndpoint,
+		createSnapshotEndpoint:       createSnapshotEndpoint,
+		listSnapshotsEndpoint:        listSnapshotsEndpoint,
+		revertSnapshotEndpoint:       revertSnapshotEndpoint,
+		deleteSnapshotEndpoint:       deleteSnapshotEndpoint,
+		instanceConsoleEndpoint:      instanceConsoleEndpoint,
+		listVmDisksEndpoint:          listVmDisksEndpoint,
 	}
 }
 
@@ -215,6 +373,10 @@ func (server *ApiServer) Run() {
 		"GET "+server.listInstancesStatusEndpoint,
 		createHttpHandler(server.handleListInstancesStatus),
 	)
+	mux.HandleFunc(
+		"GET "+server.listVmDisksEndpoint,
+		createHttpHandler(server.handleListVmDisks),
+	)
 	mux.HandleFunc(
 		"GET "+server.getResourceStatusEndpoint,
 		createHttpHandler(server.handleGetResourceStatus),
@@ -223,10 +385,47 @@ func (server *ApiServer) Run() {
 		"GET "+server.isAliveEndpoint,
 		createHttpHandler(server.handleIsAlive),
 	)
+	mux.HandleFunc(
+		"POST "+server.migrateInstanceEndpoint,
+		createHttpHandler(server.handleMigrateInstance),
+	)
+	mux.HandleFunc(
+		"PUT "+server.receiveVmFileEndpoint+"/{vmId}/{fileName}",
+		createHttpHandler(server.handleReceiveVmFile),
+	)
+	mux.HandleFunc(
+		"POST "+server.importInstanceEndpoint+"/{instanceId}",
+		createHttpHandler(server.handleImportInstance),
+	)
+	mux.HandleFunc(
+		"POST "+server.setupInstanceNetworkEndpoint,
+		createHttpHandler(server.handleSetupInstanceNetwork),
+	)
+	mux.HandleFunc(
+		"POST "+server.createSnapshotEndpoint,
+		createHttpHandler(server.handleCreateSnapshot),
+	)
+	mux.HandleFunc(
+		"GET "+server.listSnapshotsEndpoint+"/{instanceId}",
+		createHttpHandler(server.handleListSnapshots),
+	)
+	mux.HandleFunc(
+		"POST "+server.revertSnapshotEndpoint+"/{instanceId}/{snapshotId}",
+		createHttpHandler(server.handleRevertSnapshot),
+	)
+	mux.HandleFunc(
+		"DELETE "+server.deleteSnapshotEndpoint+"/{instanceId}/{snapshotId}",
+		createHttpHandler(server.handleDeleteSnapshot),
+	)
+
+	mux.HandleFunc(
+		"GET "+server.instanceConsoleEndpoint+"/{instanceId}",
+		createHttpHandler(server.handleInstanceConsole),
+	)
 
 	log.Println("Starting server agent on", server.listenAddr)
 
-	if err := http.ListenAndServe(server.listenAddr, mux); err != nil {
+	if err := server.auth.ListenAndServe(server.listenAddr, mux, server.receiveVmFileEndpoint+"/"); err != nil {
 		log.Fatal("Error starting server agent:", err)
 	}
 }
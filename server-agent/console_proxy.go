@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const CONSOLE_DIAL_TIMEOUT = 5 * time.Second
+
+// noVNC and most VNC web clients negotiate the "binary" subprotocol
+var consoleUpgrader = websocket.Upgrader{
+	Subprotocols: []string{"binary"},
+	// Consoles are only reachable through the vms-manager, which validates the ticket
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type DomainGraphicsXML struct {
+	Graphics []struct {
+		Type   string `xml:"type,attr"`
+		Port   string `xml:"port,attr"`
+		Listen string `xml:"listen,attr"`
+	} `xml:"devices>graphics"`
+}
+
+// getVncAddress resolves the address of the VNC server of a running domain from its XML
+func getVncAddress(domainXml string) (string, error) {
+	var domain DomainGraphicsXML
+	if err := xml.Unmarshal([]byte(domainXml), &domain); err != nil {
+		return "", logAndReturnError("Error parsing domain XML: ", err.Error())
+	}
+
+	for _, graphics := range domain.Graphics {
+		if graphics.Type != "vnc" {
+			continue
+		}
+
+		// The port is -1 until the domain is started
+		port, err := strconv.Atoi(graphics.Port)
+		if err != nil || port <= 0 {
+			return "", NewHttpError(http.StatusBadRequest, errors.New("instance is not running in this server"))
+		}
+
+		// Older domains listen on every interface, but the console is only proxied locally
+		host := graphics.Listen
+		if host == "" || host == "0.0.0.0" {
+			host = "127.0.0.1"
+		}
+
+		return net.JoinHostPort(host, strconv.Itoa(port)), nil
+	}
+
+	return "", NewHttpError(http.StatusNotFound, errors.New("instance has no VNC console"))
+}
+
+// proxyConsole relays the VNC stream between the websocket and the VNC server until one of them closes
+func proxyConsole(ws *websocket.Conn, vnc net.Conn) {
+	defer ws.Close()
+	defer vnc.Close()
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		defer func() { done <- struct{}{} }()
+		buffer := make([]byte, 32*1024)
+		for {
+			n, err := vnc.Read(buffer)
+			if n > 0 {
+				if err := ws.WriteMessage(websocket.BinaryMessage, buffer[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("Error reading from VNC server: %v", err)
+				}
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer func() { done <- struct{}{} }()
+		for {
+			_, message, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, err := vnc.Write(message); err != nil {
+				log.Printf("Error writing to VNC server: %v", err)
+				return
+			}
+		}
+	}()
+
+	<-done
+}
+
+func dialVnc(address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, CONSOLE_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, logAndReturnError(fmt.Sprintf("Error connecting to VNC server at %s: ", address), err.Error())
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Listing the domains is a local libvirt call, it's cheap enough to diff them every few seconds
+const DOMAIN_EVENTS_POLL_INTERVAL = 2 * time.Second
+
+// The vms manager keeps the domains in memory, full reports rebuild them after it restarts
+// and tell it this server agent is still reporting
+const DOMAIN_EVENTS_FULL_REPORT_INTERVAL = 30 * time.Second
+
+// DomainEvents reports to the vms manager the domains whose state changed, e.g. when an
+// instance finishes booting or shuts down from inside, so it doesn't have to ask every server agent
+type DomainEvents struct {
+	hypervisor           Hypervisor
+	client               *http.Client
+	vmsManagerUrl        string
+	advertiseUrl         string
+	domainEventsEndpoint string
+	// States the vms manager already knows, only updated when a report succeeds
+	reported       map[string]string
+	lastFullReport time.Time
+	failing        bool
+}
+
+func (events *DomainEvents) Run() {
+	for {
+		time.Sleep(DOMAIN_EVENTS_POLL_INTERVAL)
+
+		if err := events.report(); err != nil {
+			// The vms manager may have lost the state, the next report sends all the domains
+			events.lastFullReport = time.Time{}
+			if !events.failing {
+				log.Printf("Error reporting domain events to the vms manager: %v", err)
+				events.failing = true
+			}
+			continue
+		}
+
+		if events.failing {
+			log.Printf("Reporting domain events to the vms manager again")
+			events.failing = false
+		}
+	}
+}
+
+func (events *DomainEvents) report() error {
+	domains, err := events.hypervisor.ListDomains()
+	if err != nil {
+		return logAndReturnError("Error listing domains: ", err.Error())
+	}
+
+	current := map[string]string{}
+	for _, domain := range domains {
+		current[domain.Name] = string(domain.State)
+	}
+
+	request := DomainEventsRequest{
+		Url:            events.advertiseUrl,
+		Full:           time.Since(events.lastFullReport) >= DOMAIN_EVENTS_FULL_REPORT_INTERVAL,
+		Domains:        []ListInstancesStatusResponse{},
+		RemovedDomains: []string{},
+	}
+
+	for _, status := range toListInstancesStatusResponse(domains) {
+		if previous, found := events.reported[status.InstanceId]; request.Full || !found || previous != status.Status {
+			request.Domains = append(request.Domains, status)
+		}
+	}
+
+	if !request.Full {
+		for instanceId := range events.reported {
+			if _, found := current[instanceId]; !found {
+				request.RemovedDomains = append(request.RemovedDomains, instanceId)
+			}
+		}
+
+		if len(request.Domains) == 0 && len(request.RemovedDomains) == 0 {
+			return nil
+		}
+	}
+
+	if err := events.post(request); err != nil {
+		return err
+	}
+
+	events.reported = current
+	if request.Full {
+		events.lastFullReport = time.Now()
+	}
+
+	return nil
+}
+
+func (events *DomainEvents) post(request DomainEventsRequest) error {
+	requestBody, err := json.Marshal(request)
+	if err != nil {
+		return logAndReturnError("Error marshalling request: ", err.Error())
+	}
+
+	resp, err := events.client.Post(
+		events.vmsManagerUrl+events.domainEventsEndpoint,
+		"application/json",
+		bytes.NewBuffer(requestBody),
+	)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkIfStatusCodeIsOk(resp)
+}
+
+func NewDomainEvents(
+	hypervisor Hypervisor,
+	client *http.Client,
+	vmsManagerUrl string,
+	advertiseUrl string,
+	domainEventsEndpoint string,
+) *DomainEvents {
+	return &DomainEvents{
+		hypervisor:           hypervisor,
+		client:               client,
+		vmsManagerUrl:        strings.TrimSuffix(vmsManagerUrl, "/"),
+		advertiseUrl:         strings.TrimSuffix(advertiseUrl, "/"),
+		domainEventsEndpoint: domainEventsEndpoint,
+		reported:             map[string]string{},
+	}
+}
@@ -2,4 +2,13 @@ module github.com/ajutra/remote-vms-deployment/server-agent
 
 go 1.23.5
 
-require github.com/joho/godotenv v1.5.1
+require (
+	github.com/digitalocean/go-libvirt v0.0.0-20240812180835-9c6c0a310c6c
+	github.com/gorilla/websocket v1.5.3
+	github.com/joho/godotenv v1.5.1
+)
+
+require (
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+)
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+)
+
+// DomainState values match the ones printed by virsh, they are
+// returned as is to the vms-manager as the status of the instances
+type DomainState string
+
+const (
+	DomainNoState     DomainState = "no state"
+	DomainRunning     DomainState = "running"
+	DomainIdle        DomainState = "idle"
+	DomainPaused      DomainState = "paused"
+	DomainInShutdown  DomainState = "in shutdown"
+	DomainShutOff     DomainState = "shut off"
+	DomainCrashed     DomainState = "crashed"
+	DomainPmSuspended DomainState = "pmsuspended"
+)
+
+var ErrDomainNotFound = errors.New("domain not found")
+var ErrDomainNotRunning = errors.New("domain is not running")
+var ErrDomainAlreadyRunning = errors.New("domain is already running")
+
+type Domain struct {
+	Name  string
+	State DomainState
+}
+
+// Hypervisor manages the lifecycle of the VMs domains, implementations must return ErrDomainNotFound,
+// ErrDomainAlreadyRunning when starting and ErrDomainNotRunning when shutting down, rebooting or destroying
+// (wrapped or not) so callers can tell those cases apart
+type Hypervisor interface {
+	DefineDomain(xml string) error
+	StartDomain(name string) error
+	ShutdownDomain(name string) error
+	RebootDomain(name string) error
+	DestroyDomain(name string) error
+	UndefineDomain(name string) error
+	ListDomains() ([]Domain, error)
+	DumpDomainXML(name string) (string, error)
+	Close() error
+}
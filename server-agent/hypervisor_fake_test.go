@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type fakeDomain struct {
+	xml   string
+	state DomainState
+}
+
+// FakeHypervisor keeps the domains in memory, it is meant to run the agent's
+// lifecycle logic without KVM. ShutdownsToIgnore makes running domains ignore
+// that many shutdown requests, like a guest that doesn't handle ACPI events
+type FakeHypervisor struct {
+	domains           map[string]*fakeDomain
+	ShutdownsToIgnore int
+	Calls             []string
+	mutex             sync.Mutex
+}
+
+func (h *FakeHypervisor) DefineDomain(domainXml string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var definition struct {
+		Name string `xml:"name"`
+	}
+	if err := xml.Unmarshal([]byte(domainXml), &definition); err != nil {
+		return fmt.Errorf("error parsing domain XML: %w", err)
+	}
+
+	h.Calls = append(h.Calls, "define "+definition.Name)
+
+	if domain, ok := h.domains[definition.Name]; ok {
+		domain.xml = domainXml
+		return nil
+	}
+
+	h.domains[definition.Name] = &fakeDomain{xml: domainXml, state: DomainShutOff}
+	return nil
+}
+
+func (h *FakeHypervisor) StartDomain(name string) error {
+	return h.withDomain("start", name, func(domain *fakeDomain) error {
+		if domain.state == DomainRunning {
+			return ErrDomainAlreadyRunning
+		}
+		domain.state = DomainRunning
+		return nil
+	})
+}
+
+func (h *FakeHypervisor) ShutdownDomain(name string) error {
+	return h.withDomain("shutdown", name, func(domain *fakeDomain) error {
+		if domain.state != DomainRunning {
+			return ErrDomainNotRunning
+		}
+
+		if h.ShutdownsToIgnore > 0 {
+			h.ShutdownsToIgnore--
+			return nil
+		}
+
+		domain.state = DomainShutOff
+		return nil
+	})
+}
+
+func (h *FakeHypervisor) RebootDomain(name string) error {
+	return h.withDomain("reboot", name, func(domain *fakeDomain) error {
+		if domain.state != DomainRunning {
+			return ErrDomainNotRunning
+		}
+		return nil
+	})
+}
+
+func (h *FakeHypervisor) DestroyDomain(name string) error {
+	return h.withDomain("destroy", name, func(domain *fakeDomain) error {
+		if domain.state != DomainRunning {
+			return ErrDomainNotRunning
+		}
+		domain.state = DomainShutOff
+		return nil
+	})
+}
+
+func (h *FakeHypervisor) UndefineDomain(name string) error {
+	return h.withDomain("undefine", name, func(domain *fakeDomain) error {
+		delete(h.domains, name)
+		return nil
+	})
+}
+
+func (h *FakeHypervisor) ListDomains() ([]Domain, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	result := []Domain{}
+	for name, domain := range h.domains {
+		result = append(result, Domain{Name: name, State: domain.state})
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result, nil
+}
+
+func (h *FakeHypervisor) DumpDomainXML(name string) (string, error) {
+	var domainXml string
+	err := h.withDomain("dumpxml", name, func(domain *fakeDomain) error {
+		domainXml = domain.xml
+		return nil
+	})
+
+	return domainXml, err
+}
+
+func (h *FakeHypervisor) Close() error {
+	return nil
+}
+
+// SetDomainState allows simulating state changes that happen outside the agent, e.g. a guest crash
+func (h *FakeHypervisor) SetDomainState(name string, state DomainState) error {
+	return h.withDomain("set-state", name, func(domain *fakeDomain) error {
+		domain.state = state
+		return nil
+	})
+}
+
+func (h *FakeHypervisor) withDomain(call string, name string, fn func(domain *fakeDomain) error) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.Calls = append(h.Calls, call+" "+name)
+
+	domain, ok := h.domains[name]
+	if !ok {
+		return fmt.Errorf("%w: '%s'", ErrDomainNotFound, name)
+	}
+
+	return fn(domain)
+}
+
+func NewFakeHypervisor() *FakeHypervisor {
+	return &FakeHypervisor{
+		domains: make(map[string]*fakeDomain),
+	}
+}
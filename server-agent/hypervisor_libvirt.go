@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+const DEFAULT_LIBVIRT_URI = "qemu:///system"
+
+// LibvirtHypervisor talks to libvirtd through its RPC protocol
+type LibvirtHypervisor struct {
+	uri   *url.URL
+	conn  *libvirt.Libvirt
+	mutex sync.Mutex
+}
+
+func (h *LibvirtHypervisor) DefineDomain(xml string) error {
+	conn, err := h.connection()
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.DomainDefineXML(xml); err != nil {
+		return toHypervisorError(err, nil)
+	}
+
+	return nil
+}
+
+func (h *LibvirtHypervisor) StartDomain(name string) error {
+	return h.withDomain(name, ErrDomainAlreadyRunning, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		return conn.DomainCreate(domain)
+	})
+}
+
+func (h *LibvirtHypervisor) ShutdownDomain(name string) error {
+	return h.withDomain(name, ErrDomainNotRunning, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		return conn.DomainShutdown(domain)
+	})
+}
+
+func (h *LibvirtHypervisor) RebootDomain(name string) error {
+	return h.withDomain(name, ErrDomainNotRunning, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		return conn.DomainReboot(domain, 0)
+	})
+}
+
+func (h *LibvirtHypervisor) DestroyDomain(name string) error {
+	return h.withDomain(name, ErrDomainNotRunning, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		return conn.DomainDestroy(domain)
+	})
+}
+
+func (h *LibvirtHypervisor) UndefineDomain(name string) error {
+	return h.withDomain(name, nil, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		return conn.DomainUndefineFlags(domain, libvirt.DomainUndefineNvram)
+	})
+}
+
+func (h *LibvirtHypervisor) ListDomains() ([]Domain, error) {
+	conn, err := h.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	domains, _, err := conn.ConnectListAllDomains(
+		1,
+		libvirt.ConnectListDomainsActive|libvirt.ConnectListDomainsInactive,
+	)
+	if err != nil {
+		return nil, toHypervisorError(err, nil)
+	}
+
+	result := []Domain{}
+	for _, domain := range domains {
+		state, _, err := conn.DomainGetState(domain, 0)
+		if err != nil {
+			// The domain might have been undefined after listing it
+			if libvirt.IsNotFound(err) {
+				continue
+			}
+			return nil, toHypervisorError(err, nil)
+		}
+
+		result = append(result, Domain{
+			Name:  domain.Name,
+			State: toDomainState(libvirt.DomainState(state)),
+		})
+	}
+
+	return result, nil
+}
+
+func (h *LibvirtHypervisor) DumpDomainXML(name string) (string, error) {
+	var xml string
+	err := h.withDomain(name, nil, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		var err error
+		xml, err = conn.DomainGetXMLDesc(domain, 0)
+		return err
+	})
+
+	return xml, err
+}
+
+func (h *LibvirtHypervisor) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.conn == nil || !h.conn.IsConnected() {
+		return nil
+	}
+
+	return h.conn.Disconnect()
+}
+
+// withDomain runs fn on the domain, libvirt answers operations not allowed in the current
+// state of the domain with the same code so the caller tells what it means, nil to not map it
+func (h *LibvirtHypervisor) withDomain(
+	name string,
+	operationInvalidErr error,
+	fn func(conn *libvirt.Libvirt, domain libvirt.Domain) error,
+) error {
+	conn, err := h.connection()
+	if err != nil {
+		return err
+	}
+
+	domain, err := conn.DomainLookupByName(name)
+	if err != nil {
+		return toHypervisorError(err, nil)
+	}
+
+	if err := fn(conn, domain); err != nil {
+		return toHypervisorError(err, operationInvalidErr)
+	}
+
+	return nil
+}
+
+// connection returns the current connection to libvirtd, reconnecting
+// if it was lost, e.g. because libvirtd was restarted
+func (h *LibvirtHypervisor) connection() (*libvirt.Libvirt, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.conn != nil && h.conn.IsConnected() {
+		return h.conn, nil
+	}
+
+	log.Printf("Connecting to libvirt at '%s'...", h.uri.String())
+
+	conn, err := libvirt.ConnectToURI(h.uri)
+	if err != nil {
+		return nil, logAndReturnError("Error connecting to libvirt: ", err.Error())
+	}
+
+	h.conn = conn
+	return conn, nil
+}
+
+func toHypervisorError(err error, operationInvalidErr error) error {
+	if libvirt.IsNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrDomainNotFound, err.Error())
+	}
+
+	if e, ok := err.(libvirt.Error); ok && e.Code == uint32(libvirt.ErrOperationInvalid) && operationInvalidErr != nil {
+		return fmt.Errorf("%w: %s", operationInvalidErr, err.Error())
+	}
+
+	return err
+}
+
+func toDomainState(state libvirt.DomainState) DomainState {
+	switch state {
+	case libvirt.DomainRunning:
+		return DomainRunning
+	case libvirt.DomainBlocked:
+		return DomainIdle
+	case libvirt.DomainPaused:
+		return DomainPaused
+	case libvirt.DomainShutdown:
+		return DomainInShutdown
+	case libvirt.DomainShutoff:
+		return DomainShutOff
+	case libvirt.DomainCrashed:
+		return DomainCrashed
+	case libvirt.DomainPmsuspended:
+		return DomainPmSuspended
+	default:
+		return DomainNoState
+	}
+}
+
+func NewLibvirtHypervisor(uri string) (Hypervisor, error) {
+	if uri == "" {
+		uri = DEFAULT_LIBVIRT_URI
+	}
+
+	parsedUri, err := url.Parse(uri)
+	if err != nil {
+		return nil, logAndReturnError("Error parsing libvirt URI: ", err.Error())
+	}
+
+	hypervisor := &LibvirtHypervisor{uri: parsedUri}
+	if _, err := hypervisor.connection(); err != nil {
+		return nil, err
+	}
+
+	return hypervisor, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Results of idempotent requests are kept this long, the vms manager sends them again within seconds
+const IDEMPOTENT_REQUEST_TTL = time.Hour
+
+type idempotentRequest struct {
+	vmId       string
+	done       chan struct{}
+	err        error
+	finishedAt time.Time
+}
+
+// IdempotentRequests runs requests that create VMs once per idempotency key. They're kept in memory,
+// after a restart the vms manager's job has already failed and nobody sends them again
+type IdempotentRequests struct {
+	mutex    sync.Mutex
+	requests map[string]*idempotentRequest
+}
+
+func NewIdempotentRequests() *IdempotentRequests {
+	return &IdempotentRequests{
+		requests: make(map[string]*idempotentRequest),
+	}
+}
+
+// Run runs the request the first time its key is seen, requests sent again wait for the first one and get its result.
+// Failed requests release their key so they can be retried, requests without key always run
+func (r *IdempotentRequests) Run(idempotencyKey string, vmId string, run func() error) error {
+	if idempotencyKey == "" {
+		return run()
+	}
+
+	r.mutex.Lock()
+	r.deleteExpiredRequests()
+	request, exists := r.requests[idempotencyKey]
+	if exists {
+		r.mutex.Unlock()
+
+		if request.vmId != vmId {
+			return NewHttpError(
+				http.StatusConflict,
+				fmt.Errorf("idempotency key '%s' was used for VM '%s'", idempotencyKey, request.vmId),
+			)
+		}
+
+		log.Printf("Request with idempotency key %s already received, waiting for it", idempotencyKey)
+		<-request.done
+		return request.err
+	}
+
+	request = &idempotentRequest{
+		vmId: vmId,
+		done: make(chan struct{}),
+	}
+	r.requests[idempotencyKey] = request
+	r.mutex.Unlock()
+
+	err := run()
+
+	r.mutex.Lock()
+	request.err = err
+	request.finishedAt = time.Now()
+	if err != nil {
+		delete(r.requests, idempotencyKey)
+	}
+	r.mutex.Unlock()
+	close(request.done)
+
+	return err
+}
+
+// deleteExpiredRequests must be called with the mutex held
+func (r *IdempotentRequests) deleteExpiredRequests() {
+	for key, request := range r.requests {
+		if !request.finishedAt.IsZero() && time.Since(request.finishedAt) > IDEMPOTENT_REQUEST_TTL {
+			delete(r.requests, key)
+		}
+	}
+}
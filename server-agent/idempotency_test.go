@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotentRequestsRepeatedWhileRunning(t *testing.T) {
+	requests := NewIdempotentRequests()
+
+	var runs atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	run := func() error {
+		if runs.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return nil
+	}
+
+	results := make(chan error, 2)
+	go func() { results <- requests.Run("key", testInstanceId, run) }()
+	<-started
+	go func() { results <- requests.Run("key", testInstanceId, run) }()
+
+	select {
+	case err := <-results:
+		t.Fatalf("expected both requests to wait for the first one, one returned %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatalf("Run returned error: %v", err)
+		}
+	}
+
+	if runs.Load() != 1 {
+		t.Fatalf("expected the request to run once, it ran %d times", runs.Load())
+	}
+}
+
+func TestIdempotentRequestsRepeatedAfterSuccess(t *testing.T) {
+	requests := NewIdempotentRequests()
+
+	runs := 0
+	run := func() error {
+		runs++
+		return nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := requests.Run("key", testInstanceId, run); err != nil {
+			t.Fatalf("Run returned error: %v", err)
+		}
+	}
+
+	if runs != 1 {
+		t.Fatalf("expected the request to run once, it ran %d times", runs)
+	}
+}
+
+func TestIdempotentRequestsRepeatedAfterFailure(t *testing.T) {
+	requests := NewIdempotentRequests()
+
+	runs := 0
+	failure := errors.New("disk full")
+	run := func() error {
+		runs++
+		if runs == 1 {
+			return failure
+		}
+		return nil
+	}
+
+	if err := requests.Run("key", testInstanceId, run); !errors.Is(err, failure) {
+		t.Fatalf("expected the first request to fail, got %v", err)
+	}
+
+	// The key was released, so the request runs again
+	if err := requests.Run("key", testInstanceId, run); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	if runs != 2 {
+		t.Fatalf("expected the request to run twice, it ran %d times", runs)
+	}
+}
+
+func TestIdempotentRequestsRepeatedAfterTtl(t *testing.T) {
+	requests := NewIdempotentRequests()
+
+	runs := 0
+	run := func() error {
+		runs++
+		return nil
+	}
+
+	if err := requests.Run("key", testInstanceId, run); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	requests.mutex.Lock()
+	requests.requests["key"].finishedAt = time.Now().Add(-IDEMPOTENT_REQUEST_TTL - time.Second)
+	requests.mutex.Unlock()
+
+	if err := requests.Run("key", testInstanceId, run); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	if runs != 2 {
+		t.Fatalf("expected the expired request to run again, it ran %d times", runs)
+	}
+}
+
+func TestIdempotentRequestsKeyOfAnotherVm(t *testing.T) {
+	requests := NewIdempotentRequests()
+
+	if err := requests.Run("key", testInstanceId, func() error { return nil }); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	err := requests.Run("key", testTemplateId, func() error {
+		t.Fatal("expected the request not to run")
+		return nil
+	})
+
+	var httpErr *HttpError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusConflict {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+}
+
+func TestIdempotentRequestsWithoutKeyAlwaysRun(t *testing.T) {
+	requests := NewIdempotentRequests()
+
+	runs := 0
+	for i := 0; i < 2; i++ {
+		if err := requests.Run("", testInstanceId, func() error { runs++; return nil }); err != nil {
+			t.Fatalf("Run returned error: %v", err)
+		}
+	}
+
+	if runs != 2 {
+		t.Fatalf("expected requests without key to always run, they ran %d times", runs)
+	}
+}
@@ -23,22 +23,85 @@ func main() {
 	stopInstanceEndpoint := os.Getenv("STOP_INSTANCE_ENDPOINT")
 	restartInstanceEndpoint := os.Getenv("RESTART_INSTANCE_ENDPOINT")
 	listInstancesStatusEndpoint := os.Getenv("LIST_INSTANCES_STATUS_ENDPOINT")
+	listVmDisksEndpoint := os.Getenv("LIST_VM_DISKS_ENDPOINT")
 	vmsBridge := os.Getenv("VMS_BRIDGE")
 	vmNetworkInterface := os.Getenv("VM_NETWORK_INTERFACE")
 	getResourceStatusEndpoint := os.Getenv("GET_RESOURCE_STATUS_ENDPOINT")
 	isAliveEndpoint := os.Getenv("IS_ALIVE_ENDPOINT")
+	migrateInstanceEndpoint := os.Getenv("MIGRATE_INSTANCE_ENDPOINT")
+	receiveVmFileEndpoint := os.Getenv("RECEIVE_VM_FILE_ENDPOINT")
+	importInstanceEndpoint := os.Getenv("IMPORT_INSTANCE_ENDPOINT")
+	setupInstanceNetworkEndpoint := os.Getenv("SETUP_INSTANCE_NETWORK_ENDPOINT")
+	createSnapshotEndpoint := os.Getenv("CREATE_SNAPSHOT_ENDPOINT")
+	listSnapshotsEndpoint := os.Getenv("LIST_SNAPSHOTS_ENDPOINT")
+	revertSnapshotEndpoint := os.Getenv("REVERT_SNAPSHOT_ENDPOINT")
+	deleteSnapshotEndpoint := os.Getenv("DELETE_SNAPSHOT_ENDPOINT")
+	instanceConsoleEndpoint := os.Getenv("INSTANCE_CONSOLE_ENDPOINT")
+	libvirtUri := os.Getenv("LIBVIRT_URI")
+	agentAuthSecret := os.Getenv("AGENT_AUTH_SECRET")
+	tlsCertFile := os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := os.Getenv("TLS_KEY_FILE")
+	tlsClientCaFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	tlsCaFile := os.Getenv("TLS_CA_FILE")
+	vmsManagerUrl := os.Getenv("VMS_MANAGER_URL")
+	advertiseUrl := os.Getenv("ADVERTISE_URL")
+	agentLabels := os.Getenv("AGENT_LABELS")
+	registerServerAgentEndpoint := os.Getenv("REGISTER_SERVER_AGENT_ENDPOINT")
+	serverAgentHeartbeatEndpoint := os.Getenv("SERVER_AGENT_HEARTBEAT_ENDPOINT")
+	domainEventsEndpoint := os.Getenv("DOMAIN_EVENTS_ENDPOINT")
+
+	if vmsManagerUrl == "" || advertiseUrl == "" {
+		log.Fatal("VMS_MANAGER_URL and ADVERTISE_URL are required to register in the vms manager")
+	}
+
+	agentAuth, err := NewAgentAuth(agentAuthSecret, tlsCertFile, tlsKeyFile, tlsClientCaFile, tlsCaFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hypervisor, err := NewLibvirtHypervisor(libvirtUri)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer hypervisor.Close()
 
 	serverAgent := NewServerAgent(
+		hypervisor,
+		agentAuth.Client(),
 		vmsStoragePath,
 		cloudInitImagesPath,
 		vmsBridge,
 		vmNetworkInterface,
+		receiveVmFileEndpoint,
+		importInstanceEndpoint,
+		deleteVmEndpoint,
+	)
+
+	registration := NewRegistration(
+		serverAgent,
+		agentAuth.Client(),
+		vmsManagerUrl,
+		advertiseUrl,
+		agentLabels,
+		registerServerAgentEndpoint,
+		serverAgentHeartbeatEndpoint,
+	)
+	go registration.Run()
+
+	domainEvents := NewDomainEvents(
+		hypervisor,
+		agentAuth.Client(),
+		vmsManagerUrl,
+		advertiseUrl,
+		domainEventsEndpoint,
 	)
+	go domainEvents.Run()
 
 	listenAddr := getListenAddr()
 
 	apiServer := NewApiServer(
 		listenAddr,
+		agentAuth,
 		serverAgent,
 		listBaseImagesEndpoint,
 		defineTemplateEndpoint,
@@ -50,6 +113,16 @@ func main() {
 		listInstancesStatusEndpoint,
 		getResourceStatusEndpoint,
 		isAliveEndpoint,
+		migrateInstanceEndpoint,
+		receiveVmFileEndpoint,
+		importInstanceEndpoint,
+		setupInstanceNetworkEndpoint,
+		createSnapshotEndpoint,
+		listSnapshotsEndpoint,
+		revertSnapshotEndpoint,
+		deleteSnapshotEndpoint,
+		instanceConsoleEndpoint,
+		listVmDisksEndpoint,
 	)
 	apiServer.Run()
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const AGENT_HEARTBEAT_INTERVAL = 15 * time.Second
+const AGENT_REGISTRATION_RETRY_INTERVAL = 10 * time.Second
+
+// Set at build time with -ldflags "-X main.serverAgentVersion=<version>"
+var serverAgentVersion = "dev"
+
+// Registration registers the server agent in the vms-manager when it boots and
+// keeps it alive with periodic heartbeats carrying its resource status
+type Registration struct {
+	serverAgent                  ServerAgent
+	client                       *http.Client
+	vmsManagerUrl                string
+	advertiseUrl                 string
+	labels                       map[string]string
+	registerServerAgentEndpoint  string
+	serverAgentHeartbeatEndpoint string
+}
+
+func (reg *Registration) Run() {
+	registered := false
+
+	for {
+		if !registered {
+			if err := reg.register(); err != nil {
+				log.Printf("Error registering in the vms manager, retrying in %s: %v", AGENT_REGISTRATION_RETRY_INTERVAL, err)
+				time.Sleep(AGENT_REGISTRATION_RETRY_INTERVAL)
+				continue
+			}
+
+			log.Printf("Registered in the vms manager at '%s' as '%s'", reg.vmsManagerUrl, reg.advertiseUrl)
+			registered = true
+		}
+
+		time.Sleep(AGENT_HEARTBEAT_INTERVAL)
+
+		if err := reg.heartbeat(); err != nil {
+			// The vms manager forgot about this server agent, e.g. it was deregistered
+			var httpErr *HttpError
+			if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+				registered = false
+			}
+			log.Printf("Error sending heartbeat to the vms manager: %v", err)
+		}
+	}
+}
+
+func (reg *Registration) register() error {
+	resourceStatus, err := reg.serverAgent.GetResourceStatus()
+	if err != nil {
+		return err
+	}
+
+	return reg.post(reg.registerServerAgentEndpoint, RegisterServerAgentRequest{
+		Url:           reg.advertiseUrl,
+		Version:       serverAgentVersion,
+		Labels:        reg.labels,
+		VcpuCount:     runtime.NumCPU(),
+		TotalMemoryMB: resourceStatus.TotalMemoryMB,
+		TotalDiskMB:   resourceStatus.TotalDiskMB,
+	})
+}
+
+func (reg *Registration) heartbeat() error {
+	resourceStatus, err := reg.serverAgent.GetResourceStatus()
+	if err != nil {
+		return err
+	}
+
+	return reg.post(reg.serverAgentHeartbeatEndpoint, ServerAgentHeartbeatRequest{
+		Url:            reg.advertiseUrl,
+		ResourceStatus: resourceStatus,
+	})
+}
+
+func (reg *Registration) post(endpoint string, body any) error {
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return logAndReturnError("Error marshalling request: ", err.Error())
+	}
+
+	resp, err := reg.client.Post(reg.vmsManagerUrl+endpoint, "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkIfStatusCodeIsOk(resp)
+}
+
+// parseLabels parses labels in the "key=value,key=value" format
+func parseLabels(labels string) map[string]string {
+	parsed := map[string]string{}
+
+	for _, label := range strings.Split(labels, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(label), "=")
+		if key != "" {
+			parsed[key] = value
+		}
+	}
+
+	return parsed
+}
+
+func NewRegistration(
+	serverAgent ServerAgent,
+	client *http.Client,
+	vmsManagerUrl string,
+	advertiseUrl string,
+	labels string,
+	registerServerAgentEndpoint string,
+	serverAgentHeartbeatEndpoint string,
+) *Registration {
+	return &Registration{
+		serverAgent:                  serverAgent,
+		client:                       client,
+		vmsManagerUrl:                strings.TrimSuffix(vmsManagerUrl, "/"),
+		advertiseUrl:                 strings.TrimSuffix(advertiseUrl, "/"),
+		labels:                       parseLabels(labels),
+		registerServerAgentEndpoint:  registerServerAgentEndpoint,
+		serverAgentHeartbeatEndpoint: serverAgentHeartbeatEndpoint,
+	}
+}
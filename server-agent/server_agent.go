@@ -2,14 +2,24 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -22,11 +32,14 @@ const AFTER_INSTALL_WAIT_TIME = 20 * time.Second
 const SHUTDOWN_WAIT_TIME = 5 * time.Second
 const RETRY_SHUTDOWN_WAIT_TIME = 10 * time.Second
 const FORCE_SHUTDOWN_WAIT_TIME = 20 * time.Second
-const SHUTOFF_STATUS = "shut off"
+const LIVE_MIGRATION_URI_FORMAT = "qemu+ssh://%s/system"
 
 //go:embed templates/*.tmpl
 var templateFS embed.FS
 
+// Instance and template IDs are generated by the vms manager as UUIDs
+var instanceIdRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
 type ServerAgent interface {
 	ListBaseImages() (ListBaseImagesResponse, error)
 	DefineTemplate(request DefineTemplateRequest) error
@@ -36,14 +49,50 @@ type ServerAgent interface {
 	StopInstance(instanceId string) error
 	RestartInstance(instanceId string) error
 	ListInstancesStatus() ([]ListInstancesStatusResponse, error)
+	ListVmDisks() ([]ListVmDisksResponse, error)
 	GetResourceStatus() (GetResourceStatusResponse, error)
+	MigrateInstance(request MigrateInstanceRequest) error
+	ReceiveVmFile(vmId string, fileName string, content io.Reader) error
+	ImportInstance(instanceId string) error
+	SetupInstanceNetwork(request SetupInstanceNetworkRequest) error
+	CreateSnapshot(request CreateSnapshotRequest) error
+	ListSnapshots(instanceId string) ([]ListSnapshotsResponse, error)
+	RevertSnapshot(instanceId string, snapshotId string) error
+	DeleteSnapshot(instanceId string, snapshotId string) error
+	OpenInstanceConsole(instanceId string) (net.Conn, error)
 }
 
 type ServerAgentImpl struct {
-	vmsStoragePath      string
-	cloudInitImagesPath string
-	vmsBridge           string
-	vmNetworkInterface  string
+	hypervisor             Hypervisor
+	agentClient            *http.Client
+	vmsStoragePath         string
+	cloudInitImagesPath    string
+	vmsBridge              string
+	vmNetworkInterface     string
+	receiveVmFileEndpoint  string
+	importInstanceEndpoint string
+	deleteVmEndpoint       string
+	idempotentRequests     *IdempotentRequests
+	shutdownWaits          ShutdownWaits
+}
+
+// ShutdownWaits are the times StopInstance waits for the guest to shut down before asking again
+// and before forcing it to stop, tests use shorter ones
+type ShutdownWaits struct {
+	Check time.Duration
+	Retry time.Duration
+	Force time.Duration
+}
+
+type QemuImgInfo struct {
+	VirtualSize         int64             `json:"virtual-size"`
+	FullBackingFilename string            `json:"full-backing-filename"`
+	Snapshots           []QemuImgSnapshot `json:"snapshots"`
+}
+
+type QemuImgSnapshot struct {
+	Name    string `json:"name"`
+	DateSec int64  `json:"date-sec"`
 }
 
 type VmType string
@@ -70,6 +119,10 @@ type CreateVmRequest struct {
 	Dns2            string
 	Gateway         string
 	VlanEtiquete    string
+	// Empty when IPv6 is disabled
+	Ipv6AddWithSubnet string
+	Ipv6Gateway       string
+	LabInterfaces     []LabInterface
 }
 
 type CloudInitMetadata struct {
@@ -84,10 +137,20 @@ type CloudInitUserData struct {
 }
 
 type CloudInitNetworkConfig struct {
+	IpAddWithSubnet   string
+	Dns1              string
+	Dns2              string
+	Gateway           string
+	Ipv6AddWithSubnet string
+	Ipv6Gateway       string
+	LabInterfaces     []CloudInitLabInterface
+}
+
+// The guest names the interfaces of the internal networks after their position, matching them by MAC
+type CloudInitLabInterface struct {
+	Name            string
+	MacAddress      string
 	IpAddWithSubnet string
-	Dns1            string
-	Dns2            string
-	Gateway         string
 }
 
 func (agent *ServerAgentImpl) ListBaseImages() (ListBaseImagesResponse, error) {
@@ -124,45 +187,57 @@ func (agent *ServerAgentImpl) DefineTemplate(request DefineTemplateRequest) erro
 		VcpuCount:    request.VcpuCount,
 	}
 
-	return agent.createVm(createVmRequest)
+	return agent.idempotentRequests.Run(request.IdempotencyKey, request.TemplateId, func() error {
+		return agent.createVm(createVmRequest)
+	})
 }
 
 func (agent *ServerAgentImpl) CreateInstance(request CreateInstanceRequest) error {
 	createVmRequest := CreateVmRequest{
-		VmType:          InstanceVm,
-		VmId:            request.InstanceId,
-		SourceVmId:      request.SourceVmId,
-		SourceIsBase:    request.SourceIsBase,
-		DirPath:         agent.vmsStoragePath + "/" + request.InstanceId,
-		SizeMB:          request.SizeMB,
-		VramMB:          request.VramMB,
-		VcpuCount:       request.VcpuCount,
-		Username:        request.Username,
-		Password:        request.Password,
-		PublicSshKeys:   request.PublicSshKeys,
-		IpAddWithSubnet: request.IpAddWithSubnet,
-		Dns1:            request.Dns1,
-		Dns2:            request.Dns2,
-		Gateway:         request.Gateway,
-		VlanEtiquete:    request.VlanEtiquete,
-	}
-
-	return agent.createVm(createVmRequest)
+		VmType:            InstanceVm,
+		VmId:              request.InstanceId,
+		SourceVmId:        request.SourceVmId,
+		SourceIsBase:      request.SourceIsBase,
+		DirPath:           agent.vmsStoragePath + "/" + request.InstanceId,
+		SizeMB:            request.SizeMB,
+		VramMB:            request.VramMB,
+		VcpuCount:         request.VcpuCount,
+		Username:          request.Username,
+		Password:          request.Password,
+		PublicSshKeys:     request.PublicSshKeys,
+		IpAddWithSubnet:   request.IpAddWithSubnet,
+		Dns1:              request.Dns1,
+		Dns2:              request.Dns2,
+		Gateway:           request.Gateway,
+		VlanEtiquete:      request.VlanEtiquete,
+		Ipv6AddWithSubnet: request.Ipv6AddWithSubnet,
+		Ipv6Gateway:       request.Ipv6Gateway,
+		LabInterfaces:     request.LabInterfaces,
+	}
+
+	return agent.idempotentRequests.Run(request.IdempotencyKey, request.InstanceId, func() error {
+		return agent.createVm(createVmRequest)
+	})
 }
 
 func (agent *ServerAgentImpl) DeleteVm(request DeleteVmRequest) error {
 	log.Printf("Deleting VM '%s'...", request.VmId)
 
-	cmd := exec.Command(
-		"virsh", "undefine", request.VmId, "--remove-all-storage",
-	)
-
-	output, err := cmd.CombinedOutput()
+	// The id is part of the path removed from storage, even when there's no domain to undefine
+	if !instanceIdRegexp.MatchString(request.VmId) {
+		return NewHttpError(http.StatusBadRequest, errors.New("invalid VM id"))
+	}
 
-	if err != nil {
+	if err := agent.hypervisor.UndefineDomain(request.VmId); err != nil {
 		// If the domain doesn't exist, it means it does not exist in this server
 		// we need to remove the vlan etiquete from the network bridge anyway
-		if strings.Contains(string(output), "failed to get domain") {
+		if errors.Is(err, ErrDomainNotFound) {
+			// There might still be files without a domain, e.g. a template copied here
+			// as the backing file of a migrated instance or an interrupted migration
+			if err := os.RemoveAll(agent.vmsStoragePath + "/" + request.VmId); err != nil {
+				return logAndReturnError("Error deleting VM '"+request.VmId+"' files from storage: ", err.Error())
+			}
+
 			if request.RemoveEtiquete {
 				if err := agent.removeVidFromNetworkBridge(request.Vid); err != nil {
 					return err
@@ -171,7 +246,7 @@ func (agent *ServerAgentImpl) DeleteVm(request DeleteVmRequest) error {
 			return nil
 		}
 
-		return logAndReturnError("Error deleting VM '"+request.VmId+"': ", string(output))
+		return logAndReturnError("Error deleting VM '"+request.VmId+"': ", err.Error())
 	}
 
 	log.Printf("Removing VM '%s' files from storage...", request.VmId)
@@ -200,14 +275,8 @@ func (agent *ServerAgentImpl) StartInstance(request StartInstanceRequest) error
 		}
 	}
 
-	cmd := exec.Command(
-		"virsh", "start", request.InstanceId,
-	)
-
-	output, err := cmd.CombinedOutput()
-
-	if err != nil {
-		return logAndReturnError("Error starting instance '"+request.InstanceId+"': ", string(output))
+	if err := agent.hypervisor.StartDomain(request.InstanceId); err != nil {
+		return logAndReturnError("Error starting instance '"+request.InstanceId+"': ", err.Error())
 	}
 
 	log.Printf("Started instance '%s' successfully!", request.InstanceId)
@@ -216,58 +285,60 @@ func (agent *ServerAgentImpl) StartInstance(request StartInstanceRequest) error
 		return err
 	}
 
+	for _, labInterface := range request.LabInterfaces {
+		if err := agent.setupLabInterface(labInterface); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (agent *ServerAgentImpl) StopInstance(instanceId string) error {
 	log.Printf("Stopping instance '%s'...", instanceId)
-	cmd := exec.Command(
-		"virsh", "shutdown", instanceId,
-	)
 
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if err := agent.hypervisor.ShutdownDomain(instanceId); err != nil {
 		// If the domain doesn't exist, or is already shut down, we return a bad request
 		// to inform the vms-manager that the instance is not running in this server
-		if strings.Contains(string(output), "failed to get domain") || strings.Contains(string(output), "Domain is not running") {
+		if errors.Is(err, ErrDomainNotFound) || errors.Is(err, ErrDomainNotRunning) {
 			return NewHttpError(http.StatusBadRequest, errors.New("instance is not running in this server"))
 		}
 
-		return logAndReturnError("Error stopping instance '"+instanceId+"': ", string(output))
+		return logAndReturnError("Error stopping instance '"+instanceId+"': ", err.Error())
 	}
 
 	// Wait for the instance to shut down
-	time.Sleep(SHUTDOWN_WAIT_TIME)
+	time.Sleep(agent.shutdownWaits.Check)
 
-	// Check if the instance is shut down
+	// Check if the instance is shut down, the guest might ignore the first
+	// shutdown request so we retry once before forcing it to stop
 	currentTime := time.Now()
 	retryShutdown := true
 	for {
-		statuses, err := agent.ListInstancesStatus()
+		status, err := agent.getInstanceStatus(instanceId)
 		if err != nil {
 			return err
 		}
 
-		for _, status := range statuses {
-			if status.InstanceId == instanceId {
-				if status.Status != SHUTOFF_STATUS {
-					if time.Since(currentTime) >= FORCE_SHUTDOWN_WAIT_TIME {
-						return agent.forceStopVM(instanceId)
-					} else if time.Since(currentTime) >= RETRY_SHUTDOWN_WAIT_TIME && retryShutdown {
-						retryShutdown = false
-						retryShutdownCmd := exec.Command(
-							"virsh", "shutdown", instanceId,
-						)
-						if output, err := retryShutdownCmd.CombinedOutput(); err != nil {
-							return logAndReturnError("Error stopping instance '"+instanceId+"': ", string(output))
-						}
-					} else {
-						time.Sleep(SHUTDOWN_WAIT_TIME)
-					}
-				} else {
-					log.Printf("Stopped instance '%s' successfully!", instanceId)
-					return nil
-				}
+		if status == "" {
+			return NewHttpError(http.StatusBadRequest, errors.New("instance is not running in this server"))
+		}
+
+		if status == DomainShutOff {
+			log.Printf("Stopped instance '%s' successfully!", instanceId)
+			return nil
+		}
+
+		if time.Since(currentTime) >= agent.shutdownWaits.Force {
+			return agent.forceStopVM(instanceId)
+		} else if time.Since(currentTime) >= agent.shutdownWaits.Retry && retryShutdown {
+			retryShutdown = false
+			// The instance might have shut down in the meantime
+			if err := agent.hypervisor.ShutdownDomain(instanceId); err != nil && !errors.Is(err, ErrDomainNotRunning) {
+				return logAndReturnError("Error stopping instance '"+instanceId+"': ", err.Error())
 			}
+		} else {
+			time.Sleep(agent.shutdownWaits.Check)
 		}
 	}
 }
@@ -281,20 +352,14 @@ func (agent *ServerAgentImpl) RestartInstance(instanceId string) error {
 		return NewHttpError(http.StatusBadRequest, errors.New("instance is not running in this server"))
 	}
 
-	cmd := exec.Command(
-		"virsh", "reboot", instanceId,
-	)
-
-	output, err := cmd.CombinedOutput()
-
-	if err != nil {
+	if err := agent.hypervisor.RebootDomain(instanceId); err != nil {
 		// If the domain is not running, we return a bad request to inform the vms-manager
 		// that the instance is not running in this server
-		if strings.Contains(string(output), "Domain is not running") {
+		if errors.Is(err, ErrDomainNotFound) || errors.Is(err, ErrDomainNotRunning) {
 			return NewHttpError(http.StatusBadRequest, errors.New("instance is not running in this server"))
 		}
 
-		return logAndReturnError("Error restarting instance '"+instanceId+"': ", string(output))
+		return logAndReturnError("Error restarting instance '"+instanceId+"': ", err.Error())
 	}
 
 	log.Printf("Restarted instance '%s' successfully!", instanceId)
@@ -303,33 +368,41 @@ func (agent *ServerAgentImpl) RestartInstance(instanceId string) error {
 }
 
 func (agent *ServerAgentImpl) ListInstancesStatus() ([]ListInstancesStatusResponse, error) {
-	cmd := exec.Command(
-		"virsh", "list", "--all",
-	)
+	domains, err := agent.hypervisor.ListDomains()
+	if err != nil {
+		return nil, logAndReturnError("Error listing VMs status: ", err.Error())
+	}
 
-	output, err := cmd.CombinedOutput()
+	log.Printf("VMs status:")
+	for _, domain := range domains {
+		log.Printf("%s: %s", domain.Name, domain.State)
+	}
+
+	return toListInstancesStatusResponse(domains), nil
+}
+
+// ListVmDisks lists the VMs, instances and templates, whose disk image is in the storage of this server
+func (agent *ServerAgentImpl) ListVmDisks() ([]ListVmDisksResponse, error) {
+	entries, err := os.ReadDir(agent.vmsStoragePath)
 	if err != nil {
-		return nil, logAndReturnError("Error listing VMs status: ", string(output))
+		return nil, logAndReturnError("Error listing VM disks: ", err.Error())
 	}
 
-	lines := strings.Split(string(output), "\n")
-	vmStatusMap := make(map[string]string)
+	response := []ListVmDisksResponse{}
+	for _, entry := range entries {
+		// The base images directory lives in the storage path too
+		if !entry.IsDir() {
+			continue
+		}
 
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		if len(fields) == 3 && fields[0] != "Id" {
-			vmStatusMap[fields[1]] = fields[2]
-		} else if len(fields) > 3 && fields[0] != "Id" {
-			vmStatusMap[fields[1]] = fields[2] + " " + fields[3]
+		if _, err := os.Stat(agent.getDiskImagePath(entry.Name())); err != nil {
+			continue
 		}
-	}
 
-	log.Printf("VMs status:")
-	for vmName, status := range vmStatusMap {
-		log.Printf("%s: %s", vmName, status)
+		response = append(response, ListVmDisksResponse{VmId: entry.Name()})
 	}
 
-	return toListInstancesStatusResponse(vmStatusMap), nil
+	return response, nil
 }
 
 func (agent *ServerAgentImpl) GetResourceStatus() (GetResourceStatusResponse, error) {
@@ -357,6 +430,216 @@ func (agent *ServerAgentImpl) GetResourceStatus() (GetResourceStatusResponse, er
 	}, nil
 }
 
+func (agent *ServerAgentImpl) MigrateInstance(request MigrateInstanceRequest) error {
+	log.Printf("Migrating instance '%s' to '%s'...", request.InstanceId, request.TargetServerAgentUrl)
+
+	if !instanceIdRegexp.MatchString(request.InstanceId) {
+		return NewHttpError(http.StatusBadRequest, errors.New("invalid instance id"))
+	}
+
+	if request.BackingTemplateId != "" && !instanceIdRegexp.MatchString(request.BackingTemplateId) {
+		return NewHttpError(http.StatusBadRequest, errors.New("invalid backing template id"))
+	}
+
+	status, err := agent.getInstanceStatus(request.InstanceId)
+	if err != nil {
+		return err
+	}
+
+	if status == "" {
+		return NewHttpError(http.StatusBadRequest, errors.New("instance does not exist in this server"))
+	}
+
+	if request.Live && status != DomainRunning {
+		return NewHttpError(http.StatusBadRequest, errors.New("instance must be running to be live migrated"))
+	}
+
+	if !request.Live && status != DomainShutOff {
+		return NewHttpError(http.StatusBadRequest, errors.New("instance must be shut off to be cold migrated"))
+	}
+
+	// Instances disks are overlays, so the target needs the template they are backed by
+	if request.BackingTemplateId != "" {
+		log.Printf("Copying backing template '%s'...", request.BackingTemplateId)
+
+		if err := agent.sendVmFiles(request.TargetServerAgentUrl, request.BackingTemplateId); err != nil {
+			agent.deleteVmInServerAgent(request.TargetServerAgentUrl, request.BackingTemplateId)
+			return err
+		}
+	}
+
+	if request.Live {
+		err = agent.liveMigrateInstance(request)
+	} else {
+		err = agent.coldMigrateInstance(request)
+	}
+
+	if err != nil {
+		// Don't leave a half copied instance in the target, the instance keeps running here.
+		// The template is only sent when the target didn't have it, so no other instance uses it there
+		agent.deleteVmInServerAgent(request.TargetServerAgentUrl, request.InstanceId)
+		if request.BackingTemplateId != "" {
+			agent.deleteVmInServerAgent(request.TargetServerAgentUrl, request.BackingTemplateId)
+		}
+		return err
+	}
+
+	log.Printf("Removing instance '%s' files from storage...", request.InstanceId)
+
+	if err := os.RemoveAll(agent.vmsStoragePath + "/" + request.InstanceId); err != nil {
+		return logAndReturnError("Error deleting instance '"+request.InstanceId+"' files from storage: ", err.Error())
+	}
+
+	if request.RemoveEtiquete {
+		if err := agent.removeVidFromNetworkBridge(request.Vid); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Migrated instance '%s' successfully!", request.InstanceId)
+
+	return nil
+}
+
+func (agent *ServerAgentImpl) ReceiveVmFile(vmId string, fileName string, content io.Reader) error {
+	// Only plain names are allowed, we don't want to write outside the VM directory
+	if !isPlainFileName(vmId) || !isPlainFileName(fileName) {
+		return NewHttpError(http.StatusBadRequest, errors.New("invalid VM id or file name"))
+	}
+
+	dirPath := agent.vmsStoragePath + "/" + vmId
+	if err := createDir(dirPath); err != nil {
+		return err
+	}
+
+	log.Printf("Receiving file '%s' of VM '%s'...", fileName, vmId)
+
+	// Write to a temporary file first so an interrupted transfer never leaves a truncated disk
+	tmpFilePath := dirPath + "/." + fileName + ".part"
+	file, err := os.Create(tmpFilePath)
+	if err != nil {
+		return logAndReturnError("Error creating file '"+fileName+"': ", err.Error())
+	}
+
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		os.Remove(tmpFilePath)
+		return logAndReturnError("Error writing file '"+fileName+"': ", err.Error())
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmpFilePath)
+		return logAndReturnError("Error writing file '"+fileName+"': ", err.Error())
+	}
+
+	if err := os.Rename(tmpFilePath, dirPath+"/"+fileName); err != nil {
+		return logAndReturnError("Error moving file '"+fileName+"': ", err.Error())
+	}
+
+	return nil
+}
+
+func (agent *ServerAgentImpl) ImportInstance(instanceId string) error {
+	log.Printf("Importing instance '%s'...", instanceId)
+
+	if agent.vmDomainExists(instanceId) {
+		return NewHttpError(http.StatusConflict, errors.New("instance already exists in this server"))
+	}
+
+	if err := agent.importVmDomain(instanceId); err != nil {
+		return err
+	}
+
+	log.Printf("Imported instance '%s' successfully!", instanceId)
+
+	return nil
+}
+
+func (agent *ServerAgentImpl) SetupInstanceNetwork(request SetupInstanceNetworkRequest) error {
+	return agent.setupVMNetwork(request.Vid, request.VlanEtiquete)
+}
+
+func (agent *ServerAgentImpl) CreateSnapshot(request CreateSnapshotRequest) error {
+	log.Printf("Creating snapshot '%s' of instance '%s'...", request.SnapshotId, request.InstanceId)
+
+	if err := checkSnapshotIds(request.InstanceId, request.SnapshotId); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(
+		"qemu-img", "snapshot", "-c", request.SnapshotId, agent.getDiskImagePath(request.InstanceId),
+	)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return logAndReturnError("Error creating snapshot of instance '"+request.InstanceId+"': ", string(output))
+	}
+
+	log.Printf("Created snapshot '%s' successfully!", request.SnapshotId)
+
+	return nil
+}
+
+func (agent *ServerAgentImpl) ListSnapshots(instanceId string) ([]ListSnapshotsResponse, error) {
+	if !instanceIdRegexp.MatchString(instanceId) {
+		return nil, NewHttpError(http.StatusBadRequest, errors.New("invalid instance id"))
+	}
+
+	info, err := agent.getDiskImageInfo(instanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	return toListSnapshotsResponse(info.Snapshots), nil
+}
+
+func (agent *ServerAgentImpl) RevertSnapshot(instanceId string, snapshotId string) error {
+	log.Printf("Reverting instance '%s' to snapshot '%s'...", instanceId, snapshotId)
+
+	if err := checkSnapshotIds(instanceId, snapshotId); err != nil {
+		return err
+	}
+
+	if err := agent.checkIfSnapshotExists(instanceId, snapshotId); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(
+		"qemu-img", "snapshot", "-a", snapshotId, agent.getDiskImagePath(instanceId),
+	)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return logAndReturnError("Error reverting instance '"+instanceId+"' to snapshot: ", string(output))
+	}
+
+	log.Printf("Reverted instance '%s' successfully!", instanceId)
+
+	return nil
+}
+
+func (agent *ServerAgentImpl) DeleteSnapshot(instanceId string, snapshotId string) error {
+	log.Printf("Deleting snapshot '%s' of instance '%s'...", snapshotId, instanceId)
+
+	if err := checkSnapshotIds(instanceId, snapshotId); err != nil {
+		return err
+	}
+
+	if err := agent.checkIfSnapshotExists(instanceId, snapshotId); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(
+		"qemu-img", "snapshot", "-d", snapshotId, agent.getDiskImagePath(instanceId),
+	)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return logAndReturnError("Error deleting snapshot of instance '"+instanceId+"': ", string(output))
+	}
+
+	log.Printf("Deleted snapshot '%s' successfully!", snapshotId)
+
+	return nil
+}
+
 func (agent *ServerAgentImpl) createVm(request CreateVmRequest) error {
 	if err := createDir(request.DirPath); err != nil {
 		return err
@@ -389,6 +672,25 @@ func (agent *ServerAgentImpl) createVm(request CreateVmRequest) error {
 	return nil
 }
 
+func (agent *ServerAgentImpl) OpenInstanceConsole(instanceId string) (net.Conn, error) {
+	domainXml, err := agent.hypervisor.DumpDomainXML(instanceId)
+	if err != nil {
+		if errors.Is(err, ErrDomainNotFound) {
+			return nil, NewHttpError(http.StatusBadRequest, errors.New("instance is not running in this server"))
+		}
+		return nil, logAndReturnError("Error getting instance '"+instanceId+"' XML: ", err.Error())
+	}
+
+	address, err := getVncAddress(domainXml)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Opening console of instance '%s' at %s...", instanceId, address)
+
+	return dialVnc(address)
+}
+
 func (agent *ServerAgentImpl) removeVidFromNetworkBridge(vid string) error {
 	log.Printf("Removing vlan etiquete from network bridge...")
 
@@ -425,6 +727,35 @@ func (agent *ServerAgentImpl) setupVMNetwork(vid string, vlanEtiquete string) er
 	return nil
 }
 
+// setupLabInterface sets the interface as an access port of its internal network. Unlike setupVMNetwork
+// the VLAN is not added to the VMs network interface, so the internal network never leaves this server
+func (agent *ServerAgentImpl) setupLabInterface(labInterface LabInterface) error {
+	setupLabInterfaceAsAccessPortCmd := exec.Command(
+		"bridge", "vlan", "add",
+		"vid", labInterface.Vid,
+		"dev", labInterface.VlanEtiquete,
+		"pvid", labInterface.Vid,
+		"untagged",
+	)
+
+	if output, err := setupLabInterfaceAsAccessPortCmd.CombinedOutput(); err != nil {
+		return logAndReturnError("Error setting up lab interface as access port: ", string(output))
+	}
+
+	return nil
+}
+
+// getLabInterfaceMacAddress returns a locally administered MAC derived from the VM and the position of the
+// interface, the network config needs it before the VM exists and it must not change across migrations
+func getLabInterfaceMacAddress(vmId string, position int) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", vmId, position)))
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", hash[0], hash[1], hash[2])
+}
+
+func getLabInterfaceName(position int) string {
+	return fmt.Sprintf("lab%d", position)
+}
+
 func toListBaseImagesResponse(fileNames []string) ListBaseImagesResponse {
 	response := ListBaseImagesResponse{FileNames: fileNames}
 	return response
@@ -481,10 +812,23 @@ func (agent *ServerAgentImpl) createVmConfigurationFiles(request CreateVmRequest
 
 		// And setup the network config
 		cloudInitNetworkConfig := CloudInitNetworkConfig{
-			IpAddWithSubnet: request.IpAddWithSubnet,
-			Dns1:            request.Dns1,
-			Dns2:            request.Dns2,
-			Gateway:         request.Gateway,
+			IpAddWithSubnet:   request.IpAddWithSubnet,
+			Dns1:              request.Dns1,
+			Dns2:              request.Dns2,
+			Gateway:           request.Gateway,
+			Ipv6AddWithSubnet: request.Ipv6AddWithSubnet,
+			Ipv6Gateway:       request.Ipv6Gateway,
+		}
+
+		for position, labInterface := range request.LabInterfaces {
+			cloudInitNetworkConfig.LabInterfaces = append(
+				cloudInitNetworkConfig.LabInterfaces,
+				CloudInitLabInterface{
+					Name:            getLabInterfaceName(position),
+					MacAddress:      getLabInterfaceMacAddress(request.VmId, position),
+					IpAddWithSubnet: labInterface.IpAddWithSubnet,
+				},
+			)
 		}
 
 		if err := createFileFromTemplate(request.DirPath, "network-config", cloudInitNetworkConfig); err != nil {
@@ -600,20 +944,37 @@ func (agent *ServerAgentImpl) removeBackingFileFromTemplateDiskImage(dirPath str
 func (agent *ServerAgentImpl) installVm(request CreateVmRequest) error {
 	log.Printf("Installing VM...")
 
-	installVmCmd := exec.Command(
-		"virt-install",
+	args := []string{
 		"--name", request.VmId,
 		"--ram", strconv.Itoa(request.VramMB),
 		"--vcpus", strconv.Itoa(request.VcpuCount),
 		"--import",
-		"--disk", "path="+request.DirPath+"/"+request.VmId+".qcow2,format=qcow2",
-		"--disk", "path="+request.DirPath+"/cidata.iso,device=cdrom",
+		"--disk", "path=" + request.DirPath + "/" + request.VmId + ".qcow2,format=qcow2",
+		"--disk", "path=" + request.DirPath + "/cidata.iso,device=cdrom",
 		"--os-variant", DEFAULT_OS_VARIANT,
-		"--network", "bridge="+agent.vmsBridge+",target="+request.VlanEtiquete+",model=virtio",
-		"--graphics", "vnc,listen=0.0.0.0",
+		"--network", "bridge=" + agent.vmsBridge + ",target=" + request.VlanEtiquete + ",model=virtio",
+	}
+
+	// The internal networks of a lab are attached after the subject network, in order
+	for position, labInterface := range request.LabInterfaces {
+		args = append(
+			args,
+			"--network",
+			"bridge="+agent.vmsBridge+
+				",target="+labInterface.VlanEtiquete+
+				",model=virtio,mac="+getLabInterfaceMacAddress(request.VmId, position),
+		)
+	}
+
+	args = append(
+		args,
+		// VNC is only reachable through the console proxy
+		"--graphics", "vnc,listen=127.0.0.1",
 		"--noautoconsole",
 	)
 
+	installVmCmd := exec.Command("virt-install", args...)
+
 	installVmCmdOutput, err := installVmCmd.CombinedOutput()
 	if err != nil {
 		return logAndReturnError("Error installing VM: ", string(installVmCmdOutput))
@@ -631,15 +992,14 @@ func (agent *ServerAgentImpl) dumpVmXML(vmId string) {
 	log.Printf("Dumping VM XML to %s...", xmlPath)
 
 	for {
-		cmd := exec.Command("virsh", "dumpxml", vmId)
-		output, err := cmd.Output()
+		output, err := agent.hypervisor.DumpDomainXML(vmId)
 		if err != nil {
 			log.Printf("Error dumping VM XML: %v; retrying…", err)
 			time.Sleep(time.Second)
 			continue
 		}
 
-		if err := os.WriteFile(xmlPath, output, 0644); err != nil {
+		if err := os.WriteFile(xmlPath, []byte(output), 0644); err != nil {
 			log.Printf("Error writing XML file: %v; retrying…", err)
 			time.Sleep(time.Second)
 			continue
@@ -652,14 +1012,8 @@ func (agent *ServerAgentImpl) dumpVmXML(vmId string) {
 func (agent *ServerAgentImpl) forceStopVM(vmId string) error {
 	log.Printf("Force stopping VM '%s'...", vmId)
 
-	cmd := exec.Command(
-		"virsh", "destroy", vmId,
-	)
-
-	output, err := cmd.CombinedOutput()
-
-	if err != nil {
-		return logAndReturnError("Error force stopping VM '"+vmId+"': ", string(output))
+	if err := agent.hypervisor.DestroyDomain(vmId); err != nil {
+		return logAndReturnError("Error force stopping VM '"+vmId+"': ", err.Error())
 	}
 
 	return nil
@@ -683,21 +1037,335 @@ func (agent *ServerAgentImpl) vmDomainExists(vmId string) bool {
 func (agent *ServerAgentImpl) importVmDomain(vmId string) error {
 	log.Printf("Importing VM domain...")
 
-	importVmDomainCmd := exec.Command(
-		"virsh", "define", agent.vmsStoragePath+"/"+vmId+"/"+vmId+".xml",
+	domainXml, err := os.ReadFile(agent.vmsStoragePath + "/" + vmId + "/" + vmId + ".xml")
+	if err != nil {
+		return logAndReturnError("Error reading VM domain XML: ", err.Error())
+	}
+
+	if err := agent.hypervisor.DefineDomain(string(domainXml)); err != nil {
+		return logAndReturnError("Error importing VM domain: ", err.Error())
+	}
+
+	return nil
+}
+
+// getInstanceStatus returns an empty state if the instance doesn't exist in this server
+func (agent *ServerAgentImpl) getInstanceStatus(instanceId string) (DomainState, error) {
+	domains, err := agent.hypervisor.ListDomains()
+	if err != nil {
+		return "", logAndReturnError("Error listing VMs status: ", err.Error())
+	}
+
+	for _, domain := range domains {
+		if domain.Name == instanceId {
+			return domain.State, nil
+		}
+	}
+
+	return "", nil
+}
+
+func (agent *ServerAgentImpl) coldMigrateInstance(request MigrateInstanceRequest) error {
+	// Make sure the target gets the latest domain definition
+	agent.dumpVmXML(request.InstanceId)
+
+	if err := agent.sendVmFiles(request.TargetServerAgentUrl, request.InstanceId); err != nil {
+		return err
+	}
+
+	if err := agent.importInstanceInServerAgent(request.TargetServerAgentUrl, request.InstanceId); err != nil {
+		return err
+	}
+
+	if err := agent.hypervisor.UndefineDomain(request.InstanceId); err != nil {
+		return logAndReturnError("Error undefining instance '"+request.InstanceId+"': ", err.Error())
+	}
+
+	return nil
+}
+
+func (agent *ServerAgentImpl) liveMigrateInstance(request MigrateInstanceRequest) error {
+	// Snapshots live inside the disk image and libvirt only mirrors the current state
+	snapshots, err := agent.ListSnapshots(request.InstanceId)
+	if err != nil {
+		return err
+	}
+
+	if len(snapshots) > 0 {
+		return NewHttpError(
+			http.StatusBadRequest,
+			errors.New("instances with snapshots can only be cold migrated"),
+		)
+	}
+
+	agent.dumpVmXML(request.InstanceId)
+
+	// The disk is copied by libvirt while the instance keeps running,
+	// we only send the files that don't change and an empty overlay for the disk
+	diskFileName := request.InstanceId + ".qcow2"
+	if err := agent.sendVmFiles(request.TargetServerAgentUrl, request.InstanceId, diskFileName); err != nil {
+		return err
+	}
+
+	if err := agent.sendEmptyOverlay(request.TargetServerAgentUrl, request.InstanceId); err != nil {
+		return err
+	}
+
+	targetUrl, err := url.Parse(request.TargetServerAgentUrl)
+	if err != nil {
+		return logAndReturnError("Error parsing target server agent URL: ", err.Error())
+	}
+
+	log.Printf("Live migrating instance '%s'...", request.InstanceId)
+
+	cmd := exec.Command(
+		"virsh", "migrate",
+		"--live",
+		"--persistent",
+		"--undefinesource",
+		"--copy-storage-inc",
+		request.InstanceId,
+		fmt.Sprintf(LIVE_MIGRATION_URI_FORMAT, targetUrl.Hostname()),
+	)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return logAndReturnError("Error live migrating instance '"+request.InstanceId+"': ", string(output))
+	}
+
+	return nil
+}
+
+func (agent *ServerAgentImpl) sendEmptyOverlay(serverAgentUrl string, instanceId string) error {
+	info, err := agent.getDiskImageInfo(instanceId)
+	if err != nil {
+		return err
+	}
+
+	dirPath := agent.vmsStoragePath + "/" + instanceId
+	overlayFilePath := dirPath + "/" + instanceId + ".migration.qcow2"
+	defer os.Remove(overlayFilePath)
+
+	createOverlayCmd := exec.Command(
+		"qemu-img",
+		"create",
+		"-b", info.FullBackingFilename,
+		"-f", "qcow2",
+		"-F", "qcow2",
+		overlayFilePath,
+		strconv.FormatInt(info.VirtualSize, 10),
+	)
+
+	if output, err := createOverlayCmd.CombinedOutput(); err != nil {
+		return logAndReturnError("Error creating migration disk image: ", string(output))
+	}
+
+	return agent.sendVmFile(serverAgentUrl, instanceId, instanceId+".qcow2", overlayFilePath)
+}
+
+func (agent *ServerAgentImpl) sendVmFiles(serverAgentUrl string, vmId string, excludedFileNames ...string) error {
+	entries, err := os.ReadDir(agent.vmsStoragePath + "/" + vmId)
+	if err != nil {
+		return logAndReturnError("Error reading VM '"+vmId+"' directory: ", err.Error())
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || slices.Contains(excludedFileNames, entry.Name()) {
+			continue
+		}
+
+		filePath := agent.vmsStoragePath + "/" + vmId + "/" + entry.Name()
+		if err := agent.sendVmFile(serverAgentUrl, vmId, entry.Name(), filePath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (agent *ServerAgentImpl) sendVmFile(serverAgentUrl string, vmId string, fileName string, filePath string) error {
+	log.Printf("Sending file '%s' of VM '%s' to '%s'...", fileName, vmId, serverAgentUrl)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return logAndReturnError("Error opening file '"+fileName+"': ", err.Error())
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return logAndReturnError("Error reading file '"+fileName+"': ", err.Error())
+	}
+
+	// The file is streamed, its hash is signed with the request so the receiving server agent can check it
+	fileHash := sha256.New()
+	if _, err := io.Copy(fileHash, file); err != nil {
+		return logAndReturnError("Error hashing file '"+fileName+"': ", err.Error())
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return logAndReturnError("Error reading file '"+fileName+"': ", err.Error())
+	}
+
+	req, err := http.NewRequest(
+		http.MethodPut,
+		serverAgentUrl+agent.receiveVmFileEndpoint+"/"+vmId+"/"+fileName,
+		file,
+	)
+	if err != nil {
+		return logAndReturnError("Error creating request: ", err.Error())
+	}
+	req.ContentLength = fileInfo.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(AGENT_BODY_HASH_HEADER, hex.EncodeToString(fileHash.Sum(nil)))
+
+	resp, err := agent.agentClient.Do(req)
+	if err != nil {
+		return logAndReturnError("Error sending file '"+fileName+"': ", err.Error())
+	}
+	defer resp.Body.Close()
+
+	return checkIfStatusCodeIsOk(resp)
+}
+
+func (agent *ServerAgentImpl) importInstanceInServerAgent(serverAgentUrl string, instanceId string) error {
+	resp, err := agent.agentClient.Post(
+		serverAgentUrl+agent.importInstanceEndpoint+"/"+instanceId,
+		"application/json",
+		nil,
 	)
+	if err != nil {
+		return logAndReturnError("Error importing instance in target server agent: ", err.Error())
+	}
+	defer resp.Body.Close()
+
+	return checkIfStatusCodeIsOk(resp)
+}
+
+func (agent *ServerAgentImpl) deleteVmInServerAgent(serverAgentUrl string, vmId string) {
+	log.Printf("Removing VM '%s' from '%s'...", vmId, serverAgentUrl)
+
+	requestBody, err := json.Marshal(DeleteVmRequest{VmId: vmId})
+	if err != nil {
+		log.Printf("Error marshalling delete request: %v", err)
+		return
+	}
+
+	req, err := http.NewRequest(
+		http.MethodDelete,
+		serverAgentUrl+agent.deleteVmEndpoint,
+		bytes.NewBuffer(requestBody),
+	)
+	if err != nil {
+		log.Printf("Error creating delete request: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
 
-	if output, err := importVmDomainCmd.CombinedOutput(); err != nil {
-		return logAndReturnError("Error importing VM domain: ", string(output))
+	resp, err := agent.agentClient.Do(req)
+	if err != nil {
+		log.Printf("Error removing VM '%s' from '%s': %v", vmId, serverAgentUrl, err)
+		return
 	}
+	defer resp.Body.Close()
+
+	if err := checkIfStatusCodeIsOk(resp); err != nil {
+		log.Printf("Error removing VM '%s' from '%s': %v", vmId, serverAgentUrl, err)
+	}
+}
 
+func checkIfStatusCodeIsOk(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		var apiErr ApiError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+			// If JSON decoding fails, read the response body as a string
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return logAndReturnError("Error reading response body: ", err.Error())
+			}
+			return NewHttpError(resp.StatusCode, errors.New(string(body)))
+		}
+		return NewHttpError(resp.StatusCode, errors.New(apiErr.Error))
+	}
 	return nil
 }
 
-func toListInstancesStatusResponse(vmStatusMap map[string]string) []ListInstancesStatusResponse {
+func isPlainFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+// checkSnapshotIds validates the ids before they're used in the disk image path and the qemu-img arguments,
+// snapshot ids can't start with a dash so they aren't taken as options
+func checkSnapshotIds(instanceId string, snapshotId string) error {
+	if !instanceIdRegexp.MatchString(instanceId) {
+		return NewHttpError(http.StatusBadRequest, errors.New("invalid instance id"))
+	}
+
+	if !isPlainFileName(snapshotId) || strings.HasPrefix(snapshotId, "-") {
+		return NewHttpError(http.StatusBadRequest, errors.New("invalid snapshot id"))
+	}
+
+	return nil
+}
+
+func (agent *ServerAgentImpl) getDiskImagePath(vmId string) string {
+	return agent.vmsStoragePath + "/" + vmId + "/" + vmId + ".qcow2"
+}
+
+func (agent *ServerAgentImpl) getDiskImageInfo(vmId string) (QemuImgInfo, error) {
+	// --force-share lets us read the image while the VM is running
+	cmd := exec.Command(
+		"qemu-img", "info", "--output=json", "--force-share", agent.getDiskImagePath(vmId),
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(output), "No such file or directory") {
+			return QemuImgInfo{}, NewHttpError(
+				http.StatusNotFound,
+				errors.New("VM '"+vmId+"' does not exist in this server"),
+			)
+		}
+
+		return QemuImgInfo{}, logAndReturnError("Error getting disk image info: ", string(output))
+	}
+
+	var info QemuImgInfo
+	if err := json.Unmarshal(output, &info); err != nil {
+		return QemuImgInfo{}, logAndReturnError("Error parsing disk image info: ", err.Error())
+	}
+
+	return info, nil
+}
+
+func (agent *ServerAgentImpl) checkIfSnapshotExists(instanceId string, snapshotId string) error {
+	snapshots, err := agent.ListSnapshots(instanceId)
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.SnapshotId == snapshotId {
+			return nil
+		}
+	}
+
+	return NewHttpError(http.StatusNotFound, errors.New("snapshot '"+snapshotId+"' does not exist"))
+}
+
+func toListSnapshotsResponse(snapshots []QemuImgSnapshot) []ListSnapshotsResponse {
+	response := []ListSnapshotsResponse{}
+	for _, snapshot := range snapshots {
+		response = append(response, ListSnapshotsResponse{
+			SnapshotId: snapshot.Name,
+			CreatedAt:  time.Unix(snapshot.DateSec, 0).UTC().Format(time.RFC3339),
+		})
+	}
+	return response
+}
+
+func toListInstancesStatusResponse(domains []Domain) []ListInstancesStatusResponse {
 	response := []ListInstancesStatusResponse{}
-	for vmName, status := range vmStatusMap {
-		response = append(response, ListInstancesStatusResponse{InstanceId: vmName, Status: status})
+	for _, domain := range domains {
+		response = append(response, ListInstancesStatusResponse{InstanceId: domain.Name, Status: string(domain.State)})
 	}
 	return response
 }
@@ -782,15 +1450,31 @@ func getDiskInfo() (totalDiskMB int, freeDiskMB int, err error) {
 }
 
 func NewServerAgent(
+	hypervisor Hypervisor,
+	agentClient *http.Client,
 	vmsStoragePath string,
 	cloudInitImagesPath string,
 	vmsBridge string,
 	vmNetworkInterface string,
+	receiveVmFileEndpoint string,
+	importInstanceEndpoint string,
+	deleteVmEndpoint string,
 ) ServerAgent {
 	return &ServerAgentImpl{
-		vmsStoragePath:      vmsStoragePath,
-		cloudInitImagesPath: cloudInitImagesPath,
-		vmsBridge:           vmsBridge,
-		vmNetworkInterface:  vmNetworkInterface,
+		hypervisor:             hypervisor,
+		agentClient:            agentClient,
+		vmsStoragePath:         vmsStoragePath,
+		cloudInitImagesPath:    cloudInitImagesPath,
+		vmsBridge:              vmsBridge,
+		vmNetworkInterface:     vmNetworkInterface,
+		receiveVmFileEndpoint:  receiveVmFileEndpoint,
+		importInstanceEndpoint: importInstanceEndpoint,
+		deleteVmEndpoint:       deleteVmEndpoint,
+		idempotentRequests:     NewIdempotentRequests(),
+		shutdownWaits: ShutdownWaits{
+			Check: SHUTDOWN_WAIT_TIME,
+			Retry: RETRY_SHUTDOWN_WAIT_TIME,
+			Force: FORCE_SHUTDOWN_WAIT_TIME,
+		},
 	}
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testInstanceId = "6f1c2a4e-8b3d-4f5a-9c7e-1d2b3a4c5e6f"
+const testTemplateId = "0a9b8c7d-6e5f-4a3b-2c1d-0e9f8a7b6c5d"
+
+// newTestServerAgent returns a server agent on the fake hypervisor with a running instance,
+// the shutdown waits are short so the whole ladder takes milliseconds
+func newTestServerAgent(t *testing.T) (*ServerAgentImpl, *FakeHypervisor) {
+	t.Helper()
+
+	hypervisor := NewFakeHypervisor()
+	if err := hypervisor.DefineDomain("<domain><name>" + testInstanceId + "</name></domain>"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hypervisor.StartDomain(testInstanceId); err != nil {
+		t.Fatal(err)
+	}
+	hypervisor.Calls = nil
+
+	agent := &ServerAgentImpl{
+		hypervisor:         hypervisor,
+		idempotentRequests: NewIdempotentRequests(),
+		shutdownWaits: ShutdownWaits{
+			Check: time.Millisecond,
+			Retry: 10 * time.Millisecond,
+			Force: 30 * time.Millisecond,
+		},
+	}
+
+	return agent, hypervisor
+}
+
+func countCalls(hypervisor *FakeHypervisor, call string) int {
+	count := 0
+	for _, c := range hypervisor.Calls {
+		if c == call+" "+testInstanceId {
+			count++
+		}
+	}
+	return count
+}
+
+func checkInstanceState(t *testing.T, agent *ServerAgentImpl, expected DomainState) {
+	t.Helper()
+
+	state, err := agent.getInstanceStatus(testInstanceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != expected {
+		t.Fatalf("expected instance to be '%s', it is '%s'", expected, state)
+	}
+}
+
+func TestStopInstanceShutsDownCleanly(t *testing.T) {
+	agent, hypervisor := newTestServerAgent(t)
+
+	if err := agent.StopInstance(testInstanceId); err != nil {
+		t.Fatalf("StopInstance returned error: %v", err)
+	}
+
+	checkInstanceState(t, agent, DomainShutOff)
+	if shutdowns := countCalls(hypervisor, "shutdown"); shutdowns != 1 {
+		t.Errorf("expected 1 shutdown, got %d (calls %v)", shutdowns, hypervisor.Calls)
+	}
+	if countCalls(hypervisor, "destroy") != 0 {
+		t.Errorf("expected no destroy, got calls %v", hypervisor.Calls)
+	}
+}
+
+func TestStopInstanceRetriesIgnoredShutdown(t *testing.T) {
+	agent, hypervisor := newTestServerAgent(t)
+	hypervisor.ShutdownsToIgnore = 1
+
+	if err := agent.StopInstance(testInstanceId); err != nil {
+		t.Fatalf("StopInstance returned error: %v", err)
+	}
+
+	checkInstanceState(t, agent, DomainShutOff)
+	if shutdowns := countCalls(hypervisor, "shutdown"); shutdowns != 2 {
+		t.Errorf("expected 2 shutdowns, got %d (calls %v)", shutdowns, hypervisor.Calls)
+	}
+	if countCalls(hypervisor, "destroy") != 0 {
+		t.Errorf("expected no destroy, got calls %v", hypervisor.Calls)
+	}
+}
+
+func TestStopInstanceForcesGuestIgnoringShutdowns(t *testing.T) {
+	agent, hypervisor := newTestServerAgent(t)
+	hypervisor.ShutdownsToIgnore = 1000
+
+	if err := agent.StopInstance(testInstanceId); err != nil {
+		t.Fatalf("StopInstance returned error: %v", err)
+	}
+
+	checkInstanceState(t, agent, DomainShutOff)
+	if shutdowns := countCalls(hypervisor, "shutdown"); shutdowns != 2 {
+		t.Errorf("expected 2 shutdowns before forcing, got %d (calls %v)", shutdowns, hypervisor.Calls)
+	}
+	if !slices.Equal(hypervisor.Calls[len(hypervisor.Calls)-1:], []string{"destroy " + testInstanceId}) {
+		t.Errorf("expected the instance to be destroyed last, got calls %v", hypervisor.Calls)
+	}
+}
+
+func TestStopInstanceNotRunning(t *testing.T) {
+	agent, hypervisor := newTestServerAgent(t)
+	if err := hypervisor.SetDomainState(testInstanceId, DomainShutOff); err != nil {
+		t.Fatal(err)
+	}
+
+	err := agent.StopInstance(testInstanceId)
+
+	var httpErr *HttpError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a bad request, got %v", err)
+	}
+}
+
+func TestFakeStartDomainAlreadyRunning(t *testing.T) {
+	_, hypervisor := newTestServerAgent(t)
+
+	if err := hypervisor.StartDomain(testInstanceId); !errors.Is(err, ErrDomainAlreadyRunning) {
+		t.Fatalf("expected ErrDomainAlreadyRunning, got %v", err)
+	}
+}
+
+func TestDeleteVmRejectsInvalidIds(t *testing.T) {
+	agent, _ := newTestServerAgent(t)
+	agent.vmsStoragePath = t.TempDir()
+
+	keptFile := filepath.Join(agent.vmsStoragePath, "kept")
+	if err := os.WriteFile(keptFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, vmId := range []string{"", ".", "..", "../" + testInstanceId} {
+		err := agent.DeleteVm(DeleteVmRequest{VmId: vmId})
+
+		var httpErr *HttpError
+		if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected a bad request for id %q, got %v", vmId, err)
+		}
+	}
+
+	if _, err := os.Stat(keptFile); err != nil {
+		t.Fatalf("expected the storage to be untouched, got %v", err)
+	}
+}
+
+func TestMigrateInstanceRejectsInvalidIds(t *testing.T) {
+	agent, _ := newTestServerAgent(t)
+
+	requests := []MigrateInstanceRequest{
+		{InstanceId: ".."},
+		{InstanceId: testInstanceId, BackingTemplateId: "../" + testTemplateId},
+	}
+
+	for _, request := range requests {
+		err := agent.MigrateInstance(request)
+
+		var httpErr *HttpError
+		if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected a bad request for %+v, got %v", request, err)
+		}
+	}
+}
+
+func TestMigrateInstanceFailureRemovesCopiedTemplate(t *testing.T) {
+	agent, hypervisor := newTestServerAgent(t)
+	if err := hypervisor.SetDomainState(testInstanceId, DomainShutOff); err != nil {
+		t.Fatal(err)
+	}
+
+	agent.vmsStoragePath = t.TempDir()
+	for _, vmId := range []string{testInstanceId, testTemplateId} {
+		if err := os.MkdirAll(filepath.Join(agent.vmsStoragePath, vmId), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(agent.vmsStoragePath, vmId, vmId+".qcow2"), []byte("disk"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The target receives the files but fails to import the instance
+	var mutex sync.Mutex
+	deleted := []string{}
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodDelete:
+			var request DeleteVmRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				t.Error(err)
+			}
+			mutex.Lock()
+			deleted = append(deleted, request.VmId)
+			mutex.Unlock()
+		case http.MethodPost:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+
+	agent.agentClient = target.Client()
+	agent.receiveVmFileEndpoint = "/vms/receive"
+	agent.importInstanceEndpoint = "/instances/import"
+	agent.deleteVmEndpoint = "/vms"
+
+	err := agent.MigrateInstance(MigrateInstanceRequest{
+		InstanceId:           testInstanceId,
+		TargetServerAgentUrl: target.URL,
+		BackingTemplateId:    testTemplateId,
+	})
+	if err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !slices.Equal(deleted, []string{testInstanceId, testTemplateId}) {
+		t.Fatalf("expected the instance and its template to be removed from the target, got %v", deleted)
+	}
+	if _, err := os.Stat(filepath.Join(agent.vmsStoragePath, testInstanceId)); err != nil {
+		t.Fatalf("expected the instance files to be kept here, got %v", err)
+	}
+}
@@ -10,6 +10,8 @@ type DefineTemplateRequest struct {
 	SizeMB           int    `json:"sizeMB"`
 	VcpuCount        int    `json:"vcpuCount"`
 	VramMB           int    `json:"vramMB"`
+	// Requests sent again with the same key get the result of the first one instead of defining the template twice
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 type CreateInstanceRequest struct {
@@ -27,14 +29,54 @@ type CreateInstanceRequest struct {
 	Dns2            string   `json:"dns2"`
 	Gateway         string   `json:"gateway"`
 	VlanEtiquete    string   `json:"vlanEtiquete"`
+	// Empty when IPv6 is disabled
+	Ipv6AddWithSubnet string `json:"ipv6AddWithSubnet,omitempty"`
+	Ipv6Gateway       string `json:"ipv6Gateway,omitempty"`
+	// Only set for instances of a lab
+	LabInterfaces []LabInterface `json:"labInterfaces,omitempty"`
+	// Requests sent again with the same key get the result of the first one instead of creating the instance twice
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 type StartInstanceRequest struct {
+	InstanceId    string         `json:"instanceId"`
+	Vid           string         `json:"vid"`
+	VlanEtiquete  string         `json:"vlanEtiquete"`
+	LabInterfaces []LabInterface `json:"labInterfaces,omitempty"`
+}
+
+// Interface of a lab instance in an internal network, its VLAN is only bridged inside this server
+type LabInterface struct {
+	Vid             string `json:"vid"`
+	VlanEtiquete    string `json:"vlanEtiquete"`
+	IpAddWithSubnet string `json:"ipAddWithSubnet,omitempty"`
+}
+
+type SetupInstanceNetworkRequest struct {
 	InstanceId   string `json:"instanceId"`
 	Vid          string `json:"vid"`
 	VlanEtiquete string `json:"vlanEtiquete"`
 }
 
+type MigrateInstanceRequest struct {
+	InstanceId           string `json:"instanceId"`
+	TargetServerAgentUrl string `json:"targetServerAgentUrl"`
+	BackingTemplateId    string `json:"backingTemplateId"` // Empty if the target already holds the backing template
+	Live                 bool   `json:"live"`
+	Vid                  string `json:"vid"`
+	RemoveEtiquete       bool   `json:"removeEtiquete"`
+}
+
+type CreateSnapshotRequest struct {
+	InstanceId string `json:"instanceId"`
+	SnapshotId string `json:"snapshotId"`
+}
+
+type ListSnapshotsResponse struct {
+	SnapshotId string `json:"snapshotId"`
+	CreatedAt  string `json:"createdAt"`
+}
+
 type DeleteVmRequest struct {
 	VmId           string `json:"vmId"`
 	RemoveEtiquete bool   `json:"removeEtiquete"`
@@ -46,6 +88,11 @@ type ListInstancesStatusResponse struct {
 	Status     string `json:"status"`
 }
 
+// ListVmDisksResponse is a VM with its files in this server, with or without a domain
+type ListVmDisksResponse struct {
+	VmId string `json:"vmId"`
+}
+
 type GetResourceStatusResponse struct {
 	CpuLoad       float64 `json:"cpuLoad"`
 	TotalMemoryMB int     `json:"totalMemoryMB"`
@@ -53,3 +100,27 @@ type GetResourceStatusResponse struct {
 	TotalDiskMB   int     `json:"totalDiskMB"`
 	FreeDiskMB    int     `json:"freeDiskMB"`
 }
+
+// VMs Manager API
+type RegisterServerAgentRequest struct {
+	Url           string            `json:"url"`
+	Version       string            `json:"version"`
+	Labels        map[string]string `json:"labels"`
+	VcpuCount     int               `json:"vcpuCount"`
+	TotalMemoryMB int               `json:"totalMemoryMB"`
+	TotalDiskMB   int               `json:"totalDiskMB"`
+}
+
+type ServerAgentHeartbeatRequest struct {
+	Url            string                    `json:"url"`
+	ResourceStatus GetResourceStatusResponse `json:"resourceStatus"`
+}
+
+// DomainEventsRequest carries the domains whose state changed since the last report,
+// or all of them when Full is set so the vms manager can replace what it knew about this server agent
+type DomainEventsRequest struct {
+	Url            string                        `json:"url"`
+	Full           bool                          `json:"full"`
+	Domains        []ListInstancesStatusResponse `json:"domains"`
+	RemovedDomains []string                      `json:"removedDomains"`
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The token scheme is shared with the server agents, agent_token.go is a copy of theirs
+//go:generate sh -c "{ echo '// Code generated from ../server-agent/agent_token.go by go generate. DO NOT EDIT.'; echo; cat ../server-agent/agent_token.go; } > agent_token.go"
+
+// AgentClient calls the server agents presenting the credentials they expect:
+// every request is signed with the secret shared with the agents and, when
+// configured, a client certificate is presented for mTLS. The same secret
+// authenticates the requests the server agents send, e.g. their heartbeats
+type AgentClient struct {
+	*http.Client
+	secret    []byte
+	tlsConfig *tls.Config
+}
+
+// DialWebSocket opens a WebSocket to a server agent, the handshake is signed like any other request
+func (c *AgentClient) DialWebSocket(dialer websocket.Dialer, wsUrl string) (*websocket.Conn, *http.Response, error) {
+	dialer.TLSClientConfig = c.tlsConfig
+
+	header := http.Header{}
+	if len(c.secret) > 0 {
+		req, err := http.NewRequest(http.MethodGet, wsUrl, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := signAgentRequest(c.secret, req, time.Now()); err != nil {
+			return nil, nil, err
+		}
+		header = req.Header
+	}
+
+	return dialer.Dial(wsUrl, header)
+}
+
+// VerifyRequest checks the token of requests sent by the server agents, e.g. their heartbeats
+func (c *AgentClient) VerifyRequest(r *http.Request) error {
+	if len(c.secret) == 0 {
+		return nil
+	}
+
+	return verifyAgentRequest(c.secret, r, false)
+}
+
+// NewAgentClient builds the client used for every server agent call. certFile and keyFile
+// are the client certificate for mTLS and caFile verifies the certificates of the agents
+func NewAgentClient(secret string, certFile string, keyFile string, caFile string) (*AgentClient, error) {
+	if secret == "" {
+		log.Println("WARNING: SERVER_AGENTS_AUTH_SECRET is not set, requests to the server agents won't be signed")
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, logAndReturnError("Error loading server agents client certificate: ", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	if caFile != "" {
+		caPem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, logAndReturnError("Error reading server agents CA file: ", err.Error())
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, logAndReturnError("Error parsing server agents CA file: ", "no PEM certificates found in "+caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	var roundTripper http.RoundTripper = transport
+	if secret != "" {
+		roundTripper = &agentTokenTransport{secret: []byte(secret), base: transport}
+	}
+
+	return &AgentClient{
+		Client:    &http.Client{Transport: roundTripper},
+		secret:    []byte(secret),
+		tlsConfig: tlsConfig,
+	}, nil
+}
@@ -2,25 +2,69 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"time"
 )
 
+// Comments are sent on idle event streams so proxies don't close them
+const INSTANCE_EVENTS_KEEPALIVE_INTERVAL = 30 * time.Second
+
 type apiFunc func(w http.ResponseWriter, r *http.Request) error
 
 type ApiServer struct {
-	listenAddr                  string
-	service                     Service
-	listBaseImagesEndpoint      string
-	defineTemplateEndpoint      string
-	deleteTemplateEndpoint      string
-	createInstanceEndpoint      string
-	deleteInstanceEndpoint      string
-	startInstanceEndpoint       string
-	stopInstanceEndpoint        string
-	restartInstanceEndpoint     string
-	listInstancesStatusEndpoint string
-	listServersStatusEndpoint   string
+	listenAddr                      string
+	service                         Service
+	jobService                      JobService
+	agentClient                     *AgentClient
+	listBaseImagesEndpoint          string
+	defineTemplateEndpoint          string
+	deleteTemplateEndpoint          string
+	createInstanceEndpoint          string
+	deleteInstanceEndpoint          string
+	startInstanceEndpoint           string
+	stopInstanceEndpoint            string
+	restartInstanceEndpoint         string
+	listInstancesStatusEndpoint     string
+	listServersStatusEndpoint       string
+	migrateInstanceEndpoint         string
+	createSnapshotEndpoint          string
+	listSnapshotsEndpoint           string
+	revertSnapshotEndpoint          string
+	deleteSnapshotEndpoint          string
+	getJobEndpoint                  string
+	createConsoleTicketEndpoint     string
+	instanceConsoleEndpoint         string
+	registerServerAgentEndpoint     string
+	serverAgentHeartbeatEndpoint    string
+	listServerAgentsEndpoint        string
+	cordonServerAgentEndpoint       string
+	drainServerAgentEndpoint        string
+	deregisterServerAgentEndpoint   string
+	getRouterDriftEndpoint          string
+	reconcileRouterEndpoint         string
+	createLabEndpoint               string
+	startLabEndpoint                string
+	stopLabEndpoint                 string
+	deleteLabEndpoint               string
+	createFirewallPolicyEndpoint    string
+	listFirewallPoliciesEndpoint    string
+	getFirewallPolicyEndpoint       string
+	updateFirewallPolicyEndpoint    string
+	deleteFirewallPolicyEndpoint    string
+	createPortForwardEndpoint       string
+	listPortForwardsEndpoint        string
+	deletePortForwardEndpoint       string
+	createWireguardPeerEndpoint     string
+	listWireguardPeersEndpoint      string
+	deleteWireguardPeerEndpoint     string
+	rotateWireguardKeyEndpoint      string
+	getReconciliationReportEndpoint string
+	runReconciliationEndpoint       string
+	listVmsEndpoint                 string
+	domainEventsEndpoint            string
+	instanceEventsEndpoint          string
 }
 
 func (server *ApiServer) handleListBaseImages(w http.ResponseWriter, r *http.Request) error {
@@ -37,22 +81,36 @@ func (server *ApiServer) handleDefineTemplate(w http.ResponseWriter, r *http.Req
 		return logAndReturnError("Error decoding request body: ", err.Error())
 	}
 
-	response, err := server.service.DefineTemplate(request)
+	response, err := server.jobService.StartIdempotentJob(
+		DefineTemplateJob,
+		&request.SourceInstanceId,
+		request.IdempotencyKey,
+		func(progress JobProgress) (any, error) {
+			return server.service.DefineTemplate(request, progress)
+		},
+	)
 	if err != nil {
 		return err
 	}
 
-	return writeResponse(w, http.StatusOK, response)
+	return writeResponse(w, http.StatusAccepted, response)
 }
 
 func (server *ApiServer) handleDeleteTemplate(w http.ResponseWriter, r *http.Request) error {
 	templateId := r.PathValue("templateId")
 
-	if err := server.service.DeleteTemplate(templateId); err != nil {
+	response, err := server.jobService.StartJob(
+		DeleteTemplateJob,
+		&templateId,
+		func(progress JobProgress) (any, error) {
+			return nil, server.service.DeleteTemplate(templateId, progress)
+		},
+	)
+	if err != nil {
 		return err
 	}
 
-	return writeResponse(w, http.StatusOK, nil)
+	return writeResponse(w, http.StatusAccepted, response)
 }
 
 func (server *ApiServer) handleCreateInstance(w http.ResponseWriter, r *http.Request) error {
@@ -61,22 +119,37 @@ func (server *ApiServer) handleCreateInstance(w http.ResponseWriter, r *http.Req
 		return logAndReturnError("Error decoding request body: ", err.Error())
 	}
 
-	response, err := server.service.CreateInstance(request)
+	// The instance ID is generated by the job, it is returned as part of the job result
+	response, err := server.jobService.StartIdempotentJob(
+		CreateInstanceJob,
+		nil,
+		request.IdempotencyKey,
+		func(progress JobProgress) (any, error) {
+			return server.service.CreateInstance(request, progress)
+		},
+	)
 	if err != nil {
 		return err
 	}
 
-	return writeResponse(w, http.StatusOK, response)
+	return writeResponse(w, http.StatusAccepted, response)
 }
 
 func (server *ApiServer) handleDeleteInstance(w http.ResponseWriter, r *http.Request) error {
 	instanceId := r.PathValue("instanceId")
 
-	if err := server.service.DeleteInstance(instanceId); err != nil {
+	response, err := server.jobService.StartJob(
+		DeleteInstanceJob,
+		&instanceId,
+		func(progress JobProgress) (any, error) {
+			return nil, server.service.DeleteInstance(instanceId, progress)
+		},
+	)
+	if err != nil {
 		return err
 	}
 
-	return writeResponse(w, http.StatusOK, nil)
+	return writeResponse(w, http.StatusAccepted, response)
 }
 
 func (server *ApiServer) handleStartInstance(w http.ResponseWriter, r *http.Request) error {
@@ -92,11 +165,18 @@ func (server *ApiServer) handleStartInstance(w http.ResponseWriter, r *http.Requ
 func (server *ApiServer) handleStopInstance(w http.ResponseWriter, r *http.Request) error {
 	instanceId := r.PathValue("instanceId")
 
-	if err := server.service.StopInstance(instanceId); err != nil {
+	response, err := server.jobService.StartJob(
+		StopInstanceJob,
+		&instanceId,
+		func(progress JobProgress) (any, error) {
+			return nil, server.service.StopInstance(instanceId, progress)
+		},
+	)
+	if err != nil {
 		return err
 	}
 
-	return writeResponse(w, http.StatusOK, nil)
+	return writeResponse(w, http.StatusAccepted, response)
 }
 
 func (server *ApiServer) handleRestartInstance(w http.ResponseWriter, r *http.Request) error {
@@ -109,6 +189,65 @@ func (server *ApiServer) handleRestartInstance(w http.ResponseWriter, r *http.Re
 	return writeResponse(w, http.StatusOK, nil)
 }
 
+func (server *ApiServer) handleMigrateInstance(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+
+	var request MigrateInstanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.service.MigrateInstance(instanceId, request); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleCreateSnapshot(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+
+	response, err := server.service.CreateSnapshot(instanceId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, response)
+}
+
+func (server *ApiServer) handleListSnapshots(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+
+	snapshots, err := server.service.ListSnapshots(instanceId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, snapshots)
+}
+
+func (server *ApiServer) handleRevertSnapshot(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+	snapshotId := r.PathValue("snapshotId")
+
+	if err := server.service.RevertSnapshot(instanceId, snapshotId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleDeleteSnapshot(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+	snapshotId := r.PathValue("snapshotId")
+
+	if err := server.service.DeleteSnapshot(instanceId, snapshotId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
 func (server *ApiServer) handleListInstancesStatus(w http.ResponseWriter, r *http.Request) error {
 	statuses, err := server.service.ListInstancesStatus()
 	if err != nil {
@@ -118,6 +257,60 @@ func (server *ApiServer) handleListInstancesStatus(w http.ResponseWriter, r *htt
 	return writeResponse(w, http.StatusOK, statuses)
 }
 
+// handleInstanceEvents streams the status of every instance and then its changes as server-sent events
+func (server *ApiServer) handleInstanceEvents(w http.ResponseWriter, r *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return logAndReturnError("Error streaming instance events: ", "streaming is not supported")
+	}
+
+	events, current := server.service.SubscribeInstanceEvents()
+	defer server.service.UnsubscribeInstanceEvents(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// Once the stream started errors can't be answered, the client reconnects when it's closed
+	for _, event := range current {
+		if err := writeServerSentEvent(w, event); err != nil {
+			return nil
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(INSTANCE_EVENTS_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case event, open := <-events:
+			if !open {
+				return nil
+			}
+			if err := writeServerSentEvent(w, event); err != nil {
+				return nil
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (server *ApiServer) handleListVms(w http.ResponseWriter, r *http.Request) error {
+	vms, err := server.service.ListVms()
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, vms)
+}
+
 func (server *ApiServer) handleListServersStatus(w http.ResponseWriter, r *http.Request) error {
 	statuses, err := server.service.ListServersStatus()
 	if err != nil {
@@ -133,6 +326,60 @@ func writeResponse(w http.ResponseWriter, status int, value any) error {
 	return json.NewEncoder(w).Encode(value)
 }
 
+func writeServerSentEvent(w http.ResponseWriter, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
+
+func (server *ApiServer) handleCreateConsoleTicket(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+
+	response, err := server.service.CreateConsoleTicket(instanceId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, response)
+}
+
+func (server *ApiServer) handleInstanceConsole(w http.ResponseWriter, r *http.Request) error {
+	ticket := r.PathValue("ticket")
+
+	// Connect to the server agent before upgrading so errors can still be answered as HTTP
+	upstream, err := server.service.OpenInstanceConsole(ticket)
+	if err != nil {
+		return err
+	}
+
+	client, err := consoleUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		upstream.Close()
+		// The upgrader already answered the request
+		log.Printf("Error upgrading console connection: %v", err)
+		return nil
+	}
+
+	relayWebSockets(client, upstream)
+
+	return nil
+}
+
+func (server *ApiServer) handleGetJob(w http.ResponseWriter, r *http.Request) error {
+	jobId := r.PathValue("jobId")
+
+	job, err := server.jobService.GetJob(jobId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, job)
+}
+
 func createHttpHandler(fn apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := fn(w, r); err != nil {
@@ -147,9 +394,363 @@ func createHttpHandler(fn apiFunc) http.HandlerFunc {
 	}
 }
 
+func (server *ApiServer) handleRegisterServerAgent(w http.ResponseWriter, r *http.Request) error {
+	var request RegisterServerAgentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.service.RegisterServerAgent(request); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleServerAgentHeartbeat(w http.ResponseWriter, r *http.Request) error {
+	var request ServerAgentHeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.service.ServerAgentHeartbeat(request); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleDomainEvents(w http.ResponseWriter, r *http.Request) error {
+	var request DomainEventsRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.service.ReportDomainEvents(request); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleGetRouterDrift(w http.ResponseWriter, r *http.Request) error {
+	response, err := server.service.GetRouterDrift()
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, response)
+}
+
+func (server *ApiServer) handleReconcileRouter(w http.ResponseWriter, r *http.Request) error {
+	response, err := server.service.ReconcileRouter()
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, response)
+}
+
+func (server *ApiServer) handleGetReconciliationReport(w http.ResponseWriter, r *http.Request) error {
+	response, err := server.service.GetReconciliationReport()
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, response)
+}
+
+func (server *ApiServer) handleRunReconciliation(w http.ResponseWriter, r *http.Request) error {
+	response, err := server.service.RunReconciliation()
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, response)
+}
+
+func (server *ApiServer) handleCreateLab(w http.ResponseWriter, r *http.Request) error {
+	var request CreateLabRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return logAndReturnError("Error decoding request body: ", err.Error())
+	}
+
+	// The lab ID is generated by the job, it is returned as part of the job result
+	response, err := server.jobService.StartJob(
+		CreateLabJob,
+		nil,
+		func(progress JobProgress) (any, error) {
+			return server.service.CreateLab(request, progress)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusAccepted, response)
+}
+
+func (server *ApiServer) handleStartLab(w http.ResponseWriter, r *http.Request) error {
+	labId := r.PathValue("labId")
+
+	if err := server.service.StartLab(labId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleStopLab(w http.ResponseWriter, r *http.Request) error {
+	labId := r.PathValue("labId")
+
+	response, err := server.jobService.StartJob(
+		StopLabJob,
+		nil,
+		func(progress JobProgress) (any, error) {
+			return nil, server.service.StopLab(labId, progress)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusAccepted, response)
+}
+
+func (server *ApiServer) handleDeleteLab(w http.ResponseWriter, r *http.Request) error {
+	labId := r.PathValue("labId")
+
+	response, err := server.jobService.StartJob(
+		DeleteLabJob,
+		nil,
+		func(progress JobProgress) (any, error) {
+			return nil, server.service.DeleteLab(labId, progress)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusAccepted, response)
+}
+
+func (server *ApiServer) handleCreateFirewallPolicy(w http.ResponseWriter, r *http.Request) error {
+	var request CreateFirewallPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	response, err := server.service.CreateFirewallPolicy(request)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusCreated, response)
+}
+
+func (server *ApiServer) handleListFirewallPolicies(w http.ResponseWriter, r *http.Request) error {
+	subjectId := r.PathValue("subjectId")
+
+	policies, err := server.service.ListFirewallPolicies(subjectId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, policies)
+}
+
+func (server *ApiServer) handleGetFirewallPolicy(w http.ResponseWriter, r *http.Request) error {
+	policyId := r.PathValue("policyId")
+
+	policy, err := server.service.GetFirewallPolicy(policyId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, policy)
+}
+
+func (server *ApiServer) handleUpdateFirewallPolicy(w http.ResponseWriter, r *http.Request) error {
+	policyId := r.PathValue("policyId")
+
+	var request UpdateFirewallPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.service.UpdateFirewallPolicy(policyId, request); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleDeleteFirewallPolicy(w http.ResponseWriter, r *http.Request) error {
+	policyId := r.PathValue("policyId")
+
+	if err := server.service.DeleteFirewallPolicy(policyId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleCreatePortForward(w http.ResponseWriter, r *http.Request) error {
+	var request CreatePortForwardRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	response, err := server.service.CreatePortForward(request)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusCreated, response)
+}
+
+func (server *ApiServer) handleListPortForwards(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+
+	forwards, err := server.service.ListPortForwards(instanceId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, forwards)
+}
+
+func (server *ApiServer) handleDeletePortForward(w http.ResponseWriter, r *http.Request) error {
+	portForwardId := r.PathValue("portForwardId")
+
+	if err := server.service.DeletePortForward(portForwardId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleCreateWireguardPeer(w http.ResponseWriter, r *http.Request) error {
+	var request CreateWireguardPeerRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	response, err := server.service.CreateWireguardPeer(request)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusCreated, response)
+}
+
+func (server *ApiServer) handleListWireguardPeers(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+
+	peers, err := server.service.ListWireguardPeers(instanceId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, peers)
+}
+
+func (server *ApiServer) handleDeleteWireguardPeer(w http.ResponseWriter, r *http.Request) error {
+	peerId := r.PathValue("peerId")
+
+	if err := server.service.DeleteWireguardPeer(peerId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleRotateWireguardKey(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+
+	var request RotateWireguardKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.service.RotateInstanceWireguardKey(instanceId, request); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleListServerAgents(w http.ResponseWriter, r *http.Request) error {
+	agents, err := server.service.ListServerAgents()
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, agents)
+}
+
+func (server *ApiServer) handleCordonServerAgent(w http.ResponseWriter, r *http.Request) error {
+	var request SetServerAgentCordonRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.service.SetServerAgentCordon(request); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+func (server *ApiServer) handleDrainServerAgent(w http.ResponseWriter, r *http.Request) error {
+	var request ServerAgentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	response, err := server.jobService.StartJob(
+		DrainAgentJob,
+		nil,
+		func(progress JobProgress) (any, error) {
+			return server.service.DrainServerAgent(request.ServerAgentUrl, progress)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusAccepted, response)
+}
+
+func (server *ApiServer) handleDeregisterServerAgent(w http.ResponseWriter, r *http.Request) error {
+	var request ServerAgentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.service.DeregisterServerAgent(request.ServerAgentUrl); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, nil)
+}
+
+// fromServerAgent only lets through requests signed by a server agent
+func (server *ApiServer) fromServerAgent(fn apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if err := server.agentClient.VerifyRequest(r); err != nil {
+			return NewHttpError(http.StatusUnauthorized, err)
+		}
+
+		return fn(w, r)
+	}
+}
+
 func NewApiServer(
 	listenAddr string,
 	service Service,
+	jobService JobService,
+	agentClient *AgentClient,
 	listBaseImagesEndpoint string,
 	defineTemplateEndpoint string,
 	deleteTemplateEndpoint string,
@@ -160,20 +761,96 @@ func NewApiServer(
 	restartInstanceEndpoint string,
 	listInstancesStatusEndpoint string,
 	listServersStatusEndpoint string,
+	migrateInstanceEndpoint string,
+	createSnapshotEndpoint string,
+	listSnapshotsEndpoint string,
+	revertSnapshotEndpoint string,
+	deleteSnapshotEndpoint string,
+	getJobEndpoint string,
+	createConsoleTicketEndpoint string,
+	instanceConsoleEndpoint string,
+	registerServerAgentEndpoint string,
+	serverAgentHeartbeatEndpoint string,
+	listServerAgentsEndpoint string,
+	cordonServerAgentEndpoint string,
+	drainServerAgentEndpoint string,
+	deregisterServerAgentEndpoint string,
+	getRouterDriftEndpoint string,
+	reconcileRouterEndpoint string,
+	createLabEndpoint string,
+	startLabEndpoint string,
+	stopLabEndpoint string,
+	deleteLabEndpoint string,
+	createFirewallPolicyEndpoint string,
+	listFirewallPoliciesEndpoint string,
+	getFirewallPolicyEndpoint string,
+	updateFirewallPolicyEndpoint string,
+	deleteFirewallPolicyEndpoint string,
+	createPortForwardEndpoint string,
+	listPortForwardsEndpoint string,
+	deletePortForwardEndpoint string,
+	createWireguardPeerEndpoint string,
+	listWireguardPeersEndpoint string,
+	deleteWireguardPeerEndpoint string,
+	rotateWireguardKeyEndpoint string,
+	getReconciliationReportEndpoint string,
+	runReconciliationEndpoint string,
+	listVmsEndpoint string,
+	domainEventsEndpoint string,
+	instanceEventsEndpoint string,
 ) *ApiServer {
 	return &ApiServer{
-		listenAddr:                  listenAddr,
-		service:                     service,
-		listBaseImagesEndpoint:      listBaseImagesEndpoint,
-		defineTemplateEndpoint:      defineTemplateEndpoint,
-		deleteTemplateEndpoint:      deleteTemplateEndpoint,
-		createInstanceEndpoint:      createInstanceEndpoint,
-		deleteInstanceEndpoint:      deleteInstanceEndpoint,
-		startInstanceEndpoint:       startInstanceEndpoint,
-		stopInstanceEndpoint:        stopInstanceEndpoint,
-		restartInstanceEndpoint:     restartInstanceEndpoint,
-		listInstancesStatusEndpoint: listInstancesStatusEndpoint,
-		listServersStatusEndpoint:   listServersStatusEndpoint,
+		listenAddr:                      listenAddr,
+		service:                         service,
+		jobService:                      jobService,
+		agentClient:                     agentClient,
+		listBaseImagesEndpoint:          listBaseImagesEndpoint,
+		defineTemplateEndpoint:          defineTemplateEndpoint,
+		deleteTemplateEndpoint:          deleteTemplateEndpoint,
+		createInstanceEndpoint:          createInstanceEndpoint,
+		deleteInstanceEndpoint:          deleteInstanceEndpoint,
+		startInstanceEndpoint:           startInstanceEndpoint,
+		stopInstanceEndpoint:            stopInstanceEndpoint,
+		restartInstanceEndpoint:         restartInstanceEndpoint,
+		listInstancesStatusEndpoint:     listInstancesStatusEndpoint,
+		listServersStatusEndpoint:       listServersStatusEndpoint,
+		migrateInstanceEndpoint:         migrateInstanceEndpoint,
+		createSnapshotEndpoint:          createSnapshotEndpoint,
+		listSnapshotsEndpoint:           listSnapshotsEndpoint,
+		revertSnapshotEndpoint:          revertSnapshotEndpoint,
+		deleteSnapshotEndpoint:          deleteSnapshotEndpoint,
+		getJobEndpoint:                  getJobEndpoint,
+		createConsoleTicketEndpoint:     createConsoleTicketEndpoint,
+		instanceConsoleEndpoint:         instanceConsoleEndpoint,
+		registerServerAgentEndpoint:     registerServerAgentEndpoint,
+		serverAgentHeartbeatEndpoint:    serverAgentHeartbeatEndpoint,
+		listServerAgentsEndpoint:        listServerAgentsEndpoint,
+		cordonServerAgentEndpoint:       cordonServerAgentEndpoint,
+		drainServerAgentEndpoint:        drainServerAgentEndpoint,
+		deregisterServerAgentEndpoint:   deregisterServerAgentEndpoint,
+		getRouterDriftEndpoint:          getRouterDriftEndpoint,
+		reconcileRouterEndpoint:         reconcileRouterEndpoint,
+		createLabEndpoint:               createLabEndpoint,
+		startLabEndpoint:                startLabEndpoint,
+		stopLabEndpoint:                 stopLabEndpoint,
+		deleteLabEndpoint:               deleteLabEndpoint,
+		createFirewallPolicyEndpoint:    createFirewallPolicyEndpoint,
+		listFirewallPoliciesEndpoint:    listFirewallPoliciesEndpoint,
+		getFirewallPolicyEndpoint:       getFirewallPolicyEndpoint,
+		updateFirewallPolicyEndpoint:    updateFirewallPolicyEndpoint,
+		deleteFirewallPolicyEndpoint:    deleteFirewallPolicyEndpoint,
+		createPortForwardEndpoint:       createPortForwardEndpoint,
+		listPortForwardsEndpoint:        listPortForwardsEndpoint,
+		deletePortForwardEndpoint:       deletePortForwardEndpoint,
+		createWireguardPeerEndpoint:     createWireguardPeerEndpoint,
+		listWireguardPeersEndpoint:      listWireguardPeersEndpoint,
+		deleteWireguardPeerEndpoint:     deleteWireguardPeerEndpoint,
+		rotateWireguardKeyEndpoint:      rotateWireguardKeyEndpoint,
+		getReconciliationReportEndpoint: getReconciliationReportEndpoint,
+		runReconciliationEndpoint:       runReconciliationEndpoint,
+		listVmsEndpoint:                 listVmsEndpoint,
+		domainEventsEndpoint:            domainEventsEndpoint,
+		instanceEventsEndpoint:          instanceEventsEndpoint,
 	}
 }
 
@@ -212,14 +889,162 @@ func (server *ApiServer) Run() {
 		"POST "+server.restartInstanceEndpoint+"/{instanceId}",
 		createHttpHandler(server.handleRestartInstance),
 	)
+	mux.HandleFunc(
+		"POST "+server.migrateInstanceEndpoint+"/{instanceId}",
+		createHttpHandler(server.handleMigrateInstance),
+	)
+	mux.HandleFunc(
+		"POST "+server.createSnapshotEndpoint+"/{instanceId}",
+		createHttpHandler(server.handleCreateSnapshot),
+	)
+	mux.HandleFunc(
+		"GET "+server.listSnapshotsEndpoint+"/{instanceId}",
+		createHttpHandler(server.handleListSnapshots),
+	)
+	mux.HandleFunc(
+		"POST "+server.revertSnapshotEndpoint+"/{instanceId}/{snapshotId}",
+		createHttpHandler(server.handleRevertSnapshot),
+	)
+	mux.HandleFunc(
+		"DELETE "+server.deleteSnapshotEndpoint+"/{instanceId}/{snapshotId}",
+		createHttpHandler(server.handleDeleteSnapshot),
+	)
+	mux.HandleFunc(
+		"POST "+server.createConsoleTicketEndpoint+"/{instanceId}",
+		createHttpHandler(server.handleCreateConsoleTicket),
+	)
+	mux.HandleFunc(
+		"GET "+server.instanceConsoleEndpoint+"/{ticket}",
+		createHttpHandler(server.handleInstanceConsole),
+	)
+	mux.HandleFunc(
+		"GET "+server.getJobEndpoint+"/{jobId}",
+		createHttpHandler(server.handleGetJob),
+	)
 	mux.HandleFunc(
 		"GET "+server.listInstancesStatusEndpoint,
 		createHttpHandler(server.handleListInstancesStatus),
 	)
+	mux.HandleFunc(
+		"GET "+server.listVmsEndpoint,
+		createHttpHandler(server.handleListVms),
+	)
+	mux.HandleFunc(
+		"GET "+server.instanceEventsEndpoint,
+		createHttpHandler(server.handleInstanceEvents),
+	)
 	mux.HandleFunc(
 		"GET "+server.listServersStatusEndpoint,
 		createHttpHandler(server.handleListServersStatus),
 	)
+	mux.HandleFunc(
+		"POST "+server.registerServerAgentEndpoint,
+		createHttpHandler(server.fromServerAgent(server.handleRegisterServerAgent)),
+	)
+	mux.HandleFunc(
+		"POST "+server.serverAgentHeartbeatEndpoint,
+		createHttpHandler(server.fromServerAgent(server.handleServerAgentHeartbeat)),
+	)
+	mux.HandleFunc(
+		"POST "+server.domainEventsEndpoint,
+		createHttpHandler(server.fromServerAgent(server.handleDomainEvents)),
+	)
+	mux.HandleFunc(
+		"GET "+server.listServerAgentsEndpoint,
+		createHttpHandler(server.handleListServerAgents),
+	)
+	mux.HandleFunc(
+		"PUT "+server.cordonServerAgentEndpoint,
+		createHttpHandler(server.handleCordonServerAgent),
+	)
+	mux.HandleFunc(
+		"POST "+server.drainServerAgentEndpoint,
+		createHttpHandler(server.handleDrainServerAgent),
+	)
+	mux.HandleFunc(
+		"POST "+server.deregisterServerAgentEndpoint,
+		createHttpHandler(server.handleDeregisterServerAgent),
+	)
+	mux.HandleFunc(
+		"GET "+server.getRouterDriftEndpoint,
+		createHttpHandler(server.handleGetRouterDrift),
+	)
+	mux.HandleFunc(
+		"POST "+server.reconcileRouterEndpoint,
+		createHttpHandler(server.handleReconcileRouter),
+	)
+	mux.HandleFunc(
+		"GET "+server.getReconciliationReportEndpoint,
+		createHttpHandler(server.handleGetReconciliationReport),
+	)
+	mux.HandleFunc(
+		"POST "+server.runReconciliationEndpoint,
+		createHttpHandler(server.handleRunReconciliation),
+	)
+	mux.HandleFunc(
+		"POST "+server.createLabEndpoint,
+		createHttpHandler(server.handleCreateLab),
+	)
+	mux.HandleFunc(
+		"POST "+server.startLabEndpoint+"/{labId}",
+		createHttpHandler(server.handleStartLab),
+	)
+	mux.HandleFunc(
+		"POST "+server.stopLabEndpoint+"/{labId}",
+		createHttpHandler(server.handleStopLab),
+	)
+	mux.HandleFunc(
+		"DELETE "+server.deleteLabEndpoint+"/{labId}",
+		createHttpHandler(server.handleDeleteLab),
+	)
+	mux.HandleFunc(
+		"POST "+server.createFirewallPolicyEndpoint,
+		createHttpHandler(server.handleCreateFirewallPolicy),
+	)
+	mux.HandleFunc(
+		"GET "+server.listFirewallPoliciesEndpoint+"/{subjectId}",
+		createHttpHandler(server.handleListFirewallPolicies),
+	)
+	mux.HandleFunc(
+		"GET "+server.getFirewallPolicyEndpoint+"/{policyId}",
+		createHttpHandler(server.handleGetFirewallPolicy),
+	)
+	mux.HandleFunc(
+		"PUT "+server.updateFirewallPolicyEndpoint+"/{policyId}",
+		createHttpHandler(server.handleUpdateFirewallPolicy),
+	)
+	mux.HandleFunc(
+		"DELETE "+server.deleteFirewallPolicyEndpoint+"/{policyId}",
+		createHttpHandler(server.handleDeleteFirewallPolicy),
+	)
+	mux.HandleFunc(
+		"POST "+server.createPortForwardEndpoint,
+		createHttpHandler(server.handleCreatePortForward),
+	)
+	mux.HandleFunc(
+		"GET "+server.listPortForwardsEndpoint+"/{instanceId}",
+		createHttpHandler(server.handleListPortForwards),
+	)
+	mux.HandleFunc(
+		"DELETE "+server.deletePortForwardEndpoint+"/{portForwardId}",
+		createHttpHandler(server.handleDeletePortForward),
+	)
+	mux.HandleFunc(
+		"POST "+server.createWireguardPeerEndpoint,
+		createHttpHandler(server.handleCreateWireguardPeer),
+	)
+	mux.HandleFunc(
+		"GET "+server.listWireguardPeersEndpoint+"/{instanceId}",
+		createHttpHandler(server.handleListWireguardPeers),
+	)
+	mux.HandleFunc(
+		"DELETE "+server.deleteWireguardPeerEndpoint+"/{peerId}",
+		createHttpHandler(server.handleDeleteWireguardPeer),
+	)
+	mux.HandleFunc(
+		"POST "+server.rotateWireguardKeyEndpoint+"/{instanceId}",
+		createHttpHandler(server.handleRotateWireguardKey),
+	)
 
 	log.Println("Starting server on", server.listenAddr)
 
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// noVNC and most VNC web clients negotiate the "binary" subprotocol
+var consoleUpgrader = websocket.Upgrader{
+	Subprotocols: []string{"binary"},
+	// Consoles are authorized by their single use ticket, not by the origin
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+var consoleDialer = websocket.Dialer{
+	Subprotocols:     []string{"binary"},
+	HandshakeTimeout: CONSOLE_DIAL_TIMEOUT,
+}
+
+// relayWebSockets copies the messages between both connections until one of them closes
+func relayWebSockets(client *websocket.Conn, upstream *websocket.Conn) {
+	defer client.Close()
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	relay := func(from *websocket.Conn, to *websocket.Conn) {
+		defer func() { done <- struct{}{} }()
+		for {
+			messageType, message, err := from.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := to.WriteMessage(messageType, message); err != nil {
+				return
+			}
+		}
+	}
+
+	go relay(client, upstream)
+	go relay(upstream, client)
+
+	<-done
+}
+
+func toWebSocketUrl(httpUrl string) string {
+	if strings.HasPrefix(httpUrl, "https://") {
+		return "wss://" + strings.TrimPrefix(httpUrl, "https://")
+	}
+	return "ws://" + strings.TrimPrefix(httpUrl, "http://")
+}
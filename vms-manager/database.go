@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -20,11 +22,11 @@ type Database interface {
 	GetBaseImages() ([]Vm, error)
 	GetDescriptionById(vmId string) (string, error)
 	DeleteBaseImagesNotInList(baseImages []string) error
-	SubjectExistsById(subjectId string) (bool, error)
-	GetSubjectVlan(subjectId string) (int, error)
 	GetAllVlans() ([]int, error)
-	AddSubject(subject Subject) error
-	GetVmsVlanIdentifiers(vlan int) ([]int, error)
+	AllocateSubject(subjectId string, allocate func(subjects []DatabaseSubject) (DatabaseSubject, error)) (DatabaseSubject, error)
+	GetSubjectByVlan(vlan int) (DatabaseSubject, error)
+	AllocateVmVlanIdentifier(subjectId string, instanceId string, maxVmVlanIdentifier int) (int, error)
+	ReleaseVmVlanIdentifier(instanceId string) error
 	GetVlanByVmId(vmId string) (int, error)
 	GetVmVlanIdentifierByVmId(vmId string) (int, error)
 	VmIsLastInstanceInSubject(vmId string) (bool, error)
@@ -33,6 +35,57 @@ type Database interface {
 	GetAllVmIds() ([]string, error)
 	SetVlanAsConfigured(vlan int) error
 	IsVlanConfigured(vlan int) (bool, error)
+	GetServerAgentUrlByVmId(vmId string) (*string, error)
+	SetServerAgentUrl(vmId string, serverAgentUrl string) error
+	VmIsLastInstanceInSubjectInServerAgent(vmId string) (bool, error)
+	GetDependsOnByVmId(vmId string) (string, error)
+	AddTemplateCopy(templateId string, serverAgentUrl string) error
+	GetTemplateCopiesServerAgentUrls(templateId string) ([]string, error)
+	AddJob(job Job) error
+	AddJobIfIdempotencyKeyIsFree(job Job) (bool, error)
+	GetJobIdByIdempotencyKey(jobType JobType, idempotencyKey string) (string, bool, error)
+	JobExistsById(jobId string) (bool, error)
+	GetJob(jobId string) (Job, error)
+	SetJobStep(jobId string, step string) error
+	SetJobStatus(jobId string, status JobStatus, errorMessage *string, result []byte) error
+	FailUnfinishedJobs(errorMessage string) error
+	UpsertServerAgent(agent ServerAgent) error
+	UpdateServerAgentHeartbeat(url string, resourceStatus GetResourceStatusAgentResponse) (bool, error)
+	GetServerAgent(url string) (ServerAgent, bool, error)
+	GetServerAgents() ([]ServerAgent, error)
+	SetServerAgentCordoned(url string, cordoned bool) error
+	SetServerAgentDraining(url string, draining bool) error
+	MarkLostServerAgents(heartbeatTimeout time.Duration) ([]string, error)
+	DeleteServerAgent(url string) error
+	GetVmsByServerAgentUrl(url string) ([]DatabaseVM, error)
+	GetVm(vmId string) (DatabaseVM, error)
+	GetServerAgentsReservations() (map[string]ServerAgentReservations, error)
+	CreateLab(lab DatabaseLab, allocate func(usedVlans []int) ([]DatabaseLabNetwork, error)) ([]DatabaseLabNetwork, error)
+	GetLab(labId string) (DatabaseLab, bool, error)
+	AddLabInstance(labId string, instanceId string, name string, networks []string) error
+	GetLabInstances(labId string) ([]DatabaseLabInstance, error)
+	GetLabIdByVmId(vmId string) (*string, error)
+	GetLabInterfacesByVmId(vmId string) ([]DatabaseLabInterface, error)
+	DeleteLab(labId string) error
+	AddFirewallPolicy(policy DatabaseFirewallPolicy) error
+	GetFirewallPolicy(policyId string) (DatabaseFirewallPolicy, bool, error)
+	GetFirewallPoliciesBySubjectId(subjectId string) ([]DatabaseFirewallPolicy, error)
+	UpdateFirewallPolicy(policyId string, name string, rules []FirewallRule) error
+	DeleteFirewallPolicy(policyId string) error
+	GetFirewallPolicyInstanceIds(subjectId string, templateId *string) ([]string, error)
+	CreatePortForward(forward DatabasePortForward, allocate func(usedPorts []int) (int, error)) (int, error)
+	GetPortForward(portForwardId string) (DatabasePortForward, bool, error)
+	GetPortForwardsByVmId(vmId string) ([]DatabasePortForward, error)
+	GetExpiredPortForwards() ([]DatabasePortForward, error)
+	DeletePortForward(portForwardId string) error
+	AllocateWireguardPeer(peer DatabaseWireguardPeer, maxPeerIdentifier int) (int, error)
+	GetWireguardPeer(peerId string) (DatabaseWireguardPeer, bool, error)
+	GetWireguardPeersByVmId(vmId string) ([]DatabaseWireguardPeer, error)
+	DeleteWireguardPeer(peerId string) error
+	GetAllVms() ([]DatabaseVM, error)
+	GetSubjectsWithoutVms() ([]DatabaseSubject, error)
+	GetAllocatedPeers() ([]GatewayPeer, error)
+	CountUnfinishedJobs() (int, error)
 }
 
 type PostgresDatabase struct {
@@ -47,11 +100,76 @@ type DatabaseVM struct {
 	DependsOn        *string
 	SubjectId        *string
 	VmVlanIdentifier *int
+	ServerAgentUrl   *string
+	VcpuCount        int
+	VramMB           int
+	SizeMB           int
 }
 
 type DatabaseSubject struct {
-	SubjectId string
-	Vlan      int
+	SubjectId  string
+	Vlan       int
+	Network    string
+	VpnNetwork string
+}
+
+type DatabaseLab struct {
+	ID             string
+	SubjectId      string
+	ServerAgentUrl string
+}
+
+type DatabaseLabNetwork struct {
+	Name string
+	Vlan int
+}
+
+type DatabaseLabInstance struct {
+	InstanceId string
+	Name       string
+}
+
+// DatabaseLabInterface is the interface of a lab instance attached to an internal network,
+// the position is the order of the interface in the instance
+type DatabaseLabInterface struct {
+	Position int
+	Network  string
+	Vlan     int
+}
+
+// DatabaseFirewallPolicy applies to the instances of the subject, in every network segment of it,
+// or only to the ones created from the template when it's set
+type DatabaseFirewallPolicy struct {
+	ID         string
+	Name       string
+	SubjectId  string
+	TemplateId *string
+	Rules      []FirewallRule
+	CreatedAt  time.Time
+}
+
+// DatabasePortForward is an external port of the gateway forwarded to a port of the instance,
+// it never expires when ExpiresAt is nil
+type DatabasePortForward struct {
+	ID           string
+	InstanceId   string
+	Protocol     string
+	ExternalPort int
+	InternalPort int
+	ExpiresAt    *time.Time
+	CreatedAt    time.Time
+}
+
+// DatabaseWireguardPeer is an extra device of the owner of an instance, its identifier is allocated
+// among the VM VLAN identifiers of the subject so its address in the VPN network is unique
+type DatabaseWireguardPeer struct {
+	ID             string
+	InstanceId     string
+	SubjectId      string
+	PeerIdentifier int
+	Name           string
+	PublicKey      string
+	CreatedAt      time.Time
 }
 
 func (postgres *PostgresDatabase) VmExistsById(vmId string) (bool, error) {
@@ -118,8 +236,14 @@ func (postgres *PostgresDatabase) AddVm(vm Vm, isBase bool, isTemplate bool) err
 	dbVm := vm.toDatabaseVM(isBase, isTemplate)
 
 	query := `
-		INSERT INTO vms (id, description, is_base, is_template, depends_on, subject_id, vm_vlan_identifier)
-		VALUES (@id, @description, @is_base, @is_template, @depends_on, @subject_id, @vm_vlan_identifier)
+		INSERT INTO vms (
+			id, description, is_base, is_template, depends_on, subject_id,
+			vm_vlan_identifier, server_agent_url, vcpu_count, vram_mb, size_mb
+		)
+		VALUES (
+			@id, @description, @is_base, @is_template, @depends_on, @subject_id,
+			@vm_vlan_identifier, @server_agent_url, @vcpu_count, @vram_mb, @size_mb
+		)
 	`
 	args := pgx.NamedArgs{
 		"id":                 dbVm.ID,
@@ -129,6 +253,10 @@ func (postgres *PostgresDatabase) AddVm(vm Vm, isBase bool, isTemplate bool) err
 		"depends_on":         dbVm.DependsOn,
 		"subject_id":         dbVm.SubjectId,
 		"vm_vlan_identifier": dbVm.VmVlanIdentifier,
+		"server_agent_url":   dbVm.ServerAgentUrl,
+		"vcpu_count":         dbVm.VcpuCount,
+		"vram_mb":            dbVm.VramMB,
+		"size_mb":            dbVm.SizeMB,
 	}
 
 	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
@@ -138,14 +266,28 @@ func (postgres *PostgresDatabase) AddVm(vm Vm, isBase bool, isTemplate bool) err
 	return nil
 }
 
+// DeleteVm also releases the VM VLAN identifier allocated to the VM
 func (postgres *PostgresDatabase) DeleteVm(vmId string) error {
-	query := "DELETE FROM vms WHERE id = @id"
+	tx, err := postgres.db.Begin(context.Background())
+	if err != nil {
+		return logAndReturnError("Error starting transaction: ", err.Error())
+	}
+	defer tx.Rollback(context.Background())
+
 	args := pgx.NamedArgs{"id": vmId}
 
-	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+	if _, err := tx.Exec(context.Background(), "DELETE FROM vms WHERE id = @id", args); err != nil {
 		return logAndReturnError("Error deleting VM: ", err.Error())
 	}
 
+	if _, err := tx.Exec(context.Background(), "DELETE FROM ipam_vm_allocations WHERE instance_id = @id", args); err != nil {
+		return logAndReturnError("Error releasing VM vlan identifier: ", err.Error())
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return logAndReturnError("Error committing transaction: ", err.Error())
+	}
+
 	return nil
 }
 
@@ -219,30 +361,6 @@ func (postgres *PostgresDatabase) DeleteBaseImagesNotInList(baseImages []string)
 	return nil
 }
 
-func (postgres *PostgresDatabase) SubjectExistsById(subjectId string) (bool, error) {
-	query := "SELECT EXISTS(SELECT 1 FROM subjects WHERE subject_id = @subject_id)"
-	args := pgx.NamedArgs{"subject_id": subjectId}
-
-	var exists bool
-	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&exists); err != nil {
-		return false, logAndReturnError("Error checking if subject exists: ", err.Error())
-	}
-
-	return exists, nil
-}
-
-func (postgres *PostgresDatabase) GetSubjectVlan(subjectId string) (int, error) {
-	query := "SELECT vlan FROM subjects WHERE subject_id = @subject_id"
-	args := pgx.NamedArgs{"subject_id": subjectId}
-
-	var vlan int
-	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&vlan); err != nil {
-		return 0, logAndReturnError("Error getting subject vlan: ", err.Error())
-	}
-
-	return vlan, nil
-}
-
 func (postgres *PostgresDatabase) GetAllVlans() ([]int, error) {
 	query := "SELECT vlan FROM subjects"
 	rows, err := postgres.db.Query(context.Background(), query)
@@ -263,52 +381,143 @@ func (postgres *PostgresDatabase) GetAllVlans() ([]int, error) {
 	return vlans, nil
 }
 
-func (postgres *PostgresDatabase) AddSubject(subject Subject) error {
-	dbSubject := subject.toDatabaseSubject()
+// AllocateSubject returns the subject, adding it with what allocate returns when it doesn't exist.
+// allocate gets every subject and runs in a transaction holding a lock, so allocations don't race
+func (postgres *PostgresDatabase) AllocateSubject(
+	subjectId string,
+	allocate func(subjects []DatabaseSubject) (DatabaseSubject, error),
+) (DatabaseSubject, error) {
+	tx, err := postgres.db.Begin(context.Background())
+	if err != nil {
+		return DatabaseSubject{}, logAndReturnError("Error starting transaction: ", err.Error())
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(context.Background(), "LOCK TABLE subjects IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return DatabaseSubject{}, logAndReturnError("Error locking subjects table: ", err.Error())
+	}
+
+	rows, err := tx.Query(context.Background(), "SELECT "+subjectColumns+" FROM subjects")
+	if err != nil {
+		return DatabaseSubject{}, logAndReturnError("Error getting subjects: ", err.Error())
+	}
+
+	subjects, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DatabaseSubject, error) {
+		return scanSubject(row)
+	})
+	if err != nil {
+		return DatabaseSubject{}, logAndReturnError("Error getting subjects: ", err.Error())
+	}
+
+	for _, subject := range subjects {
+		if subject.SubjectId == subjectId {
+			return subject, nil
+		}
+	}
+
+	subject, err := allocate(subjects)
+	if err != nil {
+		return DatabaseSubject{}, err
+	}
+
 	query := `
-		INSERT INTO subjects (subject_id, vlan)
-		VALUES (@subject_id, @vlan)
+		INSERT INTO subjects (subject_id, vlan, network, vpn_network)
+		VALUES (@subject_id, @vlan, @network, @vpn_network)
 	`
 	args := pgx.NamedArgs{
-		"subject_id": dbSubject.SubjectId,
-		"vlan":       dbSubject.Vlan,
+		"subject_id":  subject.SubjectId,
+		"vlan":        subject.Vlan,
+		"network":     subject.Network,
+		"vpn_network": subject.VpnNetwork,
 	}
 
-	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
-		return logAndReturnError("Error adding subject: ", err.Error())
+	if _, err := tx.Exec(context.Background(), query, args); err != nil {
+		return DatabaseSubject{}, logAndReturnError("Error adding subject: ", err.Error())
 	}
 
-	return nil
+	if err := tx.Commit(context.Background()); err != nil {
+		return DatabaseSubject{}, logAndReturnError("Error committing transaction: ", err.Error())
+	}
+
+	return subject, nil
 }
 
-func (postgres *PostgresDatabase) GetVmsVlanIdentifiers(vlan int) ([]int, error) {
-	query := "SELECT subject_id FROM subjects WHERE vlan = @vlan"
+func (postgres *PostgresDatabase) GetSubjectByVlan(vlan int) (DatabaseSubject, error) {
+	query := "SELECT " + subjectColumns + " FROM subjects WHERE vlan = @vlan"
 	args := pgx.NamedArgs{"vlan": vlan}
 
-	var subjectId string
-	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&subjectId); err != nil {
-		return nil, logAndReturnError("Error getting vms vlan identifiers: ", err.Error())
+	subject, err := scanSubject(postgres.db.QueryRow(context.Background(), query, args))
+	if err != nil {
+		return DatabaseSubject{}, logAndReturnError("Error getting subject by vlan: ", err.Error())
 	}
 
-	query = "SELECT vm_vlan_identifier FROM vms WHERE subject_id = @subject_id"
-	args = pgx.NamedArgs{"subject_id": subjectId}
+	return subject, nil
+}
 
-	rows, err := postgres.db.Query(context.Background(), query, args)
+// AllocateVmVlanIdentifier allocates the lowest VM VLAN identifier of the subject not allocated yet,
+// it returns 0 when all of them up to the maximum are allocated
+func (postgres *PostgresDatabase) AllocateVmVlanIdentifier(subjectId string, instanceId string, maxVmVlanIdentifier int) (int, error) {
+	tx, err := postgres.db.Begin(context.Background())
 	if err != nil {
-		return nil, logAndReturnError("Error getting vms vlan identifiers: ", err.Error())
+		return 0, logAndReturnError("Error starting transaction: ", err.Error())
 	}
-	defer rows.Close()
+	defer tx.Rollback(context.Background())
 
-	var vmsVlanIdentifiers []int
-	for rows.Next() {
-		var vmVlanIdentifier int
-		if err := rows.Scan(&vmVlanIdentifier); err != nil {
-			return nil, logAndReturnError("Error getting vms vlan identifiers: ", err.Error())
+	args := pgx.NamedArgs{
+		"subject_id":  subjectId,
+		"instance_id": instanceId,
+		"max":         maxVmVlanIdentifier,
+	}
+
+	// Locking the subject serializes the allocations in it
+	if _, err := tx.Exec(context.Background(), "SELECT 1 FROM subjects WHERE subject_id = @subject_id FOR UPDATE", args); err != nil {
+		return 0, logAndReturnError("Error locking subject: ", err.Error())
+	}
+
+	query := `
+		SELECT identifier FROM generate_series(1, @max::integer) AS identifier
+		WHERE identifier NOT IN (
+			SELECT vm_vlan_identifier FROM ipam_vm_allocations WHERE subject_id = @subject_id
+		) AND identifier NOT IN (
+			SELECT peer_identifier FROM wireguard_peers WHERE subject_id = @subject_id
+		)
+		ORDER BY identifier
+		LIMIT 1
+	`
+
+	var vmVlanIdentifier int
+	if err := tx.QueryRow(context.Background(), query, args).Scan(&vmVlanIdentifier); err != nil {
+		if err == pgx.ErrNoRows {
+			return 0, nil
 		}
-		vmsVlanIdentifiers = append(vmsVlanIdentifiers, vmVlanIdentifier)
+		return 0, logAndReturnError("Error allocating VM vlan identifier: ", err.Error())
+	}
+
+	args["vm_vlan_identifier"] = vmVlanIdentifier
+	query = `
+		INSERT INTO ipam_vm_allocations (subject_id, vm_vlan_identifier, instance_id)
+		VALUES (@subject_id, @vm_vlan_identifier, @instance_id)
+	`
+	if _, err := tx.Exec(context.Background(), query, args); err != nil {
+		return 0, logAndReturnError("Error allocating VM vlan identifier: ", err.Error())
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return 0, logAndReturnError("Error committing transaction: ", err.Error())
+	}
+
+	return vmVlanIdentifier, nil
+}
+
+func (postgres *PostgresDatabase) ReleaseVmVlanIdentifier(instanceId string) error {
+	query := "DELETE FROM ipam_vm_allocations WHERE instance_id = @instance_id"
+	args := pgx.NamedArgs{"instance_id": instanceId}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error releasing VM vlan identifier: ", err.Error())
 	}
 
-	return vmsVlanIdentifiers, nil
+	return nil
 }
 
 func (postgres *PostgresDatabase) GetVlanByVmId(vmId string) (int, error) {
@@ -435,6 +644,250 @@ func (postgres *PostgresDatabase) IsVlanConfigured(vlan int) (bool, error) {
 	return isConfigured, nil
 }
 
+func (postgres *PostgresDatabase) GetServerAgentUrlByVmId(vmId string) (*string, error) {
+	query := "SELECT server_agent_url FROM vms WHERE id = @id"
+	args := pgx.NamedArgs{"id": vmId}
+
+	var serverAgentUrl *string
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&serverAgentUrl); err != nil {
+		return nil, logAndReturnError("Error getting server agent url by vm id: ", err.Error())
+	}
+
+	return serverAgentUrl, nil
+}
+
+func (postgres *PostgresDatabase) SetServerAgentUrl(vmId string, serverAgentUrl string) error {
+	query := "UPDATE vms SET server_agent_url = @server_agent_url WHERE id = @id"
+	args := pgx.NamedArgs{"id": vmId, "server_agent_url": serverAgentUrl}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error setting server agent url: ", err.Error())
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) VmIsLastInstanceInSubjectInServerAgent(vmId string) (bool, error) {
+	query := `
+		SELECT COUNT(*) FROM vms
+		WHERE subject_id = (SELECT subject_id FROM vms WHERE id = @id)
+		AND server_agent_url = (SELECT server_agent_url FROM vms WHERE id = @id)
+	`
+	args := pgx.NamedArgs{"id": vmId}
+
+	var count int
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&count); err != nil {
+		return false, logAndReturnError("Error getting count of vms in subject in server agent: ", err.Error())
+	}
+
+	return count == 1, nil
+}
+
+func (postgres *PostgresDatabase) GetDependsOnByVmId(vmId string) (string, error) {
+	query := "SELECT depends_on FROM vms WHERE id = @id"
+	args := pgx.NamedArgs{"id": vmId}
+
+	var dependsOn string
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&dependsOn); err != nil {
+		return "", logAndReturnError("Error getting depends on by vm id: ", err.Error())
+	}
+
+	return dependsOn, nil
+}
+
+func (postgres *PostgresDatabase) AddTemplateCopy(templateId string, serverAgentUrl string) error {
+	query := `
+		INSERT INTO template_copies (template_id, server_agent_url)
+		VALUES (@template_id, @server_agent_url)
+		ON CONFLICT DO NOTHING
+	`
+	args := pgx.NamedArgs{"template_id": templateId, "server_agent_url": serverAgentUrl}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error adding template copy: ", err.Error())
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) GetTemplateCopiesServerAgentUrls(templateId string) ([]string, error) {
+	query := "SELECT server_agent_url FROM template_copies WHERE template_id = @template_id"
+	args := pgx.NamedArgs{"template_id": templateId}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, logAndReturnError("Error getting template copies: ", err.Error())
+	}
+	defer rows.Close()
+
+	var serverAgentUrls []string
+	for rows.Next() {
+		var serverAgentUrl string
+		if err := rows.Scan(&serverAgentUrl); err != nil {
+			return nil, logAndReturnError("Error getting template copies: ", err.Error())
+		}
+		serverAgentUrls = append(serverAgentUrls, serverAgentUrl)
+	}
+
+	return serverAgentUrls, nil
+}
+
+func (postgres *PostgresDatabase) AddJob(job Job) error {
+	query := `
+		INSERT INTO jobs (id, type, vm_id, status, step)
+		VALUES (@id, @type, @vm_id, @status, @step)
+	`
+	args := pgx.NamedArgs{
+		"id":     job.ID,
+		"type":   job.Type,
+		"vm_id":  job.VmId,
+		"status": job.Status,
+		"step":   job.Step,
+	}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error adding job: ", err.Error())
+	}
+
+	return nil
+}
+
+// AddJobIfIdempotencyKeyIsFree returns false when a job of the same type that didn't fail already holds the key
+func (postgres *PostgresDatabase) AddJobIfIdempotencyKeyIsFree(job Job) (bool, error) {
+	query := `
+		INSERT INTO jobs (id, type, vm_id, status, step, idempotency_key)
+		VALUES (@id, @type, @vm_id, @status, @step, @idempotency_key)
+		ON CONFLICT (type, idempotency_key) WHERE idempotency_key IS NOT NULL AND status <> 'failed'
+		DO NOTHING
+	`
+	args := pgx.NamedArgs{
+		"id":              job.ID,
+		"type":            job.Type,
+		"vm_id":           job.VmId,
+		"status":          job.Status,
+		"step":            job.Step,
+		"idempotency_key": job.IdempotencyKey,
+	}
+
+	result, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return false, logAndReturnError("Error adding job: ", err.Error())
+	}
+
+	return result.RowsAffected() == 1, nil
+}
+
+func (postgres *PostgresDatabase) GetJobIdByIdempotencyKey(jobType JobType, idempotencyKey string) (string, bool, error) {
+	query := `
+		SELECT id FROM jobs
+		WHERE type = @type AND idempotency_key = @idempotency_key AND status <> @failed
+	`
+	args := pgx.NamedArgs{
+		"type":            jobType,
+		"idempotency_key": idempotencyKey,
+		"failed":          JobFailed,
+	}
+
+	var jobId string
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&jobId); err != nil {
+		if err == pgx.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, logAndReturnError("Error getting job by idempotency key: ", err.Error())
+	}
+
+	return jobId, true, nil
+}
+
+func (postgres *PostgresDatabase) JobExistsById(jobId string) (bool, error) {
+	query := "SELECT EXISTS(SELECT 1 FROM jobs WHERE id = @id)"
+	args := pgx.NamedArgs{"id": jobId}
+
+	var exists bool
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&exists); err != nil {
+		return false, logAndReturnError("Error checking if job exists by id: ", err.Error())
+	}
+
+	return exists, nil
+}
+
+func (postgres *PostgresDatabase) GetJob(jobId string) (Job, error) {
+	query := `
+		SELECT id, type, vm_id, status, step, error, result, idempotency_key, created_at, updated_at
+		FROM jobs WHERE id = @id
+	`
+	args := pgx.NamedArgs{"id": jobId}
+
+	var job Job
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(
+		&job.ID,
+		&job.Type,
+		&job.VmId,
+		&job.Status,
+		&job.Step,
+		&job.Error,
+		&job.Result,
+		&job.IdempotencyKey,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	); err != nil {
+		return Job{}, logAndReturnError("Error getting job: ", err.Error())
+	}
+
+	return job, nil
+}
+
+func (postgres *PostgresDatabase) SetJobStep(jobId string, step string) error {
+	query := "UPDATE jobs SET step = @step, updated_at = NOW() WHERE id = @id"
+	args := pgx.NamedArgs{"id": jobId, "step": step}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error setting job step: ", err.Error())
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) SetJobStatus(jobId string, status JobStatus, errorMessage *string, result []byte) error {
+	query := `
+		UPDATE jobs
+		SET status = @status, error = @error, result = @result, updated_at = NOW()
+		WHERE id = @id
+	`
+	args := pgx.NamedArgs{
+		"id":     jobId,
+		"status": status,
+		"error":  errorMessage,
+		"result": result,
+	}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error setting job status: ", err.Error())
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) FailUnfinishedJobs(errorMessage string) error {
+	query := `
+		UPDATE jobs
+		SET status = @failed, error = @error, updated_at = NOW()
+		WHERE status IN (@queued, @running)
+	`
+	args := pgx.NamedArgs{
+		"failed":  JobFailed,
+		"queued":  JobQueued,
+		"running": JobRunning,
+		"error":   errorMessage,
+	}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error failing unfinished jobs: ", err.Error())
+	}
+
+	return nil
+}
+
 func (dbVm *DatabaseVM) toVm() Vm {
 	return Vm{
 		ID:               dbVm.ID,
@@ -442,6 +895,10 @@ func (dbVm *DatabaseVM) toVm() Vm {
 		DependsOn:        dbVm.DependsOn,
 		SubjectId:        dbVm.SubjectId,
 		VmVlanIdentifier: dbVm.VmVlanIdentifier,
+		ServerAgentUrl:   dbVm.ServerAgentUrl,
+		VcpuCount:        dbVm.VcpuCount,
+		VramMB:           dbVm.VramMB,
+		SizeMB:           dbVm.SizeMB,
 	}
 }
 
@@ -454,49 +911,1061 @@ func (vm *Vm) toDatabaseVM(isBase bool, isTemplate bool) DatabaseVM {
 		DependsOn:        vm.DependsOn,
 		SubjectId:        vm.SubjectId,
 		VmVlanIdentifier: vm.VmVlanIdentifier,
+		ServerAgentUrl:   vm.ServerAgentUrl,
+		VcpuCount:        vm.VcpuCount,
+		VramMB:           vm.VramMB,
+		SizeMB:           vm.SizeMB,
 	}
 }
 
-func (dbSubject *DatabaseSubject) toSubject() Subject {
-	return Subject{
-		SubjectId: dbSubject.SubjectId,
-		Vlan:      dbSubject.Vlan,
+func (postgres *PostgresDatabase) UpsertServerAgent(agent ServerAgent) error {
+	labels, err := json.Marshal(agent.Labels)
+	if err != nil {
+		return logAndReturnError("Error marshalling server agent labels: ", err.Error())
+	}
+
+	// Cordon and drain flags survive re-registrations, e.g. after rebooting a retired host
+	query := `
+		INSERT INTO server_agents (
+			url, version, labels, vcpu_count, total_memory_mb, total_disk_mb, state, registered_at, last_heartbeat_at
+		)
+		VALUES (@url, @version, @labels, @vcpu_count, @total_memory_mb, @total_disk_mb, @state, NOW(), NOW())
+		ON CONFLICT (url) DO UPDATE SET
+			version = EXCLUDED.version,
+			labels = EXCLUDED.labels,
+			vcpu_count = EXCLUDED.vcpu_count,
+			total_memory_mb = EXCLUDED.total_memory_mb,
+			total_disk_mb = EXCLUDED.total_disk_mb,
+			state = EXCLUDED.state,
+			registered_at = NOW(),
+			last_heartbeat_at = NOW()
+	`
+	args := pgx.NamedArgs{
+		"url":             agent.Url,
+		"version":         agent.Version,
+		"labels":          labels,
+		"vcpu_count":      agent.VcpuCount,
+		"total_memory_mb": agent.TotalMemoryMB,
+		"total_disk_mb":   agent.TotalDiskMB,
+		"state":           ServerAgentAlive,
 	}
-}
 
-func (subject *Subject) toDatabaseSubject() DatabaseSubject {
-	return DatabaseSubject{
-		SubjectId: subject.SubjectId,
-		Vlan:      subject.Vlan,
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error registering server agent: ", err.Error())
 	}
+
+	return nil
 }
 
-func NewDatabase(databaseURL string) (Database, error) {
-	dbpool, err := pgxpool.New(context.Background(), databaseURL)
-	if err != nil {
-		return nil, logAndReturnError("Error creating database connection pool: ", err.Error())
+// UpdateServerAgentHeartbeat returns false if the server agent is not registered
+func (postgres *PostgresDatabase) UpdateServerAgentHeartbeat(url string, resourceStatus GetResourceStatusAgentResponse) (bool, error) {
+	query := `
+		UPDATE server_agents
+		SET cpu_load = @cpu_load,
+			total_memory_mb = @total_memory_mb,
+			free_memory_mb = @free_memory_mb,
+			total_disk_mb = @total_disk_mb,
+			free_disk_mb = @free_disk_mb,
+			state = @state,
+			last_heartbeat_at = NOW()
+		WHERE url = @url
+	`
+	args := pgx.NamedArgs{
+		"url":             url,
+		"cpu_load":        resourceStatus.CpuLoad,
+		"total_memory_mb": resourceStatus.TotalMemoryMB,
+		"free_memory_mb":  resourceStatus.FreeMemoryMB,
+		"total_disk_mb":   resourceStatus.TotalDiskMB,
+		"free_disk_mb":    resourceStatus.FreeDiskMB,
+		"state":           ServerAgentAlive,
 	}
 
-	if err := dbpool.Ping(context.Background()); err != nil {
-		return nil, logAndReturnError("Error pinging database: ", err.Error())
+	tag, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return false, logAndReturnError("Error updating server agent heartbeat: ", err.Error())
 	}
 
-	log.Printf("Connected to database")
+	return tag.RowsAffected() > 0, nil
+}
 
-	db := &PostgresDatabase{db: dbpool}
+const serverAgentColumns = `
+	url, version, labels, vcpu_count, total_memory_mb, total_disk_mb, cpu_load, free_memory_mb,
+	free_disk_mb, state, cordoned, draining, registered_at, last_heartbeat_at
+`
+
+func scanServerAgent(row pgx.Row) (ServerAgent, error) {
+	var agent ServerAgent
+	var labels []byte
+
+	if err := row.Scan(
+		&agent.Url,
+		&agent.Version,
+		&labels,
+		&agent.VcpuCount,
+		&agent.TotalMemoryMB,
+		&agent.TotalDiskMB,
+		&agent.ResourceStatus.CpuLoad,
+		&agent.ResourceStatus.FreeMemoryMB,
+		&agent.ResourceStatus.FreeDiskMB,
+		&agent.State,
+		&agent.Cordoned,
+		&agent.Draining,
+		&agent.RegisteredAt,
+		&agent.LastHeartbeatAt,
+	); err != nil {
+		return ServerAgent{}, err
+	}
 
-	if err := db.createTablesIfNotExist(); err != nil {
-		return nil, err
+	agent.ResourceStatus.TotalMemoryMB = agent.TotalMemoryMB
+	agent.ResourceStatus.TotalDiskMB = agent.TotalDiskMB
+
+	if err := json.Unmarshal(labels, &agent.Labels); err != nil {
+		return ServerAgent{}, err
 	}
 
-	return db, nil
+	return agent, nil
 }
 
-func (postgres *PostgresDatabase) Close() {
-	postgres.db.Close()
+// GetServerAgent returns false if the server agent is not registered
+func (postgres *PostgresDatabase) GetServerAgent(url string) (ServerAgent, bool, error) {
+	query := "SELECT " + serverAgentColumns + " FROM server_agents WHERE url = @url"
+	args := pgx.NamedArgs{"url": url}
+
+	agent, err := scanServerAgent(postgres.db.QueryRow(context.Background(), query, args))
+	if err == pgx.ErrNoRows {
+		return ServerAgent{}, false, nil
+	}
+	if err != nil {
+		return ServerAgent{}, false, logAndReturnError("Error getting server agent: ", err.Error())
+	}
+
+	return agent, true, nil
 }
 
-func (postgres *PostgresDatabase) createTablesIfNotExist() error {
+func (postgres *PostgresDatabase) GetServerAgents() ([]ServerAgent, error) {
+	query := "SELECT " + serverAgentColumns + " FROM server_agents ORDER BY url"
+
+	rows, err := postgres.db.Query(context.Background(), query)
+	if err != nil {
+		return nil, logAndReturnError("Error getting server agents: ", err.Error())
+	}
+	defer rows.Close()
+
+	agents := []ServerAgent{}
+	for rows.Next() {
+		agent, err := scanServerAgent(rows)
+		if err != nil {
+			return nil, logAndReturnError("Error getting server agents: ", err.Error())
+		}
+		agents = append(agents, agent)
+	}
+
+	return agents, nil
+}
+
+func (postgres *PostgresDatabase) SetServerAgentCordoned(url string, cordoned bool) error {
+	// Uncordoning a server agent also stops considering it as draining
+	query := "UPDATE server_agents SET cordoned = @cordoned, draining = draining AND @cordoned WHERE url = @url"
+	args := pgx.NamedArgs{"url": url, "cordoned": cordoned}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error setting server agent cordon: ", err.Error())
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) SetServerAgentDraining(url string, draining bool) error {
+	// Draining server agents are always cordoned so nothing new is placed on them
+	query := "UPDATE server_agents SET draining = @draining, cordoned = cordoned OR @draining WHERE url = @url"
+	args := pgx.NamedArgs{"url": url, "draining": draining}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error setting server agent draining: ", err.Error())
+	}
+
+	return nil
+}
+
+// MarkLostServerAgents marks as lost the alive server agents that didn't send a
+// heartbeat within the timeout and returns their URLs
+func (postgres *PostgresDatabase) MarkLostServerAgents(heartbeatTimeout time.Duration) ([]string, error) {
+	query := `
+		UPDATE server_agents SET state = @lost
+		WHERE state = @alive AND last_heartbeat_at < NOW() - @timeout::interval
+		RETURNING url
+	`
+	args := pgx.NamedArgs{
+		"lost":    ServerAgentLost,
+		"alive":   ServerAgentAlive,
+		"timeout": heartbeatTimeout.String(),
+	}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, logAndReturnError("Error marking lost server agents: ", err.Error())
+	}
+	defer rows.Close()
+
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, logAndReturnError("Error marking lost server agents: ", err.Error())
+		}
+		urls = append(urls, url)
+	}
+
+	return urls, nil
+}
+
+// DeleteServerAgent also forgets the template copies it held, they are gone with the host
+func (postgres *PostgresDatabase) DeleteServerAgent(url string) error {
+	tx, err := postgres.db.Begin(context.Background())
+	if err != nil {
+		return logAndReturnError("Error starting transaction: ", err.Error())
+	}
+	defer tx.Rollback(context.Background())
+
+	args := pgx.NamedArgs{"url": url}
+
+	if _, err := tx.Exec(context.Background(), "DELETE FROM template_copies WHERE server_agent_url = @url", args); err != nil {
+		return logAndReturnError("Error deleting server agent template copies: ", err.Error())
+	}
+
+	if _, err := tx.Exec(context.Background(), "DELETE FROM server_agents WHERE url = @url", args); err != nil {
+		return logAndReturnError("Error deleting server agent: ", err.Error())
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return logAndReturnError("Error committing transaction: ", err.Error())
+	}
+
+	return nil
+}
+
+// GetVmsByServerAgentUrl returns the instances and templates placed in the server agent,
+// copies of templates held because of migrations are not included
+func (postgres *PostgresDatabase) GetVmsByServerAgentUrl(url string) ([]DatabaseVM, error) {
+	query := "SELECT " + vmColumns + " FROM vms WHERE server_agent_url = @url"
+	args := pgx.NamedArgs{"url": url}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, logAndReturnError("Error getting vms by server agent url: ", err.Error())
+	}
+	defer rows.Close()
+
+	var vms []DatabaseVM
+	for rows.Next() {
+		vm, err := scanVm(rows)
+		if err != nil {
+			return nil, logAndReturnError("Error getting vms by server agent url: ", err.Error())
+		}
+		vms = append(vms, vm)
+	}
+
+	return vms, nil
+}
+
+func (postgres *PostgresDatabase) GetVm(vmId string) (DatabaseVM, error) {
+	query := "SELECT " + vmColumns + " FROM vms WHERE id = @id"
+	args := pgx.NamedArgs{"id": vmId}
+
+	vm, err := scanVm(postgres.db.QueryRow(context.Background(), query, args))
+	if err != nil {
+		return DatabaseVM{}, logAndReturnError("Error getting VM: ", err.Error())
+	}
+
+	return vm, nil
+}
+
+// GetServerAgentsReservations sums the resources committed to the VMs placed in every server agent.
+// Templates, including the copies held because of migrations, only reserve disk since they never run
+func (postgres *PostgresDatabase) GetServerAgentsReservations() (map[string]ServerAgentReservations, error) {
+	query := `
+		SELECT server_agent_url, subject_id, is_template, vcpu_count, vram_mb, size_mb
+		FROM vms WHERE is_base = false AND server_agent_url IS NOT NULL
+		UNION ALL
+		SELECT tc.server_agent_url, NULL, true, v.vcpu_count, v.vram_mb, v.size_mb
+		FROM template_copies tc JOIN vms v ON v.id = tc.template_id
+	`
+
+	rows, err := postgres.db.Query(context.Background(), query)
+	if err != nil {
+		return nil, logAndReturnError("Error getting server agents reservations: ", err.Error())
+	}
+	defer rows.Close()
+
+	reservations := map[string]ServerAgentReservations{}
+	for rows.Next() {
+		var url string
+		var subjectId *string
+		var isTemplate bool
+		var vcpuCount, vramMB, sizeMB int
+		if err := rows.Scan(&url, &subjectId, &isTemplate, &vcpuCount, &vramMB, &sizeMB); err != nil {
+			return nil, logAndReturnError("Error getting server agents reservations: ", err.Error())
+		}
+
+		reserved, ok := reservations[url]
+		if !ok {
+			reserved = ServerAgentReservations{SubjectInstances: map[string]int{}}
+		}
+
+		reserved.SizeMB += sizeMB
+		if vcpuCount == 0 && vramMB == 0 && sizeMB == 0 {
+			reserved.UnreservedVms++
+		}
+		if !isTemplate {
+			reserved.VcpuCount += vcpuCount
+			reserved.VramMB += vramMB
+			if subjectId != nil {
+				reserved.SubjectInstances[getNetworkSegmentSubjectId(*subjectId)]++
+			}
+		}
+
+		reservations[url] = reserved
+	}
+
+	return reservations, nil
+}
+
+const subjectColumns = "subject_id, vlan, network, vpn_network"
+
+// CreateLab adds the lab with the internal networks allocate returns. allocate gets the VLANs of the
+// internal networks already in the server agent and runs in a transaction holding a lock, so allocations don't race
+func (postgres *PostgresDatabase) CreateLab(
+	lab DatabaseLab,
+	allocate func(usedVlans []int) ([]DatabaseLabNetwork, error),
+) ([]DatabaseLabNetwork, error) {
+	tx, err := postgres.db.Begin(context.Background())
+	if err != nil {
+		return nil, logAndReturnError("Error starting transaction: ", err.Error())
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(context.Background(), "LOCK TABLE lab_networks IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return nil, logAndReturnError("Error locking lab_networks table: ", err.Error())
+	}
+
+	args := pgx.NamedArgs{
+		"id":               lab.ID,
+		"subject_id":       lab.SubjectId,
+		"server_agent_url": lab.ServerAgentUrl,
+	}
+
+	rows, err := tx.Query(
+		context.Background(),
+		"SELECT vlan FROM lab_networks WHERE server_agent_url = @server_agent_url",
+		args,
+	)
+	if err != nil {
+		return nil, logAndReturnError("Error getting lab networks vlans: ", err.Error())
+	}
+
+	usedVlans, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, logAndReturnError("Error getting lab networks vlans: ", err.Error())
+	}
+
+	networks, err := allocate(usedVlans)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO labs (id, subject_id, server_agent_url)
+		VALUES (@id, @subject_id, @server_agent_url)
+	`
+	if _, err := tx.Exec(context.Background(), query, args); err != nil {
+		return nil, logAndReturnError("Error adding lab: ", err.Error())
+	}
+
+	query = `
+		INSERT INTO lab_networks (lab_id, name, server_agent_url, vlan)
+		VALUES (@id, @name, @server_agent_url, @vlan)
+	`
+	for _, network := range networks {
+		args["name"] = network.Name
+		args["vlan"] = network.Vlan
+		if _, err := tx.Exec(context.Background(), query, args); err != nil {
+			return nil, logAndReturnError("Error adding lab network: ", err.Error())
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return nil, logAndReturnError("Error committing transaction: ", err.Error())
+	}
+
+	return networks, nil
+}
+
+func (postgres *PostgresDatabase) GetLab(labId string) (DatabaseLab, bool, error) {
+	query := "SELECT id, subject_id, server_agent_url FROM labs WHERE id = @id"
+	args := pgx.NamedArgs{"id": labId}
+
+	var lab DatabaseLab
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(
+		&lab.ID,
+		&lab.SubjectId,
+		&lab.ServerAgentUrl,
+	); err != nil {
+		if err == pgx.ErrNoRows {
+			return DatabaseLab{}, false, nil
+		}
+		return DatabaseLab{}, false, logAndReturnError("Error getting lab: ", err.Error())
+	}
+
+	return lab, true, nil
+}
+
+// AddLabInstance adds the instance to the lab attached to the internal networks, in order
+func (postgres *PostgresDatabase) AddLabInstance(labId string, instanceId string, name string, networks []string) error {
+	tx, err := postgres.db.Begin(context.Background())
+	if err != nil {
+		return logAndReturnError("Error starting transaction: ", err.Error())
+	}
+	defer tx.Rollback(context.Background())
+
+	args := pgx.NamedArgs{
+		"lab_id":      labId,
+		"instance_id": instanceId,
+		"name":        name,
+	}
+
+	query := `
+		INSERT INTO lab_instances (instance_id, lab_id, name)
+		VALUES (@instance_id, @lab_id, @name)
+	`
+	if _, err := tx.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error adding lab instance: ", err.Error())
+	}
+
+	query = `
+		INSERT INTO lab_interfaces (instance_id, position, lab_id, network)
+		VALUES (@instance_id, @position, @lab_id, @network)
+	`
+	for position, network := range networks {
+		args["position"] = position
+		args["network"] = network
+		if _, err := tx.Exec(context.Background(), query, args); err != nil {
+			return logAndReturnError("Error adding lab interface: ", err.Error())
+		}
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return logAndReturnError("Error committing transaction: ", err.Error())
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) GetLabInstances(labId string) ([]DatabaseLabInstance, error) {
+	query := "SELECT instance_id, name FROM lab_instances WHERE lab_id = @lab_id ORDER BY name"
+	args := pgx.NamedArgs{"lab_id": labId}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, logAndReturnError("Error getting lab instances: ", err.Error())
+	}
+
+	instances, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DatabaseLabInstance, error) {
+		var instance DatabaseLabInstance
+		err := row.Scan(&instance.InstanceId, &instance.Name)
+		return instance, err
+	})
+	if err != nil {
+		return nil, logAndReturnError("Error getting lab instances: ", err.Error())
+	}
+
+	return instances, nil
+}
+
+// GetLabIdByVmId returns nil when the VM doesn't belong to a lab
+func (postgres *PostgresDatabase) GetLabIdByVmId(vmId string) (*string, error) {
+	query := "SELECT lab_id FROM lab_instances WHERE instance_id = @instance_id"
+	args := pgx.NamedArgs{"instance_id": vmId}
+
+	var labId string
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&labId); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, logAndReturnError("Error getting lab id by vm id: ", err.Error())
+	}
+
+	return &labId, nil
+}
+
+func (postgres *PostgresDatabase) GetLabInterfacesByVmId(vmId string) ([]DatabaseLabInterface, error) {
+	query := `
+		SELECT li.position, li.network, ln.vlan
+		FROM lab_interfaces li
+		JOIN lab_networks ln ON ln.lab_id = li.lab_id AND ln.name = li.network
+		WHERE li.instance_id = @instance_id
+		ORDER BY li.position
+	`
+	args := pgx.NamedArgs{"instance_id": vmId}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, logAndReturnError("Error getting lab interfaces: ", err.Error())
+	}
+
+	interfaces, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DatabaseLabInterface, error) {
+		var labInterface DatabaseLabInterface
+		err := row.Scan(&labInterface.Position, &labInterface.Network, &labInterface.Vlan)
+		return labInterface, err
+	})
+	if err != nil {
+		return nil, logAndReturnError("Error getting lab interfaces: ", err.Error())
+	}
+
+	return interfaces, nil
+}
+
+// DeleteLab deletes the lab and its internal networks, its instances have to be deleted before
+func (postgres *PostgresDatabase) DeleteLab(labId string) error {
+	query := "DELETE FROM labs WHERE id = @id"
+	args := pgx.NamedArgs{"id": labId}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error deleting lab: ", err.Error())
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) AddFirewallPolicy(policy DatabaseFirewallPolicy) error {
+	rules, err := json.Marshal(policy.Rules)
+	if err != nil {
+		return logAndReturnError("Error marshalling firewall policy rules: ", err.Error())
+	}
+
+	query := `
+		INSERT INTO firewall_policies (id, name, subject_id, template_id, rules)
+		VALUES (@id, @name, @subject_id, @template_id, @rules)
+	`
+	args := pgx.NamedArgs{
+		"id":          policy.ID,
+		"name":        policy.Name,
+		"subject_id":  policy.SubjectId,
+		"template_id": policy.TemplateId,
+		"rules":       rules,
+	}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error adding firewall policy: ", err.Error())
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) GetFirewallPolicy(policyId string) (DatabaseFirewallPolicy, bool, error) {
+	query := "SELECT " + firewallPolicyColumns + " FROM firewall_policies WHERE id = @id"
+	args := pgx.NamedArgs{"id": policyId}
+
+	policy, err := scanFirewallPolicy(postgres.db.QueryRow(context.Background(), query, args))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return DatabaseFirewallPolicy{}, false, nil
+		}
+		return DatabaseFirewallPolicy{}, false, logAndReturnError("Error getting firewall policy: ", err.Error())
+	}
+
+	return policy, true, nil
+}
+
+// GetFirewallPoliciesBySubjectId returns the policies in evaluation order, the ones of the whole subject first
+func (postgres *PostgresDatabase) GetFirewallPoliciesBySubjectId(subjectId string) ([]DatabaseFirewallPolicy, error) {
+	query := `
+		SELECT ` + firewallPolicyColumns + `
+		FROM firewall_policies
+		WHERE subject_id = @subject_id
+		ORDER BY template_id IS NOT NULL, created_at, id
+	`
+	args := pgx.NamedArgs{"subject_id": subjectId}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, logAndReturnError("Error getting firewall policies: ", err.Error())
+	}
+
+	policies, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DatabaseFirewallPolicy, error) {
+		return scanFirewallPolicy(row)
+	})
+	if err != nil {
+		return nil, logAndReturnError("Error getting firewall policies: ", err.Error())
+	}
+
+	return policies, nil
+}
+
+func (postgres *PostgresDatabase) UpdateFirewallPolicy(policyId string, name string, rules []FirewallRule) error {
+	rulesJson, err := json.Marshal(rules)
+	if err != nil {
+		return logAndReturnError("Error marshalling firewall policy rules: ", err.Error())
+	}
+
+	query := "UPDATE firewall_policies SET name = @name, rules = @rules WHERE id = @id"
+	args := pgx.NamedArgs{
+		"id":    policyId,
+		"name":  name,
+		"rules": rulesJson,
+	}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error updating firewall policy: ", err.Error())
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) DeleteFirewallPolicy(policyId string) error {
+	query := "DELETE FROM firewall_policies WHERE id = @id"
+	args := pgx.NamedArgs{"id": policyId}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error deleting firewall policy: ", err.Error())
+	}
+
+	return nil
+}
+
+// GetFirewallPolicyInstanceIds returns the instances a policy of the subject and template applies to,
+// instances of isolated subjects are in segments named after the subject
+func (postgres *PostgresDatabase) GetFirewallPolicyInstanceIds(subjectId string, templateId *string) ([]string, error) {
+	query := `
+		SELECT id FROM vms
+		WHERE (subject_id = @subject_id OR starts_with(subject_id, @subject_id || '/'))
+		AND (@template_id::text IS NULL OR depends_on = @template_id)
+	`
+	args := pgx.NamedArgs{
+		"subject_id":  subjectId,
+		"template_id": templateId,
+	}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, logAndReturnError("Error getting firewall policy instances: ", err.Error())
+	}
+
+	instanceIds, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, logAndReturnError("Error getting firewall policy instances: ", err.Error())
+	}
+
+	return instanceIds, nil
+}
+
+// CreatePortForward adds the forward with the external port allocate returns. allocate gets the external ports
+// of the protocol already forwarded and runs in a transaction holding a lock, so allocations don't race
+func (postgres *PostgresDatabase) CreatePortForward(
+	forward DatabasePortForward,
+	allocate func(usedPorts []int) (int, error),
+) (int, error) {
+	tx, err := postgres.db.Begin(context.Background())
+	if err != nil {
+		return 0, logAndReturnError("Error starting transaction: ", err.Error())
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(context.Background(), "LOCK TABLE port_forwards IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return 0, logAndReturnError("Error locking port_forwards table: ", err.Error())
+	}
+
+	args := pgx.NamedArgs{
+		"id":            forward.ID,
+		"instance_id":   forward.InstanceId,
+		"protocol":      forward.Protocol,
+		"internal_port": forward.InternalPort,
+		"expires_at":    forward.ExpiresAt,
+	}
+
+	rows, err := tx.Query(
+		context.Background(),
+		"SELECT external_port FROM port_forwards WHERE protocol = @protocol",
+		args,
+	)
+	if err != nil {
+		return 0, logAndReturnError("Error getting forwarded ports: ", err.Error())
+	}
+
+	usedPorts, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, logAndReturnError("Error getting forwarded ports: ", err.Error())
+	}
+
+	externalPort, err := allocate(usedPorts)
+	if err != nil {
+		return 0, err
+	}
+	args["external_port"] = externalPort
+
+	query := `
+		INSERT INTO port_forwards (id, instance_id, protocol, external_port, internal_port, expires_at)
+		VALUES (@id, @instance_id, @protocol, @external_port, @internal_port, @expires_at)
+	`
+	if _, err := tx.Exec(context.Background(), query, args); err != nil {
+		return 0, logAndReturnError("Error adding port forward: ", err.Error())
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return 0, logAndReturnError("Error committing transaction: ", err.Error())
+	}
+
+	return externalPort, nil
+}
+
+func (postgres *PostgresDatabase) GetPortForward(portForwardId string) (DatabasePortForward, bool, error) {
+	query := "SELECT " + portForwardColumns + " FROM port_forwards WHERE id = @id"
+	args := pgx.NamedArgs{"id": portForwardId}
+
+	forward, err := scanPortForward(postgres.db.QueryRow(context.Background(), query, args))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return DatabasePortForward{}, false, nil
+		}
+		return DatabasePortForward{}, false, logAndReturnError("Error getting port forward: ", err.Error())
+	}
+
+	return forward, true, nil
+}
+
+func (postgres *PostgresDatabase) GetPortForwardsByVmId(vmId string) ([]DatabasePortForward, error) {
+	query := "SELECT " + portForwardColumns + " FROM port_forwards WHERE instance_id = @instance_id ORDER BY created_at"
+	args := pgx.NamedArgs{"instance_id": vmId}
+
+	return postgres.queryPortForwards(query, args)
+}
+
+func (postgres *PostgresDatabase) GetExpiredPortForwards() ([]DatabasePortForward, error) {
+	query := "SELECT " + portForwardColumns + " FROM port_forwards WHERE expires_at <= NOW()"
+
+	return postgres.queryPortForwards(query, pgx.NamedArgs{})
+}
+
+func (postgres *PostgresDatabase) DeletePortForward(portForwardId string) error {
+	query := "DELETE FROM port_forwards WHERE id = @id"
+	args := pgx.NamedArgs{"id": portForwardId}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error deleting port forward: ", err.Error())
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) queryPortForwards(query string, args pgx.NamedArgs) ([]DatabasePortForward, error) {
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, logAndReturnError("Error getting port forwards: ", err.Error())
+	}
+
+	forwards, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DatabasePortForward, error) {
+		return scanPortForward(row)
+	})
+	if err != nil {
+		return nil, logAndReturnError("Error getting port forwards: ", err.Error())
+	}
+
+	return forwards, nil
+}
+
+// AllocateWireguardPeer adds the peer with the lowest identifier not used by a VM or a peer of its subject,
+// it returns 0 when they are all used
+func (postgres *PostgresDatabase) AllocateWireguardPeer(peer DatabaseWireguardPeer, maxPeerIdentifier int) (int, error) {
+	tx, err := postgres.db.Begin(context.Background())
+	if err != nil {
+		return 0, logAndReturnError("Error starting transaction: ", err.Error())
+	}
+	defer tx.Rollback(context.Background())
+
+	args := pgx.NamedArgs{
+		"id":          peer.ID,
+		"instance_id": peer.InstanceId,
+		"subject_id":  peer.SubjectId,
+		"name":        peer.Name,
+		"public_key":  peer.PublicKey,
+		"max":         maxPeerIdentifier,
+	}
+
+	// Locking the subject serializes the allocations in it, like the ones of VMs
+	if _, err := tx.Exec(context.Background(), "SELECT 1 FROM subjects WHERE subject_id = @subject_id FOR UPDATE", args); err != nil {
+		return 0, logAndReturnError("Error locking subject: ", err.Error())
+	}
+
+	query := `
+		SELECT identifier FROM generate_series(1, @max::integer) AS identifier
+		WHERE identifier NOT IN (
+			SELECT vm_vlan_identifier FROM ipam_vm_allocations WHERE subject_id = @subject_id
+		) AND identifier NOT IN (
+			SELECT peer_identifier FROM wireguard_peers WHERE subject_id = @subject_id
+		)
+		ORDER BY identifier
+		LIMIT 1
+	`
+
+	var peerIdentifier int
+	if err := tx.QueryRow(context.Background(), query, args).Scan(&peerIdentifier); err != nil {
+		if err == pgx.ErrNoRows {
+			return 0, nil
+		}
+		return 0, logAndReturnError("Error allocating wireguard peer identifier: ", err.Error())
+	}
+
+	args["peer_identifier"] = peerIdentifier
+	query = `
+		INSERT INTO wireguard_peers (id, instance_id, subject_id, peer_identifier, name, public_key)
+		VALUES (@id, @instance_id, @subject_id, @peer_identifier, @name, @public_key)
+	`
+	if _, err := tx.Exec(context.Background(), query, args); err != nil {
+		return 0, logAndReturnError("Error adding wireguard peer: ", err.Error())
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return 0, logAndReturnError("Error committing transaction: ", err.Error())
+	}
+
+	return peerIdentifier, nil
+}
+
+func (postgres *PostgresDatabase) GetWireguardPeer(peerId string) (DatabaseWireguardPeer, bool, error) {
+	query := "SELECT " + wireguardPeerColumns + " FROM wireguard_peers WHERE id = @id"
+	args := pgx.NamedArgs{"id": peerId}
+
+	peer, err := scanWireguardPeer(postgres.db.QueryRow(context.Background(), query, args))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return DatabaseWireguardPeer{}, false, nil
+		}
+		return DatabaseWireguardPeer{}, false, logAndReturnError("Error getting wireguard peer: ", err.Error())
+	}
+
+	return peer, true, nil
+}
+
+func (postgres *PostgresDatabase) GetWireguardPeersByVmId(vmId string) ([]DatabaseWireguardPeer, error) {
+	query := "SELECT " + wireguardPeerColumns + " FROM wireguard_peers WHERE instance_id = @instance_id ORDER BY created_at"
+	args := pgx.NamedArgs{"instance_id": vmId}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, logAndReturnError("Error getting wireguard peers: ", err.Error())
+	}
+
+	peers, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DatabaseWireguardPeer, error) {
+		return scanWireguardPeer(row)
+	})
+	if err != nil {
+		return nil, logAndReturnError("Error getting wireguard peers: ", err.Error())
+	}
+
+	return peers, nil
+}
+
+func (postgres *PostgresDatabase) DeleteWireguardPeer(peerId string) error {
+	query := "DELETE FROM wireguard_peers WHERE id = @id"
+	args := pgx.NamedArgs{"id": peerId}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return logAndReturnError("Error deleting wireguard peer: ", err.Error())
+	}
+
+	return nil
+}
+
+// GetAllVms returns the instances and templates, base images are the same in every server agent
+func (postgres *PostgresDatabase) GetAllVms() ([]DatabaseVM, error) {
+	query := "SELECT " + vmColumns + " FROM vms WHERE is_base = false"
+
+	rows, err := postgres.db.Query(context.Background(), query)
+	if err != nil {
+		return nil, logAndReturnError("Error getting all vms: ", err.Error())
+	}
+
+	vms, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DatabaseVM, error) {
+		return scanVm(row)
+	})
+	if err != nil {
+		return nil, logAndReturnError("Error getting all vms: ", err.Error())
+	}
+
+	return vms, nil
+}
+
+// GetSubjectsWithoutVms returns the subjects left behind when their last VM was deleted
+func (postgres *PostgresDatabase) GetSubjectsWithoutVms() ([]DatabaseSubject, error) {
+	query := `
+		SELECT ` + subjectColumns + ` FROM subjects s
+		WHERE NOT EXISTS (SELECT 1 FROM vms v WHERE v.subject_id = s.subject_id)
+	`
+
+	rows, err := postgres.db.Query(context.Background(), query)
+	if err != nil {
+		return nil, logAndReturnError("Error getting subjects without vms: ", err.Error())
+	}
+
+	subjects, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DatabaseSubject, error) {
+		return scanSubject(row)
+	})
+	if err != nil {
+		return nil, logAndReturnError("Error getting subjects without vms: ", err.Error())
+	}
+
+	return subjects, nil
+}
+
+// GetAllocatedPeers returns the WireGuard peers that should be in the gateway, the ones of the VMs
+// and the ones of the extra devices
+func (postgres *PostgresDatabase) GetAllocatedPeers() ([]GatewayPeer, error) {
+	query := `
+		SELECT s.vlan, a.vm_vlan_identifier FROM ipam_vm_allocations a
+		JOIN subjects s ON s.subject_id = a.subject_id
+		UNION ALL
+		SELECT s.vlan, p.peer_identifier FROM wireguard_peers p
+		JOIN subjects s ON s.subject_id = p.subject_id
+	`
+
+	rows, err := postgres.db.Query(context.Background(), query)
+	if err != nil {
+		return nil, logAndReturnError("Error getting allocated peers: ", err.Error())
+	}
+
+	peers, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (GatewayPeer, error) {
+		var peer GatewayPeer
+		err := row.Scan(&peer.Vlan, &peer.PeerIdentifier)
+		return peer, err
+	})
+	if err != nil {
+		return nil, logAndReturnError("Error getting allocated peers: ", err.Error())
+	}
+
+	return peers, nil
+}
+
+func (postgres *PostgresDatabase) CountUnfinishedJobs() (int, error) {
+	query := "SELECT COUNT(*) FROM jobs WHERE status IN (@queued, @running)"
+	args := pgx.NamedArgs{"queued": JobQueued, "running": JobRunning}
+
+	var count int
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&count); err != nil {
+		return 0, logAndReturnError("Error counting unfinished jobs: ", err.Error())
+	}
+
+	return count, nil
+}
+
+const wireguardPeerColumns = "id, instance_id, subject_id, peer_identifier, name, public_key, created_at"
+
+func scanWireguardPeer(row pgx.Row) (DatabaseWireguardPeer, error) {
+	var peer DatabaseWireguardPeer
+	err := row.Scan(
+		&peer.ID,
+		&peer.InstanceId,
+		&peer.SubjectId,
+		&peer.PeerIdentifier,
+		&peer.Name,
+		&peer.PublicKey,
+		&peer.CreatedAt,
+	)
+
+	return peer, err
+}
+
+const portForwardColumns = "id, instance_id, protocol, external_port, internal_port, expires_at, created_at"
+
+func scanPortForward(row pgx.Row) (DatabasePortForward, error) {
+	var forward DatabasePortForward
+	err := row.Scan(
+		&forward.ID,
+		&forward.InstanceId,
+		&forward.Protocol,
+		&forward.ExternalPort,
+		&forward.InternalPort,
+		&forward.ExpiresAt,
+		&forward.CreatedAt,
+	)
+
+	return forward, err
+}
+
+const firewallPolicyColumns = "id, name, subject_id, template_id, rules, created_at"
+
+func scanFirewallPolicy(row pgx.Row) (DatabaseFirewallPolicy, error) {
+	var policy DatabaseFirewallPolicy
+	var rules []byte
+	if err := row.Scan(
+		&policy.ID,
+		&policy.Name,
+		&policy.SubjectId,
+		&policy.TemplateId,
+		&rules,
+		&policy.CreatedAt,
+	); err != nil {
+		return DatabaseFirewallPolicy{}, err
+	}
+
+	err := json.Unmarshal(rules, &policy.Rules)
+	return policy, err
+}
+
+func scanSubject(row pgx.Row) (DatabaseSubject, error) {
+	var subject DatabaseSubject
+	err := row.Scan(&subject.SubjectId, &subject.Vlan, &subject.Network, &subject.VpnNetwork)
+	return subject, err
+}
+
+const vmColumns = `
+	id, description, is_base, is_template, depends_on, subject_id,
+	vm_vlan_identifier, server_agent_url, vcpu_count, vram_mb, size_mb
+`
+
+func scanVm(row pgx.Row) (DatabaseVM, error) {
+	var vm DatabaseVM
+	err := row.Scan(
+		&vm.ID,
+		&vm.Description,
+		&vm.IsBase,
+		&vm.IsTemplate,
+		&vm.DependsOn,
+		&vm.SubjectId,
+		&vm.VmVlanIdentifier,
+		&vm.ServerAgentUrl,
+		&vm.VcpuCount,
+		&vm.VramMB,
+		&vm.SizeMB,
+	)
+
+	return vm, err
+}
+
+func NewDatabase(databaseURL string) (Database, error) {
+	dbpool, err := pgxpool.New(context.Background(), databaseURL)
+	if err != nil {
+		return nil, logAndReturnError("Error creating database connection pool: ", err.Error())
+	}
+
+	if err := dbpool.Ping(context.Background()); err != nil {
+		return nil, logAndReturnError("Error pinging database: ", err.Error())
+	}
+
+	log.Printf("Connected to database")
+
+	db := &PostgresDatabase{db: dbpool}
+
+	if err := db.createTablesIfNotExist(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (postgres *PostgresDatabase) Close() {
+	postgres.db.Close()
+}
+
+func (postgres *PostgresDatabase) createTablesIfNotExist() error {
 	_, err := postgres.db.Exec(context.Background(), `
 		CREATE TABLE IF NOT EXISTS subjects (
 			subject_id TEXT PRIMARY KEY,
@@ -519,6 +1988,7 @@ func (postgres *PostgresDatabase) createTablesIfNotExist() error {
 			depends_on TEXT DEFAULT NULL,
 			subject_id TEXT DEFAULT NULL,
 			vm_vlan_identifier INTEGER DEFAULT NULL,
+			server_agent_url TEXT DEFAULT NULL,
 			CONSTRAINT check_base_template CHECK (
 				NOT (is_base = true AND is_template = true)
 			),
@@ -545,5 +2015,273 @@ func (postgres *PostgresDatabase) createTablesIfNotExist() error {
 		return logAndReturnError("Error creating vms table: ", err.Error())
 	}
 
+	// Subjects created before the IPAM got the fixed 10.0.<vlan - 100>.0/24 network and its VPN counterpart
+	_, err = postgres.db.Exec(context.Background(), `
+		ALTER TABLE subjects
+			ADD COLUMN IF NOT EXISTS network TEXT,
+			ADD COLUMN IF NOT EXISTS vpn_network TEXT
+	`)
+	if err != nil {
+		return logAndReturnError("Error adding network columns to subjects table: ", err.Error())
+	}
+
+	_, err = postgres.db.Exec(context.Background(), `
+		UPDATE subjects
+		SET network = '10.0.' || (vlan - 100) || '.0/24', vpn_network = '10.1.' || (vlan - 100) || '.0/24'
+		WHERE network IS NULL
+	`)
+	if err != nil {
+		return logAndReturnError("Error setting network of existing subjects: ", err.Error())
+	}
+
+	// Databases created before VM placement was persisted don't have this column
+	_, err = postgres.db.Exec(context.Background(), `
+		ALTER TABLE vms ADD COLUMN IF NOT EXISTS server_agent_url TEXT DEFAULT NULL
+	`)
+	if err != nil {
+		return logAndReturnError("Error adding server_agent_url column to vms table: ", err.Error())
+	}
+
+	// Resources reserved by the VM in its server agent, VMs created before the scheduler tracked
+	// reservations don't reserve anything and the scheduler uses the live usage of their server agent
+	_, err = postgres.db.Exec(context.Background(), `
+		ALTER TABLE vms
+			ADD COLUMN IF NOT EXISTS vcpu_count INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS vram_mb INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS size_mb INTEGER NOT NULL DEFAULT 0
+	`)
+	if err != nil {
+		return logAndReturnError("Error adding resources columns to vms table: ", err.Error())
+	}
+
+	// VM VLAN identifiers allocated in every subject, they are allocated before the VM is added
+	// so concurrent creations in a subject don't get the same address
+	_, err = postgres.db.Exec(context.Background(), `
+		CREATE TABLE IF NOT EXISTS ipam_vm_allocations (
+			subject_id TEXT NOT NULL,
+			vm_vlan_identifier INTEGER NOT NULL,
+			instance_id TEXT NOT NULL UNIQUE,
+			PRIMARY KEY (subject_id, vm_vlan_identifier),
+			CONSTRAINT fk_subject FOREIGN KEY (subject_id)
+				REFERENCES subjects(subject_id)
+				ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return logAndReturnError("Error creating ipam_vm_allocations table: ", err.Error())
+	}
+
+	_, err = postgres.db.Exec(context.Background(), `
+		INSERT INTO ipam_vm_allocations (subject_id, vm_vlan_identifier, instance_id)
+		SELECT subject_id, vm_vlan_identifier, id FROM vms WHERE subject_id IS NOT NULL
+		ON CONFLICT DO NOTHING
+	`)
+	if err != nil {
+		return logAndReturnError("Error allocating VM vlan identifiers of existing VMs: ", err.Error())
+	}
+
+	// Server agents holding a copy of a template because an instance backed by it was migrated there
+	_, err = postgres.db.Exec(context.Background(), `
+		CREATE TABLE IF NOT EXISTS template_copies (
+			template_id TEXT NOT NULL,
+			server_agent_url TEXT NOT NULL,
+			PRIMARY KEY (template_id, server_agent_url),
+			CONSTRAINT fk_template FOREIGN KEY (template_id)
+				REFERENCES vms(id)
+				ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return logAndReturnError("Error creating template_copies table: ", err.Error())
+	}
+
+	// Server agents register themselves when they boot and send heartbeats afterwards
+	_, err = postgres.db.Exec(context.Background(), `
+		CREATE TABLE IF NOT EXISTS server_agents (
+			url TEXT PRIMARY KEY,
+			version TEXT NOT NULL DEFAULT '',
+			labels JSONB NOT NULL DEFAULT '{}',
+			vcpu_count INTEGER NOT NULL DEFAULT 0,
+			total_memory_mb INTEGER NOT NULL DEFAULT 0,
+			total_disk_mb INTEGER NOT NULL DEFAULT 0,
+			cpu_load DOUBLE PRECISION NOT NULL DEFAULT 0,
+			free_memory_mb INTEGER NOT NULL DEFAULT 0,
+			free_disk_mb INTEGER NOT NULL DEFAULT 0,
+			state TEXT NOT NULL,
+			cordoned BOOLEAN NOT NULL DEFAULT false,
+			draining BOOLEAN NOT NULL DEFAULT false,
+			registered_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			last_heartbeat_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return logAndReturnError("Error creating server_agents table: ", err.Error())
+	}
+
+	// Labs are instances of the same owner placed in one server agent and linked by internal networks
+	_, err = postgres.db.Exec(context.Background(), `
+		CREATE TABLE IF NOT EXISTS labs (
+			id TEXT PRIMARY KEY,
+			subject_id TEXT NOT NULL,
+			server_agent_url TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return logAndReturnError("Error creating labs table: ", err.Error())
+	}
+
+	// The VLANs of the internal networks are only bridged in the server agent of the lab,
+	// so they only have to be unique there
+	_, err = postgres.db.Exec(context.Background(), `
+		CREATE TABLE IF NOT EXISTS lab_networks (
+			lab_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			server_agent_url TEXT NOT NULL,
+			vlan INTEGER NOT NULL,
+			PRIMARY KEY (lab_id, name),
+			UNIQUE (server_agent_url, vlan),
+			CONSTRAINT fk_lab FOREIGN KEY (lab_id)
+				REFERENCES labs(id)
+				ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return logAndReturnError("Error creating lab_networks table: ", err.Error())
+	}
+
+	_, err = postgres.db.Exec(context.Background(), `
+		CREATE TABLE IF NOT EXISTS lab_instances (
+			instance_id TEXT PRIMARY KEY,
+			lab_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			UNIQUE (lab_id, name),
+			CONSTRAINT fk_instance FOREIGN KEY (instance_id)
+				REFERENCES vms(id)
+				ON DELETE CASCADE,
+			CONSTRAINT fk_lab FOREIGN KEY (lab_id)
+				REFERENCES labs(id)
+				ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return logAndReturnError("Error creating lab_instances table: ", err.Error())
+	}
+
+	_, err = postgres.db.Exec(context.Background(), `
+		CREATE TABLE IF NOT EXISTS lab_interfaces (
+			instance_id TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			lab_id TEXT NOT NULL,
+			network TEXT NOT NULL,
+			PRIMARY KEY (instance_id, position),
+			CONSTRAINT fk_instance FOREIGN KEY (instance_id)
+				REFERENCES lab_instances(instance_id)
+				ON DELETE CASCADE,
+			CONSTRAINT fk_network FOREIGN KEY (lab_id, network)
+				REFERENCES lab_networks(lab_id, name)
+				ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return logAndReturnError("Error creating lab_interfaces table: ", err.Error())
+	}
+
+	// Policies of a template are deleted with it, the ones of the subject outlive its network
+	// because the subject is deleted from here with its last instance
+	_, err = postgres.db.Exec(context.Background(), `
+		CREATE TABLE IF NOT EXISTS firewall_policies (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			subject_id TEXT NOT NULL,
+			template_id TEXT DEFAULT NULL,
+			rules JSONB NOT NULL DEFAULT '[]',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			CONSTRAINT fk_template FOREIGN KEY (template_id)
+				REFERENCES vms(id)
+				ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return logAndReturnError("Error creating firewall_policies table: ", err.Error())
+	}
+
+	// The external port of a forward is unique per protocol in the gateway
+	_, err = postgres.db.Exec(context.Background(), `
+		CREATE TABLE IF NOT EXISTS port_forwards (
+			id TEXT PRIMARY KEY,
+			instance_id TEXT NOT NULL,
+			protocol TEXT NOT NULL,
+			external_port INTEGER NOT NULL,
+			internal_port INTEGER NOT NULL,
+			expires_at TIMESTAMPTZ DEFAULT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			UNIQUE (protocol, external_port),
+			CONSTRAINT fk_instance FOREIGN KEY (instance_id)
+				REFERENCES vms(id)
+				ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return logAndReturnError("Error creating port_forwards table: ", err.Error())
+	}
+
+	// Peers take identifiers of the subject VMs, they are released with the peer or its instance
+	_, err = postgres.db.Exec(context.Background(), `
+		CREATE TABLE IF NOT EXISTS wireguard_peers (
+			id TEXT PRIMARY KEY,
+			instance_id TEXT NOT NULL,
+			subject_id TEXT NOT NULL,
+			peer_identifier INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			public_key TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			UNIQUE (subject_id, peer_identifier),
+			CONSTRAINT fk_instance FOREIGN KEY (instance_id)
+				REFERENCES vms(id)
+				ON DELETE CASCADE,
+			CONSTRAINT fk_subject FOREIGN KEY (subject_id)
+				REFERENCES subjects(subject_id)
+				ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return logAndReturnError("Error creating wireguard_peers table: ", err.Error())
+	}
+
+	_, err = postgres.db.Exec(context.Background(), `
+		CREATE TABLE IF NOT EXISTS jobs (
+			id TEXT PRIMARY KEY,
+			type TEXT NOT NULL,
+			vm_id TEXT DEFAULT NULL,
+			status TEXT NOT NULL,
+			step TEXT NOT NULL DEFAULT '',
+			error TEXT DEFAULT NULL,
+			result JSONB DEFAULT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return logAndReturnError("Error creating jobs table: ", err.Error())
+	}
+
+	// Jobs started with the same idempotency key are the same request sent again, the key is released
+	// when the job fails so the request can be retried
+	_, err = postgres.db.Exec(context.Background(), `
+		ALTER TABLE jobs ADD COLUMN IF NOT EXISTS idempotency_key TEXT DEFAULT NULL
+	`)
+	if err != nil {
+		return logAndReturnError("Error adding idempotency_key column to jobs table: ", err.Error())
+	}
+
+	_, err = postgres.db.Exec(context.Background(), `
+		CREATE UNIQUE INDEX IF NOT EXISTS jobs_idempotency_key_idx ON jobs (type, idempotency_key)
+		WHERE idempotency_key IS NOT NULL AND status <> 'failed'
+	`)
+	if err != nil {
+		return logAndReturnError("Error creating jobs idempotency key index: ", err.Error())
+	}
+
 	return nil
 }
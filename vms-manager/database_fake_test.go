@@ -0,0 +1,476 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+type fakeSubject struct {
+	DatabaseSubject
+	vlanIsConfigured bool
+}
+
+type fakeVmAllocation struct {
+	subjectId        string
+	vmVlanIdentifier int
+}
+
+// fakeDatabase keeps in memory what the instance lifecycle needs, like the tables of the
+// Postgres database. Methods it doesn't implement panic on the embedded nil Database,
+// so a test reaching them fails instead of silently getting zero values
+type fakeDatabase struct {
+	Database
+	mutex            sync.Mutex
+	vms              map[string]DatabaseVM
+	subjects         map[string]*fakeSubject
+	vmAllocations    map[string]fakeVmAllocation
+	serverAgents     []ServerAgent
+	firewallPolicies []DatabaseFirewallPolicy
+	jobs             map[string]Job
+	// Number of AddVm calls that fail next, like when the database is down
+	addVmFailures int
+}
+
+func newFakeDatabase() *fakeDatabase {
+	return &fakeDatabase{
+		vms:           map[string]DatabaseVM{},
+		subjects:      map[string]*fakeSubject{},
+		vmAllocations: map[string]fakeVmAllocation{},
+		jobs:          map[string]Job{},
+	}
+}
+
+func (db *fakeDatabase) VmExistsById(vmId string) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	_, found := db.vms[vmId]
+	return found, nil
+}
+
+func (db *fakeDatabase) VmIsTemplate(vmId string) (bool, error) {
+	vm, err := db.GetVm(vmId)
+	return vm.IsTemplate, err
+}
+
+func (db *fakeDatabase) VmIsBase(vmId string) (bool, error) {
+	vm, err := db.GetVm(vmId)
+	return vm.IsBase, err
+}
+
+func (db *fakeDatabase) GetDescriptionById(vmId string) (string, error) {
+	vm, err := db.GetVm(vmId)
+	if err != nil {
+		return "", err
+	}
+
+	if vm.Description == nil {
+		return "", fmt.Errorf("VM %s has no description", vmId)
+	}
+
+	return *vm.Description, nil
+}
+
+func (db *fakeDatabase) AddVm(vm Vm, isBase bool, isTemplate bool) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.addVmFailures > 0 {
+		db.addVmFailures--
+		return fmt.Errorf("database is down")
+	}
+
+	if _, found := db.vms[vm.ID]; found {
+		return fmt.Errorf("VM %s already exists", vm.ID)
+	}
+
+	db.vms[vm.ID] = vm.toDatabaseVM(isBase, isTemplate)
+	return nil
+}
+
+func (db *fakeDatabase) DeleteVm(vmId string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	delete(db.vms, vmId)
+	delete(db.vmAllocations, vmId)
+	return nil
+}
+
+func (db *fakeDatabase) GetVm(vmId string) (DatabaseVM, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	vm, found := db.vms[vmId]
+	if !found {
+		return DatabaseVM{}, fmt.Errorf("VM %s not found", vmId)
+	}
+
+	return vm, nil
+}
+
+func (db *fakeDatabase) GetAllVmIds() ([]string, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	vmIds := []string{}
+	for vmId, vm := range db.vms {
+		if !vm.IsBase {
+			vmIds = append(vmIds, vmId)
+		}
+	}
+
+	return vmIds, nil
+}
+
+func (db *fakeDatabase) AllocateSubject(
+	subjectId string,
+	allocate func(subjects []DatabaseSubject) (DatabaseSubject, error),
+) (DatabaseSubject, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if subject, found := db.subjects[subjectId]; found {
+		return subject.DatabaseSubject, nil
+	}
+
+	subjects := []DatabaseSubject{}
+	for _, subject := range db.subjects {
+		subjects = append(subjects, subject.DatabaseSubject)
+	}
+
+	subject, err := allocate(subjects)
+	if err != nil {
+		return DatabaseSubject{}, err
+	}
+
+	db.subjects[subjectId] = &fakeSubject{DatabaseSubject: subject}
+	return subject, nil
+}
+
+func (db *fakeDatabase) GetSubjectByVlan(vlan int) (DatabaseSubject, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	subject, err := db.getSubjectByVlan(vlan)
+	if err != nil {
+		return DatabaseSubject{}, err
+	}
+
+	return subject.DatabaseSubject, nil
+}
+
+// Must be called with the mutex locked
+func (db *fakeDatabase) getSubjectByVlan(vlan int) (*fakeSubject, error) {
+	for _, subject := range db.subjects {
+		if subject.Vlan == vlan {
+			return subject, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no subject with vlan %d", vlan)
+}
+
+func (db *fakeDatabase) DeleteSubject(subjectId string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	delete(db.subjects, subjectId)
+	return nil
+}
+
+func (db *fakeDatabase) SetVlanAsConfigured(vlan int) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	subject, err := db.getSubjectByVlan(vlan)
+	if err != nil {
+		return err
+	}
+
+	subject.vlanIsConfigured = true
+	return nil
+}
+
+func (db *fakeDatabase) IsVlanConfigured(vlan int) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	subject, err := db.getSubjectByVlan(vlan)
+	if err != nil {
+		return false, err
+	}
+
+	return subject.vlanIsConfigured, nil
+}
+
+func (db *fakeDatabase) AllocateVmVlanIdentifier(subjectId string, instanceId string, maxVmVlanIdentifier int) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	used := map[int]bool{}
+	for _, allocation := range db.vmAllocations {
+		if allocation.subjectId == subjectId {
+			used[allocation.vmVlanIdentifier] = true
+		}
+	}
+
+	for vmVlanIdentifier := 1; vmVlanIdentifier <= maxVmVlanIdentifier; vmVlanIdentifier++ {
+		if !used[vmVlanIdentifier] {
+			db.vmAllocations[instanceId] = fakeVmAllocation{subjectId: subjectId, vmVlanIdentifier: vmVlanIdentifier}
+			return vmVlanIdentifier, nil
+		}
+	}
+
+	return 0, nil
+}
+
+func (db *fakeDatabase) ReleaseVmVlanIdentifier(instanceId string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	delete(db.vmAllocations, instanceId)
+	return nil
+}
+
+func (db *fakeDatabase) GetSubjectIdByVmId(vmId string) (string, error) {
+	vm, err := db.GetVm(vmId)
+	if err != nil {
+		return "", err
+	}
+
+	if vm.SubjectId == nil {
+		return "", fmt.Errorf("VM %s has no subject", vmId)
+	}
+
+	return *vm.SubjectId, nil
+}
+
+func (db *fakeDatabase) GetVlanByVmId(vmId string) (int, error) {
+	subjectId, err := db.GetSubjectIdByVmId(vmId)
+	if err != nil {
+		return 0, err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	subject, found := db.subjects[subjectId]
+	if !found {
+		return 0, fmt.Errorf("subject %s not found", subjectId)
+	}
+
+	return subject.Vlan, nil
+}
+
+func (db *fakeDatabase) GetVmVlanIdentifierByVmId(vmId string) (int, error) {
+	vm, err := db.GetVm(vmId)
+	if err != nil {
+		return 0, err
+	}
+
+	if vm.VmVlanIdentifier == nil {
+		return 0, fmt.Errorf("VM %s has no vm vlan identifier", vmId)
+	}
+
+	return *vm.VmVlanIdentifier, nil
+}
+
+func (db *fakeDatabase) VmIsLastInstanceInSubject(vmId string) (bool, error) {
+	return db.isLastInstance(vmId, false)
+}
+
+func (db *fakeDatabase) VmIsLastInstanceInSubjectInServerAgent(vmId string) (bool, error) {
+	return db.isLastInstance(vmId, true)
+}
+
+func (db *fakeDatabase) isLastInstance(vmId string, inServerAgent bool) (bool, error) {
+	vm, err := db.GetVm(vmId)
+	if err != nil {
+		return false, err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	count := 0
+	for _, other := range db.vms {
+		if other.SubjectId == nil || vm.SubjectId == nil || *other.SubjectId != *vm.SubjectId {
+			continue
+		}
+
+		if inServerAgent && (other.ServerAgentUrl == nil || vm.ServerAgentUrl == nil || *other.ServerAgentUrl != *vm.ServerAgentUrl) {
+			continue
+		}
+
+		count++
+	}
+
+	return count == 1, nil
+}
+
+func (db *fakeDatabase) GetServerAgentUrlByVmId(vmId string) (*string, error) {
+	vm, err := db.GetVm(vmId)
+	return vm.ServerAgentUrl, err
+}
+
+func (db *fakeDatabase) GetServerAgent(url string) (ServerAgent, bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, agent := range db.serverAgents {
+		if agent.Url == url {
+			return agent, true, nil
+		}
+	}
+
+	return ServerAgent{}, false, nil
+}
+
+func (db *fakeDatabase) GetServerAgents() ([]ServerAgent, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return append([]ServerAgent{}, db.serverAgents...), nil
+}
+
+func (db *fakeDatabase) GetServerAgentsReservations() (map[string]ServerAgentReservations, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	reservations := map[string]ServerAgentReservations{}
+	for _, vm := range db.vms {
+		if vm.IsBase || vm.ServerAgentUrl == nil {
+			continue
+		}
+
+		reserved, found := reservations[*vm.ServerAgentUrl]
+		if !found {
+			reserved = ServerAgentReservations{SubjectInstances: map[string]int{}}
+		}
+
+		reserved.SizeMB += vm.SizeMB
+		if vm.VcpuCount == 0 && vm.VramMB == 0 && vm.SizeMB == 0 {
+			reserved.UnreservedVms++
+		}
+		if !vm.IsTemplate {
+			reserved.VcpuCount += vm.VcpuCount
+			reserved.VramMB += vm.VramMB
+			if vm.SubjectId != nil {
+				reserved.SubjectInstances[getNetworkSegmentSubjectId(*vm.SubjectId)]++
+			}
+		}
+
+		reservations[*vm.ServerAgentUrl] = reserved
+	}
+
+	return reservations, nil
+}
+
+func (db *fakeDatabase) GetFirewallPoliciesBySubjectId(subjectId string) ([]DatabaseFirewallPolicy, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	policies := []DatabaseFirewallPolicy{}
+	for _, policy := range db.firewallPolicies {
+		if policy.SubjectId == subjectId {
+			policies = append(policies, policy)
+		}
+	}
+
+	return policies, nil
+}
+
+func (db *fakeDatabase) GetLabIdByVmId(vmId string) (*string, error) {
+	return nil, nil
+}
+
+func (db *fakeDatabase) GetPortForwardsByVmId(vmId string) ([]DatabasePortForward, error) {
+	return []DatabasePortForward{}, nil
+}
+
+func (db *fakeDatabase) GetWireguardPeersByVmId(vmId string) ([]DatabaseWireguardPeer, error) {
+	return []DatabaseWireguardPeer{}, nil
+}
+
+func (db *fakeDatabase) AddJob(job Job) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.jobs[job.ID] = job
+	return nil
+}
+
+// AddJobIfIdempotencyKeyIsFree follows the unique index of the jobs table, which skips failed jobs
+func (db *fakeDatabase) AddJobIfIdempotencyKeyIsFree(job Job) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, found := db.getJobByIdempotencyKey(job.Type, *job.IdempotencyKey); found {
+		return false, nil
+	}
+
+	db.jobs[job.ID] = job
+	return true, nil
+}
+
+func (db *fakeDatabase) GetJobIdByIdempotencyKey(jobType JobType, idempotencyKey string) (string, bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	job, found := db.getJobByIdempotencyKey(jobType, idempotencyKey)
+	return job.ID, found, nil
+}
+
+// Must be called with the mutex locked
+func (db *fakeDatabase) getJobByIdempotencyKey(jobType JobType, idempotencyKey string) (Job, bool) {
+	for _, job := range db.jobs {
+		if job.Type == jobType && job.IdempotencyKey != nil && *job.IdempotencyKey == idempotencyKey && job.Status != JobFailed {
+			return job, true
+		}
+	}
+
+	return Job{}, false
+}
+
+func (db *fakeDatabase) JobExistsById(jobId string) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	_, found := db.jobs[jobId]
+	return found, nil
+}
+
+func (db *fakeDatabase) GetJob(jobId string) (Job, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	job, found := db.jobs[jobId]
+	if !found {
+		return Job{}, fmt.Errorf("job %s not found", jobId)
+	}
+
+	return job, nil
+}
+
+func (db *fakeDatabase) SetJobStep(jobId string, step string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	job := db.jobs[jobId]
+	job.Step = step
+	db.jobs[jobId] = job
+	return nil
+}
+
+func (db *fakeDatabase) SetJobStatus(jobId string, status JobStatus, errorMessage *string, result []byte) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	job := db.jobs[jobId]
+	job.Status = status
+	job.Error = errorMessage
+	job.Result = result
+	db.jobs[jobId] = job
+	return nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	FIREWALL_DIRECTION_EGRESS  = "egress"
+	FIREWALL_DIRECTION_INGRESS = "ingress"
+	FIREWALL_ACTION_ACCEPT     = "accept"
+	FIREWALL_ACTION_DROP       = "drop"
+	FIREWALL_PROTOCOL_TCP      = "tcp"
+	FIREWALL_PROTOCOL_UDP      = "udp"
+	FIREWALL_PROTOCOL_ICMP     = "icmp"
+)
+
+func (s *ServiceImpl) CreateFirewallPolicy(request CreateFirewallPolicyRequest) (CreateFirewallPolicyResponse, error) {
+	if request.Name == "" || request.SubjectId == "" {
+		return CreateFirewallPolicyResponse{}, NewHttpError(
+			http.StatusBadRequest,
+			fmt.Errorf("invalid request: name and subjectId must be non-empty"),
+		)
+	}
+
+	if err := validateFirewallRules(request.Rules); err != nil {
+		return CreateFirewallPolicyResponse{}, err
+	}
+
+	if request.TemplateId != nil {
+		if err := s.checkIfVmExists(*request.TemplateId); err != nil {
+			return CreateFirewallPolicyResponse{}, err
+		}
+
+		isTemplate, err := s.db.VmIsTemplate(*request.TemplateId)
+		if err != nil {
+			return CreateFirewallPolicyResponse{}, err
+		}
+
+		if !isTemplate {
+			return CreateFirewallPolicyResponse{}, NewHttpError(
+				http.StatusBadRequest,
+				fmt.Errorf("VM '%s' is not a template", *request.TemplateId),
+			)
+		}
+	}
+
+	policy := DatabaseFirewallPolicy{
+		ID:         uuid.New().String(),
+		Name:       request.Name,
+		SubjectId:  request.SubjectId,
+		TemplateId: request.TemplateId,
+		Rules:      request.Rules,
+	}
+	if err := s.db.AddFirewallPolicy(policy); err != nil {
+		return CreateFirewallPolicyResponse{}, err
+	}
+
+	if err := s.applyFirewallPolicyInstances(policy); err != nil {
+		return CreateFirewallPolicyResponse{}, err
+	}
+
+	return CreateFirewallPolicyResponse{PolicyId: policy.ID}, nil
+}
+
+func (s *ServiceImpl) ListFirewallPolicies(subjectId string) ([]FirewallPolicyResponse, error) {
+	policies, err := s.db.GetFirewallPoliciesBySubjectId(subjectId)
+	if err != nil {
+		return nil, err
+	}
+
+	response := []FirewallPolicyResponse{}
+	for _, policy := range policies {
+		response = append(response, toFirewallPolicyResponse(policy))
+	}
+
+	return response, nil
+}
+
+func (s *ServiceImpl) GetFirewallPolicy(policyId string) (FirewallPolicyResponse, error) {
+	policy, err := s.getFirewallPolicy(policyId)
+	if err != nil {
+		return FirewallPolicyResponse{}, err
+	}
+
+	return toFirewallPolicyResponse(policy), nil
+}
+
+func (s *ServiceImpl) UpdateFirewallPolicy(policyId string, request UpdateFirewallPolicyRequest) error {
+	if request.Name == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("invalid request: name must be non-empty"))
+	}
+
+	if err := validateFirewallRules(request.Rules); err != nil {
+		return err
+	}
+
+	policy, err := s.getFirewallPolicy(policyId)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.UpdateFirewallPolicy(policyId, request.Name, request.Rules); err != nil {
+		return err
+	}
+
+	return s.applyFirewallPolicyInstances(policy)
+}
+
+func (s *ServiceImpl) DeleteFirewallPolicy(policyId string) error {
+	policy, err := s.getFirewallPolicy(policyId)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.DeleteFirewallPolicy(policyId); err != nil {
+		return err
+	}
+
+	return s.applyFirewallPolicyInstances(policy)
+}
+
+func (s *ServiceImpl) getFirewallPolicy(policyId string) (DatabaseFirewallPolicy, error) {
+	policy, exists, err := s.db.GetFirewallPolicy(policyId)
+	if err != nil {
+		return DatabaseFirewallPolicy{}, err
+	}
+
+	if !exists {
+		return DatabaseFirewallPolicy{}, NewHttpError(
+			http.StatusNotFound,
+			fmt.Errorf("firewall policy '%s' not found", policyId),
+		)
+	}
+
+	return policy, nil
+}
+
+// applyFirewallPolicyInstances applies the firewall again to every instance the policy applies to,
+// an instance failing doesn't stop the rest from getting the policy
+func (s *ServiceImpl) applyFirewallPolicyInstances(policy DatabaseFirewallPolicy) error {
+	instanceIds, err := s.db.GetFirewallPolicyInstanceIds(policy.SubjectId, policy.TemplateId)
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, instanceId := range instanceIds {
+		if err := s.applyInstanceFirewall(instanceId); err != nil {
+			log.Printf("Error applying firewall policy %s to instance %s: %v", policy.ID, instanceId, err)
+			errs = append(errs, fmt.Errorf("instance %s: %v", instanceId, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// applyInstanceFirewall applies the rules of every policy of the instance's subject and template,
+// the ones of the whole subject first so they can't be overridden by the template ones
+func (s *ServiceImpl) applyInstanceFirewall(instanceId string) error {
+	vm, err := s.db.GetVm(instanceId)
+	if err != nil {
+		return err
+	}
+
+	if vm.SubjectId == nil || vm.VmVlanIdentifier == nil {
+		return logAndReturnError("Error applying instance firewall: ", fmt.Sprintf("VM %s is not an instance", instanceId))
+	}
+
+	policies, err := s.db.GetFirewallPoliciesBySubjectId(getNetworkSegmentSubjectId(*vm.SubjectId))
+	if err != nil {
+		return err
+	}
+
+	rules := []FirewallRule{}
+	for _, policy := range policies {
+		if policy.TemplateId == nil || (vm.DependsOn != nil && *policy.TemplateId == *vm.DependsOn) {
+			rules = append(rules, policy.Rules...)
+		}
+	}
+
+	vlan, err := s.db.GetVlanByVmId(instanceId)
+	if err != nil {
+		return err
+	}
+
+	addresses, err := s.getInstanceAddresses(vlan, *vm.VmVlanIdentifier)
+	if err != nil {
+		return err
+	}
+
+	return s.networkBackend.ApplyVmFirewall(VmFirewallConfig{
+		Vlan:             vlan,
+		VmVlanIdentifier: *vm.VmVlanIdentifier,
+		Addresses:        addresses,
+		Rules:            rules,
+	})
+}
+
+// getInstanceAddresses returns the addresses of the instance in the VLAN without prefix length, the IPv4 one first
+func (s *ServiceImpl) getInstanceAddresses(vlan int, vmVlanIdentifier int) ([]string, error) {
+	subjectNetwork, err := s.ipam.GetSubjectNetworkByVlan(vlan)
+	if err != nil {
+		return nil, err
+	}
+
+	addressesWithSubnet := []string{subjectNetwork.VmAddressWithSubnet(vmVlanIdentifier)}
+	if s.isIpv6Enabled() {
+		addressesWithSubnet = append(addressesWithSubnet, s.getIpv6AddWithSubnet(vlan, vmVlanIdentifier))
+	}
+
+	addresses := []string{}
+	for _, address := range addressesWithSubnet {
+		prefix, err := netip.ParsePrefix(address)
+		if err != nil {
+			return nil, logAndReturnError("Error parsing instance address: ", err.Error())
+		}
+		addresses = append(addresses, prefix.Addr().String())
+	}
+
+	return addresses, nil
+}
+
+func toFirewallPolicyResponse(policy DatabaseFirewallPolicy) FirewallPolicyResponse {
+	return FirewallPolicyResponse{
+		Id:         policy.ID,
+		Name:       policy.Name,
+		SubjectId:  policy.SubjectId,
+		TemplateId: policy.TemplateId,
+		Rules:      policy.Rules,
+		CreatedAt:  policy.CreatedAt,
+	}
+}
+
+func validateFirewallRules(rules []FirewallRule) error {
+	if len(rules) == 0 {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("invalid request: a firewall policy needs rules"))
+	}
+
+	for i, rule := range rules {
+		if err := validateFirewallRule(rule); err != nil {
+			return NewHttpError(http.StatusBadRequest, fmt.Errorf("invalid request: rule %d: %v", i, err))
+		}
+	}
+
+	return nil
+}
+
+func validateFirewallRule(rule FirewallRule) error {
+	if !slices.Contains([]string{FIREWALL_DIRECTION_EGRESS, FIREWALL_DIRECTION_INGRESS}, rule.Direction) {
+		return fmt.Errorf("direction must be %s or %s", FIREWALL_DIRECTION_EGRESS, FIREWALL_DIRECTION_INGRESS)
+	}
+
+	if !slices.Contains([]string{FIREWALL_ACTION_ACCEPT, FIREWALL_ACTION_DROP}, rule.Action) {
+		return fmt.Errorf("action must be %s or %s", FIREWALL_ACTION_ACCEPT, FIREWALL_ACTION_DROP)
+	}
+
+	if !slices.Contains([]string{"", FIREWALL_PROTOCOL_TCP, FIREWALL_PROTOCOL_UDP, FIREWALL_PROTOCOL_ICMP}, rule.Protocol) {
+		return fmt.Errorf(
+			"protocol must be %s, %s, %s or empty",
+			FIREWALL_PROTOCOL_TCP,
+			FIREWALL_PROTOCOL_UDP,
+			FIREWALL_PROTOCOL_ICMP,
+		)
+	}
+
+	if rule.Ports != "" {
+		if rule.Protocol != FIREWALL_PROTOCOL_TCP && rule.Protocol != FIREWALL_PROTOCOL_UDP {
+			return fmt.Errorf("ports are only valid with %s or %s", FIREWALL_PROTOCOL_TCP, FIREWALL_PROTOCOL_UDP)
+		}
+
+		for _, ports := range strings.Split(rule.Ports, ",") {
+			first, last, isRange := strings.Cut(ports, "-")
+			if !isValidPort(first) || (isRange && !isValidPort(last)) {
+				return fmt.Errorf("invalid ports '%s', e.g. 80,443,8000-8080", rule.Ports)
+			}
+		}
+	}
+
+	if rule.Remote != "" {
+		// Remote networks are written to the gateway as they are, so they must be in canonical form
+		prefix, err := netip.ParsePrefix(rule.Remote)
+		if err != nil || prefix.Masked() != prefix {
+			return fmt.Errorf("invalid remote network '%s', e.g. 192.0.2.0/24", rule.Remote)
+		}
+	}
+
+	return nil
+}
+
+func isValidPort(port string) bool {
+	number, err := strconv.Atoi(port)
+	return err == nil && number > 0 && number <= 65535
+}
+
+// appliesToAddress tells whether the rule applies to the VM address, rules with a remote network only apply to its family
+func (rule FirewallRule) appliesToAddress(ip netip.Addr) bool {
+	if rule.Remote == "" {
+		return true
+	}
+
+	prefix, err := netip.ParsePrefix(rule.Remote)
+	return err == nil && prefix.Addr().Is4() == ip.Is4()
+}
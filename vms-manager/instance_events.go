@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server agents send a full report every 30 seconds, the domains of the ones that miss two are forgotten
+// and their instances are listed by asking them again
+const INSTANCE_EVENTS_STALE_AFTER = 75 * time.Second
+const INSTANCE_EVENTS_PRUNE_INTERVAL = 15 * time.Second
+
+// Subscribers that don't keep up are dropped, they get the current state again when they reconnect
+const INSTANCE_EVENTS_SUBSCRIBER_BUFFER = 64
+
+type agentDomains struct {
+	statuses   map[string]string
+	reportedAt time.Time
+}
+
+// InstanceEvents aggregates the domains reported by the server agents and publishes the instances whose
+// status changed. An instance running in any server agent is running, e.g. while it's being migrated
+type InstanceEvents struct {
+	mutex       sync.Mutex
+	agents      map[string]*agentDomains
+	subscribers map[chan InstanceEvent]bool
+}
+
+func NewInstanceEvents() *InstanceEvents {
+	return &InstanceEvents{
+		agents:      make(map[string]*agentDomains),
+		subscribers: make(map[chan InstanceEvent]bool),
+	}
+}
+
+// Report applies the domains reported by a server agent. Partial reports are only accepted after a full one,
+// otherwise the server agent is asked for a full report
+func (e *InstanceEvents) Report(request DomainEventsRequest) error {
+	url := strings.TrimSuffix(request.Url, "/")
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	agent, found := e.agents[url]
+	if !found && !request.Full {
+		return NewHttpError(
+			http.StatusConflict,
+			fmt.Errorf("no full report received from server agent '%s'", url),
+		)
+	}
+
+	instanceIds := []string{}
+	for _, domain := range request.Domains {
+		instanceIds = append(instanceIds, domain.InstanceId)
+	}
+	instanceIds = append(instanceIds, request.RemovedDomains...)
+	if found && request.Full {
+		for instanceId := range agent.statuses {
+			instanceIds = append(instanceIds, instanceId)
+		}
+	}
+
+	previous := map[string]string{}
+	for _, instanceId := range instanceIds {
+		previous[instanceId] = e.aggregatedStatus(instanceId)
+	}
+
+	if !found || request.Full {
+		agent = &agentDomains{statuses: map[string]string{}}
+		e.agents[url] = agent
+	}
+
+	agent.reportedAt = time.Now()
+	for _, domain := range request.Domains {
+		agent.statuses[domain.InstanceId] = domain.Status
+	}
+	for _, instanceId := range request.RemovedDomains {
+		delete(agent.statuses, instanceId)
+	}
+
+	e.publishChanges(previous)
+
+	return nil
+}
+
+// AgentStatuses returns the domains of a server agent, false if it isn't reporting them
+func (e *InstanceEvents) AgentStatuses(agentUrl string) ([]ListInstancesStatusResponse, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	agent, found := e.agents[agentUrl]
+	if !found || time.Since(agent.reportedAt) > INSTANCE_EVENTS_STALE_AFTER {
+		return nil, false
+	}
+
+	statuses := []ListInstancesStatusResponse{}
+	for instanceId, status := range agent.statuses {
+		statuses = append(statuses, ListInstancesStatusResponse{InstanceId: instanceId, Status: status})
+	}
+
+	return statuses, true
+}
+
+// Subscribe returns the status of every reported instance and the channel where the changes are sent,
+// the channel is closed if the subscriber falls behind
+func (e *InstanceEvents) Subscribe() (chan InstanceEvent, []InstanceEvent) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	current := []InstanceEvent{}
+	seen := map[string]bool{}
+	for _, agent := range e.agents {
+		for instanceId := range agent.statuses {
+			if !seen[instanceId] {
+				seen[instanceId] = true
+				current = append(current, InstanceEvent{InstanceId: instanceId, Status: e.aggregatedStatus(instanceId)})
+			}
+		}
+	}
+
+	events := make(chan InstanceEvent, INSTANCE_EVENTS_SUBSCRIBER_BUFFER)
+	e.subscribers[events] = true
+
+	return events, current
+}
+
+func (e *InstanceEvents) Unsubscribe(events chan InstanceEvent) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.subscribers[events] {
+		delete(e.subscribers, events)
+		close(events)
+	}
+}
+
+// pruneStaleAgents forgets the domains of the server agents that stopped reporting them
+func (e *InstanceEvents) pruneStaleAgents() {
+	for {
+		time.Sleep(INSTANCE_EVENTS_PRUNE_INTERVAL)
+
+		e.mutex.Lock()
+		for url, agent := range e.agents {
+			if time.Since(agent.reportedAt) <= INSTANCE_EVENTS_STALE_AFTER {
+				continue
+			}
+
+			previous := map[string]string{}
+			for instanceId := range agent.statuses {
+				previous[instanceId] = e.aggregatedStatus(instanceId)
+			}
+
+			log.Printf("Server agent '%s' stopped reporting its domains", url)
+			delete(e.agents, url)
+			e.publishChanges(previous)
+		}
+		e.mutex.Unlock()
+	}
+}
+
+// aggregatedStatus must be called with the mutex held, instances no server agent reports are shut off
+func (e *InstanceEvents) aggregatedStatus(instanceId string) string {
+	status := ""
+	statusAgentUrl := ""
+	for url, agent := range e.agents {
+		agentStatus, found := agent.statuses[instanceId]
+		if !found {
+			continue
+		}
+
+		if agentStatus == RUNNING_STATUS {
+			return RUNNING_STATUS
+		}
+
+		// The same server agent is picked every time so the status doesn't flap
+		if status == "" || url < statusAgentUrl {
+			status = agentStatus
+			statusAgentUrl = url
+		}
+	}
+
+	if status == "" {
+		return SHUTOFF_STATUS
+	}
+
+	return status
+}
+
+// publishChanges must be called with the mutex held
+func (e *InstanceEvents) publishChanges(previous map[string]string) {
+	for instanceId, previousStatus := range previous {
+		status := e.aggregatedStatus(instanceId)
+		if status == previousStatus {
+			continue
+		}
+
+		event := InstanceEvent{InstanceId: instanceId, Status: status}
+		for events := range e.subscribers {
+			select {
+			case events <- event:
+			default:
+				log.Printf("Instance events subscriber fell behind, dropping it")
+				delete(e.subscribers, events)
+				close(events)
+			}
+		}
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_IPAM_VLAN_RANGE = "100-354"
+
+// VLANs of the internal networks of labs, they never leave the server agent but share its bridge with the subject VLANs
+const DEFAULT_IPAM_LAB_VLAN_RANGE = "3000-4094"
+
+// External ports of the gateway forwarded to instances, they must not collide with the WireGuard ports of the VLANs
+const DEFAULT_IPAM_PORT_FORWARD_RANGE = "30000-39999"
+const DEFAULT_IPAM_VMS_SUPERNETS = "10.0.0.0/16"
+const DEFAULT_IPAM_VPN_SUPERNETS = "10.1.0.0/16"
+const DEFAULT_IPAM_PREFIX_LENGTH = 24
+
+// Segments of isolated subjects only hold the instances of a student, 13 VMs fit in a /28
+const DEFAULT_IPAM_ISOLATED_PREFIX_LENGTH = 28
+
+// The smallest network has the network address, the gateway, one VM and the broadcast address
+const IPAM_MAX_PREFIX_LENGTH = 30
+
+// SubjectNetwork is what the IPAM allocated to a subject: its VLAN, the network of its VMs
+// and the network of its WireGuard VPN, both networks have the same size
+type SubjectNetwork struct {
+	SubjectId  string
+	Vlan       int
+	Network    netip.Prefix
+	VpnNetwork netip.Prefix
+}
+
+type IPAM interface {
+	// AllocateSubjectNetwork returns the network of the subject, allocating it with the prefix
+	// length (0 for the default one of the segment kind) when it has none. Subjects keep it until they are deleted
+	AllocateSubjectNetwork(subjectId string, prefixLength int, isolated bool) (SubjectNetwork, error)
+	GetSubjectNetworkByVlan(vlan int) (SubjectNetwork, error)
+	// AllocateVm returns the VM VLAN identifier allocated to the instance in the subject network,
+	// it's released with ReleaseVm or when the VM is deleted from the database
+	AllocateVm(subjectNetwork SubjectNetwork, instanceId string) (int, error)
+	ReleaseVm(instanceId string) error
+	// AllocateWireguardPeer adds the peer allocating it an identifier among the VM VLAN identifiers of the subject
+	// network, so it gets a unique address in its VPN network. It's released when the peer or its instance are deleted
+	AllocateWireguardPeer(subjectNetwork SubjectNetwork, peer DatabaseWireguardPeer) (int, error)
+	// AllocateLab adds the lab allocating a VLAN of the server agent to each of its internal networks,
+	// they are released when the lab is deleted
+	AllocateLab(lab DatabaseLab, networks []string) (map[string]int, error)
+	// AllocatePortForward adds the forward allocating it an external port of its protocol,
+	// it's released when the forward or its instance are deleted
+	AllocatePortForward(forward DatabasePortForward) (int, error)
+}
+
+type IPAMImpl struct {
+	db                  Database
+	firstVlan           int
+	lastVlan            int
+	vmsSupernets        []netip.Prefix
+	vpnSupernets        []netip.Prefix
+	defaultPrefixLength int
+	// Default prefix length of the segments of isolated subjects
+	isolatedPrefixLength int
+	firstLabVlan         int
+	lastLabVlan          int
+	firstForwardedPort   int
+	lastForwardedPort    int
+}
+
+func NewIPAM(
+	db Database,
+	vlanRange string,
+	vmsSupernets string,
+	vpnSupernets string,
+	defaultPrefixLength int,
+	isolatedPrefixLength int,
+	labVlanRange string,
+	portForwardRange string,
+) (IPAM, error) {
+	firstVlan, lastVlan, err := parseVlanRange(vlanRange)
+	if err != nil {
+		return nil, logAndReturnError("Error parsing IPAM_VLAN_RANGE: ", err.Error())
+	}
+
+	firstLabVlan, lastLabVlan, err := parseVlanRange(labVlanRange)
+	if err != nil {
+		return nil, logAndReturnError("Error parsing IPAM_LAB_VLAN_RANGE: ", err.Error())
+	}
+
+	// A lab VLAN equal to a subject VLAN would bridge the internal network to the subject network
+	if firstLabVlan <= lastVlan && firstVlan <= lastLabVlan {
+		return nil, logAndReturnError(
+			"Error creating IPAM: ",
+			fmt.Sprintf("lab vlan range %s overlaps vlan range %s", labVlanRange, vlanRange),
+		)
+	}
+
+	firstForwardedPort, lastForwardedPort, err := parsePortRange(portForwardRange)
+	if err != nil {
+		return nil, logAndReturnError("Error parsing IPAM_PORT_FORWARD_RANGE: ", err.Error())
+	}
+
+	if firstForwardedPort <= getVlanRouterPort(lastVlan) && getVlanRouterPort(firstVlan) <= lastForwardedPort {
+		return nil, logAndReturnError(
+			"Error creating IPAM: ",
+			fmt.Sprintf("port forward range %s overlaps the WireGuard ports of vlan range %s", portForwardRange, vlanRange),
+		)
+	}
+
+	parsedVmsSupernets, err := parseSupernets(vmsSupernets)
+	if err != nil {
+		return nil, logAndReturnError("Error parsing IPAM_VMS_SUPERNETS: ", err.Error())
+	}
+
+	parsedVpnSupernets, err := parseSupernets(vpnSupernets)
+	if err != nil {
+		return nil, logAndReturnError("Error parsing IPAM_VPN_SUPERNETS: ", err.Error())
+	}
+
+	for _, vmsSupernet := range parsedVmsSupernets {
+		for _, vpnSupernet := range parsedVpnSupernets {
+			if vmsSupernet.Overlaps(vpnSupernet) {
+				return nil, logAndReturnError(
+					"Error creating IPAM: ",
+					fmt.Sprintf("VMs supernet %s overlaps VPN supernet %s", vmsSupernet, vpnSupernet),
+				)
+			}
+		}
+	}
+
+	ipam := &IPAMImpl{
+		db:                   db,
+		firstVlan:            firstVlan,
+		lastVlan:             lastVlan,
+		vmsSupernets:         parsedVmsSupernets,
+		vpnSupernets:         parsedVpnSupernets,
+		defaultPrefixLength:  defaultPrefixLength,
+		isolatedPrefixLength: isolatedPrefixLength,
+		firstLabVlan:         firstLabVlan,
+		lastLabVlan:          lastLabVlan,
+		firstForwardedPort:   firstForwardedPort,
+		lastForwardedPort:    lastForwardedPort,
+	}
+
+	if err := ipam.checkPrefixLength(defaultPrefixLength); err != nil {
+		return nil, logAndReturnError("Error parsing IPAM_DEFAULT_PREFIX_LENGTH: ", err.Error())
+	}
+
+	if err := ipam.checkPrefixLength(isolatedPrefixLength); err != nil {
+		return nil, logAndReturnError("Error parsing IPAM_ISOLATED_PREFIX_LENGTH: ", err.Error())
+	}
+
+	return ipam, nil
+}
+
+func (ipam *IPAMImpl) AllocateSubjectNetwork(subjectId string, prefixLength int, isolated bool) (SubjectNetwork, error) {
+	if prefixLength == 0 && isolated {
+		prefixLength = ipam.isolatedPrefixLength
+	} else if prefixLength == 0 {
+		prefixLength = ipam.defaultPrefixLength
+	}
+
+	if err := ipam.checkPrefixLength(prefixLength); err != nil {
+		return SubjectNetwork{}, NewHttpError(http.StatusBadRequest, err)
+	}
+
+	// The allocation runs in a transaction holding a lock, so concurrent allocations see each other
+	dbSubject, err := ipam.db.AllocateSubject(subjectId, func(subjects []DatabaseSubject) (DatabaseSubject, error) {
+		vlans := map[int]bool{}
+		usedNetworks := []netip.Prefix{}
+		for _, subject := range subjects {
+			vlans[subject.Vlan] = true
+			for _, network := range []string{subject.Network, subject.VpnNetwork} {
+				if prefix, err := netip.ParsePrefix(network); err == nil {
+					usedNetworks = append(usedNetworks, prefix)
+				}
+			}
+		}
+
+		vlan := ipam.firstVlan
+		for vlans[vlan] {
+			vlan++
+		}
+		if vlan > ipam.lastVlan {
+			return DatabaseSubject{}, NewHttpError(http.StatusServiceUnavailable, fmt.Errorf("no more vlans available"))
+		}
+
+		network, found := findFreeNetwork(ipam.vmsSupernets, prefixLength, usedNetworks)
+		if !found {
+			return DatabaseSubject{}, NewHttpError(
+				http.StatusServiceUnavailable,
+				fmt.Errorf("no more /%d networks available for VMs", prefixLength),
+			)
+		}
+
+		vpnNetwork, found := findFreeNetwork(ipam.vpnSupernets, prefixLength, usedNetworks)
+		if !found {
+			return DatabaseSubject{}, NewHttpError(
+				http.StatusServiceUnavailable,
+				fmt.Errorf("no more /%d networks available for VPNs", prefixLength),
+			)
+		}
+
+		return DatabaseSubject{
+			SubjectId:  subjectId,
+			Vlan:       vlan,
+			Network:    network.String(),
+			VpnNetwork: vpnNetwork.String(),
+		}, nil
+	})
+	if err != nil {
+		return SubjectNetwork{}, err
+	}
+
+	return toSubjectNetwork(dbSubject)
+}
+
+func (ipam *IPAMImpl) GetSubjectNetworkByVlan(vlan int) (SubjectNetwork, error) {
+	dbSubject, err := ipam.db.GetSubjectByVlan(vlan)
+	if err != nil {
+		return SubjectNetwork{}, err
+	}
+
+	return toSubjectNetwork(dbSubject)
+}
+
+func (ipam *IPAMImpl) AllocateVm(subjectNetwork SubjectNetwork, instanceId string) (int, error) {
+	vmVlanIdentifier, err := ipam.db.AllocateVmVlanIdentifier(
+		subjectNetwork.SubjectId,
+		instanceId,
+		subjectNetwork.MaxVms(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	if vmVlanIdentifier == 0 {
+		return 0, NewHttpError(
+			http.StatusServiceUnavailable,
+			fmt.Errorf("maximum number of VMs in subject network %s reached", subjectNetwork.Network),
+		)
+	}
+
+	return vmVlanIdentifier, nil
+}
+
+func (ipam *IPAMImpl) ReleaseVm(instanceId string) error {
+	return ipam.db.ReleaseVmVlanIdentifier(instanceId)
+}
+
+func (ipam *IPAMImpl) AllocateWireguardPeer(subjectNetwork SubjectNetwork, peer DatabaseWireguardPeer) (int, error) {
+	peer.SubjectId = subjectNetwork.SubjectId
+	peerIdentifier, err := ipam.db.AllocateWireguardPeer(peer, subjectNetwork.MaxVms())
+	if err != nil {
+		return 0, err
+	}
+
+	if peerIdentifier == 0 {
+		return 0, NewHttpError(
+			http.StatusServiceUnavailable,
+			fmt.Errorf("maximum number of VMs and peers in subject network %s reached", subjectNetwork.Network),
+		)
+	}
+
+	return peerIdentifier, nil
+}
+
+func (ipam *IPAMImpl) AllocateLab(lab DatabaseLab, networks []string) (map[string]int, error) {
+	labNetworks, err := ipam.db.CreateLab(lab, func(usedVlans []int) ([]DatabaseLabNetwork, error) {
+		labNetworks := []DatabaseLabNetwork{}
+		vlan := ipam.firstLabVlan
+		for _, network := range networks {
+			for slices.Contains(usedVlans, vlan) {
+				vlan++
+			}
+			if vlan > ipam.lastLabVlan {
+				return nil, NewHttpError(
+					http.StatusServiceUnavailable,
+					fmt.Errorf("no more lab vlans available in server agent '%s'", lab.ServerAgentUrl),
+				)
+			}
+
+			labNetworks = append(labNetworks, DatabaseLabNetwork{Name: network, Vlan: vlan})
+			vlan++
+		}
+
+		return labNetworks, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	vlans := map[string]int{}
+	for _, labNetwork := range labNetworks {
+		vlans[labNetwork.Name] = labNetwork.Vlan
+	}
+
+	return vlans, nil
+}
+
+func (ipam *IPAMImpl) AllocatePortForward(forward DatabasePortForward) (int, error) {
+	return ipam.db.CreatePortForward(forward, func(usedPorts []int) (int, error) {
+		for port := ipam.firstForwardedPort; port <= ipam.lastForwardedPort; port++ {
+			if !slices.Contains(usedPorts, port) {
+				return port, nil
+			}
+		}
+
+		return 0, NewHttpError(
+			http.StatusServiceUnavailable,
+			fmt.Errorf("no more %s ports available to forward", forward.Protocol),
+		)
+	})
+}
+
+// checkPrefixLength checks that networks of the prefix length fit in a VMs and a VPN supernet
+func (ipam *IPAMImpl) checkPrefixLength(prefixLength int) error {
+	if prefixLength > IPAM_MAX_PREFIX_LENGTH {
+		return fmt.Errorf("prefix length /%d is too long, the maximum is /%d", prefixLength, IPAM_MAX_PREFIX_LENGTH)
+	}
+
+	fits := func(supernets []netip.Prefix) bool {
+		for _, supernet := range supernets {
+			if prefixLength >= supernet.Bits() {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !fits(ipam.vmsSupernets) || !fits(ipam.vpnSupernets) {
+		return fmt.Errorf("prefix length /%d doesn't fit in the configured supernets", prefixLength)
+	}
+
+	return nil
+}
+
+// MaxVms is the number of addresses of the network minus the network address, the gateway and the broadcast address
+func (n SubjectNetwork) MaxVms() int {
+	return 1<<(32-n.Network.Bits()) - 3
+}
+
+func (n SubjectNetwork) GatewayIp() string {
+	return addToIpv4(n.Network.Addr(), FIRST_IP_IN_SUBNET).String()
+}
+
+func (n SubjectNetwork) VpnGatewayIp() string {
+	return addToIpv4(n.VpnNetwork.Addr(), FIRST_IP_IN_SUBNET).String()
+}
+
+// VmAddressWithSubnet returns the address of the VM in the VLAN, the first one after the gateway is 1
+func (n SubjectNetwork) VmAddressWithSubnet(vmVlanIdentifier int) string {
+	return fmt.Sprintf(
+		"%s/%d",
+		addToIpv4(n.Network.Addr(), vmVlanIdentifier+FIRST_IP_IN_SUBNET),
+		n.Network.Bits(),
+	)
+}
+
+// InterfaceAddressWithSubnet returns the address of the user's WireGuard interface,
+// it has the same host as the VM in the VPN network
+func (n SubjectNetwork) InterfaceAddressWithSubnet(vmVlanIdentifier int) string {
+	return fmt.Sprintf(
+		"%s/%d",
+		addToIpv4(n.VpnNetwork.Addr(), vmVlanIdentifier+FIRST_IP_IN_SUBNET),
+		INTERFACE_ADDRESS_SUBNET_MASK,
+	)
+}
+
+func toSubjectNetwork(dbSubject DatabaseSubject) (SubjectNetwork, error) {
+	network, err := netip.ParsePrefix(dbSubject.Network)
+	if err != nil {
+		return SubjectNetwork{}, logAndReturnError("Error parsing subject network: ", err.Error())
+	}
+
+	vpnNetwork, err := netip.ParsePrefix(dbSubject.VpnNetwork)
+	if err != nil {
+		return SubjectNetwork{}, logAndReturnError("Error parsing subject VPN network: ", err.Error())
+	}
+
+	return SubjectNetwork{
+		SubjectId:  dbSubject.SubjectId,
+		Vlan:       dbSubject.Vlan,
+		Network:    network,
+		VpnNetwork: vpnNetwork,
+	}, nil
+}
+
+// findFreeNetwork returns the first network of the prefix length in the supernets not overlapping the used ones
+func findFreeNetwork(supernets []netip.Prefix, prefixLength int, usedNetworks []netip.Prefix) (netip.Prefix, bool) {
+	size := uint64(1) << (32 - prefixLength)
+
+	for _, supernet := range supernets {
+		if prefixLength < supernet.Bits() {
+			continue
+		}
+
+		start := uint64(ipv4ToUint32(supernet.Addr()))
+		end := start + uint64(1)<<(32-supernet.Bits())
+
+	candidates:
+		for candidateStart := start; candidateStart < end; {
+			candidate := netip.PrefixFrom(uint32ToIpv4(uint32(candidateStart)), prefixLength)
+
+			for _, used := range usedNetworks {
+				if !candidate.Overlaps(used) {
+					continue
+				}
+
+				// Skip every candidate inside the used network, it may be larger than them
+				usedEnd := uint64(ipv4ToUint32(used.Masked().Addr())) + uint64(1)<<(32-used.Bits())
+				candidateStart = max(candidateStart+size, (usedEnd+size-1)/size*size)
+				continue candidates
+			}
+
+			return candidate, true
+		}
+	}
+
+	return netip.Prefix{}, false
+}
+
+func parseVlanRange(vlanRange string) (int, int, error) {
+	first, last, found := strings.Cut(vlanRange, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid vlan range '%s', it must be like 100-354", vlanRange)
+	}
+
+	firstVlan, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid vlan range '%s': %v", vlanRange, err)
+	}
+
+	lastVlan, err := strconv.Atoi(strings.TrimSpace(last))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid vlan range '%s': %v", vlanRange, err)
+	}
+
+	// VLAN 1 is the default VLAN of most switches and 4095 is reserved
+	if firstVlan < 2 || lastVlan > 4094 || firstVlan > lastVlan {
+		return 0, 0, fmt.Errorf("invalid vlan range '%s', vlans must be between 2 and 4094", vlanRange)
+	}
+
+	return firstVlan, lastVlan, nil
+}
+
+func parsePortRange(portRange string) (int, int, error) {
+	first, last, found := strings.Cut(portRange, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid port range '%s', it must be like 30000-39999", portRange)
+	}
+
+	firstPort, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range '%s': %v", portRange, err)
+	}
+
+	lastPort, err := strconv.Atoi(strings.TrimSpace(last))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range '%s': %v", portRange, err)
+	}
+
+	// Well known ports are left to the services of the gateway
+	if firstPort < 1024 || lastPort > 65535 || firstPort > lastPort {
+		return 0, 0, fmt.Errorf("invalid port range '%s', ports must be between 1024 and 65535", portRange)
+	}
+
+	return firstPort, lastPort, nil
+}
+
+func parseSupernets(supernets string) ([]netip.Prefix, error) {
+	parsed := []netip.Prefix{}
+	for _, supernet := range strings.Split(supernets, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(supernet))
+		if err != nil || !prefix.Addr().Is4() {
+			return nil, fmt.Errorf("invalid IPv4 supernet '%s'", supernet)
+		}
+
+		parsed = append(parsed, prefix.Masked())
+	}
+
+	return parsed, nil
+}
+
+func addToIpv4(addr netip.Addr, offset int) netip.Addr {
+	return uint32ToIpv4(ipv4ToUint32(addr) + uint32(offset))
+}
+
+func ipv4ToUint32(addr netip.Addr) uint32 {
+	bytes := addr.As4()
+	return binary.BigEndian.Uint32(bytes[:])
+}
+
+func uint32ToIpv4(value uint32) netip.Addr {
+	var bytes [4]byte
+	binary.BigEndian.PutUint32(bytes[:], value)
+	return netip.AddrFrom4(bytes)
+}
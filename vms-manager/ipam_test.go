@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func parseTestPrefixes(t *testing.T, prefixes ...string) []netip.Prefix {
+	t.Helper()
+
+	parsed := []netip.Prefix{}
+	for _, prefix := range prefixes {
+		parsed = append(parsed, netip.MustParsePrefix(prefix))
+	}
+
+	return parsed
+}
+
+func TestFindFreeNetwork(t *testing.T) {
+	tests := []struct {
+		name         string
+		supernets    []string
+		prefixLength int
+		used         []string
+		expected     string // Empty when no network is free
+	}{
+		{
+			name:         "first network of an empty supernet",
+			supernets:    []string{"10.0.0.0/16"},
+			prefixLength: 24,
+			expected:     "10.0.0.0/24",
+		},
+		{
+			name:         "skips used networks",
+			supernets:    []string{"10.0.0.0/16"},
+			prefixLength: 24,
+			used:         []string{"10.0.0.0/24", "10.0.1.0/24"},
+			expected:     "10.0.2.0/24",
+		},
+		{
+			name:         "fills gaps between used networks",
+			supernets:    []string{"10.0.0.0/16"},
+			prefixLength: 24,
+			used:         []string{"10.0.0.0/24", "10.0.2.0/24"},
+			expected:     "10.0.1.0/24",
+		},
+		{
+			name:         "skips every candidate inside a larger used network",
+			supernets:    []string{"10.0.0.0/16"},
+			prefixLength: 28,
+			used:         []string{"10.0.0.0/24"},
+			expected:     "10.0.1.0/28",
+		},
+		{
+			name:         "skips a candidate overlapping a smaller used network",
+			supernets:    []string{"10.0.0.0/16"},
+			prefixLength: 24,
+			used:         []string{"10.0.0.64/28"},
+			expected:     "10.0.1.0/24",
+		},
+		{
+			name:         "used networks outside the supernets don't matter",
+			supernets:    []string{"10.0.0.0/16"},
+			prefixLength: 24,
+			used:         []string{"10.1.0.0/24", "192.168.0.0/16"},
+			expected:     "10.0.0.0/24",
+		},
+		{
+			name:         "used network overlapping the whole supernet",
+			supernets:    []string{"10.0.0.0/16"},
+			prefixLength: 24,
+			used:         []string{"10.0.0.0/8"},
+		},
+		{
+			name:         "next supernet once the first one is exhausted",
+			supernets:    []string{"10.0.0.0/23", "172.16.0.0/16"},
+			prefixLength: 24,
+			used:         []string{"10.0.0.0/24", "10.0.1.0/24"},
+			expected:     "172.16.0.0/24",
+		},
+		{
+			name:         "supernets smaller than the prefix length are skipped",
+			supernets:    []string{"10.0.0.0/26", "172.16.0.0/16"},
+			prefixLength: 24,
+			expected:     "172.16.0.0/24",
+		},
+		{
+			name:         "exhausted pool",
+			supernets:    []string{"10.0.0.0/23"},
+			prefixLength: 24,
+			used:         []string{"10.0.0.0/24", "10.0.1.0/24"},
+		},
+		{
+			name:         "/30 after a used /30",
+			supernets:    []string{"10.0.0.0/29"},
+			prefixLength: 30,
+			used:         []string{"10.0.0.0/30"},
+			expected:     "10.0.0.4/30",
+		},
+		{
+			name:         "/30 supernet holding a single network",
+			supernets:    []string{"10.0.0.0/30"},
+			prefixLength: 30,
+			expected:     "10.0.0.0/30",
+		},
+		{
+			name:         "exhausted /30 supernet",
+			supernets:    []string{"10.0.0.0/30"},
+			prefixLength: 30,
+			used:         []string{"10.0.0.0/30"},
+		},
+		{
+			name:         "/31 after a used /31",
+			supernets:    []string{"10.0.0.0/30"},
+			prefixLength: 31,
+			used:         []string{"10.0.0.0/31"},
+			expected:     "10.0.0.2/31",
+		},
+		{
+			name:         "last network of the address space",
+			supernets:    []string{"255.255.255.0/24"},
+			prefixLength: 25,
+			used:         []string{"255.255.255.0/25"},
+			expected:     "255.255.255.128/25",
+		},
+		{
+			name:         "exhausted end of the address space",
+			supernets:    []string{"255.255.255.252/30"},
+			prefixLength: 30,
+			used:         []string{"255.255.255.252/30"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			network, found := findFreeNetwork(
+				parseTestPrefixes(t, test.supernets...),
+				test.prefixLength,
+				parseTestPrefixes(t, test.used...),
+			)
+
+			if test.expected == "" {
+				if found {
+					t.Fatalf("expected no free network, got %s", network)
+				}
+				return
+			}
+
+			if !found {
+				t.Fatalf("expected %s, no network was found", test.expected)
+			}
+			if network.String() != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, network)
+			}
+		})
+	}
+}
+
+func TestSubjectNetworkMaxVms(t *testing.T) {
+	tests := []struct {
+		network  string
+		expected int
+	}{
+		{network: "10.0.0.0/24", expected: 253},
+		{network: "10.0.0.0/28", expected: 13},
+		{network: "10.0.0.0/29", expected: 5},
+		{network: "10.0.0.0/30", expected: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.network, func(t *testing.T) {
+			network := SubjectNetwork{Network: netip.MustParsePrefix(test.network)}
+
+			if maxVms := network.MaxVms(); maxVms != test.expected {
+				t.Fatalf("expected %d VMs, got %d", test.expected, maxVms)
+			}
+		})
+	}
+}
+
+func TestNewIPAM(t *testing.T) {
+	tests := []struct {
+		name                 string
+		vlanRange            string
+		vmsSupernets         string
+		vpnSupernets         string
+		defaultPrefixLength  int
+		isolatedPrefixLength int
+		labVlanRange         string
+		portForwardRange     string
+		valid                bool
+	}{
+		{
+			name:  "defaults",
+			valid: true,
+		},
+		{
+			name:                 "/30 networks",
+			defaultPrefixLength:  30,
+			isolatedPrefixLength: 30,
+			valid:                true,
+		},
+		{
+			name:                 "/31 networks have no room for a VM",
+			isolatedPrefixLength: 31,
+		},
+		{
+			name:                "networks larger than the supernets",
+			vmsSupernets:        "10.0.0.0/24",
+			defaultPrefixLength: 23,
+		},
+		{
+			name:                "networks larger than the VPN supernets",
+			vpnSupernets:        "10.1.0.0/25",
+			defaultPrefixLength: 24,
+		},
+		{
+			name:         "overlapping VMs and VPN supernets",
+			vmsSupernets: "10.0.0.0/16",
+			vpnSupernets: "10.0.128.0/17",
+		},
+		{
+			name:         "VPN supernet inside one of the VMs supernets",
+			vmsSupernets: "172.16.0.0/16, 10.0.0.0/8",
+			vpnSupernets: "10.1.0.0/16",
+		},
+		{
+			name:         "VMs and VPN supernets next to each other",
+			vmsSupernets: "10.0.0.0/16",
+			vpnSupernets: "10.1.0.0/16",
+			valid:        true,
+		},
+		{
+			name:         "lab vlans overlapping the subject vlans",
+			vlanRange:    "100-354",
+			labVlanRange: "354-400",
+		},
+		{
+			name:             "forwarded ports overlapping the WireGuard ports",
+			vlanRange:        "100-354",
+			portForwardRange: "20300-20400",
+		},
+		{
+			name:             "forwarded ports after the WireGuard ports",
+			vlanRange:        "100-354",
+			portForwardRange: "20355-20400",
+			valid:            true,
+		},
+		{
+			name:         "IPv6 supernet",
+			vmsSupernets: "fd00::/64",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			orDefault := func(value string, defaultValue string) string {
+				if value == "" {
+					return defaultValue
+				}
+				return value
+			}
+			orDefaultLength := func(value int, defaultValue int) int {
+				if value == 0 {
+					return defaultValue
+				}
+				return value
+			}
+
+			_, err := NewIPAM(
+				newFakeDatabase(),
+				orDefault(test.vlanRange, DEFAULT_IPAM_VLAN_RANGE),
+				orDefault(test.vmsSupernets, DEFAULT_IPAM_VMS_SUPERNETS),
+				orDefault(test.vpnSupernets, DEFAULT_IPAM_VPN_SUPERNETS),
+				orDefaultLength(test.defaultPrefixLength, DEFAULT_IPAM_PREFIX_LENGTH),
+				orDefaultLength(test.isolatedPrefixLength, DEFAULT_IPAM_ISOLATED_PREFIX_LENGTH),
+				orDefault(test.labVlanRange, DEFAULT_IPAM_LAB_VLAN_RANGE),
+				orDefault(test.portForwardRange, DEFAULT_IPAM_PORT_FORWARD_RANGE),
+			)
+
+			if test.valid && err != nil {
+				t.Fatalf("expected the IPAM to be created, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("expected the configuration to be rejected")
+			}
+		})
+	}
+}
+
+func TestAllocateSubjectNetworkExhaustsPool(t *testing.T) {
+	db := newFakeDatabase()
+	ipam, err := NewIPAM(db, "100-354", "10.0.0.0/29", "10.1.0.0/29", 30, 30, DEFAULT_IPAM_LAB_VLAN_RANGE, DEFAULT_IPAM_PORT_FORWARD_RANGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two /30 networks fit in every /29 supernet
+	expected := []SubjectNetwork{
+		{SubjectId: "subject1", Vlan: 100, Network: netip.MustParsePrefix("10.0.0.0/30"), VpnNetwork: netip.MustParsePrefix("10.1.0.0/30")},
+		{SubjectId: "subject2", Vlan: 101, Network: netip.MustParsePrefix("10.0.0.4/30"), VpnNetwork: netip.MustParsePrefix("10.1.0.4/30")},
+	}
+	for _, expectedNetwork := range expected {
+		network, err := ipam.AllocateSubjectNetwork(expectedNetwork.SubjectId, 0, false)
+		if err != nil {
+			t.Fatalf("AllocateSubjectNetwork returned error: %v", err)
+		}
+		if network != expectedNetwork {
+			t.Fatalf("expected %+v, got %+v", expectedNetwork, network)
+		}
+	}
+
+	// Subjects keep their network
+	network, err := ipam.AllocateSubjectNetwork("subject1", 0, false)
+	if err != nil || network != expected[0] {
+		t.Fatalf("expected subject1 to keep %+v, got %+v (%v)", expected[0], network, err)
+	}
+
+	_, err = ipam.AllocateSubjectNetwork("subject3", 0, false)
+
+	var httpErr *HttpError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the pool to be exhausted, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// Every subject VLAN gets a /64 for its VMs and another one for its WireGuard network,
+// taken from the 16 bits after a /48 prefix. The subnet ID of the VMs is the VLAN ID
+const IPV6_MAX_PREFIX_LENGTH = 48
+const IPV6_SUBNET_MASK = 64
+const IPV6_INTERFACE_ADDRESS_SUBNET_MASK = 128
+
+// Added to the subnet ID of the VLAN to get the subnet ID of its WireGuard network, like the VPN supernets for IPv4
+const IPV6_VPN_SUBNET_OFFSET = 0x8000
+
+// parseIpv6Prefix parses the optional prefix the IPv6 networks of the VLANs are taken from,
+// a ULA (e.g. fd00:10:20::/48) or a prefix delegated to the router. Empty disables IPv6
+func parseIpv6Prefix(prefix string) (netip.Prefix, error) {
+	if prefix == "" {
+		return netip.Prefix{}, nil
+	}
+
+	parsed, err := netip.ParsePrefix(prefix)
+	if err != nil || !parsed.Addr().Is6() || parsed.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("invalid IPv6 prefix '%s'", prefix)
+	}
+
+	if parsed.Bits() > IPV6_MAX_PREFIX_LENGTH {
+		return netip.Prefix{}, fmt.Errorf(
+			"IPv6 prefix '%s' is too small, it must be a /%d or larger",
+			prefix,
+			IPV6_MAX_PREFIX_LENGTH,
+		)
+	}
+
+	return parsed.Masked(), nil
+}
+
+// getIpv6Address returns the address with the given subnet ID and host of the prefix
+func getIpv6Address(prefix netip.Prefix, subnetId int, host int) netip.Addr {
+	bytes := prefix.Addr().As16()
+	binary.BigEndian.PutUint16(bytes[6:8], uint16(subnetId))
+	binary.BigEndian.PutUint64(bytes[8:16], uint64(host))
+	return netip.AddrFrom16(bytes)
+}
+
+func getVlanIpv6SubnetId(vlan int) int {
+	return vlan
+}
+
+func getVpnIpv6SubnetId(vlan int) int {
+	return getVlanIpv6SubnetId(vlan) + IPV6_VPN_SUBNET_OFFSET
+}
+
+func (s *ServiceImpl) isIpv6Enabled() bool {
+	return s.ipv6Prefix.IsValid()
+}
+
+func (s *ServiceImpl) getVlanIpv6GatewayIp(vlan int) string {
+	return getIpv6Address(s.ipv6Prefix, getVlanIpv6SubnetId(vlan), FIRST_IP_IN_SUBNET).String()
+}
+
+func (s *ServiceImpl) getVpnIpv6GatewayIp(vlan int) string {
+	return getIpv6Address(s.ipv6Prefix, getVpnIpv6SubnetId(vlan), FIRST_IP_IN_SUBNET).String()
+}
+
+func (s *ServiceImpl) getVlanIpv6NetworkWithSubnet(vlan int) string {
+	return fmt.Sprintf("%s/%d", getIpv6Address(s.ipv6Prefix, getVlanIpv6SubnetId(vlan), 0), IPV6_SUBNET_MASK)
+}
+
+func (s *ServiceImpl) getVpnIpv6NetworkWithSubnet(vlan int) string {
+	return fmt.Sprintf("%s/%d", getIpv6Address(s.ipv6Prefix, getVpnIpv6SubnetId(vlan), 0), IPV6_SUBNET_MASK)
+}
+
+func (s *ServiceImpl) getIpv6AddWithSubnet(vlan int, vmVlanIdentifier int) string {
+	return fmt.Sprintf(
+		"%s/%d",
+		getIpv6Address(s.ipv6Prefix, getVlanIpv6SubnetId(vlan), vmVlanIdentifier+FIRST_IP_IN_SUBNET),
+		IPV6_SUBNET_MASK,
+	)
+}
+
+// getIpv6InterfaceAddressWithSubnet returns the IPv6 address of the user's WireGuard interface,
+// it has the same host as the VM like the IPv4 one
+func (s *ServiceImpl) getIpv6InterfaceAddressWithSubnet(vlan int, vmVlanIdentifier int) string {
+	return fmt.Sprintf(
+		"%s/%d",
+		getIpv6Address(s.ipv6Prefix, getVpnIpv6SubnetId(vlan), vmVlanIdentifier+FIRST_IP_IN_SUBNET),
+		IPV6_INTERFACE_ADDRESS_SUBNET_MASK,
+	)
+}
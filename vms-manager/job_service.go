@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const MAX_CONCURRENT_JOBS = 8
+
+// The job holding an idempotency key may fail while a repeated request looks for it, the key is then
+// free again and the job is started once more
+const IDEMPOTENT_JOB_START_ATTEMPTS = 3
+
+// JobProgress reports the step a job is currently in, it may be nil
+// when the operation is not running as a job
+type JobProgress func(step string)
+
+func (progress JobProgress) Report(step string) {
+	if progress != nil {
+		progress(step)
+	}
+}
+
+type JobService interface {
+	StartJob(jobType JobType, vmId *string, run func(progress JobProgress) (any, error)) (JobResponse, error)
+	StartIdempotentJob(jobType JobType, vmId *string, idempotencyKey string, run func(progress JobProgress) (any, error)) (JobResponse, error)
+	GetJob(jobId string) (Job, error)
+}
+
+type JobServiceImpl struct {
+	db            Database
+	jobsSemaphore chan struct{}
+}
+
+func (s *JobServiceImpl) StartJob(jobType JobType, vmId *string, run func(progress JobProgress) (any, error)) (JobResponse, error) {
+	job := Job{
+		ID:     uuid.New().String(),
+		Type:   jobType,
+		VmId:   vmId,
+		Status: JobQueued,
+	}
+
+	if err := s.db.AddJob(job); err != nil {
+		return JobResponse{}, err
+	}
+
+	go s.runJob(job.ID, run)
+
+	return JobResponse{JobId: job.ID}, nil
+}
+
+// StartIdempotentJob starts the job once per job type and idempotency key, repeated requests get the job
+// that holds the key, whether it's still running or it succeeded. Failed jobs release their key
+func (s *JobServiceImpl) StartIdempotentJob(
+	jobType JobType,
+	vmId *string,
+	idempotencyKey string,
+	run func(progress JobProgress) (any, error),
+) (JobResponse, error) {
+	if idempotencyKey == "" {
+		return s.StartJob(jobType, vmId, run)
+	}
+
+	for attempt := 0; attempt < IDEMPOTENT_JOB_START_ATTEMPTS; attempt++ {
+		job := Job{
+			ID:             uuid.New().String(),
+			Type:           jobType,
+			VmId:           vmId,
+			Status:         JobQueued,
+			IdempotencyKey: &idempotencyKey,
+		}
+
+		added, err := s.db.AddJobIfIdempotencyKeyIsFree(job)
+		if err != nil {
+			return JobResponse{}, err
+		}
+
+		if added {
+			go s.runJob(job.ID, run)
+			return JobResponse{JobId: job.ID}, nil
+		}
+
+		jobId, exists, err := s.db.GetJobIdByIdempotencyKey(jobType, idempotencyKey)
+		if err != nil {
+			return JobResponse{}, err
+		}
+
+		if exists {
+			log.Printf("Request with idempotency key %s already started job %s", idempotencyKey, jobId)
+			return JobResponse{JobId: jobId}, nil
+		}
+	}
+
+	return JobResponse{}, NewHttpError(
+		http.StatusConflict,
+		fmt.Errorf("the job with idempotency key '%s' keeps changing, retry the request", idempotencyKey),
+	)
+}
+
+func (s *JobServiceImpl) GetJob(jobId string) (Job, error) {
+	exists, err := s.db.JobExistsById(jobId)
+	if err != nil {
+		return Job{}, err
+	}
+
+	if !exists {
+		return Job{}, NewHttpError(http.StatusNotFound, fmt.Errorf("job '%s' not found", jobId))
+	}
+
+	return s.db.GetJob(jobId)
+}
+
+func (s *JobServiceImpl) runJob(jobId string, run func(progress JobProgress) (any, error)) {
+	// Limit how many long running operations hit the server agents at the same time
+	s.jobsSemaphore <- struct{}{}
+	defer func() { <-s.jobsSemaphore }()
+
+	log.Printf("Running job %s", jobId)
+	s.updateJobStatusInDb(jobId, JobRunning, nil, nil)
+
+	result, err := run(func(step string) {
+		// Progress is only informative, failing to record it must not stop the job
+		if err := s.db.SetJobStep(jobId, step); err != nil {
+			log.Println(err.Error())
+		}
+	})
+	if err != nil {
+		errorMessage := err.Error()
+		log.Printf("Job %s failed: %s", jobId, errorMessage)
+		s.updateJobStatusInDb(jobId, JobFailed, &errorMessage, nil)
+		return
+	}
+
+	var resultJson []byte
+	if result != nil {
+		resultJson, err = json.Marshal(result)
+		if err != nil {
+			errorMessage := "error marshalling job result: " + err.Error()
+			log.Printf("Job %s failed: %s", jobId, errorMessage)
+			s.updateJobStatusInDb(jobId, JobFailed, &errorMessage, nil)
+			return
+		}
+	}
+
+	log.Printf("Job %s succeeded", jobId)
+	s.updateJobStatusInDb(jobId, JobSucceeded, nil, resultJson)
+}
+
+func (s *JobServiceImpl) updateJobStatusInDb(jobId string, status JobStatus, errorMessage *string, result []byte) {
+	// Try to update the job until it succeeds
+	// The only reason it might fail is if the DB has gone down
+	// Otherwise the job would look like it never finishes
+	for {
+		if err := s.db.SetJobStatus(jobId, status, errorMessage, result); err != nil {
+			log.Println(err.Error())
+		} else {
+			break
+		}
+	}
+}
+
+func NewJobService(db Database) (JobService, error) {
+	// Jobs that were queued or running when the vms manager stopped will never finish
+	if err := db.FailUnfinishedJobs("interrupted by a vms manager restart"); err != nil {
+		return nil, err
+	}
+
+	return &JobServiceImpl{
+		db:            db,
+		jobsSemaphore: make(chan struct{}, MAX_CONCURRENT_JOBS),
+	}, nil
+}
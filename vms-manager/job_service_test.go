@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestJobService() (*JobServiceImpl, *fakeDatabase) {
+	db := newFakeDatabase()
+	return &JobServiceImpl{db: db, jobsSemaphore: make(chan struct{}, MAX_CONCURRENT_JOBS)}, db
+}
+
+func waitForJobStatus(t *testing.T, service *JobServiceImpl, jobId string, status JobStatus) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := service.GetJob(jobId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == status {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected job %s to be %s, it is %s", jobId, status, job.Status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStartIdempotentJobWhileRunning(t *testing.T) {
+	service, _ := newTestJobService()
+
+	var runs atomic.Int32
+	release := make(chan struct{})
+	run := func(progress JobProgress) (any, error) {
+		runs.Add(1)
+		<-release
+		return nil, nil
+	}
+
+	first, err := service.StartIdempotentJob(CreateInstanceJob, nil, "key", run)
+	if err != nil {
+		t.Fatalf("StartIdempotentJob returned error: %v", err)
+	}
+	waitForJobStatus(t, service, first.JobId, JobRunning)
+
+	repeated, err := service.StartIdempotentJob(CreateInstanceJob, nil, "key", run)
+	if err != nil {
+		t.Fatalf("StartIdempotentJob returned error: %v", err)
+	}
+
+	close(release)
+	waitForJobStatus(t, service, first.JobId, JobSucceeded)
+
+	if repeated.JobId != first.JobId {
+		t.Fatalf("expected the repeated request to get job %s, got %s", first.JobId, repeated.JobId)
+	}
+	if runs.Load() != 1 {
+		t.Fatalf("expected the job to run once, it ran %d times", runs.Load())
+	}
+}
+
+func TestStartIdempotentJobAfterSuccess(t *testing.T) {
+	service, _ := newTestJobService()
+
+	var runs atomic.Int32
+	run := func(progress JobProgress) (any, error) {
+		runs.Add(1)
+		return CreateInstanceResponse{InstanceId: "instance"}, nil
+	}
+
+	first, err := service.StartIdempotentJob(CreateInstanceJob, nil, "key", run)
+	if err != nil {
+		t.Fatalf("StartIdempotentJob returned error: %v", err)
+	}
+	waitForJobStatus(t, service, first.JobId, JobSucceeded)
+
+	repeated, err := service.StartIdempotentJob(CreateInstanceJob, nil, "key", run)
+	if err != nil {
+		t.Fatalf("StartIdempotentJob returned error: %v", err)
+	}
+
+	if repeated.JobId != first.JobId {
+		t.Fatalf("expected the repeated request to get job %s, got %s", first.JobId, repeated.JobId)
+	}
+	if runs.Load() != 1 {
+		t.Fatalf("expected the job to run once, it ran %d times", runs.Load())
+	}
+}
+
+func TestStartIdempotentJobAfterFailure(t *testing.T) {
+	service, _ := newTestJobService()
+
+	var runs atomic.Int32
+	run := func(progress JobProgress) (any, error) {
+		if runs.Add(1) == 1 {
+			return nil, errors.New("no server agent available")
+		}
+		return nil, nil
+	}
+
+	first, err := service.StartIdempotentJob(CreateInstanceJob, nil, "key", run)
+	if err != nil {
+		t.Fatalf("StartIdempotentJob returned error: %v", err)
+	}
+	waitForJobStatus(t, service, first.JobId, JobFailed)
+
+	// The failed job released the key, so the request starts another one
+	retried, err := service.StartIdempotentJob(CreateInstanceJob, nil, "key", run)
+	if err != nil {
+		t.Fatalf("StartIdempotentJob returned error: %v", err)
+	}
+	waitForJobStatus(t, service, retried.JobId, JobSucceeded)
+
+	if retried.JobId == first.JobId {
+		t.Fatalf("expected a new job, got the failed job %s", first.JobId)
+	}
+	if runs.Load() != 2 {
+		t.Fatalf("expected the job to run twice, it ran %d times", runs.Load())
+	}
+}
+
+func TestStartIdempotentJobKeysPerJobType(t *testing.T) {
+	service, _ := newTestJobService()
+
+	run := func(progress JobProgress) (any, error) {
+		return nil, nil
+	}
+
+	create, err := service.StartIdempotentJob(CreateInstanceJob, nil, "key", run)
+	if err != nil {
+		t.Fatalf("StartIdempotentJob returned error: %v", err)
+	}
+
+	define, err := service.StartIdempotentJob(DefineTemplateJob, nil, "key", run)
+	if err != nil {
+		t.Fatalf("StartIdempotentJob returned error: %v", err)
+	}
+
+	if create.JobId == define.JobId {
+		t.Fatalf("expected jobs of different types not to share the key, both got %s", create.JobId)
+	}
+	waitForJobStatus(t, service, create.JobId, JobSucceeded)
+	waitForJobStatus(t, service, define.JobId, JobSucceeded)
+}
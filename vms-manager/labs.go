@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// labPlacement is where the instances of a lab are created and how they are attached to its internal networks
+type labPlacement struct {
+	serverAgentUrl string
+	interfaces     []labInterface
+}
+
+type labInterface struct {
+	vlan            int
+	ipAddWithSubnet string
+}
+
+func (s *ServiceImpl) CreateLab(request CreateLabRequest, progress JobProgress) (CreateLabResponse, error) {
+	progress.Report("validating request")
+	if err := validateCreateLabRequest(request); err != nil {
+		return CreateLabResponse{}, err
+	}
+
+	// Every instance of the lab lives in the same server agent, the only one bridging its internal networks
+	schedulingRequest := SchedulingRequest{
+		SubjectId: request.SubjectId,
+	}
+	for _, node := range request.Nodes {
+		schedulingRequest.VcpuCount += node.VcpuCount
+		schedulingRequest.VramMB += node.VramMB
+		schedulingRequest.SizeMB += node.SizeMB
+
+		if err := s.checkIfVmExists(node.SourceVmId); err != nil {
+			return CreateLabResponse{}, err
+		}
+
+		isTemplate, err := s.db.VmIsTemplate(node.SourceVmId)
+		if err != nil {
+			return CreateLabResponse{}, err
+		}
+
+		if !isTemplate {
+			continue
+		}
+
+		// Templates are the backing file of their instances, so the lab goes where they are
+		templateAgentUrl, err := s.getVmServerAgent(node.SourceVmId)
+		if err != nil {
+			return CreateLabResponse{}, err
+		}
+
+		if schedulingRequest.ServerAgentUrl != "" && schedulingRequest.ServerAgentUrl != templateAgentUrl {
+			return CreateLabResponse{}, NewHttpError(
+				http.StatusBadRequest,
+				fmt.Errorf("the templates of the lab are in different server agents"),
+			)
+		}
+		schedulingRequest.ServerAgentUrl = templateAgentUrl
+	}
+
+	// The reservation covers the whole lab until every instance is persisted
+	progress.Report("scheduling lab")
+	reservation, err := s.scheduler.Schedule(schedulingRequest)
+	if err != nil {
+		return CreateLabResponse{}, err
+	}
+	defer s.scheduler.Release(reservation)
+
+	progress.Report("allocating internal networks")
+	lab := DatabaseLab{
+		ID:             uuid.New().String(),
+		SubjectId:      request.SubjectId,
+		ServerAgentUrl: reservation.ServerAgentUrl,
+	}
+
+	vlans, err := s.ipam.AllocateLab(lab, request.Networks)
+	if err != nil {
+		return CreateLabResponse{}, err
+	}
+
+	response := CreateLabResponse{
+		LabId:     lab.ID,
+		Instances: []LabInstanceResponse{},
+	}
+
+	for _, node := range request.Nodes {
+		placement := labPlacement{serverAgentUrl: lab.ServerAgentUrl}
+		networks := []string{}
+		for _, nodeInterface := range node.Interfaces {
+			placement.interfaces = append(placement.interfaces, labInterface{
+				vlan:            vlans[nodeInterface.Network],
+				ipAddWithSubnet: nodeInterface.IpAddWithSubnet,
+			})
+			networks = append(networks, nodeInterface.Network)
+		}
+
+		instanceRequest := CreateInstanceRequest{
+			SourceVmId:          node.SourceVmId,
+			SizeMB:              node.SizeMB,
+			VcpuCount:           node.VcpuCount,
+			VramMB:              node.VramMB,
+			Username:            request.Username,
+			Password:            request.Password,
+			PublicSshKeys:       request.PublicSshKeys,
+			SubjectId:           request.SubjectId,
+			SubjectPrefixLength: request.SubjectPrefixLength,
+			SubjectIsolated:     request.SubjectIsolated,
+			OwnerId:             request.OwnerId,
+			UserWgPubKey:        node.UserWgPubKey,
+		}
+
+		nodeProgress := func(step string) {
+			progress.Report(fmt.Sprintf("%s: %s", node.Name, step))
+		}
+
+		instance, err := s.createInstance(instanceRequest, &placement, nodeProgress)
+		if err != nil {
+			s.deleteLabWhenFailed(lab.ID, response.Instances)
+			return CreateLabResponse{}, err
+		}
+
+		response.Instances = append(response.Instances, LabInstanceResponse{
+			Name:                   node.Name,
+			CreateInstanceResponse: instance,
+		})
+
+		if err := s.db.AddLabInstance(lab.ID, instance.InstanceId, node.Name, networks); err != nil {
+			s.deleteLabWhenFailed(lab.ID, response.Instances)
+			return CreateLabResponse{}, err
+		}
+	}
+
+	log.Printf("Lab %s created successfully in %s", lab.ID, lab.ServerAgentUrl)
+
+	return response, nil
+}
+
+func (s *ServiceImpl) StartLab(labId string) error {
+	instances, err := s.getLabInstances(labId)
+	if err != nil {
+		return err
+	}
+
+	statuses, err := s.ListInstancesStatus()
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		if isInstanceRunning(instance.InstanceId, statuses) {
+			continue
+		}
+
+		if err := s.StartInstance(instance.InstanceId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *ServiceImpl) StopLab(labId string, progress JobProgress) error {
+	progress.Report("validating request")
+	instances, err := s.getLabInstances(labId)
+	if err != nil {
+		return err
+	}
+
+	return s.stopLabInstances(instances, progress)
+}
+
+func (s *ServiceImpl) DeleteLab(labId string, progress JobProgress) error {
+	progress.Report("validating request")
+	instances, err := s.getLabInstances(labId)
+	if err != nil {
+		return err
+	}
+
+	if err := s.stopLabInstances(instances, progress); err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		progress.Report(fmt.Sprintf("deleting instance %s", instance.Name))
+		if err := s.deleteInstance(instance.InstanceId, nil); err != nil {
+			return err
+		}
+	}
+
+	// The VLANs of the internal networks are released with the lab
+	if err := s.db.DeleteLab(labId); err != nil {
+		return err
+	}
+
+	log.Printf("Lab %s deleted successfully", labId)
+
+	return nil
+}
+
+func (s *ServiceImpl) getLabInstances(labId string) ([]DatabaseLabInstance, error) {
+	_, exists, err := s.db.GetLab(labId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, NewHttpError(http.StatusNotFound, fmt.Errorf("lab '%s' not found", labId))
+	}
+
+	return s.db.GetLabInstances(labId)
+}
+
+func (s *ServiceImpl) stopLabInstances(instances []DatabaseLabInstance, progress JobProgress) error {
+	statuses, err := s.ListInstancesStatus()
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		if !isInstanceRunning(instance.InstanceId, statuses) {
+			continue
+		}
+
+		progress.Report(fmt.Sprintf("stopping instance %s", instance.Name))
+		if err := s.StopInstance(instance.InstanceId, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteLabWhenFailed deletes the instances already created and the lab, a lab is created whole or not at all
+func (s *ServiceImpl) deleteLabWhenFailed(labId string, instances []LabInstanceResponse) {
+	for _, instance := range instances {
+		if err := s.deleteInstance(instance.InstanceId, nil); err != nil {
+			log.Printf("Error deleting instance %s of failed lab %s: %v", instance.InstanceId, labId, err)
+		}
+	}
+
+	if err := s.db.DeleteLab(labId); err != nil {
+		log.Printf("Error deleting failed lab %s: %v", labId, err)
+	}
+}
+
+func (s *ServiceImpl) checkIfVmIsNotInLab(vmId string) error {
+	labId, err := s.db.GetLabIdByVmId(vmId)
+	if err != nil {
+		return err
+	}
+
+	if labId != nil {
+		return NewHttpError(
+			http.StatusBadRequest,
+			fmt.Errorf("VM '%s' belongs to lab '%s', the whole lab has to be managed instead", vmId, *labId),
+		)
+	}
+
+	return nil
+}
+
+func validateCreateLabRequest(request CreateLabRequest) error {
+	if request.SubjectId == "" || request.Username == "" || request.Password == "" || len(request.Nodes) == 0 {
+		return NewHttpError(
+			http.StatusBadRequest,
+			fmt.Errorf("invalid request: subjectId, username, password and nodes must be non-empty"),
+		)
+	}
+
+	if request.SubjectIsolated && request.OwnerId == "" {
+		return NewHttpError(
+			http.StatusBadRequest,
+			fmt.Errorf("invalid request: ownerId must be non-empty when subjectIsolated is set"),
+		)
+	}
+
+	for i, network := range request.Networks {
+		if network == "" || slices.Contains(request.Networks[:i], network) {
+			return NewHttpError(
+				http.StatusBadRequest,
+				fmt.Errorf("invalid request: network names must be non-empty and unique"),
+			)
+		}
+	}
+
+	nodeNames := []string{}
+	for _, node := range request.Nodes {
+		if node.Name == "" || slices.Contains(nodeNames, node.Name) {
+			return NewHttpError(
+				http.StatusBadRequest,
+				fmt.Errorf("invalid request: node names must be non-empty and unique"),
+			)
+		}
+		nodeNames = append(nodeNames, node.Name)
+
+		if node.SourceVmId == "" ||
+			node.SizeMB <= 0 ||
+			node.VcpuCount <= 0 ||
+			node.VramMB <= 0 ||
+			node.UserWgPubKey == "" {
+			return NewHttpError(
+				http.StatusBadRequest,
+				fmt.Errorf(
+					"invalid request: node '%s' needs a sourceVmId, sizeMB, vcpuCount, vramMB and userWgPubKey",
+					node.Name,
+				),
+			)
+		}
+
+		// Every interface gets a tap named after the network VLAN, so a node can't be attached twice to it
+		nodeNetworks := []string{}
+		for _, nodeInterface := range node.Interfaces {
+			if !slices.Contains(request.Networks, nodeInterface.Network) ||
+				slices.Contains(nodeNetworks, nodeInterface.Network) {
+				return NewHttpError(
+					http.StatusBadRequest,
+					fmt.Errorf(
+						"invalid request: node '%s' must be attached once to networks of the lab, '%s' isn't valid",
+						node.Name,
+						nodeInterface.Network,
+					),
+				)
+			}
+			nodeNetworks = append(nodeNetworks, nodeInterface.Network)
+
+			if nodeInterface.IpAddWithSubnet != "" {
+				if _, err := netip.ParsePrefix(nodeInterface.IpAddWithSubnet); err != nil {
+					return NewHttpError(
+						http.StatusBadRequest,
+						fmt.Errorf("invalid request: invalid address '%s'", nodeInterface.IpAddWithSubnet),
+					)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func getLabInterfacesAgentRequest(interfaces []labInterface, vmVlanIdentifier int) []LabInterfaceAgentRequest {
+	agentRequest := []LabInterfaceAgentRequest{}
+	for _, labInterface := range interfaces {
+		agentRequest = append(agentRequest, LabInterfaceAgentRequest{
+			Vid:             fmt.Sprintf("%d", labInterface.vlan),
+			VlanEtiquete:    getLabEtiquete(labInterface.vlan, vmVlanIdentifier),
+			IpAddWithSubnet: labInterface.ipAddWithSubnet,
+		})
+	}
+
+	return agentRequest
+}
+
+// getLabEtiquete returns the tap of the instance in the internal network, lab VLANs belong to a
+// single lab in the server agent and its instances share the subject network, so it's unique
+func getLabEtiquete(vlan int, vmVlanIdentifier int) string {
+	return fmt.Sprintf("lab%d-%d", vlan, vmVlanIdentifier)
+}
+
+func isInstanceRunning(instanceId string, statuses []ListInstancesStatusResponse) bool {
+	for _, status := range statuses {
+		if status.InstanceId == instanceId {
+			return status.Status == RUNNING_STATUS
+		}
+	}
+
+	return false
+}
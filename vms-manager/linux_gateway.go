@@ -0,0 +1,1061 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Routing table of the VRF of every VLAN, offset so they don't collide with the tables of the host
+const LINUX_GATEWAY_VRF_TABLE_OFFSET = 1000
+const LINUX_GATEWAY_WIREGUARD_MTU = 1420
+
+// Every rule is added to this nftables table, the rest of the host firewall is left untouched
+const LINUX_GATEWAY_NFT_TABLE = "remote_labs"
+
+// LinuxGatewayBackend configures a Linux host as the gateway of the subject VLANs with iproute2,
+// wireguard-tools and nftables. The vms manager must run in the gateway host network namespace
+// with the NET_ADMIN capability. Every VLAN gets a sub-interface of the trunk interface and a
+// WireGuard interface, both enslaved to its own VRF so subjects can't reach each other
+type LinuxGatewayBackend struct {
+	trunkInterface  string
+	wanInterface    string
+	externalGateway string
+	// Optional, without it the VLAN's have no IPv6 default route
+	externalIpv6Gateway string
+	wireguardKeysDir    string
+	mutex               sync.Mutex
+}
+
+// linuxGatewayItem is a piece of the gateway config. get returns the current properties and whether it
+// exists, set fixes changed properties in place, items without it are removed and added again
+type linuxGatewayItem struct {
+	resource   string
+	key        map[string]string
+	properties map[string]string
+	// Shared items are used by every VLAN, they are never removed
+	shared bool
+	get    func() (map[string]string, bool, error)
+	add    func() error
+	set    func() error
+	remove func() error
+}
+
+type ipLink struct {
+	Ifname   string `json:"ifname"`
+	Mtu      int    `json:"mtu"`
+	Master   string `json:"master"`
+	Link     string `json:"link"`
+	Linkinfo struct {
+		InfoKind string `json:"info_kind"`
+		InfoData struct {
+			Id    int `json:"id"`
+			Table int `json:"table"`
+		} `json:"info_data"`
+	} `json:"linkinfo"`
+}
+
+type ipAddress struct {
+	AddrInfo []struct {
+		Local     string `json:"local"`
+		Prefixlen int    `json:"prefixlen"`
+	} `json:"addr_info"`
+}
+
+type ipRoute struct {
+	Dst     string `json:"dst"`
+	Gateway string `json:"gateway"`
+	Dev     string `json:"dev"`
+}
+
+func NewLinuxGatewayBackend(
+	trunkInterface string,
+	wanInterface string,
+	externalGateway string,
+	externalIpv6Gateway string,
+	wireguardKeysDir string,
+) (NetworkBackend, error) {
+	for _, tool := range []string{"ip", "wg", "nft"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, logAndReturnError("Error starting linux gateway backend: ", tool+" is not installed")
+		}
+	}
+
+	if trunkInterface == "" || wanInterface == "" || externalGateway == "" {
+		return nil, logAndReturnError(
+			"Error starting linux gateway backend: ",
+			"LINUX_GATEWAY_TRUNK_INTERFACE, LINUX_GATEWAY_WAN_INTERFACE and LINUX_GATEWAY_EXTERNAL_GATEWAY are required",
+		)
+	}
+
+	// Private keys are kept so the WireGuard public keys users have configured survive restarts
+	if err := os.MkdirAll(wireguardKeysDir, 0700); err != nil {
+		return nil, logAndReturnError("Error creating wireguard keys directory: ", err.Error())
+	}
+
+	return &LinuxGatewayBackend{
+		trunkInterface:      trunkInterface,
+		wanInterface:        wanInterface,
+		externalGateway:     externalGateway,
+		externalIpv6Gateway: externalIpv6Gateway,
+		wireguardKeysDir:    wireguardKeysDir,
+		mutex:               sync.Mutex{},
+	}, nil
+}
+
+func (b *LinuxGatewayBackend) Close() {}
+
+func (b *LinuxGatewayBackend) ApplyVlanConfig(config VlanNetworkConfig) ([]NetworkDrift, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	applied := []NetworkDrift{}
+	for _, item := range b.getVlanItems(config) {
+		drift, err := getLinuxGatewayItemDrift(item)
+		if err != nil {
+			return applied, err
+		}
+
+		if drift == nil {
+			continue
+		}
+
+		if drift.Kind == NetworkItemMissing {
+			err = item.add()
+		} else if item.set != nil {
+			err = item.set()
+		} else if err = item.remove(); err == nil {
+			err = item.add()
+		}
+		if err != nil {
+			return applied, err
+		}
+
+		applied = append(applied, *drift)
+	}
+
+	if len(applied) > 0 {
+		log.Printf("Reconciled vlan %d config, %d items applied", config.Vlan, len(applied))
+	}
+
+	return applied, nil
+}
+
+func (b *LinuxGatewayBackend) GetVlanConfigDrift(config VlanNetworkConfig) ([]NetworkDrift, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	drifts := []NetworkDrift{}
+	for _, item := range b.getVlanItems(config) {
+		drift, err := getLinuxGatewayItemDrift(item)
+		if err != nil {
+			return nil, err
+		}
+
+		if drift != nil {
+			drifts = append(drifts, *drift)
+		}
+	}
+
+	return drifts, nil
+}
+
+func (b *LinuxGatewayBackend) RemoveVlanConfig(config VlanNetworkConfig) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	log.Printf("Removing vlan %d config...", config.Vlan)
+
+	items := b.getVlanItems(config)
+
+	var errs []error
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		if item.shared {
+			continue
+		}
+
+		_, found, err := item.get()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if found {
+			if err := item.remove(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if err := os.Remove(b.getWireguardKeyFile(config.Vlan)); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (b *LinuxGatewayBackend) ApplyVmConfig(vmNetworkConfig VmNetworkConfig, vlan int, userPubKey string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, err := runGatewayCommand(
+		"wg", "set", getWireguardInterfaceName(vlan),
+		"peer", userPubKey, "allowed-ips", getVmPeerAllowedIps(vmNetworkConfig),
+	); err != nil {
+		return fmt.Errorf("error adding wireguard peer: %v", err)
+	}
+
+	// WireGuard peers have no name, the public key of the peer of every VM is kept to remove it
+	peerFile := b.getWireguardPeerFile(vlan, vmNetworkConfig.VmVlanIdentifier)
+	if err := os.WriteFile(peerFile, []byte(userPubKey), 0600); err != nil {
+		return fmt.Errorf("error saving wireguard peer: %v", err)
+	}
+
+	return nil
+}
+
+func (b *LinuxGatewayBackend) RemoveVmConfig(vlan int, vlanIdentifier int) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	peerFile := b.getWireguardPeerFile(vlan, vlanIdentifier)
+	userPubKey, err := os.ReadFile(peerFile)
+	if err != nil {
+		return fmt.Errorf("error removing wireguard peer: %v", err)
+	}
+
+	if _, err := runGatewayCommand(
+		"wg", "set", getWireguardInterfaceName(vlan), "peer", string(userPubKey), "remove",
+	); err != nil {
+		return fmt.Errorf("error removing wireguard peer: %v", err)
+	}
+
+	return os.Remove(peerFile)
+}
+
+func (b *LinuxGatewayBackend) RotateVmWireguardKey(vmNetworkConfig VmNetworkConfig, vlan int, userPubKey string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	args := []string{
+		"set", getWireguardInterfaceName(vlan),
+		"peer", userPubKey, "allowed-ips", getVmPeerAllowedIps(vmNetworkConfig),
+	}
+
+	peerFile := b.getWireguardPeerFile(vlan, vmNetworkConfig.VmVlanIdentifier)
+	oldPubKey, err := os.ReadFile(peerFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error rotating wireguard peer key: %v", err)
+	}
+
+	// Both peers are changed by the same command
+	if len(oldPubKey) > 0 && string(oldPubKey) != userPubKey {
+		args = append(args, "peer", string(oldPubKey), "remove")
+	}
+
+	if _, err := runGatewayCommand("wg", args...); err != nil {
+		return fmt.Errorf("error rotating wireguard peer key: %v", err)
+	}
+
+	if err := os.WriteFile(peerFile, []byte(userPubKey), 0600); err != nil {
+		return fmt.Errorf("error saving wireguard peer: %v", err)
+	}
+
+	return nil
+}
+
+func (b *LinuxGatewayBackend) AddWireguardPeer(config WireguardPeerConfig) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, err := runGatewayCommand(
+		"wg", "set", getWireguardInterfaceName(config.Vlan),
+		"peer", config.PublicKey, "allowed-ips", strings.Join(config.InterfaceAddresses, ","),
+	); err != nil {
+		return fmt.Errorf("error adding wireguard peer: %v", err)
+	}
+
+	peerFile := b.getWireguardPeerFile(config.Vlan, config.PeerIdentifier)
+	if err := os.WriteFile(peerFile, []byte(config.PublicKey), 0600); err != nil {
+		return fmt.Errorf("error saving wireguard peer: %v", err)
+	}
+
+	return nil
+}
+
+func (b *LinuxGatewayBackend) RemoveWireguardPeer(vlan int, peerIdentifier int) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	peerFile := b.getWireguardPeerFile(vlan, peerIdentifier)
+	peerPubKey, err := os.ReadFile(peerFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error removing wireguard peer: %v", err)
+	}
+
+	if _, err := runGatewayCommand(
+		"wg", "set", getWireguardInterfaceName(vlan), "peer", string(peerPubKey), "remove",
+	); err != nil {
+		return fmt.Errorf("error removing wireguard peer: %v", err)
+	}
+
+	return os.Remove(peerFile)
+}
+
+func (b *LinuxGatewayBackend) ListVlans() ([]int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	output, err := runGatewayCommand("ip", "-j", "link", "show", "type", "vlan")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list vlan interfaces: %v", err)
+	}
+
+	var links []ipLink
+	if err := json.Unmarshal([]byte(output), &links); err != nil {
+		return nil, fmt.Errorf("failed to parse vlan interfaces: %v", err)
+	}
+
+	vlans := []int{}
+	for _, link := range links {
+		if vlan, ok := parseVlanInterfaceName(link.Ifname); ok {
+			vlans = append(vlans, vlan)
+		}
+	}
+
+	return vlans, nil
+}
+
+// ListWireguardPeers lists the peer files, WireGuard peers have no name in the interfaces
+func (b *LinuxGatewayBackend) ListWireguardPeers() ([]GatewayPeer, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entries, err := os.ReadDir(b.wireguardKeysDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list wireguard peers: %v", err)
+	}
+
+	peers := []GatewayPeer{}
+	for _, entry := range entries {
+		if peer, ok := parseWireguardPeerName(strings.TrimSuffix(entry.Name(), ".pub")); ok {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers, nil
+}
+
+func (b *LinuxGatewayBackend) GetWireguardPublicKey(vlan int) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	output, err := runGatewayCommand("wg", "show", getWireguardInterfaceName(vlan), "public-key")
+	if err != nil {
+		return "", fmt.Errorf("failed to get wireguard public key of vlan %d: %v", vlan, err)
+	}
+
+	return strings.TrimSpace(output), nil
+}
+
+// getVlanItems returns the desired config of the VLAN, ordered so the items referenced by others are created first
+func (b *LinuxGatewayBackend) getVlanItems(config VlanNetworkConfig) []linuxGatewayItem {
+	vlan := config.Vlan
+	vlanName := getVlanInterfaceName(vlan)
+	vrfName := getVrfName(vlan)
+	wireguardName := getWireguardInterfaceName(vlan)
+	table := strconv.Itoa(LINUX_GATEWAY_VRF_TABLE_OFFSET + vlan)
+	port := strconv.Itoa(config.WireguardPort)
+
+	items := b.getNftBaseItems()
+
+	items = append(items,
+		b.linkItem(
+			vrfName,
+			map[string]string{"kind": "vrf", "table": table},
+			[][]string{
+				{"ip", "link", "add", vrfName, "type", "vrf", "table", table},
+				{"ip", "link", "set", vrfName, "up"},
+			},
+			nil,
+		),
+		b.linkItem(
+			vlanName,
+			map[string]string{"kind": "vlan", "vlan-id": strconv.Itoa(vlan), "link": b.trunkInterface, "master": vrfName},
+			[][]string{
+				{"ip", "link", "add", "link", b.trunkInterface, "name", vlanName, "type", "vlan", "id", strconv.Itoa(vlan)},
+				{"ip", "link", "set", vlanName, "master", vrfName, "up"},
+			},
+			nil,
+		),
+		b.wireguardItem(vlan, port, vrfName),
+		b.addressItem(vlanName, config.GatewayAddress),
+		b.addressItem(wireguardName, config.VpnGatewayAddress),
+		b.routeItem("-4", table, "default", map[string]string{"gateway": b.externalGateway, "dev": b.wanInterface}),
+		b.routeItem("-4", "main", config.Network, map[string]string{"dev": vlanName}),
+		b.nftRuleItem(
+			"input",
+			fmt.Sprintf("vlan%d-wireguard", vlan),
+			fmt.Sprintf(`iifname "%s" udp dport %s accept`, b.wanInterface, port),
+			true,
+		),
+		// Accepted traffic is inserted before the drop rules of every VLAN, so it's still
+		// accepted when it's added again after drifting
+		b.nftRuleItem(
+			"forward",
+			fmt.Sprintf("vlan%d-to-wan", vlan),
+			fmt.Sprintf(`iifname { "%s", "%s" } oifname "%s" accept`, vlanName, wireguardName, b.wanInterface),
+			true,
+		),
+		b.nftRuleItem(
+			"forward",
+			fmt.Sprintf("vlan%d-to-vlan%d", vlan, vlan),
+			fmt.Sprintf(
+				`iifname { "%s", "%s" } oifname { "%s", "%s" } accept`,
+				vlanName, wireguardName, vlanName, wireguardName,
+			),
+			true,
+		),
+		b.nftRuleItem(
+			"forward",
+			fmt.Sprintf("wan-to-vlan%d", vlan),
+			fmt.Sprintf(`iifname "%s" oifname { "%s", "%s" } accept`, b.wanInterface, vlanName, wireguardName),
+			true,
+		),
+		b.nftRuleItem(
+			"forward",
+			fmt.Sprintf("vlan%d-drop", vlan),
+			fmt.Sprintf(`oifname { "%s", "%s" } drop`, vlanName, wireguardName),
+			false,
+		),
+		b.nftRuleItem(
+			"postrouting",
+			fmt.Sprintf("vlan%d-masquerade", vlan),
+			fmt.Sprintf(`oifname "%s" ip saddr %s masquerade`, b.wanInterface, config.Network),
+			false,
+		),
+	)
+
+	// The forward rules match interfaces in an inet table, so they already cover IPv6
+	if config.isIpv6Enabled() {
+		items = append(items,
+			b.addressItem(vlanName, config.Ipv6GatewayAddress),
+			b.addressItem(wireguardName, config.Ipv6VpnGatewayAddress),
+			b.routeItem("-6", "main", config.Ipv6Network, map[string]string{"dev": vlanName}),
+		)
+
+		if b.externalIpv6Gateway != "" {
+			items = append(items, b.routeItem(
+				"-6",
+				table,
+				"default",
+				map[string]string{"gateway": b.externalIpv6Gateway, "dev": b.wanInterface},
+			))
+		}
+	}
+
+	return items
+}
+
+// getNftBaseItems returns the nftables table and chains shared by every VLAN
+func (b *LinuxGatewayBackend) getNftBaseItems() []linuxGatewayItem {
+	items := []linuxGatewayItem{{
+		resource: "nftables table",
+		key:      map[string]string{"name": LINUX_GATEWAY_NFT_TABLE},
+		shared:   true,
+		get: func() (map[string]string, bool, error) {
+			return getCommandExists("nft", "list", "table", "inet", LINUX_GATEWAY_NFT_TABLE)
+		},
+		add: func() error {
+			return runGatewayCommands([][]string{{"nft", "add", "table", "inet", LINUX_GATEWAY_NFT_TABLE}})
+		},
+	}}
+
+	chains := map[string]string{
+		"input":       "type filter hook input priority 0 ; policy accept ;",
+		"forward":     "type filter hook forward priority 0 ; policy accept ;",
+		"prerouting":  "type nat hook prerouting priority -100 ;",
+		"postrouting": "type nat hook postrouting priority 100 ;",
+	}
+	for _, chain := range []string{"input", "forward", "prerouting", "postrouting"} {
+		definition := chains[chain]
+		items = append(items, linuxGatewayItem{
+			resource: "nftables chain",
+			key:      map[string]string{"table": LINUX_GATEWAY_NFT_TABLE, "name": chain},
+			shared:   true,
+			get: func() (map[string]string, bool, error) {
+				return getCommandExists("nft", "list", "chain", "inet", LINUX_GATEWAY_NFT_TABLE, chain)
+			},
+			add: func() error {
+				return runGatewayCommands([][]string{
+					{"nft", "add", "chain", "inet", LINUX_GATEWAY_NFT_TABLE, chain, "{ " + definition + " }"},
+				})
+			},
+		})
+	}
+
+	return items
+}
+
+func (b *LinuxGatewayBackend) linkItem(
+	name string,
+	properties map[string]string,
+	addCommands [][]string,
+	setCommands [][]string,
+) linuxGatewayItem {
+	item := linuxGatewayItem{
+		resource:   "link",
+		key:        map[string]string{"name": name},
+		properties: properties,
+		get: func() (map[string]string, bool, error) {
+			return getLink(name)
+		},
+		add: func() error {
+			return runGatewayCommands(addCommands)
+		},
+		remove: func() error {
+			return runGatewayCommands([][]string{{"ip", "link", "del", name}})
+		},
+	}
+
+	if setCommands != nil {
+		item.set = func() error {
+			return runGatewayCommands(setCommands)
+		}
+	}
+
+	return item
+}
+
+func (b *LinuxGatewayBackend) wireguardItem(vlan int, port string, vrfName string) linuxGatewayItem {
+	name := getWireguardInterfaceName(vlan)
+	mtu := strconv.Itoa(LINUX_GATEWAY_WIREGUARD_MTU)
+	keyFile := b.getWireguardKeyFile(vlan)
+
+	configureCommands := [][]string{
+		{"ip", "link", "set", name, "mtu", mtu},
+		{"wg", "set", name, "listen-port", port, "private-key", keyFile},
+		{"ip", "link", "set", name, "master", vrfName, "up"},
+	}
+
+	item := b.linkItem(
+		name,
+		map[string]string{"kind": "wireguard", "mtu": mtu, "master": vrfName, "listen-port": port},
+		append([][]string{{"ip", "link", "add", name, "type", "wireguard"}}, configureCommands...),
+		configureCommands,
+	)
+
+	item.get = func() (map[string]string, bool, error) {
+		properties, found, err := getLink(name)
+		if err != nil || !found {
+			return properties, found, err
+		}
+
+		listenPort, err := runGatewayCommand("wg", "show", name, "listen-port")
+		if err != nil {
+			return nil, false, err
+		}
+		properties["listen-port"] = strings.TrimSpace(listenPort)
+
+		return properties, true, nil
+	}
+
+	add := item.add
+	item.add = func() error {
+		if err := b.ensureWireguardKey(keyFile); err != nil {
+			return err
+		}
+		return add()
+	}
+
+	return item
+}
+
+func (b *LinuxGatewayBackend) addressItem(iface string, address string) linuxGatewayItem {
+	return linuxGatewayItem{
+		resource: "address",
+		key:      map[string]string{"address": address, "interface": iface},
+		get: func() (map[string]string, bool, error) {
+			output, err := runGatewayCommand("ip", "-j", "address", "show", "dev", iface)
+			if err != nil {
+				if isNotFoundOutput(err) {
+					return nil, false, nil
+				}
+				return nil, false, err
+			}
+
+			var addresses []ipAddress
+			if err := json.Unmarshal([]byte(output), &addresses); err != nil {
+				return nil, false, fmt.Errorf("failed to parse addresses of %s: %v", iface, err)
+			}
+
+			for _, ifaceAddresses := range addresses {
+				for _, info := range ifaceAddresses.AddrInfo {
+					if fmt.Sprintf("%s/%d", info.Local, info.Prefixlen) == address {
+						return map[string]string{}, true, nil
+					}
+				}
+			}
+
+			return nil, false, nil
+		},
+		add: func() error {
+			return runGatewayCommands([][]string{{"ip", "address", "add", address, "dev", iface}})
+		},
+		remove: func() error {
+			return runGatewayCommands([][]string{{"ip", "address", "del", address, "dev", iface}})
+		},
+	}
+}
+
+// routeItem is a route of the given family (-4 or -6) identified by its destination and table
+func (b *LinuxGatewayBackend) routeItem(family string, table string, dst string, properties map[string]string) linuxGatewayItem {
+	routeArgs := []string{dst}
+	if gateway, ok := properties["gateway"]; ok {
+		routeArgs = append(routeArgs, "via", gateway)
+	}
+	routeArgs = append(routeArgs, "dev", properties["dev"], "table", table)
+
+	return linuxGatewayItem{
+		resource:   "route",
+		key:        map[string]string{"family": family, "dst": dst, "table": table},
+		properties: properties,
+		get: func() (map[string]string, bool, error) {
+			output, err := runGatewayCommand("ip", "-j", family, "route", "show", "table", table)
+			if err != nil {
+				if isNotFoundOutput(err) {
+					return nil, false, nil
+				}
+				return nil, false, err
+			}
+
+			var routes []ipRoute
+			if err := json.Unmarshal([]byte(output), &routes); err != nil {
+				return nil, false, fmt.Errorf("failed to parse routes of table %s: %v", table, err)
+			}
+
+			for _, route := range routes {
+				if route.Dst == dst {
+					return map[string]string{"gateway": route.Gateway, "dev": route.Dev}, true, nil
+				}
+			}
+
+			return nil, false, nil
+		},
+		add: func() error {
+			return runGatewayCommands([][]string{append([]string{"ip", family, "route", "add"}, routeArgs...)})
+		},
+		set: func() error {
+			return runGatewayCommands([][]string{append([]string{"ip", family, "route", "replace"}, routeArgs...)})
+		},
+		remove: func() error {
+			return runGatewayCommands([][]string{{"ip", family, "route", "del", dst, "table", table}})
+		},
+	}
+}
+
+// nftRuleItem is a rule identified by its comment. Rules inserted go to the top of the chain, the rest to the bottom
+func (b *LinuxGatewayBackend) nftRuleItem(chain string, comment string, rule string, insert bool) linuxGatewayItem {
+	command := "add"
+	if insert {
+		command = "insert"
+	}
+
+	findHandle := func() (string, bool, error) {
+		handles, err := findNftRuleHandles(chain, comment)
+		if err != nil || len(handles) == 0 {
+			return "", false, err
+		}
+		return handles[0], true, nil
+	}
+
+	return linuxGatewayItem{
+		resource: "nftables rule",
+		key:      map[string]string{"chain": chain, "comment": comment},
+		get: func() (map[string]string, bool, error) {
+			_, found, err := findHandle()
+			return map[string]string{}, found, err
+		},
+		add: func() error {
+			return runGatewayCommands([][]string{{
+				"nft", command, "rule", "inet", LINUX_GATEWAY_NFT_TABLE, chain, rule, `comment "` + comment + `"`,
+			}})
+		},
+		remove: func() error {
+			handle, found, err := findHandle()
+			if err != nil || !found {
+				return err
+			}
+			return runGatewayCommands([][]string{
+				{"nft", "delete", "rule", "inet", LINUX_GATEWAY_NFT_TABLE, chain, "handle", handle},
+			})
+		},
+	}
+}
+
+func (b *LinuxGatewayBackend) ApplyVmFirewall(config VmFirewallConfig) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	chain := getVmFirewallName(config.Vlan, config.VmVlanIdentifier)
+	if err := removeNftVmFirewall(chain); err != nil {
+		return err
+	}
+
+	if len(config.Rules) == 0 {
+		return nil
+	}
+
+	// The rules of the VM live in their own chain, so they are evaluated in order wherever the jumps are
+	commands := [][]string{{"nft", "add", "chain", "inet", LINUX_GATEWAY_NFT_TABLE, chain}}
+	for _, address := range config.Addresses {
+		ip, err := netip.ParseAddr(address)
+		if err != nil {
+			continue
+		}
+
+		for _, rule := range config.Rules {
+			if rule.appliesToAddress(ip) {
+				commands = append(commands, []string{
+					"nft", "add", "rule", "inet", LINUX_GATEWAY_NFT_TABLE, chain, b.getNftFirewallRule(ip, rule),
+				})
+			}
+		}
+	}
+
+	// The jumps are inserted at the top of the forward chain, before the accepts of the VLANs
+	for _, address := range config.Addresses {
+		family := "ip"
+		if ip, err := netip.ParseAddr(address); err == nil && ip.Is6() {
+			family = "ip6"
+		}
+
+		for _, match := range []string{
+			fmt.Sprintf(`%s saddr %s oifname "%s"`, family, address, b.wanInterface),
+			fmt.Sprintf(`%s daddr %s iifname "%s"`, family, address, b.wanInterface),
+		} {
+			commands = append(commands, []string{
+				"nft", "insert", "rule", "inet", LINUX_GATEWAY_NFT_TABLE, "forward",
+				match + " jump " + chain, `comment "` + chain + `"`,
+			})
+		}
+	}
+
+	if err := runGatewayCommands(commands); err != nil {
+		return fmt.Errorf("error applying firewall of %s: %v", chain, err)
+	}
+
+	return nil
+}
+
+func (b *LinuxGatewayBackend) RemoveVmFirewall(vlan int, vmVlanIdentifier int) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return removeNftVmFirewall(getVmFirewallName(vlan, vmVlanIdentifier))
+}
+
+// getNftFirewallRule returns the rule of the VM firewall chain. It only matches new connections,
+// so the replies of connections already accepted aren't dropped
+func (b *LinuxGatewayBackend) getNftFirewallRule(ip netip.Addr, rule FirewallRule) string {
+	family, icmpProtocol := "ip", "icmp"
+	if ip.Is6() {
+		family, icmpProtocol = "ip6", "icmpv6"
+	}
+
+	matches := []string{}
+	if rule.Direction == FIREWALL_DIRECTION_EGRESS {
+		matches = append(matches, fmt.Sprintf(`%s saddr %s oifname "%s"`, family, ip, b.wanInterface))
+		if rule.Remote != "" {
+			matches = append(matches, fmt.Sprintf("%s daddr %s", family, rule.Remote))
+		}
+	} else {
+		matches = append(matches, fmt.Sprintf(`%s daddr %s iifname "%s"`, family, ip, b.wanInterface))
+		if rule.Remote != "" {
+			matches = append(matches, fmt.Sprintf("%s saddr %s", family, rule.Remote))
+		}
+	}
+
+	switch {
+	case rule.Ports != "":
+		matches = append(matches, fmt.Sprintf("%s dport { %s }", rule.Protocol, strings.ReplaceAll(rule.Ports, ",", ", ")))
+	case rule.Protocol == FIREWALL_PROTOCOL_ICMP:
+		matches = append(matches, "meta l4proto "+icmpProtocol)
+	case rule.Protocol != "":
+		matches = append(matches, "meta l4proto "+rule.Protocol)
+	}
+
+	return strings.Join(append(matches, "ct state new", rule.Action), " ")
+}
+
+// removeNftVmFirewall removes the jumps to the firewall chain of the VM and the chain. Must be called with the mutex locked
+func removeNftVmFirewall(chain string) error {
+	handles, err := findNftRuleHandles("forward", chain)
+	if err != nil {
+		return err
+	}
+
+	commands := [][]string{}
+	for _, handle := range handles {
+		commands = append(commands, []string{"nft", "delete", "rule", "inet", LINUX_GATEWAY_NFT_TABLE, "forward", "handle", handle})
+	}
+	if err := runGatewayCommands(commands); err != nil {
+		return fmt.Errorf("error removing firewall of %s: %v", chain, err)
+	}
+
+	_, found, err := getCommandExists("nft", "list", "chain", "inet", LINUX_GATEWAY_NFT_TABLE, chain)
+	if err != nil || !found {
+		return err
+	}
+
+	if err := runGatewayCommands([][]string{
+		{"nft", "flush", "chain", "inet", LINUX_GATEWAY_NFT_TABLE, chain},
+		{"nft", "delete", "chain", "inet", LINUX_GATEWAY_NFT_TABLE, chain},
+	}); err != nil {
+		return fmt.Errorf("error removing firewall of %s: %v", chain, err)
+	}
+
+	return nil
+}
+
+func (b *LinuxGatewayBackend) AddPortForward(config PortForwardConfig) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// The prerouting chain is missing in gateways whose VLANs were configured before port forwards
+	for _, item := range b.getNftBaseItems() {
+		_, found, err := item.get()
+		if err != nil {
+			return err
+		}
+		if !found {
+			if err := item.add(); err != nil {
+				return err
+			}
+		}
+	}
+
+	comment := getPortForwardName(config.Protocol, config.ExternalPort)
+	if err := removeNftPortForward(comment); err != nil {
+		return err
+	}
+
+	// The route to the VLAN network in the main table takes the forwarded traffic into the VRF
+	if err := runGatewayCommands([][]string{{
+		"nft", "add", "rule", "inet", LINUX_GATEWAY_NFT_TABLE, "prerouting",
+		fmt.Sprintf(
+			`iifname "%s" %s dport %d dnat ip to %s:%d`,
+			b.wanInterface, config.Protocol, config.ExternalPort, config.Address, config.InternalPort,
+		),
+		`comment "` + comment + `"`,
+	}}); err != nil {
+		return fmt.Errorf("error adding port forward %s: %v", comment, err)
+	}
+
+	return nil
+}
+
+func (b *LinuxGatewayBackend) RemovePortForward(protocol string, externalPort int) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return removeNftPortForward(getPortForwardName(protocol, externalPort))
+}
+
+// removeNftPortForward removes the dnat rules with the comment of the forward. Must be called with the mutex locked
+func removeNftPortForward(comment string) error {
+	handles, err := findNftRuleHandles("prerouting", comment)
+	if err != nil {
+		return err
+	}
+
+	for _, handle := range handles {
+		if err := runGatewayCommands([][]string{
+			{"nft", "delete", "rule", "inet", LINUX_GATEWAY_NFT_TABLE, "prerouting", "handle", handle},
+		}); err != nil {
+			return fmt.Errorf("error removing port forward %s: %v", comment, err)
+		}
+	}
+
+	return nil
+}
+
+// findNftRuleHandles returns the handles of the rules of the chain with the comment, none if the chain doesn't exist
+func findNftRuleHandles(chain string, comment string) ([]string, error) {
+	output, err := runGatewayCommand("nft", "-a", "list", "chain", "inet", LINUX_GATEWAY_NFT_TABLE, chain)
+	if err != nil {
+		if isNotFoundOutput(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	handles := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.Contains(line, `comment "`+comment+`"`) {
+			continue
+		}
+
+		_, handle, found := strings.Cut(line, "# handle ")
+		if found {
+			handles = append(handles, strings.TrimSpace(handle))
+		}
+	}
+
+	return handles, nil
+}
+
+func (b *LinuxGatewayBackend) ensureWireguardKey(keyFile string) error {
+	if _, err := os.Stat(keyFile); err == nil {
+		return nil
+	}
+
+	privateKey, err := runGatewayCommand("wg", "genkey")
+	if err != nil {
+		return fmt.Errorf("failed to generate wireguard private key: %v", err)
+	}
+
+	if err := os.WriteFile(keyFile, []byte(privateKey), 0600); err != nil {
+		return fmt.Errorf("failed to save wireguard private key: %v", err)
+	}
+
+	return nil
+}
+
+func (b *LinuxGatewayBackend) getWireguardKeyFile(vlan int) string {
+	return filepath.Join(b.wireguardKeysDir, getWireguardInterfaceName(vlan)+".key")
+}
+
+// getVmPeerAllowedIps returns the allowed IPs of the peer of a VM in the format of wg
+func getVmPeerAllowedIps(vmNetworkConfig VmNetworkConfig) string {
+	allowedIps := []string{
+		vmNetworkConfig.Network,
+		vmNetworkConfig.InterfaceAddress,
+	}
+	if vmNetworkConfig.Ipv6InterfaceAddress != "" {
+		allowedIps = append(allowedIps, vmNetworkConfig.Ipv6InterfaceAddress)
+	}
+
+	return strings.Join(allowedIps, ",")
+}
+
+func (b *LinuxGatewayBackend) getWireguardPeerFile(vlan int, vmVlanIdentifier int) string {
+	return filepath.Join(b.wireguardKeysDir, getWireguardPeerName(vlan, vmVlanIdentifier)+".pub")
+}
+
+func getLinuxGatewayItemDrift(item linuxGatewayItem) (*NetworkDrift, error) {
+	actual, found, err := item.get()
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return &NetworkDrift{
+			Resource: item.resource,
+			Key:      item.key,
+			Kind:     NetworkItemMissing,
+			Expected: item.properties,
+		}, nil
+	}
+
+	expected := map[string]string{}
+	actualProperties := map[string]string{}
+	for property, value := range item.properties {
+		if actual[property] != value {
+			expected[property] = value
+			actualProperties[property] = actual[property]
+		}
+	}
+
+	if len(expected) == 0 {
+		return nil, nil
+	}
+
+	return &NetworkDrift{
+		Resource: item.resource,
+		Key:      item.key,
+		Kind:     NetworkItemChanged,
+		Expected: expected,
+		Actual:   actualProperties,
+	}, nil
+}
+
+func getLink(name string) (map[string]string, bool, error) {
+	output, err := runGatewayCommand("ip", "-j", "-d", "link", "show", "dev", name)
+	if err != nil {
+		if isNotFoundOutput(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	var links []ipLink
+	if err := json.Unmarshal([]byte(output), &links); err != nil {
+		return nil, false, fmt.Errorf("failed to parse link %s: %v", name, err)
+	}
+
+	if len(links) == 0 {
+		return nil, false, nil
+	}
+
+	link := links[0]
+	return map[string]string{
+		"kind":    link.Linkinfo.InfoKind,
+		"vlan-id": strconv.Itoa(link.Linkinfo.InfoData.Id),
+		"table":   strconv.Itoa(link.Linkinfo.InfoData.Table),
+		"link":    link.Link,
+		"master":  link.Master,
+		"mtu":     strconv.Itoa(link.Mtu),
+	}, true, nil
+}
+
+// getCommandExists runs a command listing an object, it doesn't exist when the command fails with not found
+func getCommandExists(name string, args ...string) (map[string]string, bool, error) {
+	if _, err := runGatewayCommand(name, args...); err != nil {
+		if isNotFoundOutput(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	return map[string]string{}, true, nil
+}
+
+func runGatewayCommands(commands [][]string) error {
+	for _, command := range commands {
+		if _, err := runGatewayCommand(command[0], command[1:]...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runGatewayCommand(name string, args ...string) (string, error) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+
+	return string(output), nil
+}
+
+// isNotFoundOutput tells whether a command failed because the object it refers to doesn't exist
+func isNotFoundOutput(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "does not exist") ||
+		strings.Contains(message, "No such file or directory") ||
+		strings.Contains(message, "Cannot find device")
+}
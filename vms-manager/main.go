@@ -3,7 +3,9 @@ package main
 import (
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -14,7 +16,10 @@ func main() {
 	}
 
 	databaseURL := os.Getenv("DATABASE_URL")
-	serverAgentsURLs := strings.Split(os.Getenv("SERVER_AGENTS_API_URLS"), ",")
+	serverAgentsAuthSecret := os.Getenv("SERVER_AGENTS_AUTH_SECRET")
+	serverAgentsTlsCertFile := os.Getenv("SERVER_AGENTS_TLS_CERT_FILE")
+	serverAgentsTlsKeyFile := os.Getenv("SERVER_AGENTS_TLS_KEY_FILE")
+	serverAgentsTlsCaFile := os.Getenv("SERVER_AGENTS_TLS_CA_FILE")
 	listBaseImagesEndpoint := os.Getenv("LIST_BASE_IMAGES_ENDPOINT")
 	defineTemplateEndpoint := os.Getenv("DEFINE_TEMPLATE_ENDPOINT")
 	deleteTemplateEndpoint := os.Getenv("DELETE_TEMPLATE_ENDPOINT")
@@ -24,17 +29,75 @@ func main() {
 	stopInstanceEndpoint := os.Getenv("STOP_INSTANCE_ENDPOINT")
 	restartInstanceEndpoint := os.Getenv("RESTART_INSTANCE_ENDPOINT")
 	listInstancesStatusEndpoint := os.Getenv("LIST_INSTANCES_STATUS_ENDPOINT")
-	getResourceStatusEndpoint := os.Getenv("GET_RESOURCE_STATUS_ENDPOINT")
-	serverAgentIsAliveEndpoint := os.Getenv("SERVER_AGENT_IS_ALIVE_ENDPOINT")
 	vmsDns1 := os.Getenv("VMS_DNS_1")
 	vmsDns2 := os.Getenv("VMS_DNS_2")
+	vmsIpv6Prefix := os.Getenv("VMS_IPV6_PREFIX")
 	routerosApiUrl := os.Getenv("ROUTEROS_API_URL")
 	routerosApiUsername := os.Getenv("ROUTEROS_API_USERNAME")
 	routerosApiPassword := os.Getenv("ROUTEROS_API_PASSWORD")
 	routerosVlanBridge := os.Getenv("ROUTEROS_VLAN_BRIDGE")
 	routerosTaggedBridges := strings.Split(os.Getenv("ROUTEROS_TAGGED_BRIDGES"), ",")
 	routerosExternalGateway := os.Getenv("ROUTEROS_EXTERNAL_GATEWAY")
+	routerosExternalIpv6Gateway := os.Getenv("ROUTEROS_EXTERNAL_IPV6_GATEWAY")
+	networkBackendName := os.Getenv("NETWORK_BACKEND")
+	linuxGatewayTrunkInterface := os.Getenv("LINUX_GATEWAY_TRUNK_INTERFACE")
+	linuxGatewayWanInterface := os.Getenv("LINUX_GATEWAY_WAN_INTERFACE")
+	linuxGatewayExternalGateway := os.Getenv("LINUX_GATEWAY_EXTERNAL_GATEWAY")
+	linuxGatewayExternalIpv6Gateway := os.Getenv("LINUX_GATEWAY_EXTERNAL_IPV6_GATEWAY")
+	linuxGatewayWireguardKeysDir := os.Getenv("LINUX_GATEWAY_WIREGUARD_KEYS_DIR")
 	listServersStatusEndpoint := os.Getenv("LIST_SERVERS_STATUS_ENDPOINT")
+	migrateInstanceEndpoint := os.Getenv("MIGRATE_INSTANCE_ENDPOINT")
+	setupInstanceNetworkEndpoint := os.Getenv("SETUP_INSTANCE_NETWORK_ENDPOINT")
+	createSnapshotEndpoint := os.Getenv("CREATE_SNAPSHOT_ENDPOINT")
+	listSnapshotsEndpoint := os.Getenv("LIST_SNAPSHOTS_ENDPOINT")
+	revertSnapshotEndpoint := os.Getenv("REVERT_SNAPSHOT_ENDPOINT")
+	deleteSnapshotEndpoint := os.Getenv("DELETE_SNAPSHOT_ENDPOINT")
+	getJobEndpoint := os.Getenv("GET_JOB_ENDPOINT")
+	createConsoleTicketEndpoint := os.Getenv("CREATE_CONSOLE_TICKET_ENDPOINT")
+	instanceConsoleEndpoint := os.Getenv("INSTANCE_CONSOLE_ENDPOINT")
+	registerServerAgentEndpoint := os.Getenv("REGISTER_SERVER_AGENT_ENDPOINT")
+	serverAgentHeartbeatEndpoint := os.Getenv("SERVER_AGENT_HEARTBEAT_ENDPOINT")
+	listServerAgentsEndpoint := os.Getenv("LIST_SERVER_AGENTS_ENDPOINT")
+	cordonServerAgentEndpoint := os.Getenv("CORDON_SERVER_AGENT_ENDPOINT")
+	drainServerAgentEndpoint := os.Getenv("DRAIN_SERVER_AGENT_ENDPOINT")
+	deregisterServerAgentEndpoint := os.Getenv("DEREGISTER_SERVER_AGENT_ENDPOINT")
+	getRouterDriftEndpoint := os.Getenv("GET_ROUTER_DRIFT_ENDPOINT")
+	reconcileRouterEndpoint := os.Getenv("RECONCILE_ROUTER_ENDPOINT")
+	createLabEndpoint := os.Getenv("CREATE_LAB_ENDPOINT")
+	startLabEndpoint := os.Getenv("START_LAB_ENDPOINT")
+	stopLabEndpoint := os.Getenv("STOP_LAB_ENDPOINT")
+	deleteLabEndpoint := os.Getenv("DELETE_LAB_ENDPOINT")
+	createFirewallPolicyEndpoint := os.Getenv("CREATE_FIREWALL_POLICY_ENDPOINT")
+	listFirewallPoliciesEndpoint := os.Getenv("LIST_FIREWALL_POLICIES_ENDPOINT")
+	getFirewallPolicyEndpoint := os.Getenv("GET_FIREWALL_POLICY_ENDPOINT")
+	updateFirewallPolicyEndpoint := os.Getenv("UPDATE_FIREWALL_POLICY_ENDPOINT")
+	deleteFirewallPolicyEndpoint := os.Getenv("DELETE_FIREWALL_POLICY_ENDPOINT")
+	createPortForwardEndpoint := os.Getenv("CREATE_PORT_FORWARD_ENDPOINT")
+	listPortForwardsEndpoint := os.Getenv("LIST_PORT_FORWARDS_ENDPOINT")
+	deletePortForwardEndpoint := os.Getenv("DELETE_PORT_FORWARD_ENDPOINT")
+	createWireguardPeerEndpoint := os.Getenv("CREATE_WIREGUARD_PEER_ENDPOINT")
+	listWireguardPeersEndpoint := os.Getenv("LIST_WIREGUARD_PEERS_ENDPOINT")
+	deleteWireguardPeerEndpoint := os.Getenv("DELETE_WIREGUARD_PEER_ENDPOINT")
+	rotateWireguardKeyEndpoint := os.Getenv("ROTATE_WIREGUARD_KEY_ENDPOINT")
+	listVmDisksEndpoint := os.Getenv("LIST_VM_DISKS_ENDPOINT")
+	getReconciliationReportEndpoint := os.Getenv("GET_RECONCILIATION_REPORT_ENDPOINT")
+	runReconciliationEndpoint := os.Getenv("RUN_RECONCILIATION_ENDPOINT")
+	listVmsEndpoint := os.Getenv("LIST_VMS_ENDPOINT")
+	domainEventsEndpoint := os.Getenv("DOMAIN_EVENTS_ENDPOINT")
+	instanceEventsEndpoint := os.Getenv("INSTANCE_EVENTS_ENDPOINT")
+	reconcilerIntervalMinutes := getEnvInt("RECONCILER_INTERVAL_MINUTES", DEFAULT_RECONCILER_INTERVAL_MINUTES)
+	reconcilerRepair := os.Getenv("RECONCILER_REPAIR") == "true"
+	cpuOvercommitRatio := getEnvFloat("SCHEDULER_CPU_OVERCOMMIT_RATIO", DEFAULT_CPU_OVERCOMMIT_RATIO)
+	ramOvercommitRatio := getEnvFloat("SCHEDULER_RAM_OVERCOMMIT_RATIO", DEFAULT_RAM_OVERCOMMIT_RATIO)
+	diskOvercommitRatio := getEnvFloat("SCHEDULER_DISK_OVERCOMMIT_RATIO", DEFAULT_DISK_OVERCOMMIT_RATIO)
+	maxSubjectInstancesPerAgent := getEnvInt("SCHEDULER_MAX_SUBJECT_INSTANCES_PER_SERVER_AGENT", 0)
+	ipamVlanRange := getEnvString("IPAM_VLAN_RANGE", DEFAULT_IPAM_VLAN_RANGE)
+	ipamVmsSupernets := getEnvString("IPAM_VMS_SUPERNETS", DEFAULT_IPAM_VMS_SUPERNETS)
+	ipamVpnSupernets := getEnvString("IPAM_VPN_SUPERNETS", DEFAULT_IPAM_VPN_SUPERNETS)
+	ipamDefaultPrefixLength := getEnvInt("IPAM_DEFAULT_PREFIX_LENGTH", DEFAULT_IPAM_PREFIX_LENGTH)
+	ipamIsolatedPrefixLength := getEnvInt("IPAM_ISOLATED_PREFIX_LENGTH", DEFAULT_IPAM_ISOLATED_PREFIX_LENGTH)
+	ipamLabVlanRange := getEnvString("IPAM_LAB_VLAN_RANGE", DEFAULT_IPAM_LAB_VLAN_RANGE)
+	ipamPortForwardRange := getEnvString("IPAM_PORT_FORWARD_RANGE", DEFAULT_IPAM_PORT_FORWARD_RANGE)
 
 	database, err := NewDatabase(databaseURL)
 	if err != nil {
@@ -42,15 +105,71 @@ func main() {
 	}
 	defer database.Close()
 
-	routerosService, err := NewRouterOSService(routerosApiUrl, routerosApiUsername, routerosApiPassword)
+	var networkBackend NetworkBackend
+	switch networkBackendName {
+	case LINUX_NETWORK_BACKEND:
+		networkBackend, err = NewLinuxGatewayBackend(
+			linuxGatewayTrunkInterface,
+			linuxGatewayWanInterface,
+			linuxGatewayExternalGateway,
+			linuxGatewayExternalIpv6Gateway,
+			linuxGatewayWireguardKeysDir,
+		)
+	case ROUTEROS_NETWORK_BACKEND, "":
+		networkBackend, err = NewRouterOSService(
+			routerosApiUrl,
+			routerosApiUsername,
+			routerosApiPassword,
+			routerosVlanBridge,
+			routerosTaggedBridges,
+			routerosExternalGateway,
+			routerosExternalIpv6Gateway,
+		)
+	default:
+		log.Fatalf("Invalid NETWORK_BACKEND %q, it must be %s or %s", networkBackendName, ROUTEROS_NETWORK_BACKEND, LINUX_NETWORK_BACKEND)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer networkBackend.Close()
+
+	agentClient, err := NewAgentClient(
+		serverAgentsAuthSecret,
+		serverAgentsTlsCertFile,
+		serverAgentsTlsKeyFile,
+		serverAgentsTlsCaFile,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scheduler := NewScheduler(
+		database,
+		cpuOvercommitRatio,
+		ramOvercommitRatio,
+		diskOvercommitRatio,
+		maxSubjectInstancesPerAgent,
+	)
+
+	ipam, err := NewIPAM(
+		database,
+		ipamVlanRange,
+		ipamVmsSupernets,
+		ipamVpnSupernets,
+		ipamDefaultPrefixLength,
+		ipamIsolatedPrefixLength,
+		ipamLabVlanRange,
+		ipamPortForwardRange,
+	)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer routerosService.Close()
 
 	service, err := NewService(
 		database,
-		serverAgentsURLs,
+		agentClient,
+		scheduler,
+		ipam,
 		listBaseImagesEndpoint,
 		defineTemplateEndpoint,
 		deleteTemplateEndpoint,
@@ -60,24 +179,37 @@ func main() {
 		stopInstanceEndpoint,
 		restartInstanceEndpoint,
 		listInstancesStatusEndpoint,
-		getResourceStatusEndpoint,
-		serverAgentIsAliveEndpoint,
+		migrateInstanceEndpoint,
+		setupInstanceNetworkEndpoint,
+		createSnapshotEndpoint,
+		listSnapshotsEndpoint,
+		revertSnapshotEndpoint,
+		deleteSnapshotEndpoint,
+		instanceConsoleEndpoint,
 		vmsDns1,
 		vmsDns2,
-		routerosService,
-		routerosVlanBridge,
-		routerosTaggedBridges,
-		routerosExternalGateway,
+		networkBackend,
+		vmsIpv6Prefix,
+		listVmDisksEndpoint,
+		time.Duration(reconcilerIntervalMinutes)*time.Minute,
+		reconcilerRepair,
 	)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	jobService, err := NewJobService(database)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	listenAddr := getListenAddr()
 
 	server := NewApiServer(
 		listenAddr,
 		service,
+		jobService,
+		agentClient,
 		listBaseImagesEndpoint,
 		defineTemplateEndpoint,
 		deleteTemplateEndpoint,
@@ -88,6 +220,43 @@ func main() {
 		restartInstanceEndpoint,
 		listInstancesStatusEndpoint,
 		listServersStatusEndpoint,
+		migrateInstanceEndpoint,
+		createSnapshotEndpoint,
+		listSnapshotsEndpoint,
+		revertSnapshotEndpoint,
+		deleteSnapshotEndpoint,
+		getJobEndpoint,
+		createConsoleTicketEndpoint,
+		instanceConsoleEndpoint,
+		registerServerAgentEndpoint,
+		serverAgentHeartbeatEndpoint,
+		listServerAgentsEndpoint,
+		cordonServerAgentEndpoint,
+		drainServerAgentEndpoint,
+		deregisterServerAgentEndpoint,
+		getRouterDriftEndpoint,
+		reconcileRouterEndpoint,
+		createLabEndpoint,
+		startLabEndpoint,
+		stopLabEndpoint,
+		deleteLabEndpoint,
+		createFirewallPolicyEndpoint,
+		listFirewallPoliciesEndpoint,
+		getFirewallPolicyEndpoint,
+		updateFirewallPolicyEndpoint,
+		deleteFirewallPolicyEndpoint,
+		createPortForwardEndpoint,
+		listPortForwardsEndpoint,
+		deletePortForwardEndpoint,
+		createWireguardPeerEndpoint,
+		listWireguardPeersEndpoint,
+		deleteWireguardPeerEndpoint,
+		rotateWireguardKeyEndpoint,
+		getReconciliationReportEndpoint,
+		runReconciliationEndpoint,
+		listVmsEndpoint,
+		domainEventsEndpoint,
+		instanceEventsEndpoint,
 	)
 	server.Run()
 }
@@ -104,3 +273,39 @@ func getListenAddr() string {
 
 	return listenAddr
 }
+
+func getEnvString(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return defaultValue
+}
+
+func getEnvFloat(name string, defaultValue float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed <= 0 {
+		log.Fatalf("Invalid %s %q, it must be a positive number", name, value)
+	}
+
+	return parsed
+}
+
+func getEnvInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		log.Fatalf("Invalid %s %q, it must be a non negative integer", name, value)
+	}
+
+	return parsed
+}
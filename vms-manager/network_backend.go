@@ -0,0 +1,143 @@
+package main
+
+import "fmt"
+
+const ROUTEROS_NETWORK_BACKEND = "routeros"
+const LINUX_NETWORK_BACKEND = "linux"
+
+// NetworkBackend configures the gateway of the subject VLANs: the VLAN interface and its VRF,
+// the WireGuard interface users connect through, the firewall and the routes to the external network
+type NetworkBackend interface {
+	Close()
+	// ApplyVlanConfig only applies what is missing or changed and returns it, items applied
+	// before a failure are kept so the next call continues from there
+	ApplyVlanConfig(config VlanNetworkConfig) ([]NetworkDrift, error)
+	GetVlanConfigDrift(config VlanNetworkConfig) ([]NetworkDrift, error)
+	// RemoveVlanConfig skips the items that are already missing, so it can be retried
+	RemoveVlanConfig(config VlanNetworkConfig) error
+	ApplyVmConfig(vmNetworkConfig VmNetworkConfig, vlan int, userPubKey string) error
+	RemoveVmConfig(vlan int, vlanIdentifier int) error
+	// RotateVmWireguardKey replaces the public key of the peer of the VM in a single change,
+	// the old key stops working when the new one starts. The peer is added if it's missing
+	RotateVmWireguardKey(vmNetworkConfig VmNetworkConfig, vlan int, userPubKey string) error
+	GetWireguardPublicKey(vlan int) (string, error)
+	// AddWireguardPeer adds an extra device of the owner of a VM to the WireGuard interface of the VLAN
+	AddWireguardPeer(config WireguardPeerConfig) error
+	// RemoveWireguardPeer skips the peer if it's already missing, so it can be retried
+	RemoveWireguardPeer(vlan int, peerIdentifier int) error
+	// ApplyVmFirewall replaces the firewall rules of the VM, no rules removes them. They are evaluated
+	// before the forward rules of the VLAN and only filter traffic between the VM and the external network
+	ApplyVmFirewall(config VmFirewallConfig) error
+	// RemoveVmFirewall skips the rules that are already missing, so it can be retried
+	RemoveVmFirewall(vlan int, vmVlanIdentifier int) error
+	// AddPortForward forwards the external port to the VM, replacing a forward of the same port left behind
+	AddPortForward(config PortForwardConfig) error
+	// RemovePortForward skips the forward if it's already missing, so it can be retried
+	RemovePortForward(protocol string, externalPort int) error
+	// ListVlans returns the subject VLANs that have an interface in the gateway
+	ListVlans() ([]int, error)
+	// ListWireguardPeers returns the peers of the VMs and of the extra devices in the gateway
+	ListWireguardPeers() ([]GatewayPeer, error)
+}
+
+// VlanNetworkConfig is the gateway of a subject VLAN, whatever backend configures it
+type VlanNetworkConfig struct {
+	Vlan          int
+	WireguardPort int
+	// Address of the gateway in the VLAN with its prefix length, e.g. 10.0.1.1/24
+	GatewayAddress string
+	// Address of the gateway in the WireGuard network with its prefix length, e.g. 10.1.1.1/24
+	VpnGatewayAddress string
+	// Network of the VLAN, e.g. 10.0.1.0/24
+	Network string
+	// IPv6 counterparts of the addresses above, empty when IPv6 is disabled
+	Ipv6GatewayAddress    string
+	Ipv6VpnGatewayAddress string
+	Ipv6Network           string
+}
+
+func (c VlanNetworkConfig) isIpv6Enabled() bool {
+	return c.Ipv6Network != ""
+}
+
+// VmFirewallConfig is the firewall of a VM, the rules of its policies in evaluation order
+type VmFirewallConfig struct {
+	Vlan             int
+	VmVlanIdentifier int
+	// Addresses of the VM in the VLAN without prefix length, e.g. 10.0.1.2 and its IPv6 counterpart.
+	// Rules with a remote network only apply to the address of the same family
+	Addresses []string
+	Rules     []FirewallRule
+}
+
+// WireguardPeerConfig is an extra device of the owner of a VM, it's named like the peer of a VM
+// since its identifier is allocated among the VM ones of the VLAN
+type WireguardPeerConfig struct {
+	Vlan           int
+	PeerIdentifier int
+	PublicKey      string
+	// Addresses of the device in the VPN network with their prefix length, e.g. 10.1.1.5/32
+	InterfaceAddresses []string
+}
+
+// GatewayPeer is a WireGuard peer found in the gateway, of a VM or of an extra device
+type GatewayPeer struct {
+	Vlan           int
+	PeerIdentifier int
+}
+
+// PortForwardConfig is an external port of the gateway forwarded to the IPv4 address of a VM,
+// IPv6 addresses are reachable without it
+type PortForwardConfig struct {
+	Protocol     string
+	ExternalPort int
+	Address      string
+	InternalPort int
+}
+
+func getVlanInterfaceName(vlan int) string {
+	return fmt.Sprintf("vlan%d", vlan)
+}
+
+// parseVlanInterfaceName returns the VLAN of the interface, false if it's not a VLAN interface of a subject
+func parseVlanInterfaceName(name string) (int, bool) {
+	var vlan int
+	if _, err := fmt.Sscanf(name, "vlan%d", &vlan); err != nil || getVlanInterfaceName(vlan) != name {
+		return 0, false
+	}
+
+	return vlan, true
+}
+
+func getVrfName(vlan int) string {
+	return fmt.Sprintf("vrf%d", vlan)
+}
+
+func getWireguardInterfaceName(vlan int) string {
+	return fmt.Sprintf("wireguard%d", vlan)
+}
+
+func getWireguardPeerName(vlan int, vmVlanIdentifier int) string {
+	return fmt.Sprintf("peer%d-%d", vlan, vmVlanIdentifier)
+}
+
+// parseWireguardPeerName returns the peer of the name, false if it's not named like the peers of the VMs
+func parseWireguardPeerName(name string) (GatewayPeer, bool) {
+	var peer GatewayPeer
+	if _, err := fmt.Sscanf(name, "peer%d-%d", &peer.Vlan, &peer.PeerIdentifier); err != nil ||
+		getWireguardPeerName(peer.Vlan, peer.PeerIdentifier) != name {
+		return GatewayPeer{}, false
+	}
+
+	return peer, true
+}
+
+// getVmFirewallName identifies the firewall rules of the VM in the gateway
+func getVmFirewallName(vlan int, vmVlanIdentifier int) string {
+	return fmt.Sprintf("firewall%d-%d", vlan, vmVlanIdentifier)
+}
+
+// getPortForwardName identifies the forward of the external port in the gateway
+func getPortForwardName(protocol string, externalPort int) string {
+	return fmt.Sprintf("forward-%s-%d", protocol, externalPort)
+}
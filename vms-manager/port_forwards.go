@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const PORT_FORWARDS_EXPIRATION_INTERVAL = 1 * time.Minute
+
+func (s *ServiceImpl) CreatePortForward(request CreatePortForwardRequest) (CreatePortForwardResponse, error) {
+	if request.InstanceId == "" ||
+		(request.Protocol != FIREWALL_PROTOCOL_TCP && request.Protocol != FIREWALL_PROTOCOL_UDP) ||
+		request.InternalPort <= 0 ||
+		request.InternalPort > 65535 {
+		return CreatePortForwardResponse{}, NewHttpError(
+			http.StatusBadRequest,
+			fmt.Errorf("invalid request: instanceId must be non-empty, protocol tcp or udp and internalPort a valid port"),
+		)
+	}
+
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+		return CreatePortForwardResponse{}, NewHttpError(
+			http.StatusBadRequest,
+			fmt.Errorf("invalid request: expiresAt must be in the future"),
+		)
+	}
+
+	if err := s.checkIfVmExists(request.InstanceId); err != nil {
+		return CreatePortForwardResponse{}, err
+	}
+
+	if err := s.checkIfVmIsTemplateOrBase(request.InstanceId); err != nil {
+		return CreatePortForwardResponse{}, err
+	}
+
+	vlan, err := s.db.GetVlanByVmId(request.InstanceId)
+	if err != nil {
+		return CreatePortForwardResponse{}, err
+	}
+
+	vmVlanIdentifier, err := s.db.GetVmVlanIdentifierByVmId(request.InstanceId)
+	if err != nil {
+		return CreatePortForwardResponse{}, err
+	}
+
+	addresses, err := s.getInstanceAddresses(vlan, vmVlanIdentifier)
+	if err != nil {
+		return CreatePortForwardResponse{}, err
+	}
+
+	forward := DatabasePortForward{
+		ID:           uuid.New().String(),
+		InstanceId:   request.InstanceId,
+		Protocol:     request.Protocol,
+		InternalPort: request.InternalPort,
+		ExpiresAt:    request.ExpiresAt,
+	}
+
+	forward.ExternalPort, err = s.ipam.AllocatePortForward(forward)
+	if err != nil {
+		return CreatePortForwardResponse{}, err
+	}
+
+	if err := s.networkBackend.AddPortForward(PortForwardConfig{
+		Protocol:     forward.Protocol,
+		ExternalPort: forward.ExternalPort,
+		Address:      addresses[0],
+		InternalPort: forward.InternalPort,
+	}); err != nil {
+		s.deletePortForwardFromDb(forward.ID)
+		return CreatePortForwardResponse{}, err
+	}
+
+	log.Printf(
+		"Port %s/%d forwarded to port %d of instance %s",
+		forward.Protocol,
+		forward.ExternalPort,
+		forward.InternalPort,
+		forward.InstanceId,
+	)
+
+	return CreatePortForwardResponse{
+		PortForwardId: forward.ID,
+		ExternalPort:  forward.ExternalPort,
+	}, nil
+}
+
+func (s *ServiceImpl) ListPortForwards(instanceId string) ([]PortForwardResponse, error) {
+	if err := s.checkIfVmExists(instanceId); err != nil {
+		return nil, err
+	}
+
+	forwards, err := s.db.GetPortForwardsByVmId(instanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	response := []PortForwardResponse{}
+	for _, forward := range forwards {
+		response = append(response, PortForwardResponse{
+			Id:           forward.ID,
+			InstanceId:   forward.InstanceId,
+			Protocol:     forward.Protocol,
+			ExternalPort: forward.ExternalPort,
+			InternalPort: forward.InternalPort,
+			ExpiresAt:    forward.ExpiresAt,
+			CreatedAt:    forward.CreatedAt,
+		})
+	}
+
+	return response, nil
+}
+
+func (s *ServiceImpl) DeletePortForward(portForwardId string) error {
+	forward, exists, err := s.db.GetPortForward(portForwardId)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return NewHttpError(http.StatusNotFound, fmt.Errorf("port forward '%s' not found", portForwardId))
+	}
+
+	return s.deletePortForward(forward)
+}
+
+// deletePortForward removes the forward from the gateway before releasing its external port,
+// so the port is never allocated again while it's still forwarded
+func (s *ServiceImpl) deletePortForward(forward DatabasePortForward) error {
+	if err := s.networkBackend.RemovePortForward(forward.Protocol, forward.ExternalPort); err != nil {
+		return err
+	}
+
+	if err := s.db.DeletePortForward(forward.ID); err != nil {
+		return err
+	}
+
+	log.Printf("Port forward %s/%d of instance %s deleted", forward.Protocol, forward.ExternalPort, forward.InstanceId)
+
+	return nil
+}
+
+// deleteInstancePortForwards removes the forwards of the instance from the gateway,
+// they are deleted from the database with the instance
+func (s *ServiceImpl) deleteInstancePortForwards(instanceId string) error {
+	forwards, err := s.db.GetPortForwardsByVmId(instanceId)
+	if err != nil {
+		return err
+	}
+
+	for _, forward := range forwards {
+		if err := s.deletePortForward(forward); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *ServiceImpl) deletePortForwardFromDb(portForwardId string) {
+	if err := s.db.DeletePortForward(portForwardId); err != nil {
+		log.Printf("Error deleting port forward %s: %v", portForwardId, err)
+	}
+}
+
+// expirePortForwards deletes the port forwards once they expire
+func (s *ServiceImpl) expirePortForwards() {
+	for {
+		time.Sleep(PORT_FORWARDS_EXPIRATION_INTERVAL)
+
+		forwards, err := s.db.GetExpiredPortForwards()
+		if err != nil {
+			continue
+		}
+
+		for _, forward := range forwards {
+			if err := s.deletePortForward(forward); err != nil {
+				log.Printf("Error deleting expired port forward %s: %v", forward.ID, err)
+			}
+		}
+	}
+}
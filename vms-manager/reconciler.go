@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+const DEFAULT_RECONCILER_INTERVAL_MINUTES = 10
+
+const (
+	// Domain or disk in a server agent without a VM in the database
+	ORPHAN_AGENT_VM = "agent_vm"
+	// VM in the database whose disk is in no server agent
+	ORPHAN_VM_ROW = "vm_row"
+	// WireGuard peer in the gateway without an instance or an extra device
+	ORPHAN_PEER = "peer"
+	// VLAN in the gateway without a subject
+	ORPHAN_VLAN = "vlan"
+	// Subject in the database without VMs
+	ORPHAN_SUBJECT = "subject"
+)
+
+// reconciliationFinding is an orphan and how to repair it, nil when it's only reported
+type reconciliationFinding struct {
+	orphan ReconciliationOrphan
+	repair func() error
+}
+
+// GetReconciliationReport returns the report of the last reconciliation, empty if none ran yet
+func (s *ServiceImpl) GetReconciliationReport() (ReconciliationReport, error) {
+	s.reconcilerMutex.Lock()
+	defer s.reconcilerMutex.Unlock()
+
+	if s.lastReconciliationReport == nil {
+		return ReconciliationReport{
+			RepairEnabled: s.reconcilerRepair,
+			Orphans:       []ReconciliationOrphan{},
+			Warnings:      []string{},
+		}, nil
+	}
+
+	return *s.lastReconciliationReport, nil
+}
+
+// RunReconciliation compares the database, the server agents and the gateway now
+func (s *ServiceImpl) RunReconciliation() (ReconciliationReport, error) {
+	return s.reconcile(), nil
+}
+
+func (s *ServiceImpl) runReconciler() {
+	for {
+		time.Sleep(s.reconcilerInterval)
+
+		report := s.reconcile()
+		if len(report.Orphans) > 0 {
+			log.Printf("Reconciliation found %d orphans", len(report.Orphans))
+		}
+	}
+}
+
+// reconcile reports the orphans and, when repairing is enabled, repairs the ones that were also found by
+// the previous run. VMs being created or deleted look like orphans for a while, so nothing is repaired
+// while jobs are running either
+func (s *ServiceImpl) reconcile() ReconciliationReport {
+	s.reconcilerMutex.Lock()
+	defer s.reconcilerMutex.Unlock()
+
+	report := ReconciliationReport{
+		StartedAt:     time.Now(),
+		RepairEnabled: s.reconcilerRepair,
+		Orphans:       []ReconciliationOrphan{},
+		Warnings:      []string{},
+	}
+
+	var findings []reconciliationFinding
+	for _, find := range []func() ([]reconciliationFinding, []string, error){
+		s.findVmOrphans,
+		s.findPeerOrphans,
+		s.findVlanOrphans,
+		s.findSubjectOrphans,
+	} {
+		found, warnings, err := find()
+		if err != nil {
+			log.Printf("Error reconciling: %v", err)
+			report.Warnings = append(report.Warnings, err.Error())
+			continue
+		}
+		findings = append(findings, found...)
+		report.Warnings = append(report.Warnings, warnings...)
+	}
+
+	repair := s.reconcilerRepair
+	if repair {
+		unfinishedJobs, err := s.db.CountUnfinishedJobs()
+		if err != nil || unfinishedJobs > 0 {
+			repair = false
+			report.Warnings = append(report.Warnings, "repairs postponed until the running jobs finish")
+		}
+	}
+
+	foundOrphans := map[string]bool{}
+	for _, finding := range findings {
+		key := getOrphanKey(finding.orphan)
+		foundOrphans[key] = true
+
+		if repair && finding.repair != nil && s.previousOrphans[key] {
+			if err := finding.repair(); err != nil {
+				log.Printf("Error repairing %s orphan %s: %v", finding.orphan.Kind, finding.orphan.Id, err)
+				finding.orphan.RepairError = err.Error()
+			} else {
+				log.Printf("Repaired %s orphan %s", finding.orphan.Kind, finding.orphan.Id)
+				finding.orphan.Repaired = true
+			}
+		}
+
+		report.Orphans = append(report.Orphans, finding.orphan)
+	}
+
+	s.previousOrphans = foundOrphans
+	report.FinishedAt = time.Now()
+	s.lastReconciliationReport = &report
+
+	return report
+}
+
+// findVmOrphans compares the VMs in the database with the domains and disks of the server agents.
+// VMs are only reported as missing when every server agent answered, a lost one may hold them
+func (s *ServiceImpl) findVmOrphans() ([]reconciliationFinding, []string, error) {
+	vms, err := s.db.GetAllVms()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	agents, err := s.db.GetServerAgents()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vmsById := map[string]DatabaseVM{}
+	for _, vm := range vms {
+		vmsById[vm.ID] = vm
+	}
+
+	var findings []reconciliationFinding
+	var warnings []string
+	vmsInAgents := map[string]bool{}
+	allAgentsChecked := true
+	for _, agent := range agents {
+		if !isServerAgentAlive(agent) {
+			allAgentsChecked = false
+			warnings = append(warnings, fmt.Sprintf("server agent '%s' is lost, its VMs were not checked", agent.Url))
+			continue
+		}
+
+		statuses, err := s.listInstancesStatusInServerAgent(agent.Url)
+		var disks []ListVmDisksResponse
+		if err == nil {
+			disks, err = s.listVmDisksInServerAgent(agent.Url)
+		}
+		if err != nil {
+			allAgentsChecked = false
+			warnings = append(warnings, fmt.Sprintf("server agent '%s' could not be checked: %v", agent.Url, err))
+			continue
+		}
+
+		domainStatuses := map[string]string{}
+		for _, status := range statuses {
+			domainStatuses[status.InstanceId] = status.Status
+			vmsInAgents[status.InstanceId] = true
+		}
+		for _, disk := range disks {
+			vmsInAgents[disk.VmId] = true
+			if _, ok := domainStatuses[disk.VmId]; !ok {
+				domainStatuses[disk.VmId] = ""
+			}
+		}
+
+		for vmId, status := range domainStatuses {
+			if _, ok := vmsById[vmId]; ok {
+				continue
+			}
+			findings = append(findings, s.getAgentVmFinding(agent.Url, vmId, status))
+		}
+	}
+
+	if !allAgentsChecked {
+		return findings, warnings, nil
+	}
+
+	for _, vm := range vms {
+		if vmsInAgents[vm.ID] {
+			continue
+		}
+
+		finding := reconciliationFinding{
+			orphan: ReconciliationOrphan{
+				Kind:   ORPHAN_VM_ROW,
+				Id:     vm.ID,
+				Detail: "instance without disk in any server agent",
+			},
+		}
+		if vm.ServerAgentUrl != nil {
+			finding.orphan.ServerAgentUrl = *vm.ServerAgentUrl
+		}
+		if vm.IsTemplate {
+			// Instances created from the template can't start either, they have to be deleted by hand
+			finding.orphan.Detail = "template without disk in any server agent"
+		} else {
+			finding.repair = func() error { return s.purgeInstance(vm) }
+		}
+
+		findings = append(findings, finding)
+	}
+
+	return findings, warnings, nil
+}
+
+// getAgentVmFinding deletes the domain and the files of the VM, running domains are only reported
+func (s *ServiceImpl) getAgentVmFinding(agentUrl string, vmId string, status string) reconciliationFinding {
+	finding := reconciliationFinding{
+		orphan: ReconciliationOrphan{
+			Kind:           ORPHAN_AGENT_VM,
+			Id:             vmId,
+			ServerAgentUrl: agentUrl,
+			Detail:         "disk without VM in the database",
+		},
+	}
+
+	if status != "" {
+		finding.orphan.Detail = fmt.Sprintf("domain %s without VM in the database", status)
+	}
+
+	if status == RUNNING_STATUS {
+		finding.orphan.Detail += ", stop it to repair it"
+		return finding
+	}
+
+	finding.repair = func() error {
+		return s.deleteVmInServerAgent(agentUrl, DeleteVmAgentRequest{VmId: vmId})
+	}
+
+	return finding
+}
+
+func (s *ServiceImpl) findPeerOrphans() ([]reconciliationFinding, []string, error) {
+	allocatedPeers, err := s.db.GetAllocatedPeers()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gatewayPeers, err := s.networkBackend.ListWireguardPeers()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	isAllocated := map[GatewayPeer]bool{}
+	for _, peer := range allocatedPeers {
+		isAllocated[peer] = true
+	}
+
+	var findings []reconciliationFinding
+	for _, peer := range gatewayPeers {
+		if isAllocated[peer] {
+			continue
+		}
+
+		findings = append(findings, reconciliationFinding{
+			orphan: ReconciliationOrphan{
+				Kind:   ORPHAN_PEER,
+				Id:     getWireguardPeerName(peer.Vlan, peer.PeerIdentifier),
+				Detail: "wireguard peer without instance or device",
+			},
+			repair: func() error {
+				return s.networkBackend.RemoveWireguardPeer(peer.Vlan, peer.PeerIdentifier)
+			},
+		})
+	}
+
+	return findings, nil, nil
+}
+
+// findVlanOrphans only reports the VLANs, their config can't be built without the network of the subject
+func (s *ServiceImpl) findVlanOrphans() ([]reconciliationFinding, []string, error) {
+	subjectVlans, err := s.db.GetAllVlans()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gatewayVlans, err := s.networkBackend.ListVlans()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	isSubjectVlan := map[int]bool{}
+	for _, vlan := range subjectVlans {
+		isSubjectVlan[vlan] = true
+	}
+
+	var findings []reconciliationFinding
+	for _, vlan := range gatewayVlans {
+		if isSubjectVlan[vlan] {
+			continue
+		}
+
+		findings = append(findings, reconciliationFinding{
+			orphan: ReconciliationOrphan{
+				Kind:   ORPHAN_VLAN,
+				Id:     strconv.Itoa(vlan),
+				Detail: "vlan without subject, its config has to be removed by hand",
+			},
+		})
+	}
+
+	return findings, nil, nil
+}
+
+func (s *ServiceImpl) findSubjectOrphans() ([]reconciliationFinding, []string, error) {
+	subjects, err := s.db.GetSubjectsWithoutVms()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var findings []reconciliationFinding
+	for _, subject := range subjects {
+		findings = append(findings, reconciliationFinding{
+			orphan: ReconciliationOrphan{
+				Kind:   ORPHAN_SUBJECT,
+				Id:     subject.SubjectId,
+				Detail: fmt.Sprintf("subject of vlan %d without VMs", subject.Vlan),
+			},
+			repair: func() error {
+				if err := s.deleteVlanConfigWhenAvailable(subject.Vlan); err != nil {
+					return err
+				}
+				return s.db.DeleteSubject(subject.SubjectId)
+			},
+		})
+	}
+
+	return findings, nil, nil
+}
+
+// purgeInstance removes an instance whose disk is gone from the gateway and the database,
+// as deleting it would do without calling its server agent
+func (s *ServiceImpl) purgeInstance(vm DatabaseVM) error {
+	vmMutex := s.getVmMutex(vm.ID)
+	vmMutex.Lock()
+	defer vmMutex.Unlock()
+
+	vlan, err := s.db.GetVlanByVmId(vm.ID)
+	if err != nil {
+		return err
+	}
+
+	vmVlanIdentifier, err := s.db.GetVmVlanIdentifierByVmId(vm.ID)
+	if err != nil {
+		return err
+	}
+
+	isLastInstanceInSubject, err := s.db.VmIsLastInstanceInSubject(vm.ID)
+	if err != nil {
+		return err
+	}
+
+	errs := []error{
+		s.deleteInstancePortForwards(vm.ID),
+		s.removeInstanceWireguardPeers(vm.ID, vlan),
+		s.networkBackend.RemoveVmFirewall(vlan, vmVlanIdentifier),
+	}
+	// The peer is missing if the instance was never configured
+	if err := s.networkBackend.RemoveVmConfig(vlan, vmVlanIdentifier); err != nil {
+		log.Printf("Error removing network config of instance %s: %v", vm.ID, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	if err := s.db.DeleteVm(vm.ID); err != nil {
+		return err
+	}
+	s.deleteVmMutex(vm.ID)
+
+	if isLastInstanceInSubject && vm.SubjectId != nil {
+		if err := s.deleteVlanConfigWhenAvailable(vlan); err != nil {
+			return err
+		}
+		return s.db.DeleteSubject(*vm.SubjectId)
+	}
+
+	return nil
+}
+
+func (s *ServiceImpl) listVmDisksInServerAgent(agentUrl string) ([]ListVmDisksResponse, error) {
+	resp, err := s.agentClient.Get(agentUrl + s.listVmDisksEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkIfStatusCodeIsOk(resp); err != nil {
+		return nil, err
+	}
+
+	var disks []ListVmDisksResponse
+	if err := json.NewDecoder(resp.Body).Decode(&disks); err != nil {
+		return nil, logAndReturnError("Error decoding list VM disks response: ", err.Error())
+	}
+
+	return disks, nil
+}
+
+func getOrphanKey(orphan ReconciliationOrphan) string {
+	return orphan.Kind + "/" + orphan.ServerAgentUrl + "/" + orphan.Id
+}
@@ -0,0 +1,60 @@
+package main
+
+import "log"
+
+// GetRouterDrift compares the network backend with the desired config of every configured subject VLAN
+func (s *ServiceImpl) GetRouterDrift() ([]VlanDriftResponse, error) {
+	return s.checkConfiguredVlans(s.networkBackend.GetVlanConfigDrift)
+}
+
+// ReconcileRouter applies the missing or changed items of every configured subject VLAN,
+// the response lists the drift that was fixed
+func (s *ServiceImpl) ReconcileRouter() ([]VlanDriftResponse, error) {
+	return s.checkConfiguredVlans(s.networkBackend.ApplyVlanConfig)
+}
+
+// checkConfiguredVlans runs check for every VLAN configured in the network backend, VLANs that are not
+// configured yet are expected to be missing. A failing VLAN doesn't stop the others
+func (s *ServiceImpl) checkConfiguredVlans(check func(config VlanNetworkConfig) ([]NetworkDrift, error)) ([]VlanDriftResponse, error) {
+	s.routerVlanConfMutex.Lock()
+	defer s.routerVlanConfMutex.Unlock()
+
+	vlans, err := s.db.GetAllVlans()
+	if err != nil {
+		return nil, err
+	}
+
+	response := []VlanDriftResponse{}
+	for _, vlan := range vlans {
+		isConfigured, err := s.db.IsVlanConfigured(vlan)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isConfigured {
+			continue
+		}
+
+		config, err := s.getVlanNetworkConfig(vlan)
+		var drifts []NetworkDrift
+		if err == nil {
+			drifts, err = check(config)
+		}
+		vlanResponse := VlanDriftResponse{
+			Vlan:   vlan,
+			InSync: err == nil && len(drifts) == 0,
+			Drifts: drifts,
+		}
+		if vlanResponse.Drifts == nil {
+			vlanResponse.Drifts = []NetworkDrift{}
+		}
+		if err != nil {
+			log.Printf("Error checking vlan %d config in the network backend: %v", vlan, err)
+			vlanResponse.Error = err.Error()
+		}
+
+		response = append(response, vlanResponse)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-routeros/routeros/v3/proto"
+)
+
+// FakeRouterOS is an in-process server speaking the RouterOS API wire protocol, so the
+// RouterOS backend can be tested without a MikroTik router. It keeps the configuration in memory,
+// supports the print, add, set and remove commands of any menu and offers helpers
+// to check the resulting configuration
+type FakeRouterOS struct {
+	listener net.Listener
+	username string
+	password string
+	// Menu (e.g. /interface/vlan) to its items, every item has its .id property
+	menus    map[string][]map[string]string
+	lastId   int
+	commands []string
+	// Command (e.g. /ip/route/add) to the message of the error its next call will fail with
+	failures map[string]string
+	conns    map[net.Conn]struct{}
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+}
+
+// NewFakeRouterOS starts the fake listening on a random local port, clients must log in with the given credentials
+func NewFakeRouterOS(username string, password string) (*FakeRouterOS, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, logAndReturnError("Error starting fake RouterOS: ", err.Error())
+	}
+
+	fake := &FakeRouterOS{
+		listener: listener,
+		username: username,
+		password: password,
+		menus:    map[string][]map[string]string{},
+		failures: map[string]string{},
+		conns:    map[net.Conn]struct{}{},
+	}
+
+	fake.wg.Add(1)
+	go fake.serve()
+
+	return fake, nil
+}
+
+// Addr returns the address to dial, e.g. as ROUTEROS_API_URL
+func (f *FakeRouterOS) Addr() string {
+	return f.listener.Addr().String()
+}
+
+// Close stops the fake, clients still connected get their connection closed
+func (f *FakeRouterOS) Close() {
+	f.listener.Close()
+
+	f.mutex.Lock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.mutex.Unlock()
+
+	f.wg.Wait()
+}
+
+// Seed adds an item as if it was configured by hand, e.g. the WAN interface list. It returns its ID
+func (f *FakeRouterOS) Seed(menu string, properties map[string]string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.addItem(menu, properties)
+}
+
+// FailNext makes the next call of the command (e.g. /ip/route/add) fail with the message
+func (f *FakeRouterOS) FailNext(command string, message string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failures[command] = message
+}
+
+// Commands returns the commands received so far, without their arguments
+func (f *FakeRouterOS) Commands() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]string{}, f.commands...)
+}
+
+// Items returns a copy of the items of the menu matching every property of match
+func (f *FakeRouterOS) Items(menu string, match map[string]string) []map[string]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	items := []map[string]string{}
+	for _, item := range f.menus[menu] {
+		if itemMatches(item, match) {
+			items = append(items, maps.Clone(item))
+		}
+	}
+
+	return items
+}
+
+// ExpectItem returns an error unless exactly one item of the menu matches
+func (f *FakeRouterOS) ExpectItem(menu string, match map[string]string) error {
+	items := f.Items(menu, match)
+	if len(items) != 1 {
+		return fmt.Errorf("expected one %s matching %v, found %d: %v", menu, match, len(items), f.Items(menu, nil))
+	}
+
+	return nil
+}
+
+// ExpectNoItem returns an error if any item of the menu matches
+func (f *FakeRouterOS) ExpectNoItem(menu string, match map[string]string) error {
+	if items := f.Items(menu, match); len(items) > 0 {
+		return fmt.Errorf("expected no %s matching %v, found %v", menu, match, items)
+	}
+
+	return nil
+}
+
+// ExpectEmpty returns an error if any menu other than the given ones has items,
+// e.g. to check that everything added for a VLAN was removed
+func (f *FakeRouterOS) ExpectEmpty(except ...string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	leftovers := []string{}
+	for menu, items := range f.menus {
+		if len(items) > 0 && !slices.Contains(except, menu) {
+			leftovers = append(leftovers, fmt.Sprintf("%s: %v", menu, items))
+		}
+	}
+
+	if len(leftovers) > 0 {
+		sort.Strings(leftovers)
+		return fmt.Errorf("expected no configuration, found %s", strings.Join(leftovers, "; "))
+	}
+
+	return nil
+}
+
+func (f *FakeRouterOS) serve() {
+	defer f.wg.Done()
+
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		f.mutex.Lock()
+		f.conns[conn] = struct{}{}
+		f.mutex.Unlock()
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			f.handleConnection(conn)
+
+			f.mutex.Lock()
+			delete(f.conns, conn)
+			f.mutex.Unlock()
+		}()
+	}
+}
+
+func (f *FakeRouterOS) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := proto.NewWriter(conn)
+	loggedIn := false
+
+	for {
+		words, err := readRouterOSSentence(reader)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Fake RouterOS: error reading sentence: %v", err)
+			}
+			return
+		}
+
+		if len(words) == 0 {
+			continue
+		}
+
+		command := words[0]
+		tag, attributes, queries := parseRouterOSWords(words[1:])
+
+		var replies [][]string
+		if command == "/login" {
+			if attributes["name"] == f.username && attributes["password"] == f.password {
+				loggedIn = true
+				replies = [][]string{{"!done"}}
+			} else {
+				replies = trapReply("invalid user name or password (6)")
+			}
+		} else if !loggedIn {
+			replies = trapReply("not logged in")
+		} else {
+			replies = f.run(command, attributes, queries)
+		}
+
+		for _, reply := range replies {
+			writer.BeginSentence()
+			for _, word := range reply {
+				writer.WriteWord(word)
+			}
+			if tag != "" {
+				writer.WriteWord(".tag=" + tag)
+			}
+			if err := writer.EndSentence(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// run executes a command and returns the reply sentences
+func (f *FakeRouterOS) run(command string, attributes map[string]string, queries map[string]string) [][]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.commands = append(f.commands, command)
+
+	if message, ok := f.failures[command]; ok {
+		delete(f.failures, command)
+		return trapReply(message)
+	}
+
+	separator := strings.LastIndex(command, "/")
+	if separator <= 0 {
+		return trapReply("no such command prefix")
+	}
+	menu, action := command[:separator], command[separator+1:]
+
+	switch action {
+	case "print":
+		replies := [][]string{}
+		for _, item := range f.menus[menu] {
+			if itemMatches(item, queries) {
+				replies = append(replies, printReply(item, attributes[".proplist"]))
+			}
+		}
+		return append(replies, []string{"!done"})
+
+	case "add":
+		if name, ok := attributes["name"]; ok {
+			for _, item := range f.menus[menu] {
+				if item["name"] == name {
+					return trapReply("failure: item with this name already exists")
+				}
+			}
+		}
+		// Items are placed before another one like firewall rules, which are evaluated in order
+		placeBefore, ok := attributes["place-before"]
+		delete(attributes, "place-before")
+		if ok && f.findItem(menu, placeBefore) == nil {
+			return trapReply("no such item")
+		}
+
+		id := f.addItem(menu, attributes)
+		if ok {
+			f.moveItem(menu, id, placeBefore)
+		}
+		return [][]string{{"!done", "=ret=" + id}}
+
+	case "set":
+		item := f.findItem(menu, attributes[".id"])
+		if item == nil {
+			return trapReply("no such item")
+		}
+		for property, value := range attributes {
+			if property != ".id" {
+				item[property] = value
+			}
+		}
+		return [][]string{{"!done"}}
+
+	case "remove":
+		items := f.menus[menu]
+		for i, item := range items {
+			if item[".id"] == attributes[".id"] {
+				f.menus[menu] = append(items[:i], items[i+1:]...)
+				return [][]string{{"!done"}}
+			}
+		}
+		return trapReply("no such item")
+	}
+
+	return trapReply("no such command")
+}
+
+// Must be called with the mutex locked
+func (f *FakeRouterOS) addItem(menu string, properties map[string]string) string {
+	f.lastId++
+	item := map[string]string{}
+	maps.Copy(item, properties)
+	item[".id"] = fmt.Sprintf("*%X", f.lastId)
+
+	// WireGuard interfaces get their key pair when they are created
+	if menu == "/interface/wireguard" {
+		if _, ok := item["public-key"]; !ok {
+			item["private-key"] = randomWireguardKey()
+			item["public-key"] = randomWireguardKey()
+		}
+	}
+
+	f.menus[menu] = append(f.menus[menu], item)
+
+	return item[".id"]
+}
+
+// moveItem moves the item right before another one. Must be called with the mutex locked
+func (f *FakeRouterOS) moveItem(menu string, id string, beforeId string) {
+	items := f.menus[menu]
+	index := slices.IndexFunc(items, func(item map[string]string) bool { return item[".id"] == id })
+	item := items[index]
+	items = slices.Delete(items, index, index+1)
+
+	beforeIndex := slices.IndexFunc(items, func(item map[string]string) bool { return item[".id"] == beforeId })
+	f.menus[menu] = slices.Insert(items, beforeIndex, item)
+}
+
+// Must be called with the mutex locked
+func (f *FakeRouterOS) findItem(menu string, id string) map[string]string {
+	for _, item := range f.menus[menu] {
+		if item[".id"] == id {
+			return item
+		}
+	}
+
+	return nil
+}
+
+// readRouterOSSentence reads words until the empty word ending the sentence. The length
+// of every word is encoded in 1 to 5 bytes depending on its value
+func readRouterOSSentence(reader *bufio.Reader) ([]string, error) {
+	words := []string{}
+	for {
+		first, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		length := int(first)
+		extraBytes := 0
+		switch {
+		case first&0x80 == 0x00:
+		case first&0xC0 == 0x80:
+			length, extraBytes = int(first&0x3F), 1
+		case first&0xE0 == 0xC0:
+			length, extraBytes = int(first&0x1F), 2
+		case first&0xF0 == 0xE0:
+			length, extraBytes = int(first&0x0F), 3
+		case first == 0xF0:
+			length, extraBytes = 0, 4
+		default:
+			return nil, fmt.Errorf("invalid word length prefix 0x%X", first)
+		}
+
+		for i := 0; i < extraBytes; i++ {
+			next, err := reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length = length<<8 | int(next)
+		}
+
+		if length == 0 {
+			return words, nil
+		}
+
+		word := make([]byte, length)
+		if _, err := io.ReadFull(reader, word); err != nil {
+			return nil, err
+		}
+		words = append(words, string(word))
+	}
+}
+
+// parseRouterOSWords splits the words after the command into its tag,
+// its attributes (=name=value) and its queries (?name=value)
+func parseRouterOSWords(words []string) (string, map[string]string, map[string]string) {
+	tag := ""
+	attributes := map[string]string{}
+	queries := map[string]string{}
+
+	for _, word := range words {
+		switch {
+		case strings.HasPrefix(word, ".tag="):
+			tag = strings.TrimPrefix(word, ".tag=")
+		case strings.HasPrefix(word, "="):
+			name, value, _ := strings.Cut(word[1:], "=")
+			attributes[name] = value
+		case strings.HasPrefix(word, "?"):
+			name, value, _ := strings.Cut(word[1:], "=")
+			queries[name] = value
+		}
+	}
+
+	return tag, attributes, queries
+}
+
+func printReply(item map[string]string, proplist string) []string {
+	properties := []string{}
+	if proplist != "" {
+		properties = strings.Split(proplist, ",")
+	} else {
+		for property := range item {
+			properties = append(properties, property)
+		}
+		sort.Strings(properties)
+	}
+
+	reply := []string{"!re"}
+	for _, property := range properties {
+		if value, ok := item[property]; ok {
+			reply = append(reply, fmt.Sprintf("=%s=%s", property, value))
+		}
+	}
+
+	return reply
+}
+
+// trapReply is how RouterOS reports a failed command, a trap is always followed by done
+func trapReply(message string) [][]string {
+	return [][]string{{"!trap", "=message=" + message}, {"!done"}}
+}
+
+func itemMatches(item map[string]string, match map[string]string) bool {
+	for property, value := range match {
+		if item[property] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func randomWireguardKey() string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -11,333 +12,259 @@ import (
 	"github.com/go-routeros/routeros/v3"
 )
 
-type RouterOSService interface {
-	Close()
-	RemoveRoute(dst, gateway, table string) (response *routeros.Reply, err error)
-	ApplyVlanConfig(
-		vlan int,
-		vlanPort int,
-		vlanBridge string,
-		taggedBridges []string,
-		externalGateway string,
-		gatewaySubnetMask int,
-	) error
-	RemoveVlanConfig(
-		vlan int,
-		vlanPort int,
-		vlanBridge string,
-		externalGateway string,
-		gatewaySubnetMask int,
-	) error
-	ApplyVmConfig(vmNetworkConfig VmNetworkConfig, vlan int, userPubKey string) error
-	RemoveVmConfig(vlan int, vlanIdentifier int) error
-	GetWireguardPublicKey(name string) (string, error)
-}
+// Routes in the table of a VRF that was just created are sometimes rejected, so adding them is retried
+const ROUTEROS_ADD_ROUTE_RETRIES = 5
 
+// RouterOSServiceImpl is the network backend for MikroTik routers, configured through the RouterOS API
 type RouterOSServiceImpl struct {
-	client *routeros.Client
-	mutex  sync.Mutex
+	client          *routeros.Client
+	vlanBridge      string
+	taggedBridges   []string
+	externalGateway string
+	// Optional, without it the VLAN's have no IPv6 default route
+	externalIpv6Gateway string
+	mutex               sync.Mutex
 }
 
-func NewRouterOSService(addr, user, pass string) (RouterOSService, error) {
+func NewRouterOSService(
+	addr, user, pass string,
+	vlanBridge string,
+	taggedBridges []string,
+	externalGateway string,
+	externalIpv6Gateway string,
+) (NetworkBackend, error) {
 	c, err := routeros.Dial(addr, user, pass)
 	if err != nil {
 		return nil, err
 	}
-	return &RouterOSServiceImpl{client: c, mutex: sync.Mutex{}}, nil
+	return &RouterOSServiceImpl{
+		client:              c,
+		vlanBridge:          vlanBridge,
+		taggedBridges:       taggedBridges,
+		externalGateway:     externalGateway,
+		externalIpv6Gateway: externalIpv6Gateway,
+		mutex:               sync.Mutex{},
+	}, nil
 }
 
 func (s *RouterOSServiceImpl) Close() { s.client.Close() }
 
-func (s *RouterOSServiceImpl) ApplyVlanConfig(
-	vlan int,
-	vlanPort int,
-	vlanBridge string,
-	taggedBridges []string,
-	externalGateway string,
-	gatewaySubnetMask int,
-) error {
-	if _, err := s.addWireguard(
-		fmt.Sprintf("VPN%d", vlan),
-		vlanPort,
-		1420,
-		fmt.Sprintf("wireguard%d", vlan),
-	); err != nil {
-		return err
-	}
+// ApplyVlanConfig compares the desired state of the VLAN with what the router reports and only
+// adds the missing items and sets the changed ones. It returns the drift that was fixed, when it fails
+// the items applied so far are kept so the next reconciliation continues from there
+func (s *RouterOSServiceImpl) ApplyVlanConfig(config VlanNetworkConfig) ([]NetworkDrift, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	if _, err := s.addVlan(
-		fmt.Sprintf("VLAN%d", vlan),
-		vlanBridge,
-		fmt.Sprintf("vlan%d", vlan),
-		vlan,
-	); err != nil {
-		return err
-	}
+	state := s.getVlanDesiredState(config)
+	applied := []NetworkDrift{}
+	for _, item := range state.Items {
+		drift, id, err := s.getItemDrift(item)
+		if err != nil {
+			return applied, err
+		}
 
-	if _, err := s.addInterfaceList(
-		fmt.Sprintf("VRF%d", vlan),
-	); err != nil {
-		return err
-	}
+		if drift == nil {
+			continue
+		}
 
-	if _, err := s.addVrf(
-		fmt.Sprintf("VRF%d", vlan),
-		fmt.Sprintf("vrf%d", vlan),
-		fmt.Sprintf("vlan%d", vlan),
-		fmt.Sprintf("wireguard%d", vlan),
-	); err != nil {
-		return err
-	}
+		switch drift.Kind {
+		case NetworkItemMissing:
+			err = s.addItem(item)
+		case NetworkItemChanged:
+			err = s.setItem(item.Menu, id, drift.Expected)
+		}
+		if err != nil {
+			return applied, err
+		}
 
-	if _, err := s.addBridgeVlan(
-		vlanBridge,
-		fmt.Sprintf("VLAN%d", vlan),
-		vlan,
-		taggedBridges...,
-	); err != nil {
-		return err
+		applied = append(applied, *drift)
 	}
 
-	if _, err := s.addListMember(
-		fmt.Sprintf("VRF%d", vlan),
-		fmt.Sprintf("vlan%d", vlan),
-		fmt.Sprintf("VRF%d", vlan),
-	); err != nil {
-		return err
+	if len(applied) > 0 {
+		log.Printf("Reconciled vlan %d config, %d items applied", state.Vlan, len(applied))
 	}
 
-	if _, err := s.addListMember(
-		fmt.Sprintf("VRF%d", vlan),
-		fmt.Sprintf("wireguard%d", vlan),
-		fmt.Sprintf("VRF%d", vlan),
-	); err != nil {
-		return err
-	}
+	return applied, nil
+}
 
-	if _, err := s.addIPAddress(
-		fmt.Sprintf("%s/%d", getVlanGatewayIp(vlan), gatewaySubnetMask),
-		fmt.Sprintf("VLAN%d", vlan),
-		fmt.Sprintf("vlan%d", vlan),
-	); err != nil {
-		return err
-	}
+// GetVlanConfigDrift returns the items of the desired state that are missing or differ in the router
+func (s *RouterOSServiceImpl) GetVlanConfigDrift(config VlanNetworkConfig) ([]NetworkDrift, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	if _, err := s.addIPAddress(
-		fmt.Sprintf("%s/%d", getVpnGatewayIp(vlan), gatewaySubnetMask),
-		fmt.Sprintf("VPN%d", vlan),
-		fmt.Sprintf("wireguard%d", vlan),
-	); err != nil {
-		return err
-	}
+	drifts := []NetworkDrift{}
+	for _, item := range s.getVlanDesiredState(config).Items {
+		drift, _, err := s.getItemDrift(item)
+		if err != nil {
+			return nil, err
+		}
 
-	if _, err := s.addFirewallFilter(
-		"accept",
-		"input",
-		"defconf: accept from WAN for Wireguard",
-		map[string]string{
-			"dst-port":          strconv.Itoa(vlanPort),
-			"in-interface-list": "WAN",
-			"protocol":          "udp",
-		},
-	); err != nil {
-		return err
+		if drift != nil {
+			drifts = append(drifts, *drift)
+		}
 	}
 
-	if _, err := s.addFirewallFilter(
-		"accept",
-		"forward",
-		fmt.Sprintf("defconf: accept from VRF%d to WAN", vlan),
-		map[string]string{
-			"in-interface-list":  fmt.Sprintf("VRF%d", vlan),
-			"out-interface-list": "WAN",
-		},
-	); err != nil {
-		return err
-	}
+	return drifts, nil
+}
 
-	if _, err := s.addFirewallFilter(
-		"accept",
-		"forward",
-		fmt.Sprintf("defconf: accept from VRF%d to VRF%d", vlan, vlan),
-		map[string]string{
-			"in-interface-list":  fmt.Sprintf("VRF%d", vlan),
-			"out-interface-list": fmt.Sprintf("VRF%d", vlan),
-		},
-	); err != nil {
-		return err
-	}
+// RemoveVlanConfig removes the items of the VLAN in the reverse order they are created,
+// items that are already missing are skipped so it can be retried after a partial failure
+func (s *RouterOSServiceImpl) RemoveVlanConfig(config VlanNetworkConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	if _, err := s.addFirewallFilter(
-		"accept",
-		"forward",
-		fmt.Sprintf("defconf: accept from WAN to VRF%d", vlan),
-		map[string]string{
-			"in-interface-list":  "WAN",
-			"out-interface-list": fmt.Sprintf("VRF%d", vlan),
-		},
-	); err != nil {
-		return err
-	}
+	state := s.getVlanDesiredState(config)
+	log.Printf("Removing vlan %d config...", state.Vlan)
 
-	/*
-		if _, err := s.addRoutingTable(fmt.Sprintf("vrf%d", vlan)); err != nil {
-			return err
-		}
-	*/
+	var errs []error
+	for i := len(state.Items) - 1; i >= 0; i-- {
+		item := state.Items[i]
 
-	if _, err := s.addRoute(
-		getVlanNetworkIpWithSubnet(vlan),
-		fmt.Sprintf("vlan%d@vrf%d", vlan, vlan),
-		"main",
-	); err != nil {
-		return err
-	}
+		found, err := s.findItems(item.Menu, item.Key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
 
-	if _, err := s.addRoute(
-		"0.0.0.0/0",
-		externalGateway+"@main",
-		fmt.Sprintf("vrf%d", vlan),
-	); err != nil {
-		return err
+		for _, actual := range found {
+			if err := s.removeItem(item.Menu, actual[".id"]); err != nil {
+				errs = append(errs, err)
+			}
+		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
-func (s *RouterOSServiceImpl) RemoveVlanConfig(
-	vlan int,
-	vlanPort int,
-	vlanBridge string,
-	externalGateway string,
-	gatewaySubnetMask int,
-) error {
-	log.Println("Removing vlan config...")
-	var errFound error
-	if _, err := s.RemoveRoute(
-		"0.0.0.0/0",
-		externalGateway,
-		fmt.Sprintf("vrf%d", vlan),
-	); err != nil {
-		// Append error to errFound
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
+// getItemDrift returns nil when the item is in the router as desired, the RouterOS ID of
+// the item is also returned when it exists. Must be called with the mutex locked
+func (s *RouterOSServiceImpl) getItemDrift(item RouterOSItem) (*NetworkDrift, string, error) {
+	found, err := s.findItems(item.Menu, item.Key)
+	if err != nil {
+		return nil, "", err
 	}
 
-	if _, err := s.RemoveRoute(
-		getVlanNetworkIpWithSubnet(vlan),
-		fmt.Sprintf("vlan%d@vrf%d", vlan, vlan),
-		"main",
-	); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
+	if len(found) == 0 {
+		return &NetworkDrift{
+			Resource: item.Menu,
+			Key:      item.Key,
+			Kind:     NetworkItemMissing,
+			Expected: item.Properties,
+		}, "", nil
 	}
 
-	if _, err := s.removeFirewallFilter(
-		map[string]string{
-			"action":             "accept",
-			"chain":              "forward",
-			"in-interface-list":  "WAN",
-			"out-interface-list": fmt.Sprintf("VRF%d", vlan),
-		},
-	); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
+	actual := found[0]
+	expected := map[string]string{}
+	actualProperties := map[string]string{}
+	for property, value := range item.Properties {
+		if !routerOSValuesEqual(value, actual[property]) {
+			expected[property] = value
+			actualProperties[property] = actual[property]
+		}
 	}
 
-	if _, err := s.removeFirewallFilter(
-		map[string]string{
-			"action":             "accept",
-			"chain":              "forward",
-			"in-interface-list":  fmt.Sprintf("VRF%d", vlan),
-			"out-interface-list": fmt.Sprintf("VRF%d", vlan),
-		},
-	); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
+	if len(expected) == 0 {
+		return nil, actual[".id"], nil
 	}
 
-	if _, err := s.removeFirewallFilter(
-		map[string]string{
-			"action":             "accept",
-			"chain":              "forward",
-			"in-interface-list":  fmt.Sprintf("VRF%d", vlan),
-			"out-interface-list": "WAN",
-		},
-	); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
-	}
+	return &NetworkDrift{
+		Resource: item.Menu,
+		Key:      item.Key,
+		Kind:     NetworkItemChanged,
+		Expected: expected,
+		Actual:   actualProperties,
+	}, actual[".id"], nil
+}
 
-	if _, err := s.removeFirewallFilter(
-		map[string]string{
-			"action":            "accept",
-			"chain":             "input",
-			"dst-port":          strconv.Itoa(vlanPort),
-			"in-interface-list": "WAN",
-			"protocol":          "udp",
-		},
-	); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
+// findItems returns the items of the menu matching every property of the key. Must be called with the mutex locked
+func (s *RouterOSServiceImpl) findItems(menu string, key map[string]string) ([]map[string]string, error) {
+	args := []string{menu + "/print"}
+	for property, value := range key {
+		args = append(args, fmt.Sprintf("?%s=%s", property, value))
 	}
 
-	if _, err := s.removeIPAddress(
-		fmt.Sprintf("%s/%d", getVpnGatewayIp(vlan), gatewaySubnetMask),
-		fmt.Sprintf("wireguard%d", vlan),
-	); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
+	resp, err := s.client.RunArgs(args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %s %v: %v", menu, key, err)
 	}
 
-	if _, err := s.removeIPAddress(
-		fmt.Sprintf("%s/%d", getVlanGatewayIp(vlan), gatewaySubnetMask),
-		fmt.Sprintf("vlan%d", vlan),
-	); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
+	items := []map[string]string{}
+	for _, sentence := range resp.Re {
+		items = append(items, sentence.Map)
 	}
 
-	if _, err := s.removeListMember(fmt.Sprintf("VRF%d", vlan), fmt.Sprintf("wireguard%d", vlan)); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
-	}
+	return items, nil
+}
 
-	if _, err := s.removeListMember(fmt.Sprintf("VRF%d", vlan), fmt.Sprintf("vlan%d", vlan)); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
+// Must be called with the mutex locked
+func (s *RouterOSServiceImpl) addItem(item RouterOSItem) error {
+	args := []string{item.Menu + "/add"}
+	for property, value := range item.Key {
+		args = append(args, fmt.Sprintf("=%s=%s", property, value))
 	}
-
-	if _, err := s.removeBridgeVlan(vlanBridge, vlan); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
+	for property, value := range item.Properties {
+		args = append(args, fmt.Sprintf("=%s=%s", property, value))
 	}
 
-	if _, err := s.removeVrf(fmt.Sprintf("vrf%d", vlan)); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
+	retries := 1
+	if item.Menu == "/ip/route" || item.Menu == "/ipv6/route" {
+		retries = ROUTEROS_ADD_ROUTE_RETRIES
 	}
 
-	if _, err := s.removeInterfaceList(fmt.Sprintf("VRF%d", vlan)); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
+	var err error
+	for i := 0; i < retries; i++ {
+		if _, err = s.client.RunArgs(args); err == nil {
+			return nil
+		}
+
+		if i < retries-1 {
+			log.Printf("Error adding %s %v, retrying: %v", item.Menu, item.Key, err)
+			time.Sleep(1 * time.Second)
+		}
 	}
 
-	if _, err := s.removeVlan(fmt.Sprintf("vlan%d", vlan)); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
+	return fmt.Errorf("failed to add %s %v with %v: %v", item.Menu, item.Key, item.Properties, err)
+}
+
+// Must be called with the mutex locked
+func (s *RouterOSServiceImpl) setItem(menu string, id string, properties map[string]string) error {
+	args := []string{menu + "/set", "=.id=" + id}
+	for property, value := range properties {
+		args = append(args, fmt.Sprintf("=%s=%s", property, value))
 	}
 
-	if _, err := s.removeWireguard(fmt.Sprintf("wireguard%d", vlan)); err != nil {
-		errFound = fmt.Errorf("%v\n%v", errFound, err)
+	if _, err := s.client.RunArgs(args); err != nil {
+		return fmt.Errorf("failed to set %s %s to %v: %v", menu, id, properties, err)
 	}
 
-	/*
-		if _, err := s.removeRoutingTable(fmt.Sprintf("vrf%d", vlan)); err != nil {
-			errFound = fmt.Errorf("%v\n%v", errFound, err)
-		}
-	*/
+	return nil
+}
 
-	if errFound != nil {
-		return errFound
+// Must be called with the mutex locked
+func (s *RouterOSServiceImpl) removeItem(menu string, id string) error {
+	if _, err := s.client.RunArgs([]string{menu + "/remove", "=.id=" + id}); err != nil {
+		return fmt.Errorf("failed to remove %s %s: %v", menu, id, err)
 	}
+
 	return nil
 }
 
 func (s *RouterOSServiceImpl) ApplyVmConfig(vmNetworkConfig VmNetworkConfig, vlan int, userPubKey string) error {
+	allowedAddrs := []string{
+		vmNetworkConfig.Network,
+		vmNetworkConfig.InterfaceAddress,
+	}
+	if vmNetworkConfig.Ipv6InterfaceAddress != "" {
+		allowedAddrs = append(allowedAddrs, vmNetworkConfig.Ipv6InterfaceAddress)
+	}
+
 	if _, err := s.addWireguardPeer(
 		fmt.Sprintf("VPN%d", vlan),
-		fmt.Sprintf("wireguard%d", vlan),
-		fmt.Sprintf("peer%d-%d", vlan, vmNetworkConfig.VmVlanIdentifier),
+		getWireguardInterfaceName(vlan),
+		getWireguardPeerName(vlan, vmNetworkConfig.VmVlanIdentifier),
 		userPubKey,
-		getNetworkAddressWithSubnet(vmNetworkConfig.IpAddWithSubnet),
-		getInterfaceAddressWithSubnet(vmNetworkConfig.IpAddWithSubnet),
+		allowedAddrs...,
 	); err != nil {
 		return fmt.Errorf("error adding wireguard peer: %v", err)
 	}
@@ -346,289 +273,259 @@ func (s *RouterOSServiceImpl) ApplyVmConfig(vmNetworkConfig VmNetworkConfig, vla
 }
 
 func (s *RouterOSServiceImpl) RemoveVmConfig(vlan int, vlanIdentifier int) error {
-	if _, err := s.removeWireguardPeer(fmt.Sprintf("peer%d-%d", vlan, vlanIdentifier)); err != nil {
+	if _, err := s.removeWireguardPeer(getWireguardPeerName(vlan, vlanIdentifier)); err != nil {
 		return fmt.Errorf("error removing wireguard peer: %v", err)
 	}
 
 	return nil
 }
 
-func (s *RouterOSServiceImpl) removeByFilter(cmd string, filter ...string) (response *routeros.Reply, err error) {
-	args := []string{
-		fmt.Sprintf("%s/print", cmd),
-	}
-
-	for _, f := range filter {
-		args = append(args, "?"+f)
-	}
-
-	args = append(args, "=.proplist=.id")
-
-	findResp, findErr := s.client.RunArgs(args)
-	if findErr != nil || len(findResp.Re) == 0 {
-		return nil, fmt.Errorf("failed to find %s: %v", filter, findErr)
+func (s *RouterOSServiceImpl) RotateVmWireguardKey(vmNetworkConfig VmNetworkConfig, vlan int, userPubKey string) error {
+	rotated, err := s.setWireguardPeerKey(getWireguardPeerName(vlan, vmNetworkConfig.VmVlanIdentifier), userPubKey)
+	if err != nil {
+		return fmt.Errorf("error rotating wireguard peer key: %v", err)
 	}
 
-	id := findResp.Re[0].Map[".id"]
-
-	removeResp, removeErr := s.client.RunArgs([]string{
-		fmt.Sprintf("%s/remove", cmd),
-		fmt.Sprintf("=.id=%s", id),
-	})
-	if removeErr != nil {
-		return nil, fmt.Errorf("failed to remove %s: %v", filter, removeErr)
+	if !rotated {
+		return s.ApplyVmConfig(vmNetworkConfig, vlan, userPubKey)
 	}
 
-	return removeResp, nil
+	return nil
 }
 
-/*
-func (s *RouterOSServiceImpl) addComment(cmd, comment string, filter ...string) (response *routeros.Reply, err error) {
-	args := []string{
-		fmt.Sprintf("%s/print", cmd),
-	}
+// setWireguardPeerKey sets the public key of the peer, it returns false when the peer is missing
+func (s *RouterOSServiceImpl) setWireguardPeerKey(name string, pubKey string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	for _, f := range filter {
-		args = append(args, "?"+f)
+	peers, err := s.findItems("/interface/wireguard/peers", map[string]string{"name": name})
+	if err != nil {
+		return false, err
 	}
 
-	args = append(args, "=.proplist=.id")
-
-	findResp, findErr := s.client.RunArgs(args)
-	if findErr != nil || len(findResp.Re) == 0 {
-		return nil, fmt.Errorf("failed to find %s: %v", filter, err)
+	if len(peers) == 0 {
+		return false, nil
 	}
 
-	id := findResp.Re[0].Map[".id"]
+	return true, s.setItem("/interface/wireguard/peers", peers[0][".id"], map[string]string{"public-key": pubKey})
+}
 
-	addCommentResp, addCommentErr := s.client.RunArgs([]string{
-		fmt.Sprintf("%s/set", cmd),
-		fmt.Sprintf("=.id=%s", id),
-		fmt.Sprintf("=comment=%s", comment),
-	})
-	if addCommentErr != nil {
-		return nil, fmt.Errorf("failed to add comment to %s: %v", filter, addCommentErr)
+func (s *RouterOSServiceImpl) AddWireguardPeer(config WireguardPeerConfig) error {
+	if _, err := s.addWireguardPeer(
+		fmt.Sprintf("VPN%d", config.Vlan),
+		getWireguardInterfaceName(config.Vlan),
+		getWireguardPeerName(config.Vlan, config.PeerIdentifier),
+		config.PublicKey,
+		config.InterfaceAddresses...,
+	); err != nil {
+		return fmt.Errorf("error adding wireguard peer: %v", err)
 	}
 
-	return addCommentResp, nil
+	return nil
 }
-*/
 
-func (s *RouterOSServiceImpl) addWireguard(comment string, listenPort, mtu int, name string) (response *routeros.Reply, err error) {
+func (s *RouterOSServiceImpl) RemoveWireguardPeer(vlan int, peerIdentifier int) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	addWireguardResp, addWireguardErr := s.client.RunArgs([]string{
-		"/interface/wireguard/add",
-		fmt.Sprintf("=name=%s", name),
-		fmt.Sprintf("=listen-port=%d", listenPort),
-		fmt.Sprintf("=mtu=%d", mtu),
-	})
-	if addWireguardErr != nil {
-		return nil, fmt.Errorf(
-			"failed to add wireguard with name %s, listen port %d, mtu %d: %v",
-			name,
-			listenPort,
-			mtu,
-			addWireguardErr,
-		)
+	peers, err := s.findItems(
+		"/interface/wireguard/peers",
+		map[string]string{"name": getWireguardPeerName(vlan, peerIdentifier)},
+	)
+	if err != nil {
+		return err
 	}
 
-	/*
-		if err := s.addComment("/interface/wireguard", comment, "name="+name); err != nil {
-			return err
+	for _, peer := range peers {
+		if err := s.removeItem("/interface/wireguard/peers", peer[".id"]); err != nil {
+			return fmt.Errorf("error removing wireguard peer: %v", err)
 		}
-	*/
+	}
 
-	return addWireguardResp, nil
+	return nil
 }
 
-func (s *RouterOSServiceImpl) removeWireguard(name string) (response *routeros.Reply, err error) {
+func (s *RouterOSServiceImpl) ListVlans() ([]int, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	return s.removeByFilter("/interface/wireguard", "name="+name)
+	interfaces, err := s.findItems("/interface/vlan", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	vlans := []int{}
+	for _, vlanInterface := range interfaces {
+		if vlan, ok := parseVlanInterfaceName(vlanInterface["name"]); ok {
+			vlans = append(vlans, vlan)
+		}
+	}
+
+	return vlans, nil
 }
 
-func (s *RouterOSServiceImpl) addVlan(comment string, iface, name string, vlanID int) (response *routeros.Reply, err error) {
+func (s *RouterOSServiceImpl) ListWireguardPeers() ([]GatewayPeer, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	args := []string{
-		"/interface/vlan/add",
-		fmt.Sprintf("=name=%s", name),
-		fmt.Sprintf("=interface=%s", iface),
-		fmt.Sprintf("=vlan-id=%d", vlanID),
+	items, err := s.findItems("/interface/wireguard/peers", nil)
+	if err != nil {
+		return nil, err
 	}
 
-	addVlanResp, addVlanErr := s.client.RunArgs(args)
-	if addVlanErr != nil {
-		return nil, fmt.Errorf(
-			"failed to add vlan with name %s, interface %s, vlan id %d: %v",
-			name,
-			iface,
-			vlanID,
-			addVlanErr,
-		)
+	peers := []GatewayPeer{}
+	for _, item := range items {
+		if peer, ok := parseWireguardPeerName(item["name"]); ok {
+			peers = append(peers, peer)
+		}
 	}
 
-	/*
-		if err := s.addComment("/interface/vlan", comment, "name="+name); err != nil {
-			return err
-		}
-	*/
-	return addVlanResp, nil
+	return peers, nil
 }
 
-func (s *RouterOSServiceImpl) removeVlan(name string) (response *routeros.Reply, err error) {
+func (s *RouterOSServiceImpl) ApplyVmFirewall(config VmFirewallConfig) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	return s.removeByFilter("/interface/vlan", "name="+name)
-}
+	comment := getVmFirewallName(config.Vlan, config.VmVlanIdentifier)
+	if err := s.removeVmFirewallRules(comment); err != nil {
+		return err
+	}
 
-func (s *RouterOSServiceImpl) addInterfaceList(name string) (response *routeros.Reply, err error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	// Rules are added in order before the first forward rule, the accepts of the VLANs are always after them
+	placeBefore := map[string]string{}
+	for _, item := range s.getVmFirewallItems(config, comment) {
+		if _, ok := placeBefore[item.Menu]; !ok {
+			forwardRules, err := s.findItems(item.Menu, map[string]string{"chain": "forward"})
+			if err != nil {
+				return err
+			}
 
-	addInterfaceListResp, addInterfaceListErr := s.client.RunArgs([]string{
-		"/interface/list/add",
-		fmt.Sprintf("=name=%s", name),
-	})
-	if addInterfaceListErr != nil {
-		return nil, fmt.Errorf(
-			"failed to add interface list with name %s: %v",
-			name,
-			addInterfaceListErr,
-		)
-	}
+			placeBefore[item.Menu] = ""
+			if len(forwardRules) > 0 {
+				placeBefore[item.Menu] = forwardRules[0][".id"]
+			}
+		}
 
-	return addInterfaceListResp, nil
-}
+		if placeBefore[item.Menu] != "" {
+			item.Properties["place-before"] = placeBefore[item.Menu]
+		}
 
-func (s *RouterOSServiceImpl) removeInterfaceList(name string) (response *routeros.Reply, err error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+		if err := s.addItem(item); err != nil {
+			return fmt.Errorf("error adding firewall rule of %s: %v", comment, err)
+		}
+	}
 
-	return s.removeByFilter("/interface/list", "name="+name)
+	return nil
 }
 
-func (s *RouterOSServiceImpl) addVrf(comment string, name string, ifaces ...string) (response *routeros.Reply, err error) {
+func (s *RouterOSServiceImpl) RemoveVmFirewall(vlan int, vmVlanIdentifier int) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	addVrfResp, addVrfErr := s.client.RunArgs([]string{
-		"/ip/vrf/add",
-		fmt.Sprintf("=name=%s", name),
-		fmt.Sprintf("=interfaces=%s", strings.Join(ifaces, ",")),
-	})
-	if addVrfErr != nil {
-		return nil, fmt.Errorf(
-			"failed to add vrf with name %s, interfaces %s: %v",
-			name,
-			strings.Join(ifaces, ","),
-			addVrfErr,
-		)
-	}
+	return s.removeVmFirewallRules(getVmFirewallName(vlan, vmVlanIdentifier))
+}
 
-	/*
-		if err := s.addComment("/ip/vrf", comment, "name="+name); err != nil {
+// removeVmFirewallRules removes the rules with the comment of the VM firewall. Must be called with the mutex locked
+func (s *RouterOSServiceImpl) removeVmFirewallRules(comment string) error {
+	for _, menu := range []string{"/ip/firewall/filter", "/ipv6/firewall/filter"} {
+		rules, err := s.findItems(menu, map[string]string{"comment": comment})
+		if err != nil {
 			return err
 		}
-	*/
-	return addVrfResp, nil
-}
 
-func (s *RouterOSServiceImpl) removeVrf(name string) (response *routeros.Reply, err error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+		for _, rule := range rules {
+			if err := s.removeItem(menu, rule[".id"]); err != nil {
+				return err
+			}
+		}
+	}
 
-	return s.removeByFilter("/ip/vrf", "name="+name)
+	return nil
 }
 
-func (s *RouterOSServiceImpl) addBridgeVlan(bridge, comment string, vlanID int, tagged ...string) (response *routeros.Reply, err error) {
+func (s *RouterOSServiceImpl) AddPortForward(config PortForwardConfig) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	args := []string{
-		"/interface/bridge/vlan/add",
-		fmt.Sprintf("=bridge=%s", bridge),
-		fmt.Sprintf("=vlan-ids=%d", vlanID),
-		fmt.Sprintf("=tagged=%s", strings.Join(tagged, ",")),
+	comment := getPortForwardName(config.Protocol, config.ExternalPort)
+	if err := s.removePortForwardRules(comment); err != nil {
+		return err
 	}
 
-	addBridgeVlanResp, addBridgeVlanErr := s.client.RunArgs(args)
-	if addBridgeVlanErr != nil {
-		return nil, fmt.Errorf(
-			"failed to add bridge vlan with bridge %s, vlan id %d, tagged %s: %v",
-			bridge,
-			vlanID,
-			strings.Join(tagged, ","),
-			addBridgeVlanErr,
-		)
+	// The route to the VLAN network in the main table takes the forwarded traffic into the VRF
+	item := RouterOSItem{
+		Menu: "/ip/firewall/nat",
+		Key: map[string]string{
+			"chain":             "dstnat",
+			"action":            "dst-nat",
+			"in-interface-list": "WAN",
+			"protocol":          config.Protocol,
+			"dst-port":          strconv.Itoa(config.ExternalPort),
+			"comment":           comment,
+		},
+		Properties: map[string]string{
+			"to-addresses": config.Address,
+			"to-ports":     strconv.Itoa(config.InternalPort),
+		},
+	}
+	if err := s.addItem(item); err != nil {
+		return fmt.Errorf("error adding port forward %s: %v", comment, err)
 	}
 
-	/*
-		if err := s.addComment("/interface/bridge/vlan", comment, "vlan-ids="+strconv.Itoa(vlanID)); err != nil {
-			return err
-		}
-	*/
-	return addBridgeVlanResp, nil
+	return nil
 }
 
-func (s *RouterOSServiceImpl) removeBridgeVlan(bridge string, vlanID int) (response *routeros.Reply, err error) {
+func (s *RouterOSServiceImpl) RemovePortForward(protocol string, externalPort int) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	return s.removeByFilter(
-		"/interface/bridge/vlan",
-		"bridge="+bridge,
-		"vlan-ids="+strconv.Itoa(vlanID),
-	)
+	return s.removePortForwardRules(getPortForwardName(protocol, externalPort))
 }
 
-func (s *RouterOSServiceImpl) addListMember(comment, iface, list string) (response *routeros.Reply, err error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// removePortForwardRules removes the dst-nat rules with the comment of the forward. Must be called with the mutex locked
+func (s *RouterOSServiceImpl) removePortForwardRules(comment string) error {
+	rules, err := s.findItems("/ip/firewall/nat", map[string]string{"comment": comment})
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if err := s.removeItem("/ip/firewall/nat", rule[".id"]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
+func (s *RouterOSServiceImpl) removeByFilter(cmd string, filter ...string) (response *routeros.Reply, err error) {
 	args := []string{
-		"/interface/list/member/add",
-		fmt.Sprintf("=list=%s", list),
-		fmt.Sprintf("=interface=%s", iface),
+		fmt.Sprintf("%s/print", cmd),
 	}
 
-	addListMemberResp, addListMemberErr := s.client.RunArgs(args)
-	if addListMemberErr != nil {
-		return nil, fmt.Errorf(
-			"failed to add list member with list %s, interface %s: %v",
-			list,
-			iface,
-			addListMemberErr,
-		)
+	for _, f := range filter {
+		args = append(args, "?"+f)
 	}
 
-	/*
-		if err := s.addComment(
-			"/interface/list/member",
-			comment,
-			"list="+list,
-			"interface="+iface,
-		); err != nil {
-			return err
-		}
-	*/
-	return addListMemberResp, nil
-}
+	args = append(args, "=.proplist=.id")
 
-func (s *RouterOSServiceImpl) removeListMember(list, iface string) (response *routeros.Reply, err error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	findResp, findErr := s.client.RunArgs(args)
+	if findErr != nil || len(findResp.Re) == 0 {
+		return nil, fmt.Errorf("failed to find %s: %v", filter, findErr)
+	}
 
-	return s.removeByFilter(
-		"/interface/list/member",
-		"list="+list,
-		"interface="+iface,
-	)
+	id := findResp.Re[0].Map[".id"]
+
+	removeResp, removeErr := s.client.RunArgs([]string{
+		fmt.Sprintf("%s/remove", cmd),
+		fmt.Sprintf("=.id=%s", id),
+	})
+	if removeErr != nil {
+		return nil, fmt.Errorf("failed to remove %s: %v", filter, removeErr)
+	}
+
+	return removeResp, nil
 }
 
 func (s *RouterOSServiceImpl) addWireguardPeer(comment, iface, name, pubKey string, allowedAddrs ...string) (response *routeros.Reply, err error) {
@@ -670,170 +567,11 @@ func (s *RouterOSServiceImpl) removeWireguardPeer(name string) (response *router
 	return s.removeByFilter("/interface/wireguard/peers", "name="+name)
 }
 
-func (s *RouterOSServiceImpl) addIPAddress(addr, comment, iface string) (response *routeros.Reply, err error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	args := []string{
-		"/ip/address/add",
-		fmt.Sprintf("=interface=%s", iface),
-		fmt.Sprintf("=address=%s", addr),
-	}
-
-	addIPAddressResp, addIPAddressErr := s.client.RunArgs(args)
-	if addIPAddressErr != nil {
-		return nil, fmt.Errorf(
-			"failed to add ip address with interface %s, address %s: %v",
-			iface,
-			addr,
-			addIPAddressErr,
-		)
-	}
-
-	/*
-		if err := s.addComment("/ip/address", comment, "interface="+iface, "address="+addr); err != nil {
-			return err
-		}
-	*/
-	return addIPAddressResp, nil
-}
-
-func (s *RouterOSServiceImpl) removeIPAddress(addr, iface string) (response *routeros.Reply, err error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	return s.removeByFilter(
-		"/ip/address",
-		"interface="+iface,
-		"address="+addr,
-	)
-}
-
-func (s *RouterOSServiceImpl) addFirewallFilter(action, chain, comment string, params map[string]string) (response *routeros.Reply, err error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	args := []string{"/ip/firewall/filter/add", fmt.Sprintf("=chain=%s", chain), fmt.Sprintf("=action=%s", action)}
-
-	for k, v := range params {
-		args = append(args, fmt.Sprintf("=%s=%s", k, v))
-	}
-
-	addFirewallFilterResp, addFirewallFilterErr := s.client.RunArgs(args)
-	if addFirewallFilterErr != nil {
-		return nil, fmt.Errorf(
-			"failed to add firewall filter with chain %s, action %s, params %v: %v",
-			chain,
-			action,
-			params,
-			addFirewallFilterErr,
-		)
-	}
-
-	/*
-		filter := []string{
-			fmt.Sprintf("chain=%s", chain),
-			fmt.Sprintf("action=%s", action),
-		}
-		for k, v := range params {
-			filter = append(filter, fmt.Sprintf("%s=%s", k, v))
-		}
-
-
-		if err := s.addComment("/ip/firewall/filter", comment, filter...); err != nil {
-			return err
-		}
-	*/
-	return addFirewallFilterResp, nil
-}
-
-func (s *RouterOSServiceImpl) removeFirewallFilter(filters map[string]string) (response *routeros.Reply, err error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	parts := []string{}
-	for k, v := range filters {
-		parts = append(parts, fmt.Sprintf("%s=%s", k, v))
-	}
-	return s.removeByFilter("/ip/firewall/filter", parts...)
-}
-
-func (s *RouterOSServiceImpl) addRoutingTable(name string) (response *routeros.Reply, err error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	addRoutingTableResp, addRoutingTableErr := s.client.RunArgs([]string{
-		"/routing/table/add",
-		fmt.Sprintf("=name=%s", name),
-	})
-	if addRoutingTableErr != nil {
-		return nil, fmt.Errorf(
-			"failed to add routing table with name %s: %v",
-			name,
-			addRoutingTableErr,
-		)
-	}
-
-	return addRoutingTableResp, nil
-}
-
-func (s *RouterOSServiceImpl) removeRoutingTable(name string) (response *routeros.Reply, err error) {
+func (s *RouterOSServiceImpl) GetWireguardPublicKey(vlan int) (string, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	for {
-		// Sometimes the routing table can not be removed immediately, so we need to retry
-		resp, err := s.removeByFilter("/routing/table", "name="+name)
-		if err != nil {
-			log.Println("Error removing routing table: ", err.Error())
-			log.Println("Retrying...")
-			continue
-		} else {
-			return resp, nil
-		}
-	}
-}
-
-func (s *RouterOSServiceImpl) addRoute(dst, gateway, table string) (response *routeros.Reply, err error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	var addRouteErr error
-	for i := 0; i < 5; i++ {
-		addRouteResp, addRouteErr := s.client.RunArgs([]string{
-			"/ip/route/add",
-			fmt.Sprintf("=dst-address=%s", dst),
-			fmt.Sprintf("=gateway=%s", gateway),
-			fmt.Sprintf("=routing-table=%s", table),
-		})
-		if addRouteErr != nil {
-			log.Println("Error adding route: ", addRouteErr.Error())
-			log.Println("Retrying...")
-			time.Sleep(1 * time.Second)
-			continue
-		} else {
-			return addRouteResp, nil
-		}
-	}
-
-	return nil, fmt.Errorf("failed to add route with dst %s, gateway %s, table %s: %v", dst, gateway, table, addRouteErr)
-}
-
-func (s *RouterOSServiceImpl) RemoveRoute(dst, gateway, table string) (response *routeros.Reply, err error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	return s.removeByFilter(
-		"/ip/route",
-		"dst-address="+dst,
-		"gateway="+gateway,
-		"routing-table="+table,
-	)
-}
-
-func (s *RouterOSServiceImpl) GetWireguardPublicKey(name string) (string, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	name := getWireguardInterfaceName(vlan)
 
 	resp, err := s.client.RunArgs([]string{
 		"/interface/wireguard/print",
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const ROUTEROS_WIREGUARD_MTU = 1420
+
+// RouterOSItem is an entry of a RouterOS menu, e.g. an interface or a firewall rule.
+// Key holds the properties identifying it in the router and Properties the ones
+// that must have the given values, they are set again when they drift
+type RouterOSItem struct {
+	Menu       string
+	Key        map[string]string
+	Properties map[string]string
+}
+
+// VlanDesiredState is everything the router needs for a subject VLAN. Items are
+// ordered so the ones referenced by others are created first
+type VlanDesiredState struct {
+	Vlan  int
+	Items []RouterOSItem
+}
+
+func (s *RouterOSServiceImpl) getVlanDesiredState(config VlanNetworkConfig) VlanDesiredState {
+	vlan := config.Vlan
+	vlanPort := config.WireguardPort
+	vlanBridge := s.vlanBridge
+	wireguardName := getWireguardInterfaceName(vlan)
+	vlanName := getVlanInterfaceName(vlan)
+	vrfName := getVrfName(vlan)
+	listName := fmt.Sprintf("VRF%d", vlan)
+
+	state := VlanDesiredState{
+		Vlan: vlan,
+		Items: []RouterOSItem{
+			{
+				Menu: "/interface/wireguard",
+				Key:  map[string]string{"name": wireguardName},
+				Properties: map[string]string{
+					"listen-port": strconv.Itoa(vlanPort),
+					"mtu":         strconv.Itoa(ROUTEROS_WIREGUARD_MTU),
+				},
+			},
+			{
+				Menu: "/interface/vlan",
+				Key:  map[string]string{"name": vlanName},
+				Properties: map[string]string{
+					"interface": vlanBridge,
+					"vlan-id":   strconv.Itoa(vlan),
+				},
+			},
+			{
+				Menu: "/interface/list",
+				Key:  map[string]string{"name": listName},
+			},
+			{
+				Menu:       "/ip/vrf",
+				Key:        map[string]string{"name": vrfName},
+				Properties: map[string]string{"interfaces": vlanName + "," + wireguardName},
+			},
+			{
+				Menu:       "/interface/bridge/vlan",
+				Key:        map[string]string{"bridge": vlanBridge, "vlan-ids": strconv.Itoa(vlan)},
+				Properties: map[string]string{"tagged": strings.Join(s.taggedBridges, ",")},
+			},
+			{
+				Menu: "/interface/list/member",
+				Key:  map[string]string{"list": listName, "interface": vlanName},
+			},
+			{
+				Menu: "/interface/list/member",
+				Key:  map[string]string{"list": listName, "interface": wireguardName},
+			},
+			{
+				Menu:       "/ip/address",
+				Key:        map[string]string{"address": config.GatewayAddress},
+				Properties: map[string]string{"interface": vlanName},
+			},
+			{
+				Menu:       "/ip/address",
+				Key:        map[string]string{"address": config.VpnGatewayAddress},
+				Properties: map[string]string{"interface": wireguardName},
+			},
+			// Firewall rules have no name, they are identified by everything they match
+			{
+				Menu: "/ip/firewall/filter",
+				Key: map[string]string{
+					"chain":             "input",
+					"action":            "accept",
+					"dst-port":          strconv.Itoa(vlanPort),
+					"in-interface-list": "WAN",
+					"protocol":          "udp",
+				},
+			},
+			{
+				Menu: "/ip/firewall/filter",
+				Key: map[string]string{
+					"chain":              "forward",
+					"action":             "accept",
+					"in-interface-list":  listName,
+					"out-interface-list": "WAN",
+				},
+			},
+			{
+				Menu: "/ip/firewall/filter",
+				Key: map[string]string{
+					"chain":              "forward",
+					"action":             "accept",
+					"in-interface-list":  listName,
+					"out-interface-list": listName,
+				},
+			},
+			{
+				Menu: "/ip/firewall/filter",
+				Key: map[string]string{
+					"chain":              "forward",
+					"action":             "accept",
+					"in-interface-list":  "WAN",
+					"out-interface-list": listName,
+				},
+			},
+			{
+				Menu:       "/ip/route",
+				Key:        map[string]string{"dst-address": config.Network, "routing-table": "main"},
+				Properties: map[string]string{"gateway": vlanName + "@" + vrfName},
+			},
+			{
+				Menu:       "/ip/route",
+				Key:        map[string]string{"dst-address": "0.0.0.0/0", "routing-table": vrfName},
+				Properties: map[string]string{"gateway": s.externalGateway + "@main"},
+			},
+		},
+	}
+
+	if config.isIpv6Enabled() {
+		state.Items = append(state.Items, s.getVlanIpv6Items(config, vlanName, wireguardName, vrfName, listName)...)
+	}
+
+	return state
+}
+
+// getVlanIpv6Items mirrors the IPv4 addresses, forward rules and routes of the VLAN, IPv6 has
+// its own firewall so they are needed again. The WireGuard endpoint stays IPv4 only
+func (s *RouterOSServiceImpl) getVlanIpv6Items(
+	config VlanNetworkConfig,
+	vlanName string,
+	wireguardName string,
+	vrfName string,
+	listName string,
+) []RouterOSItem {
+	items := []RouterOSItem{
+		// Addresses are configured statically through cloud-init, so they aren't advertised
+		{
+			Menu:       "/ipv6/address",
+			Key:        map[string]string{"address": config.Ipv6GatewayAddress},
+			Properties: map[string]string{"interface": vlanName, "advertise": "no"},
+		},
+		{
+			Menu:       "/ipv6/address",
+			Key:        map[string]string{"address": config.Ipv6VpnGatewayAddress},
+			Properties: map[string]string{"interface": wireguardName, "advertise": "no"},
+		},
+	}
+
+	for _, lists := range [][2]string{{listName, "WAN"}, {listName, listName}, {"WAN", listName}} {
+		items = append(items, RouterOSItem{
+			Menu: "/ipv6/firewall/filter",
+			Key: map[string]string{
+				"chain":              "forward",
+				"action":             "accept",
+				"in-interface-list":  lists[0],
+				"out-interface-list": lists[1],
+			},
+		})
+	}
+
+	items = append(items, RouterOSItem{
+		Menu:       "/ipv6/route",
+		Key:        map[string]string{"dst-address": config.Ipv6Network, "routing-table": "main"},
+		Properties: map[string]string{"gateway": vlanName + "@" + vrfName},
+	})
+
+	if s.externalIpv6Gateway != "" {
+		items = append(items, RouterOSItem{
+			Menu:       "/ipv6/route",
+			Key:        map[string]string{"dst-address": "::/0", "routing-table": vrfName},
+			Properties: map[string]string{"gateway": s.externalIpv6Gateway + "@main"},
+		})
+	}
+
+	return items
+}
+
+// getVmFirewallItems returns the filter rules of the VM firewall in evaluation order, identified by their comment.
+// They only match new connections, so the replies of connections already accepted aren't dropped
+func (s *RouterOSServiceImpl) getVmFirewallItems(config VmFirewallConfig, comment string) []RouterOSItem {
+	items := []RouterOSItem{}
+	for _, address := range config.Addresses {
+		ip, err := netip.ParseAddr(address)
+		if err != nil {
+			continue
+		}
+
+		menu, icmpProtocol := "/ip/firewall/filter", "icmp"
+		if ip.Is6() {
+			menu, icmpProtocol = "/ipv6/firewall/filter", "icmpv6"
+		}
+
+		for _, rule := range config.Rules {
+			if !rule.appliesToAddress(ip) {
+				continue
+			}
+
+			key := map[string]string{
+				"chain":            "forward",
+				"action":           rule.Action,
+				"connection-state": "new",
+				"comment":          comment,
+			}
+
+			if rule.Direction == FIREWALL_DIRECTION_EGRESS {
+				key["src-address"] = address
+				key["out-interface-list"] = "WAN"
+				if rule.Remote != "" {
+					key["dst-address"] = rule.Remote
+				}
+			} else {
+				key["dst-address"] = address
+				key["in-interface-list"] = "WAN"
+				if rule.Remote != "" {
+					key["src-address"] = rule.Remote
+				}
+			}
+
+			if rule.Protocol == FIREWALL_PROTOCOL_ICMP {
+				key["protocol"] = icmpProtocol
+			} else if rule.Protocol != "" {
+				key["protocol"] = rule.Protocol
+			}
+
+			if rule.Ports != "" {
+				key["dst-port"] = rule.Ports
+			}
+
+			items = append(items, RouterOSItem{Menu: menu, Key: key, Properties: map[string]string{}})
+		}
+	}
+
+	return items
+}
+
+// routerOSValuesEqual compares a desired value with the one reported by the router,
+// lists are compared regardless of the order RouterOS prints them in
+func routerOSValuesEqual(desired string, actual string) bool {
+	if desired == actual {
+		return true
+	}
+
+	desiredValues := strings.Split(desired, ",")
+	actualValues := strings.Split(actual, ",")
+	slices.Sort(desiredValues)
+	slices.Sort(actualValues)
+
+	return slices.Equal(desiredValues, actualValues)
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Lab VMs are mostly idle so vCPUs can be overcommitted, RAM and disk are not overcommitted by default
+const DEFAULT_CPU_OVERCOMMIT_RATIO = 4.0
+const DEFAULT_RAM_OVERCOMMIT_RATIO = 1.0
+const DEFAULT_DISK_OVERCOMMIT_RATIO = 1.0
+
+// Server agents above these limits in their last heartbeat don't get new VMs, whatever their reservations
+const MAX_CPU_USAGE = 0.9
+const MIN_AVAILABLE_RAM_MB = 128
+
+// Weights of the scoring stage, free capacities are ratios between 0 and 1
+const FREE_RAM_WEIGHT = 1.0
+const FREE_VCPUS_WEIGHT = 0.5
+const CPU_LOAD_WEIGHT = 0.5
+const SUBJECT_SPREAD_WEIGHT = 0.25 // Penalty for every instance of the same subject already in the server agent
+
+type SchedulingRequest struct {
+	VcpuCount int
+	VramMB    int
+	SizeMB    int
+	// Instances of the same subject are spread across server agents, it's the subject of
+	// isolated subjects too, not the network segment of the owner
+	SubjectId string
+	// Restricts the placement to this server agent, e.g. the one holding the backing template
+	ServerAgentUrl string
+	// Never places in this server agent, e.g. the source of a migration
+	ExcludedServerAgentUrl string
+}
+
+// ServerAgentReservations are the resources committed to the VMs placed in a server agent,
+// whether they are running or not
+type ServerAgentReservations struct {
+	VcpuCount int
+	VramMB    int
+	SizeMB    int
+	// Instances of the network segments of isolated subjects count for their subject
+	SubjectInstances map[string]int
+	// VMs created before the scheduler tracked reservations, they don't reserve anything
+	UnreservedVms int
+}
+
+// Reservation holds the requested resources in the selected server agent until it's
+// released, which has to happen once the VM is persisted in the database or it failed
+type Reservation struct {
+	ID             uint64
+	ServerAgentUrl string
+}
+
+type schedulingCandidate struct {
+	agent    ServerAgent
+	reserved ServerAgentReservations
+}
+
+// A filter returns why the candidate can't host the request, or an empty string if it can
+type schedulerFilter func(request SchedulingRequest, candidate schedulingCandidate) string
+
+// A weigher scores the candidates that passed every filter, the highest total score wins
+type schedulerWeigher func(request SchedulingRequest, candidate schedulingCandidate) float64
+
+type Scheduler interface {
+	Schedule(request SchedulingRequest) (Reservation, error)
+	Release(reservation Reservation)
+}
+
+type SchedulerImpl struct {
+	db                          Database
+	cpuOvercommitRatio          float64
+	ramOvercommitRatio          float64
+	diskOvercommitRatio         float64
+	maxSubjectInstancesPerAgent int
+	filters                     []schedulerFilter
+	weighers                    []schedulerWeigher
+	// VMs being created or migrated are not in the database yet, their reservations are kept here
+	pendingReservations map[uint64]pendingReservation
+	lastReservationId   uint64
+	mutex               sync.Mutex
+}
+
+type pendingReservation struct {
+	serverAgentUrl string
+	request        SchedulingRequest
+}
+
+// Schedule selects the server agent for a VM and reserves its resources there. Requests that fit
+// nowhere are rejected with the reason every server agent was discarded
+func (s *SchedulerImpl) Schedule(request SchedulingRequest) (Reservation, error) {
+	// Selecting and reserving must be atomic, otherwise a burst of requests lands in the same server agent
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	agents, err := s.db.GetServerAgents()
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	reservations, err := s.db.GetServerAgentsReservations()
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	var selectedAgent string
+	bestScore := math.Inf(-1)
+	rejections := []string{}
+
+	for _, agent := range agents {
+		if request.ServerAgentUrl != "" && agent.Url != request.ServerAgentUrl {
+			continue
+		}
+
+		if agent.Url == request.ExcludedServerAgentUrl {
+			continue
+		}
+
+		candidate := schedulingCandidate{
+			agent:    agent,
+			reserved: s.getReservations(agent, reservations),
+		}
+
+		if reason := s.filter(request, candidate); reason != "" {
+			rejections = append(rejections, fmt.Sprintf("%s: %s", agent.Url, reason))
+			continue
+		}
+
+		score := s.weigh(request, candidate)
+		if score > bestScore {
+			bestScore = score
+			selectedAgent = agent.Url
+		}
+	}
+
+	if selectedAgent == "" {
+		return Reservation{}, getSchedulingError(request, rejections)
+	}
+
+	s.lastReservationId++
+	reservation := Reservation{ID: s.lastReservationId, ServerAgentUrl: selectedAgent}
+	s.pendingReservations[reservation.ID] = pendingReservation{
+		serverAgentUrl: selectedAgent,
+		request:        request,
+	}
+
+	log.Printf(
+		"Scheduled %d vCPUs, %d MB of RAM and %d MB of disk in server agent '%s'",
+		request.VcpuCount,
+		request.VramMB,
+		request.SizeMB,
+		selectedAgent,
+	)
+
+	return reservation, nil
+}
+
+func (s *SchedulerImpl) Release(reservation Reservation) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.pendingReservations, reservation.ID)
+}
+
+// getReservations adds the pending reservations to the ones persisted in the database.
+// Must be called with the mutex locked
+func (s *SchedulerImpl) getReservations(agent ServerAgent, persisted map[string]ServerAgentReservations) ServerAgentReservations {
+	reserved := ServerAgentReservations{SubjectInstances: map[string]int{}}
+
+	if agentReservations, ok := persisted[agent.Url]; ok {
+		reserved.VcpuCount = agentReservations.VcpuCount
+		reserved.VramMB = agentReservations.VramMB
+		reserved.SizeMB = agentReservations.SizeMB
+		for subjectId, count := range agentReservations.SubjectInstances {
+			reserved.SubjectInstances[subjectId] = count
+		}
+
+		// What the unreserved VMs take is unknown, the usage the server agent reports is used instead
+		if agentReservations.UnreservedVms > 0 {
+			applyLiveUsage(&reserved, agent)
+		}
+	}
+
+	for _, pending := range s.pendingReservations {
+		if pending.serverAgentUrl != agent.Url {
+			continue
+		}
+
+		reserved.VcpuCount += pending.request.VcpuCount
+		reserved.VramMB += pending.request.VramMB
+		reserved.SizeMB += pending.request.SizeMB
+		if pending.request.SubjectId != "" {
+			reserved.SubjectInstances[pending.request.SubjectId]++
+		}
+	}
+
+	return reserved
+}
+
+// applyLiveUsage raises the reservations to the usage in the last heartbeat of the server agent.
+// It only counts the VMs that are running, so it's a lower bound of what the VMs would take
+func applyLiveUsage(reserved *ServerAgentReservations, agent ServerAgent) {
+	resourceStatus := agent.ResourceStatus
+
+	reserved.VcpuCount = max(reserved.VcpuCount, int(math.Ceil(resourceStatus.CpuLoad*float64(agent.VcpuCount))))
+	if agent.TotalMemoryMB > 0 {
+		reserved.VramMB = max(reserved.VramMB, agent.TotalMemoryMB-resourceStatus.FreeMemoryMB)
+	}
+	if agent.TotalDiskMB > 0 {
+		reserved.SizeMB = max(reserved.SizeMB, agent.TotalDiskMB-resourceStatus.FreeDiskMB)
+	}
+}
+
+func (s *SchedulerImpl) filter(request SchedulingRequest, candidate schedulingCandidate) string {
+	for _, filter := range s.filters {
+		if reason := filter(request, candidate); reason != "" {
+			return reason
+		}
+	}
+
+	return ""
+}
+
+func (s *SchedulerImpl) weigh(request SchedulingRequest, candidate schedulingCandidate) float64 {
+	score := 0.0
+	for _, weigher := range s.weighers {
+		score += weigher(request, candidate)
+	}
+
+	return score
+}
+
+func (s *SchedulerImpl) filterAlive(request SchedulingRequest, candidate schedulingCandidate) string {
+	if !isServerAgentAlive(candidate.agent) {
+		return "not sending heartbeats"
+	}
+
+	return ""
+}
+
+// Cordoned server agents keep their VMs but don't get new ones. Pinned requests skip it, they can only go
+// to that server agent, e.g. instances of a template it holds, so they're placed there anyway
+func (s *SchedulerImpl) filterCordoned(request SchedulingRequest, candidate schedulingCandidate) string {
+	if request.ServerAgentUrl != "" {
+		return ""
+	}
+
+	if candidate.agent.Draining {
+		return "draining"
+	}
+
+	if candidate.agent.Cordoned {
+		return "cordoned"
+	}
+
+	return ""
+}
+
+// filterOverloaded discards server agents whose last heartbeat shows them saturated,
+// e.g. because of VMs not managed by the vms manager. Like filterCordoned it doesn't apply to pinned requests,
+// they're still rejected if the reservations don't fit
+func (s *SchedulerImpl) filterOverloaded(request SchedulingRequest, candidate schedulingCandidate) string {
+	if request.ServerAgentUrl != "" {
+		return ""
+	}
+
+	resourceStatus := candidate.agent.ResourceStatus
+
+	if resourceStatus.FreeMemoryMB < MIN_AVAILABLE_RAM_MB || resourceStatus.CpuLoad > MAX_CPU_USAGE {
+		return fmt.Sprintf(
+			"overloaded (CPU load %.2f, %d MB of free RAM)",
+			resourceStatus.CpuLoad,
+			resourceStatus.FreeMemoryMB,
+		)
+	}
+
+	return ""
+}
+
+func (s *SchedulerImpl) filterVcpus(request SchedulingRequest, candidate schedulingCandidate) string {
+	return checkCapacity(
+		"vCPUs",
+		request.VcpuCount,
+		candidate.agent.VcpuCount,
+		candidate.reserved.VcpuCount,
+		s.cpuOvercommitRatio,
+	)
+}
+
+func (s *SchedulerImpl) filterRam(request SchedulingRequest, candidate schedulingCandidate) string {
+	return checkCapacity(
+		"MB of RAM",
+		request.VramMB,
+		candidate.agent.TotalMemoryMB,
+		candidate.reserved.VramMB,
+		s.ramOvercommitRatio,
+	)
+}
+
+func (s *SchedulerImpl) filterDisk(request SchedulingRequest, candidate schedulingCandidate) string {
+	return checkCapacity(
+		"MB of disk",
+		request.SizeMB,
+		candidate.agent.TotalDiskMB,
+		candidate.reserved.SizeMB,
+		s.diskOvercommitRatio,
+	)
+}
+
+// filterSubjectInstances is the hard anti-affinity per subject, disabled when the maximum is 0
+func (s *SchedulerImpl) filterSubjectInstances(request SchedulingRequest, candidate schedulingCandidate) string {
+	if s.maxSubjectInstancesPerAgent <= 0 || request.SubjectId == "" {
+		return ""
+	}
+
+	count := candidate.reserved.SubjectInstances[request.SubjectId]
+	if count >= s.maxSubjectInstancesPerAgent {
+		return fmt.Sprintf("already holds %d instances of subject '%s'", count, request.SubjectId)
+	}
+
+	return ""
+}
+
+func (s *SchedulerImpl) weighFreeRam(request SchedulingRequest, candidate schedulingCandidate) float64 {
+	return FREE_RAM_WEIGHT * getFreeCapacityRatio(
+		request.VramMB,
+		candidate.agent.TotalMemoryMB,
+		candidate.reserved.VramMB,
+		s.ramOvercommitRatio,
+	)
+}
+
+func (s *SchedulerImpl) weighFreeVcpus(request SchedulingRequest, candidate schedulingCandidate) float64 {
+	return FREE_VCPUS_WEIGHT * getFreeCapacityRatio(
+		request.VcpuCount,
+		candidate.agent.VcpuCount,
+		candidate.reserved.VcpuCount,
+		s.cpuOvercommitRatio,
+	)
+}
+
+func (s *SchedulerImpl) weighCpuLoad(request SchedulingRequest, candidate schedulingCandidate) float64 {
+	return -CPU_LOAD_WEIGHT * candidate.agent.ResourceStatus.CpuLoad
+}
+
+// weighSubjectSpread is the soft anti-affinity per subject, so the instances of
+// a whole class don't end up in the same server agent
+func (s *SchedulerImpl) weighSubjectSpread(request SchedulingRequest, candidate schedulingCandidate) float64 {
+	if request.SubjectId == "" {
+		return 0
+	}
+
+	return -SUBJECT_SPREAD_WEIGHT * float64(candidate.reserved.SubjectInstances[request.SubjectId])
+}
+
+// checkCapacity returns why the requested amount doesn't fit in the server agent. Server agents
+// that didn't report a total (0) are not checked for that resource
+func checkCapacity(resource string, requested int, total int, reserved int, overcommitRatio float64) string {
+	if total <= 0 {
+		return ""
+	}
+
+	capacity := int(float64(total) * overcommitRatio)
+	available := max(capacity-reserved, 0)
+
+	if requested > available {
+		return fmt.Sprintf(
+			"not enough %s (%d requested, %d of %d available with a %.2f overcommit ratio)",
+			resource,
+			requested,
+			available,
+			capacity,
+			overcommitRatio,
+		)
+	}
+
+	return ""
+}
+
+// getFreeCapacityRatio returns the ratio of the capacity left after placing the request
+func getFreeCapacityRatio(requested int, total int, reserved int, overcommitRatio float64) float64 {
+	capacity := float64(total) * overcommitRatio
+	if capacity <= 0 {
+		return 0
+	}
+
+	return (capacity - float64(reserved) - float64(requested)) / capacity
+}
+
+func getSchedulingError(request SchedulingRequest, rejections []string) error {
+	if len(rejections) == 0 {
+		if request.ServerAgentUrl != "" {
+			return NewHttpError(
+				http.StatusServiceUnavailable,
+				fmt.Errorf("server agent '%s' is not registered", request.ServerAgentUrl),
+			)
+		}
+
+		return NewHttpError(
+			http.StatusServiceUnavailable,
+			fmt.Errorf("there are no server agents registered, please try again later"),
+		)
+	}
+
+	return NewHttpError(
+		http.StatusServiceUnavailable,
+		fmt.Errorf(
+			"no server agent can host %d vCPUs, %d MB of RAM and %d MB of disk: %s",
+			request.VcpuCount,
+			request.VramMB,
+			request.SizeMB,
+			strings.Join(rejections, "; "),
+		),
+	)
+}
+
+// NewScheduler builds the scheduler. The overcommit ratios multiply the capacities reported by the
+// server agents and maxSubjectInstancesPerAgent limits the instances of a subject per server agent (0 means no limit)
+func NewScheduler(
+	db Database,
+	cpuOvercommitRatio float64,
+	ramOvercommitRatio float64,
+	diskOvercommitRatio float64,
+	maxSubjectInstancesPerAgent int,
+) Scheduler {
+	scheduler := &SchedulerImpl{
+		db:                          db,
+		cpuOvercommitRatio:          cpuOvercommitRatio,
+		ramOvercommitRatio:          ramOvercommitRatio,
+		diskOvercommitRatio:         diskOvercommitRatio,
+		maxSubjectInstancesPerAgent: maxSubjectInstancesPerAgent,
+		pendingReservations:         make(map[uint64]pendingReservation),
+		mutex:                       sync.Mutex{},
+	}
+
+	// Filters run in order and the first one discarding the server agent gives the reason
+	scheduler.filters = []schedulerFilter{
+		scheduler.filterAlive,
+		scheduler.filterCordoned,
+		scheduler.filterOverloaded,
+		scheduler.filterVcpus,
+		scheduler.filterRam,
+		scheduler.filterDisk,
+		scheduler.filterSubjectInstances,
+	}
+
+	scheduler.weighers = []schedulerWeigher{
+		scheduler.weighFreeRam,
+		scheduler.weighFreeVcpus,
+		scheduler.weighCpuLoad,
+		scheduler.weighSubjectSpread,
+	}
+
+	return scheduler
+}
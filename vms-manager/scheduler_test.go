@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestSchedulerServerAgent(url string) ServerAgent {
+	return ServerAgent{
+		Url:             url,
+		VcpuCount:       16,
+		TotalMemoryMB:   32768,
+		TotalDiskMB:     512000,
+		ResourceStatus:  GetResourceStatusAgentResponse{FreeMemoryMB: 32768, FreeDiskMB: 512000},
+		State:           ServerAgentAlive,
+		LastHeartbeatAt: time.Now(),
+	}
+}
+
+// Instances in the network segments of isolated subjects count as instances of their subject
+func TestScheduleCountsIsolatedSegmentsPerSubject(t *testing.T) {
+	db := newFakeDatabase()
+	db.serverAgents = []ServerAgent{
+		newTestSchedulerServerAgent("http://agent1"),
+		newTestSchedulerServerAgent("http://agent2"),
+	}
+
+	segmentId := getNetworkSegmentId(testSubjectId, true, "alice")
+	agentUrl := "http://agent1"
+	vmVlanIdentifier := 1
+	db.vms["instance"] = DatabaseVM{
+		ID:               "instance",
+		SubjectId:        &segmentId,
+		VmVlanIdentifier: &vmVlanIdentifier,
+		ServerAgentUrl:   &agentUrl,
+		VcpuCount:        2,
+		VramMB:           2048,
+		SizeMB:           10240,
+	}
+
+	scheduler := NewScheduler(db, DEFAULT_CPU_OVERCOMMIT_RATIO, DEFAULT_RAM_OVERCOMMIT_RATIO, DEFAULT_DISK_OVERCOMMIT_RATIO, 1)
+
+	reservation, err := scheduler.Schedule(SchedulingRequest{VcpuCount: 2, VramMB: 2048, SizeMB: 10240, SubjectId: testSubjectId})
+	if err != nil {
+		t.Fatalf("Schedule returned error: %v", err)
+	}
+	defer scheduler.Release(reservation)
+
+	if reservation.ServerAgentUrl != "http://agent2" {
+		t.Fatalf("expected the instance of the subject in http://agent2, got %s", reservation.ServerAgentUrl)
+	}
+}
+
+// VMs created before reservations were tracked reserve nothing, the server agent's reported usage counts instead
+func TestScheduleUsesLiveUsageOfUnreservedVms(t *testing.T) {
+	tests := []struct {
+		name      string
+		vcpuCount int
+		vramMB    int
+		sizeMB    int
+		fits      bool
+	}{
+		{name: "unreserved VM", fits: false},
+		{name: "reserved VM", vcpuCount: 2, vramMB: 2048, sizeMB: 10240, fits: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newFakeDatabase()
+			agent := newTestSchedulerServerAgent("http://agent1")
+			agent.ResourceStatus.FreeMemoryMB = 4096
+			db.serverAgents = []ServerAgent{agent}
+
+			agentUrl := agent.Url
+			db.vms["instance"] = DatabaseVM{
+				ID:             "instance",
+				ServerAgentUrl: &agentUrl,
+				VcpuCount:      test.vcpuCount,
+				VramMB:         test.vramMB,
+				SizeMB:         test.sizeMB,
+			}
+
+			scheduler := NewScheduler(db, DEFAULT_CPU_OVERCOMMIT_RATIO, DEFAULT_RAM_OVERCOMMIT_RATIO, DEFAULT_DISK_OVERCOMMIT_RATIO, 0)
+
+			reservation, err := scheduler.Schedule(SchedulingRequest{VcpuCount: 2, VramMB: 8192, SizeMB: 10240})
+			if test.fits && err != nil {
+				t.Fatalf("Schedule returned error: %v", err)
+			}
+			if !test.fits && err == nil {
+				t.Fatalf("expected the 4096 MB of free RAM to be too little, got %s", reservation.ServerAgentUrl)
+			}
+			scheduler.Release(reservation)
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Server agents send a heartbeat every 15 seconds, missing three in a row marks them as lost
+const SERVER_AGENT_HEARTBEAT_TIMEOUT = 45 * time.Second
+const SERVER_AGENTS_MONITOR_INTERVAL = 15 * time.Second
+
+func (s *ServiceImpl) RegisterServerAgent(request RegisterServerAgentRequest) error {
+	request.Url = strings.TrimSuffix(request.Url, "/")
+	if request.Url == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing server agent url"))
+	}
+
+	agent := ServerAgent{
+		Url:           request.Url,
+		Version:       request.Version,
+		Labels:        request.Labels,
+		VcpuCount:     request.VcpuCount,
+		TotalMemoryMB: request.TotalMemoryMB,
+		TotalDiskMB:   request.TotalDiskMB,
+	}
+	if agent.Labels == nil {
+		agent.Labels = map[string]string{}
+	}
+
+	if err := s.db.UpsertServerAgent(agent); err != nil {
+		return err
+	}
+
+	log.Printf("Server agent '%s' registered (version '%s', labels %v)", agent.Url, agent.Version, agent.Labels)
+
+	// The base images may have changed, or this may be the first server agent since the vms manager started
+	go func() {
+		if err := s.addBaseImagesToDb(); err != nil {
+			log.Printf("Error adding base images to the database: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+func (s *ServiceImpl) ServerAgentHeartbeat(request ServerAgentHeartbeatRequest) error {
+	url := strings.TrimSuffix(request.Url, "/")
+
+	found, err := s.db.UpdateServerAgentHeartbeat(url, request.ResourceStatus)
+	if err != nil {
+		return err
+	}
+
+	// The server agent registers again when it gets a not found, e.g. after being deregistered
+	if !found {
+		return NewHttpError(http.StatusNotFound, fmt.Errorf("server agent '%s' is not registered", url))
+	}
+
+	return nil
+}
+
+func (s *ServiceImpl) ReportDomainEvents(request DomainEventsRequest) error {
+	url := strings.TrimSuffix(request.Url, "/")
+
+	_, found, err := s.db.GetServerAgent(url)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return NewHttpError(http.StatusNotFound, fmt.Errorf("server agent '%s' is not registered", url))
+	}
+
+	return s.instanceEvents.Report(request)
+}
+
+func (s *ServiceImpl) SubscribeInstanceEvents() (chan InstanceEvent, []InstanceEvent) {
+	return s.instanceEvents.Subscribe()
+}
+
+func (s *ServiceImpl) UnsubscribeInstanceEvents(events chan InstanceEvent) {
+	s.instanceEvents.Unsubscribe(events)
+}
+
+func (s *ServiceImpl) ListServerAgents() ([]ServerAgentResponse, error) {
+	agents, err := s.db.GetServerAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	response := []ServerAgentResponse{}
+	for _, agent := range agents {
+		response = append(response, toServerAgentResponse(agent))
+	}
+
+	return response, nil
+}
+
+func (s *ServiceImpl) SetServerAgentCordon(request SetServerAgentCordonRequest) error {
+	if _, err := s.getRegisteredServerAgent(request.ServerAgentUrl); err != nil {
+		return err
+	}
+
+	if err := s.db.SetServerAgentCordoned(request.ServerAgentUrl, request.Cordoned); err != nil {
+		return err
+	}
+
+	log.Printf("Server agent '%s' cordoned: %t", request.ServerAgentUrl, request.Cordoned)
+
+	return nil
+}
+
+// DrainServerAgent cordons the server agent and migrates its instances to other server agents,
+// running instances are live migrated. It stays draining until it's uncordoned or deregistered
+func (s *ServiceImpl) DrainServerAgent(agentUrl string, progress JobProgress) (DrainServerAgentResponse, error) {
+	response := DrainServerAgentResponse{
+		MigratedInstances:  []string{},
+		FailedInstances:    map[string]string{},
+		RemainingTemplates: []string{},
+	}
+
+	if _, err := s.getRegisteredServerAgent(agentUrl); err != nil {
+		return response, err
+	}
+
+	if err := s.db.SetServerAgentDraining(agentUrl, true); err != nil {
+		return response, err
+	}
+
+	if err := s.checkIfServerAgentIsAlive(agentUrl); err != nil {
+		return response, NewHttpError(
+			http.StatusServiceUnavailable,
+			fmt.Errorf("server agent '%s' is not available, its instances can't be migrated", agentUrl),
+		)
+	}
+
+	vms, err := s.db.GetVmsByServerAgentUrl(agentUrl)
+	if err != nil {
+		return response, err
+	}
+
+	statuses, err := s.ListInstancesStatus()
+	if err != nil {
+		return response, err
+	}
+
+	for _, vm := range vms {
+		if vm.IsBase {
+			continue
+		}
+
+		if vm.IsTemplate {
+			response.RemainingTemplates = append(response.RemainingTemplates, vm.ID)
+			continue
+		}
+
+		running := false
+		for _, status := range statuses {
+			if status.InstanceId == vm.ID {
+				running = status.Status == RUNNING_STATUS
+				break
+			}
+		}
+
+		// The scheduler selects the target of every instance
+		progress.Report(fmt.Sprintf("migrating instance %s", vm.ID))
+		request := MigrateInstanceRequest{Live: running}
+		if err := s.MigrateInstance(vm.ID, request); err != nil {
+			response.FailedInstances[vm.ID] = err.Error()
+			continue
+		}
+
+		response.MigratedInstances = append(response.MigratedInstances, vm.ID)
+	}
+
+	log.Printf(
+		"Drained server agent '%s': %d instances migrated, %d failed, %d templates remaining",
+		agentUrl,
+		len(response.MigratedInstances),
+		len(response.FailedInstances),
+		len(response.RemainingTemplates),
+	)
+
+	return response, nil
+}
+
+// DeregisterServerAgent forgets a retired server agent, it must not hold any VM
+func (s *ServiceImpl) DeregisterServerAgent(agentUrl string) error {
+	if _, err := s.getRegisteredServerAgent(agentUrl); err != nil {
+		return err
+	}
+
+	vms, err := s.db.GetVmsByServerAgentUrl(agentUrl)
+	if err != nil {
+		return err
+	}
+
+	if len(vms) > 0 {
+		return NewHttpError(
+			http.StatusConflict,
+			fmt.Errorf("server agent '%s' still holds %d VMs, drain it first", agentUrl, len(vms)),
+		)
+	}
+
+	if err := s.db.DeleteServerAgent(agentUrl); err != nil {
+		return err
+	}
+
+	log.Printf("Server agent '%s' deregistered", agentUrl)
+
+	return nil
+}
+
+func (s *ServiceImpl) getRegisteredServerAgent(agentUrl string) (ServerAgent, error) {
+	agent, found, err := s.db.GetServerAgent(agentUrl)
+	if err != nil {
+		return ServerAgent{}, err
+	}
+
+	if !found {
+		return ServerAgent{}, NewHttpError(
+			http.StatusBadRequest,
+			fmt.Errorf("server agent '%s' does not exist", agentUrl),
+		)
+	}
+
+	return agent, nil
+}
+
+// getAliveServerAgents returns the server agents that sent a heartbeat recently
+func (s *ServiceImpl) getAliveServerAgents() ([]ServerAgent, error) {
+	agents, err := s.db.GetServerAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	aliveAgents := []ServerAgent{}
+	for _, agent := range agents {
+		if isServerAgentAlive(agent) {
+			aliveAgents = append(aliveAgents, agent)
+		}
+	}
+
+	return aliveAgents, nil
+}
+
+func (s *ServiceImpl) checkIfServerAgentIsAlive(agentUrl string) error {
+	agent, found, err := s.db.GetServerAgent(agentUrl)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return fmt.Errorf("server agent '%s' is not registered", agentUrl)
+	}
+
+	if !isServerAgentAlive(agent) {
+		return fmt.Errorf("server agent '%s' didn't send a heartbeat since %s", agentUrl, agent.LastHeartbeatAt)
+	}
+
+	return nil
+}
+
+// monitorServerAgents marks as lost the server agents that stop sending heartbeats
+func (s *ServiceImpl) monitorServerAgents() {
+	for {
+		time.Sleep(SERVER_AGENTS_MONITOR_INTERVAL)
+
+		lostAgents, err := s.db.MarkLostServerAgents(SERVER_AGENT_HEARTBEAT_TIMEOUT)
+		if err != nil {
+			continue
+		}
+
+		for _, agentUrl := range lostAgents {
+			log.Printf("Server agent '%s' stopped sending heartbeats, marked as lost", agentUrl)
+		}
+	}
+}
+
+// The state is only updated by the monitor, the heartbeat time is also checked
+// so lost server agents are detected without waiting for it
+func isServerAgentAlive(agent ServerAgent) bool {
+	return agent.State == ServerAgentAlive && time.Since(agent.LastHeartbeatAt) < SERVER_AGENT_HEARTBEAT_TIMEOUT
+}
+
+func toServerAgentResponse(agent ServerAgent) ServerAgentResponse {
+	state := agent.State
+	if !isServerAgentAlive(agent) {
+		state = ServerAgentLost
+	}
+
+	return ServerAgentResponse{
+		Url:             agent.Url,
+		Version:         agent.Version,
+		Labels:          agent.Labels,
+		VcpuCount:       agent.VcpuCount,
+		TotalMemoryMB:   agent.TotalMemoryMB,
+		TotalDiskMB:     agent.TotalDiskMB,
+		ResourceStatus:  agent.ResourceStatus,
+		State:           state,
+		Cordoned:        agent.Cordoned,
+		Draining:        agent.Draining,
+		RegisteredAt:    agent.RegisteredAt,
+		LastHeartbeatAt: agent.LastHeartbeatAt,
+	}
+}
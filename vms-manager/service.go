@@ -6,67 +6,128 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"net/http"
+	"net/netip"
 	"path/filepath"
 	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 )
 
 const RUNNING_STATUS = "running"
 const SHUTOFF_STATUS = "shut off"
-const FIRST_VLAN = 100
-const MAX_VLANS = 255
-const MAX_VMS_PER_VLAN = 253 // 255 total IPs in the subnet, minus the first IP (gateway) and the last IP (broadcast)
 const FIRST_IP_IN_SUBNET = 1
-const SUBNET_MASK = 24
-const INTERFACE_ADDRESS_SECOND_OCTET = 1
 const INTERFACE_ADDRESS_SUBNET_MASK = 32
-const MAX_CPU_USAGE = 0.9
-const MIN_AVAILABLE_RAM_MB = 128
-const CPU_USAGE_PENALTY_FACTOR = 10240 // 10240 MB of RAM for 100% of CPU Load, adjust this value to change the penalty for high CPU usage
 const VLAN_TO_ROUTER_PORT_OFFSET = 20000
+const CONSOLE_TICKET_TTL = 30 * time.Second
+const CONSOLE_DIAL_TIMEOUT = 10 * time.Second
+
+// Idempotent requests to the server agents are sent again when the connection fails
+const IDEMPOTENT_AGENT_REQUEST_ATTEMPTS = 3
+const IDEMPOTENT_AGENT_REQUEST_RETRY_WAIT = 5 * time.Second
+
+// Database writes that follow a change in a server agent are retried, so a short
+// outage of the database doesn't fail the job. The wait is doubled after every attempt
+const DB_WRITE_ATTEMPTS = 5
+const DB_WRITE_RETRY_WAIT = time.Second
 
 type Service interface {
 	ListBaseImages() ([]ListBaseImagesResponse, error)
-	DefineTemplate(request DefineTemplateRequest) (DefineTemplateResponse, error)
-	DeleteTemplate(templateId string) error
-	CreateInstance(request CreateInstanceRequest) (CreateInstanceResponse, error)
-	DeleteInstance(instanceId string) error
+	DefineTemplate(request DefineTemplateRequest, progress JobProgress) (DefineTemplateResponse, error)
+	DeleteTemplate(templateId string, progress JobProgress) error
+	CreateInstance(request CreateInstanceRequest, progress JobProgress) (CreateInstanceResponse, error)
+	DeleteInstance(instanceId string, progress JobProgress) error
 	StartInstance(instanceId string) error
-	StopInstance(instanceId string) error
+	StopInstance(instanceId string, progress JobProgress) error
 	RestartInstance(instanceId string) error
 	ListInstancesStatus() ([]ListInstancesStatusResponse, error)
+	ListVms() ([]ListVmsResponse, error)
+	GetReconciliationReport() (ReconciliationReport, error)
+	RunReconciliation() (ReconciliationReport, error)
 	ListServersStatus() ([]ListServersStatusResponse, error)
+	MigrateInstance(instanceId string, request MigrateInstanceRequest) error
+	CreateSnapshot(instanceId string) (CreateSnapshotResponse, error)
+	ListSnapshots(instanceId string) ([]ListSnapshotsResponse, error)
+	RevertSnapshot(instanceId string, snapshotId string) error
+	DeleteSnapshot(instanceId string, snapshotId string) error
+	CreateConsoleTicket(instanceId string) (CreateConsoleTicketResponse, error)
+	OpenInstanceConsole(ticket string) (*websocket.Conn, error)
+	RegisterServerAgent(request RegisterServerAgentRequest) error
+	ServerAgentHeartbeat(request ServerAgentHeartbeatRequest) error
+	ReportDomainEvents(request DomainEventsRequest) error
+	SubscribeInstanceEvents() (chan InstanceEvent, []InstanceEvent)
+	UnsubscribeInstanceEvents(events chan InstanceEvent)
+	ListServerAgents() ([]ServerAgentResponse, error)
+	SetServerAgentCordon(request SetServerAgentCordonRequest) error
+	DrainServerAgent(agentUrl string, progress JobProgress) (DrainServerAgentResponse, error)
+	DeregisterServerAgent(agentUrl string) error
+	GetRouterDrift() ([]VlanDriftResponse, error)
+	ReconcileRouter() ([]VlanDriftResponse, error)
+	CreateLab(request CreateLabRequest, progress JobProgress) (CreateLabResponse, error)
+	StartLab(labId string) error
+	StopLab(labId string, progress JobProgress) error
+	DeleteLab(labId string, progress JobProgress) error
+	CreateFirewallPolicy(request CreateFirewallPolicyRequest) (CreateFirewallPolicyResponse, error)
+	ListFirewallPolicies(subjectId string) ([]FirewallPolicyResponse, error)
+	GetFirewallPolicy(policyId string) (FirewallPolicyResponse, error)
+	UpdateFirewallPolicy(policyId string, request UpdateFirewallPolicyRequest) error
+	DeleteFirewallPolicy(policyId string) error
+	CreatePortForward(request CreatePortForwardRequest) (CreatePortForwardResponse, error)
+	ListPortForwards(instanceId string) ([]PortForwardResponse, error)
+	DeletePortForward(portForwardId string) error
+	CreateWireguardPeer(request CreateWireguardPeerRequest) (CreateWireguardPeerResponse, error)
+	ListWireguardPeers(instanceId string) ([]WireguardPeerResponse, error)
+	DeleteWireguardPeer(peerId string) error
+	RotateInstanceWireguardKey(instanceId string, request RotateWireguardKeyRequest) error
 }
 
 type ServiceImpl struct {
-	db                          Database
-	serverAgentsURLs            []string
-	listBaseImagesEndpoint      string
-	defineTemplateEndpoint      string
-	deleteTemplateEndpoint      string
-	createInstanceEndpoint      string
-	deleteInstanceEndpoint      string
-	startInstanceEndpoint       string
-	stopInstanceEndpoint        string
-	restartInstanceEndpoint     string
-	listInstancesStatusEndpoint string
-	getResourceStatusEndpoint   string
-	serverAgentIsAliveEndpoint  string
-	vmsDns1                     string
-	vmsDns2                     string
-	routerosService             RouterOSService
-	routerosVlanBridge          string
-	routerosTaggedBridges       []string
-	routerosExternalGateway     string
-	vmsMutexMap                 map[string]*sync.Mutex
-	mutex                       sync.Mutex
-	routerVlanConfSharedMemory  []int
-	routerVlanConfMutex         sync.Mutex
+	db                           Database
+	agentClient                  *AgentClient
+	scheduler                    Scheduler
+	ipam                         IPAM
+	listBaseImagesEndpoint       string
+	defineTemplateEndpoint       string
+	deleteTemplateEndpoint       string
+	createInstanceEndpoint       string
+	deleteInstanceEndpoint       string
+	startInstanceEndpoint        string
+	stopInstanceEndpoint         string
+	restartInstanceEndpoint      string
+	listInstancesStatusEndpoint  string
+	migrateInstanceEndpoint      string
+	setupInstanceNetworkEndpoint string
+	createSnapshotEndpoint       string
+	listSnapshotsEndpoint        string
+	revertSnapshotEndpoint       string
+	deleteSnapshotEndpoint       string
+	instanceConsoleEndpoint      string
+	vmsDns1                      string
+	vmsDns2                      string
+	networkBackend               NetworkBackend
+	// Invalid when IPv6 is disabled
+	ipv6Prefix                 netip.Prefix
+	vmsMutexMap                map[string]*sync.Mutex
+	mutex                      sync.Mutex
+	routerVlanConfSharedMemory []int
+	routerVlanConfMutex        sync.Mutex
+	consoleTickets             map[string]ConsoleTicket
+	consoleTicketsMutex        sync.Mutex
+	listVmDisksEndpoint        string
+	// Zero disables the periodic reconciliation, it can still be run on demand
+	reconcilerInterval       time.Duration
+	reconcilerRepair         bool
+	reconcilerMutex          sync.Mutex
+	lastReconciliationReport *ReconciliationReport
+	// Orphans found by the last reconciliation, only the ones found twice in a row are repaired
+	previousOrphans map[string]bool
+	instanceEvents  *InstanceEvents
+	// Zero in tests, so failed writes are retried without waiting
+	dbWriteRetryWait time.Duration
 }
 
 type VmNetworkConfig struct {
@@ -74,6 +135,15 @@ type VmNetworkConfig struct {
 	Gateway          string
 	VlanEtiquete     string
 	VmVlanIdentifier int
+	// Networks of the subject VLAN and its VPN, e.g. 10.0.1.0/24 and 10.1.1.0/24
+	Network    string
+	VpnNetwork string
+	// Address of the user's WireGuard interface, e.g. 10.1.1.2/32
+	InterfaceAddress string
+	// Empty when IPv6 is disabled
+	Ipv6AddWithSubnet    string
+	Ipv6Gateway          string
+	Ipv6InterfaceAddress string
 }
 
 func (s *ServiceImpl) ListBaseImages() ([]ListBaseImagesResponse, error) {
@@ -85,7 +155,8 @@ func (s *ServiceImpl) ListBaseImages() ([]ListBaseImagesResponse, error) {
 	return s.toListBaseImagesResponse(baseImages)
 }
 
-func (s *ServiceImpl) DefineTemplate(request DefineTemplateRequest) (DefineTemplateResponse, error) {
+func (s *ServiceImpl) DefineTemplate(request DefineTemplateRequest, progress JobProgress) (DefineTemplateResponse, error) {
+	progress.Report("validating request")
 	if err := s.checkIfVmExists(request.SourceInstanceId); err != nil {
 		return DefineTemplateResponse{}, err
 	}
@@ -132,12 +203,14 @@ func (s *ServiceImpl) DefineTemplate(request DefineTemplateRequest) (DefineTempl
 		return DefineTemplateResponse{}, err
 	}
 
+	// The template ID is new for every job, so it identifies the request if it has to be sent again
 	agentRequest := DefineTemplateAgentRequest{
 		SourceInstanceId: request.SourceInstanceId,
 		TemplateId:       templateId,
 		SizeMB:           request.SizeMB,
 		VcpuCount:        request.VcpuCount,
 		VramMB:           request.VramMB,
+		IdempotencyKey:   templateId,
 	}
 
 	jsonData, err := json.Marshal(agentRequest)
@@ -145,20 +218,29 @@ func (s *ServiceImpl) DefineTemplate(request DefineTemplateRequest) (DefineTempl
 		return DefineTemplateResponse{}, logAndReturnError("Error marshalling define template agent request: ", err.Error())
 	}
 
-	agentUrl, err := s.selectServerAgent()
+	// The template is created from the source instance's disk image,
+	// so it has to be defined in the server agent that holds it
+	agentUrl, err := s.getVmServerAgent(request.SourceInstanceId)
+	if err != nil {
+		return DefineTemplateResponse{}, err
+	}
+
+	// Templates never run, they only need disk
+	reservation, err := s.scheduler.Schedule(SchedulingRequest{
+		SizeMB:         request.SizeMB,
+		ServerAgentUrl: agentUrl,
+	})
 	if err != nil {
 		return DefineTemplateResponse{}, err
 	}
+	defer s.scheduler.Release(reservation)
 
 	vmMutex := s.getVmMutex(request.SourceInstanceId)
 	vmMutex.Lock()
 	defer vmMutex.Unlock()
 
-	resp, err := http.Post(
-		agentUrl+s.defineTemplateEndpoint,
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
+	progress.Report("defining template in server agent")
+	resp, err := s.postIdempotentAgentRequest(agentUrl+s.defineTemplateEndpoint, jsonData)
 	if err != nil {
 		return DefineTemplateResponse{}, err
 	}
@@ -168,19 +250,30 @@ func (s *ServiceImpl) DefineTemplate(request DefineTemplateRequest) (DefineTempl
 	}
 
 	vm := Vm{
-		ID:          templateId,
-		Description: nil,
-		DependsOn:   nil,
+		ID:             templateId,
+		Description:    nil,
+		DependsOn:      nil,
+		ServerAgentUrl: &agentUrl,
+		VcpuCount:      request.VcpuCount,
+		VramMB:         request.VramMB,
+		SizeMB:         request.SizeMB,
+	}
+
+	if err := s.addVmToDb(vm, true); err != nil {
+		// The template can't be used without its record, so its files aren't left in the server agent
+		if err := s.deleteVmInServerAgent(agentUrl, DeleteVmAgentRequest{VmId: templateId}); err != nil {
+			log.Printf("Error removing template %s from its server agent: %v", templateId, err)
+		}
+		return DefineTemplateResponse{}, err
 	}
 
-	s.addVmToDb(vm, true)
-
 	return DefineTemplateResponse{
 		TemplateId: templateId,
 	}, nil
 }
 
-func (s *ServiceImpl) DeleteTemplate(templateId string) error {
+func (s *ServiceImpl) DeleteTemplate(templateId string, progress JobProgress) error {
+	progress.Report("validating request")
 	if err := s.checkIfVmExists(templateId); err != nil {
 		return err
 	}
@@ -214,60 +307,61 @@ func (s *ServiceImpl) DeleteTemplate(templateId string) error {
 		Vid:            "",
 	}
 
-	jsonData, err := json.Marshal(request)
+	agentUrl, err := s.getVmServerAgent(templateId)
 	if err != nil {
-		return logAndReturnError("Error marshalling delete template agent request: ", err.Error())
+		return err
 	}
 
-	// We need to call the deleteInstanceEndpoint for each server agent
-	// because the template might not exist in all of them
-	agentsCalled := 0
-	vmMutex := s.getVmMutex(templateId)
-	vmMutex.Lock()
-	defer vmMutex.Unlock()
-	for _, agentUrl := range s.serverAgentsURLs {
-		if err := s.checkIfServerAgentIsAlive(agentUrl); err != nil {
-			continue
-		}
-		agentsCalled++
+	// Server agents where instances backed by this template were migrated hold a copy of it
+	copiesAgentsUrls, err := s.db.GetTemplateCopiesServerAgentUrls(templateId)
+	if err != nil {
+		return err
+	}
 
-		// Calling deleteInstaceEndpoint because the server agent
-		// makes no difference between a template and an instance
-		req, err := http.NewRequest(
-			http.MethodDelete,
-			agentUrl+s.deleteInstanceEndpoint,
-			bytes.NewBuffer(jsonData),
-		)
-		if err != nil {
-			return logAndReturnError("Error creating delete template request: ", err.Error())
+	for _, copyAgentUrl := range copiesAgentsUrls {
+		if err := s.checkIfServerAgentIsAlive(copyAgentUrl); err != nil {
+			return NewHttpError(
+				http.StatusServiceUnavailable,
+				fmt.Errorf("server agent holding a copy of template '%s' is not available, please try again later", templateId),
+			)
 		}
+	}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			return logAndReturnError("Error sending delete template request: ", err.Error())
-		}
+	vmMutex := s.getVmMutex(templateId)
+	vmMutex.Lock()
+	defer vmMutex.Unlock()
 
-		if err := checkIfStatusCodeIsOk(resp); err != nil {
+	progress.Report("deleting template in server agents")
+	for _, copyAgentUrl := range copiesAgentsUrls {
+		if err := s.deleteVmInServerAgent(copyAgentUrl, request); err != nil {
 			return err
 		}
+	}
 
-		resp.Body.Close()
+	if err := s.deleteVmInServerAgent(agentUrl, request); err != nil {
+		return err
 	}
 
-	if agentsCalled == 0 {
-		return NewHttpError(
-			http.StatusInternalServerError,
-			fmt.Errorf("no server agents available to delete template"),
-		)
+	if err := s.deleteVmFromDb(templateId); err != nil {
+		return err
 	}
-	s.deleteVmFromDb(templateId)
 	s.deleteVmMutex(templateId)
 
 	return nil
 }
 
-func (s *ServiceImpl) CreateInstance(request CreateInstanceRequest) (CreateInstanceResponse, error) {
+func (s *ServiceImpl) CreateInstance(request CreateInstanceRequest, progress JobProgress) (CreateInstanceResponse, error) {
+	return s.createInstance(request, nil, progress)
+}
+
+// createInstance creates the instance in the server agent selected by the scheduler,
+// instances of a lab are created in the placement of the lab instead
+func (s *ServiceImpl) createInstance(
+	request CreateInstanceRequest,
+	placement *labPlacement,
+	progress JobProgress,
+) (CreateInstanceResponse, error) {
+	progress.Report("validating request")
 	if request.SizeMB <= 0 ||
 		request.VcpuCount <= 0 ||
 		request.VramMB <= 0 ||
@@ -283,6 +377,17 @@ func (s *ServiceImpl) CreateInstance(request CreateInstanceRequest) (CreateInsta
 		)
 	}
 
+	if request.SubjectIsolated && request.OwnerId == "" {
+		return CreateInstanceResponse{}, NewHttpError(
+			http.StatusBadRequest,
+			fmt.Errorf("invalid request: ownerId must be non-empty when subjectIsolated is set"),
+		)
+	}
+
+	// Instances of isolated subjects are placed in the network segment of their owner,
+	// from here on the segment is handled as a subject of its own
+	segmentId := getNetworkSegmentId(request.SubjectId, request.SubjectIsolated, request.OwnerId)
+
 	if err := s.checkIfVmExists(request.SourceVmId); err != nil {
 		return CreateInstanceResponse{}, err
 	}
@@ -309,11 +414,25 @@ func (s *ServiceImpl) CreateInstance(request CreateInstanceRequest) (CreateInsta
 		return CreateInstanceResponse{}, err
 	}
 
-	vmNetworkConfig, err := s.getVmNetworkConfigFromSubjectId(request.SubjectId)
+	progress.Report("allocating network")
+	vmNetworkConfig, err := s.getVmNetworkConfig(
+		segmentId,
+		instanceId,
+		request.SubjectPrefixLength,
+		request.SubjectIsolated,
+	)
 	if err != nil {
 		return CreateInstanceResponse{}, err
 	}
 
+	// Once the VM is in the database its address is released when it's deleted
+	vmPersisted := false
+	defer func() {
+		if !vmPersisted {
+			s.ipam.ReleaseVm(instanceId)
+		}
+	}()
+
 	// If the source VM is a base image, we need to get the description
 	// this is because base images are stored in servers with their description as the file name.
 	// Non-base VMs are stored with their ID as the file name.
@@ -328,20 +447,54 @@ func (s *ServiceImpl) CreateInstance(request CreateInstanceRequest) (CreateInsta
 	}
 
 	agentRequest := CreateInstanceAgentRequest{
-		SourceVmId:      sourceVmId,
-		SourceIsBase:    isBase,
-		InstanceId:      instanceId,
-		SizeMB:          request.SizeMB,
-		VcpuCount:       request.VcpuCount,
-		VramMB:          request.VramMB,
-		Username:        request.Username,
-		Password:        request.Password,
-		PublicSshKeys:   request.PublicSshKeys,
-		IpAddWithSubnet: vmNetworkConfig.IpAddWithSubnet,
-		Dns1:            s.vmsDns1,
-		Dns2:            s.vmsDns2,
-		Gateway:         vmNetworkConfig.Gateway,
-		VlanEtiquete:    vmNetworkConfig.VlanEtiquete,
+		SourceVmId:        sourceVmId,
+		SourceIsBase:      isBase,
+		InstanceId:        instanceId,
+		SizeMB:            request.SizeMB,
+		VcpuCount:         request.VcpuCount,
+		VramMB:            request.VramMB,
+		Username:          request.Username,
+		Password:          request.Password,
+		PublicSshKeys:     request.PublicSshKeys,
+		IpAddWithSubnet:   vmNetworkConfig.IpAddWithSubnet,
+		Dns1:              s.vmsDns1,
+		Dns2:              s.vmsDns2,
+		Gateway:           vmNetworkConfig.Gateway,
+		VlanEtiquete:      vmNetworkConfig.VlanEtiquete,
+		Ipv6AddWithSubnet: vmNetworkConfig.Ipv6AddWithSubnet,
+		Ipv6Gateway:       vmNetworkConfig.Ipv6Gateway,
+		IdempotencyKey:    instanceId,
+	}
+
+	var agentUrl string
+	if placement != nil {
+		// The lab holds the reservation of all its instances
+		agentUrl = placement.serverAgentUrl
+		agentRequest.LabInterfaces = getLabInterfacesAgentRequest(placement.interfaces, vmNetworkConfig.VmVlanIdentifier)
+	} else {
+		// Instances created from a template need to live in the server agent that
+		// holds the template's disk image, because it is used as their backing file
+		schedulingRequest := SchedulingRequest{
+			VcpuCount: request.VcpuCount,
+			VramMB:    request.VramMB,
+			SizeMB:    request.SizeMB,
+			SubjectId: getNetworkSegmentSubjectId(segmentId),
+		}
+		if isTemplate {
+			schedulingRequest.ServerAgentUrl, err = s.getVmServerAgent(request.SourceVmId)
+			if err != nil {
+				return CreateInstanceResponse{}, err
+			}
+		}
+
+		// The reservation is held until the instance is persisted, so concurrent requests account for it
+		progress.Report("scheduling instance")
+		reservation, err := s.scheduler.Schedule(schedulingRequest)
+		if err != nil {
+			return CreateInstanceResponse{}, err
+		}
+		defer s.scheduler.Release(reservation)
+		agentUrl = reservation.ServerAgentUrl
 	}
 
 	jsonData, err := json.Marshal(agentRequest)
@@ -349,20 +502,12 @@ func (s *ServiceImpl) CreateInstance(request CreateInstanceRequest) (CreateInsta
 		return CreateInstanceResponse{}, logAndReturnError("Error marshalling create instance agent request: ", err.Error())
 	}
 
-	agentUrl, err := s.selectServerAgent()
-	if err != nil {
-		return CreateInstanceResponse{}, err
-	}
-
 	vmMutex := s.getVmMutex(request.SourceVmId)
 	vmMutex.Lock()
 	defer vmMutex.Unlock()
 
-	resp, err := http.Post(
-		agentUrl+s.createInstanceEndpoint,
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
+	progress.Report("creating instance in server agent")
+	resp, err := s.postIdempotentAgentRequest(agentUrl+s.createInstanceEndpoint, jsonData)
 	if err != nil {
 		return CreateInstanceResponse{}, err
 	}
@@ -375,39 +520,55 @@ func (s *ServiceImpl) CreateInstance(request CreateInstanceRequest) (CreateInsta
 		ID:               instanceId,
 		Description:      nil,
 		DependsOn:        &request.SourceVmId,
-		SubjectId:        &request.SubjectId,
+		SubjectId:        &segmentId,
 		VmVlanIdentifier: &vmNetworkConfig.VmVlanIdentifier,
+		ServerAgentUrl:   &agentUrl,
+		VcpuCount:        request.VcpuCount,
+		VramMB:           request.VramMB,
+		SizeMB:           request.SizeMB,
 	}
 
-	s.addVmToDb(vm, false)
+	if err := s.addVmToDb(vm, false); err != nil {
+		// The instance can't be managed without its record, so it isn't left in the server agent
+		if err := s.deleteVmInServerAgent(agentUrl, DeleteVmAgentRequest{VmId: instanceId}); err != nil {
+			log.Printf("Error removing instance %s from its server agent: %v", instanceId, err)
+		}
+		return CreateInstanceResponse{}, err
+	}
+	vmPersisted = true
 
 	vlan, err := s.db.GetVlanByVmId(instanceId)
 	if err != nil {
 		return CreateInstanceResponse{}, err
 	}
 
+	progress.Report("configuring router")
 	if err := s.addVlanConfigIfNotExists(vlan); err != nil {
-		vmMutex.Unlock()
-		s.DeleteInstance(instanceId)
-		vmMutex.Lock()
+		s.rollbackInstance(instanceId)
 		return CreateInstanceResponse{}, err
 	}
 
-	interfaceAddress := getInterfaceAddressWithSubnet(vmNetworkConfig.IpAddWithSubnet)
-	peerAllowedIps := getPeerAllowedIps(vmNetworkConfig.IpAddWithSubnet)
+	interfaceAddress := vmNetworkConfig.InterfaceAddress
+	if s.isIpv6Enabled() {
+		// WireGuard configs take a comma separated list of interface addresses
+		interfaceAddress += ", " + vmNetworkConfig.Ipv6InterfaceAddress
+	}
+	peerAllowedIps := s.getPeerAllowedIps(vlan, vmNetworkConfig.Network, vmNetworkConfig.VpnNetwork)
 
-	peerPublicKey, err := s.routerosService.GetWireguardPublicKey(fmt.Sprintf("wireguard%d", vlan))
+	peerPublicKey, err := s.networkBackend.GetWireguardPublicKey(vlan)
 	if err != nil {
-		vmMutex.Unlock()
-		s.DeleteInstance(instanceId)
-		vmMutex.Lock()
+		s.rollbackInstance(instanceId)
 		return CreateInstanceResponse{}, err
 	}
 
-	if err := s.routerosService.ApplyVmConfig(vmNetworkConfig, vlan, request.UserWgPubKey); err != nil {
-		vmMutex.Unlock()
-		s.DeleteInstance(instanceId)
-		vmMutex.Lock()
+	if err := s.networkBackend.ApplyVmConfig(vmNetworkConfig, vlan, request.UserWgPubKey); err != nil {
+		s.rollbackInstance(instanceId)
+		return CreateInstanceResponse{}, err
+	}
+
+	progress.Report("applying firewall policies")
+	if err := s.applyInstanceFirewall(instanceId); err != nil {
+		s.rollbackInstance(instanceId)
 		return CreateInstanceResponse{}, err
 	}
 
@@ -420,7 +581,25 @@ func (s *ServiceImpl) CreateInstance(request CreateInstanceRequest) (CreateInsta
 	}, nil
 }
 
-func (s *ServiceImpl) DeleteInstance(instanceId string) error {
+// rollbackInstance deletes an instance whose creation failed after it was persisted, the caller returns
+// the error that made it fail so the rollback one is only logged
+func (s *ServiceImpl) rollbackInstance(instanceId string) {
+	if err := s.deleteInstance(instanceId, nil); err != nil {
+		log.Printf("Error rolling back instance %s: %v", instanceId, err)
+	}
+}
+
+func (s *ServiceImpl) DeleteInstance(instanceId string, progress JobProgress) error {
+	progress.Report("validating request")
+	if err := s.checkIfVmIsNotInLab(instanceId); err != nil {
+		return err
+	}
+
+	return s.deleteInstance(instanceId, progress)
+}
+
+// deleteInstance deletes the instance even if it belongs to a lab
+func (s *ServiceImpl) deleteInstance(instanceId string, progress JobProgress) error {
 	if err := s.checkIfVmExists(instanceId); err != nil {
 		return err
 	}
@@ -439,15 +618,27 @@ func (s *ServiceImpl) DeleteInstance(instanceId string) error {
 	}
 
 	// Check if the instance is the last one in that subject
-	// If it is, we need to unassign the vlan from the bridge
+	// If it is, we need to remove the vlan config from the router
 	isLastInstanceInSubject, err := s.db.VmIsLastInstanceInSubject(instanceId)
 	if err != nil {
 		return err
 	}
 
+	// Check if the instance is the last one in that subject living in its server agent
+	// If it is, we need to unassign the vlan from the server agent's bridge
+	isLastInstanceInSubjectInServerAgent, err := s.db.VmIsLastInstanceInSubjectInServerAgent(instanceId)
+	if err != nil {
+		return err
+	}
+
+	agentUrl, err := s.getVmServerAgent(instanceId)
+	if err != nil {
+		return err
+	}
+
 	request := DeleteVmAgentRequest{
 		VmId:           instanceId,
-		RemoveEtiquete: isLastInstanceInSubject,
+		RemoveEtiquete: isLastInstanceInSubjectInServerAgent,
 		Vid:            fmt.Sprintf("%d", vlan),
 	}
 
@@ -456,45 +647,28 @@ func (s *ServiceImpl) DeleteInstance(instanceId string) error {
 		return logAndReturnError("Error marshalling delete instance agent request: ", err.Error())
 	}
 
-	// We need to call the deleteInstanceEndpoint for each server agent
-	// because the instance might exist in some of them
-	agentsCalled := 0
 	vmMutex := s.getVmMutex(instanceId)
 	vmMutex.Lock()
 	defer vmMutex.Unlock()
-	for _, agentUrl := range s.serverAgentsURLs {
-		if err := s.checkIfServerAgentIsAlive(agentUrl); err != nil {
-			continue
-		}
-		agentsCalled++
-
-		req, err := http.NewRequest(
-			http.MethodDelete,
-			agentUrl+s.deleteInstanceEndpoint,
-			bytes.NewBuffer(jsonData),
-		)
-		if err != nil {
-			return logAndReturnError("Error creating delete instance request: ", err.Error())
-		}
-
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			return logAndReturnError("Error sending delete instance request: ", err.Error())
-		}
 
-		if err := checkIfStatusCodeIsOk(resp); err != nil {
-			return err
-		}
+	progress.Report("deleting instance in server agent")
+	req, err := http.NewRequest(
+		http.MethodDelete,
+		agentUrl+s.deleteInstanceEndpoint,
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		return logAndReturnError("Error creating delete instance request: ", err.Error())
+	}
 
-		resp.Body.Close()
+	resp, err := s.agentClient.Do(req)
+	if err != nil {
+		return logAndReturnError("Error sending delete instance request: ", err.Error())
 	}
+	defer resp.Body.Close()
 
-	if agentsCalled != len(s.serverAgentsURLs) {
-		return NewHttpError(
-			http.StatusInternalServerError,
-			fmt.Errorf("some server agents did not respond to delete instance request, please try again later"),
-		)
+	if err := checkIfStatusCodeIsOk(resp); err != nil {
+		return err
 	}
 
 	subjectId, err := s.db.GetSubjectIdByVmId(instanceId)
@@ -507,9 +681,25 @@ func (s *ServiceImpl) DeleteInstance(instanceId string) error {
 		return err
 	}
 
-	s.deleteVmFromDb(instanceId)
+	progress.Report("removing router configuration")
+	// A forward left behind is replaced when its port is allocated again
+	if err := s.deleteInstancePortForwards(instanceId); err != nil {
+		log.Printf("Error removing port forwards of instance %s: %v", instanceId, err)
+	}
+	if err := s.removeInstanceWireguardPeers(instanceId, vlan); err != nil {
+		log.Printf("Error removing wireguard peers of instance %s: %v", instanceId, err)
+	}
+	if err := s.deleteVmFromDb(instanceId); err != nil {
+		return err
+	}
 	s.deleteVmMutex(instanceId)
-	s.routerosService.RemoveVmConfig(vlan, vmVlanIdentifier)
+	// Whatever is left behind is reported by the reconciler
+	if err := s.networkBackend.RemoveVmConfig(vlan, vmVlanIdentifier); err != nil {
+		log.Printf("Error removing network config of instance %s: %v", instanceId, err)
+	}
+	if err := s.networkBackend.RemoveVmFirewall(vlan, vmVlanIdentifier); err != nil {
+		log.Printf("Error removing firewall of instance %s: %v", instanceId, err)
+	}
 
 	if isLastInstanceInSubject {
 		s.deleteVlanConfigWhenAvailable(vlan)
@@ -544,10 +734,22 @@ func (s *ServiceImpl) StartInstance(instanceId string) error {
 		return err
 	}
 
+	labInterfaces, err := s.db.GetLabInterfacesByVmId(instanceId)
+	if err != nil {
+		return err
+	}
+
+	// The taps of the internal networks are recreated every time the instance starts, like its subject one
+	interfaces := []labInterface{}
+	for _, dbLabInterface := range labInterfaces {
+		interfaces = append(interfaces, labInterface{vlan: dbLabInterface.Vlan})
+	}
+
 	request := StartInstanceAgentRequest{
-		InstanceId:   instanceId,
-		Vid:          fmt.Sprintf("%d", vlan),
-		VlanEtiquete: getVlanEtiquete(vlan, vmVlanIdentifier),
+		InstanceId:    instanceId,
+		Vid:           fmt.Sprintf("%d", vlan),
+		VlanEtiquete:  getVlanEtiquete(vlan, vmVlanIdentifier),
+		LabInterfaces: getLabInterfacesAgentRequest(interfaces, vmVlanIdentifier),
 	}
 
 	jsonData, err := json.Marshal(request)
@@ -555,7 +757,8 @@ func (s *ServiceImpl) StartInstance(instanceId string) error {
 		return logAndReturnError("Error marshalling start instance agent request: ", err.Error())
 	}
 
-	agentUrl, err := s.selectServerAgent()
+	// The instance has to be started in the server agent that holds its disk image
+	agentUrl, err := s.getVmServerAgent(instanceId)
 	if err != nil {
 		return err
 	}
@@ -564,7 +767,7 @@ func (s *ServiceImpl) StartInstance(instanceId string) error {
 	vmMutex.Lock()
 	defer vmMutex.Unlock()
 
-	resp, err := http.Post(
+	resp, err := s.agentClient.Post(
 		agentUrl+s.startInstanceEndpoint,
 		"application/json",
 		bytes.NewBuffer(jsonData),
@@ -580,7 +783,8 @@ func (s *ServiceImpl) StartInstance(instanceId string) error {
 	return nil
 }
 
-func (s *ServiceImpl) StopInstance(instanceId string) error {
+func (s *ServiceImpl) StopInstance(instanceId string, progress JobProgress) error {
+	progress.Report("validating request")
 	if err := s.checkIfVmExists(instanceId); err != nil {
 		return err
 	}
@@ -589,38 +793,28 @@ func (s *ServiceImpl) StopInstance(instanceId string) error {
 		return err
 	}
 
-	// We need to call the stopInstanceEndpoint for each server agent until we get a 200 response
-	// because we don't know which server agent the instance is running on
+	agentUrl, err := s.getVmServerAgent(instanceId)
+	if err != nil {
+		return err
+	}
+
 	vmMutex := s.getVmMutex(instanceId)
 	vmMutex.Lock()
 	defer vmMutex.Unlock()
-	for _, agentUrl := range s.serverAgentsURLs {
-		if err := s.checkIfServerAgentIsAlive(agentUrl); err != nil {
-			continue
-		}
-
-		resp, err := http.Post(
-			agentUrl+s.stopInstanceEndpoint+"/"+instanceId,
-			"application/json",
-			nil,
-		)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode == http.StatusBadRequest {
-			resp.Body.Close()
-			continue
-		}
-
-		if err := checkIfStatusCodeIsOk(resp); err != nil {
-			return err
-		}
+	progress.Report("stopping instance in server agent")
+	resp, err := s.agentClient.Post(
+		agentUrl+s.stopInstanceEndpoint+"/"+instanceId,
+		"application/json",
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-		// If we get a 200 response, we found the server agent that is running the instance
-		// and we can break the loop
-		break
+	if err := checkIfStatusCodeIsOk(resp); err != nil {
+		return err
 	}
 
 	return nil
@@ -635,48 +829,27 @@ func (s *ServiceImpl) RestartInstance(instanceId string) error {
 		return err
 	}
 
-	// We need to call the restartInstanceEndpoint for each server agent until we get a 200 response
-	// because we don't know which server agent the instance is running on
-	correctServerFound := false
+	agentUrl, err := s.getVmServerAgent(instanceId)
+	if err != nil {
+		return err
+	}
+
 	vmMutex := s.getVmMutex(instanceId)
 	vmMutex.Lock()
 	defer vmMutex.Unlock()
-	for _, agentUrl := range s.serverAgentsURLs {
-		if err := s.checkIfServerAgentIsAlive(agentUrl); err != nil {
-			continue
-		}
-
-		resp, err := http.Post(
-			agentUrl+s.restartInstanceEndpoint+"/"+instanceId,
-			"application/json",
-			nil,
-		)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == http.StatusBadRequest {
-			resp.Body.Close()
-			continue
-		}
-
-		if err := checkIfStatusCodeIsOk(resp); err != nil {
-			return err
-		}
 
-		correctServerFound = true
-
-		// If we get a 200 response, we found the server agent that is running the instance
-		// and we can break the loop
-		break
+	resp, err := s.agentClient.Post(
+		agentUrl+s.restartInstanceEndpoint+"/"+instanceId,
+		"application/json",
+		nil,
+	)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	if !correctServerFound {
-		return NewHttpError(
-			http.StatusInternalServerError,
-			fmt.Errorf("server agent did not respond, please start the instance again"),
-		)
+	if err := checkIfStatusCodeIsOk(resp); err != nil {
+		return err
 	}
 
 	return nil
@@ -685,25 +858,25 @@ func (s *ServiceImpl) RestartInstance(instanceId string) error {
 func (s *ServiceImpl) ListInstancesStatus() ([]ListInstancesStatusResponse, error) {
 	var globalStatuses []ListInstancesStatusResponse
 
-	// We need to call the listInstancesStatusEndpoint for each server agent to get the status of all instances
+	agents, err := s.db.GetServerAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	// Server agents report their domains when they change, the ones that don't are asked
+	// with the listInstancesStatusEndpoint
 	agentsCalled := 0
-	for _, agentUrl := range s.serverAgentsURLs {
-		if err := s.checkIfServerAgentIsAlive(agentUrl); err != nil {
+	for _, agent := range agents {
+		if !isServerAgentAlive(agent) {
 			continue
 		}
 		agentsCalled++
-		resp, err := http.Get(agentUrl + s.listInstancesStatusEndpoint)
-		if err != nil {
-			return nil, err
-		}
-
-		if err := checkIfStatusCodeIsOk(resp); err != nil {
-			return nil, err
-		}
-
-		var statuses []ListInstancesStatusResponse
-		if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
-			return nil, logAndReturnError("Error decoding list instances status response: ", err.Error())
+		statuses, reported := s.instanceEvents.AgentStatuses(agent.Url)
+		if !reported {
+			statuses, err = s.listInstancesStatusInServerAgent(agent.Url)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		// We check if the vmId is already in the globalStatuses
@@ -726,7 +899,7 @@ func (s *ServiceImpl) ListInstancesStatus() ([]ListInstancesStatusResponse, erro
 		}
 	}
 
-	if agentsCalled != len(s.serverAgentsURLs) {
+	if agentsCalled != len(agents) {
 		// In case some server agents did not respond, we need to add missing VMs with a status of "shut off"
 		vmIds, err := s.db.GetAllVmIds()
 		if err != nil {
@@ -753,26 +926,51 @@ func (s *ServiceImpl) ListInstancesStatus() ([]ListInstancesStatusResponse, erro
 	return globalStatuses, nil
 }
 
+// ListVms returns the instances and templates in the database, without asking the server agents,
+// so the web server can find the ones it doesn't know about
+func (s *ServiceImpl) ListVms() ([]ListVmsResponse, error) {
+	vms, err := s.db.GetAllVms()
+	if err != nil {
+		return nil, err
+	}
+
+	response := []ListVmsResponse{}
+	for _, vm := range vms {
+		subjectId := ""
+		if vm.SubjectId != nil {
+			subjectId = *vm.SubjectId
+		}
+		response = append(response, ListVmsResponse{
+			VmId:       vm.ID,
+			SubjectId:  subjectId,
+			IsTemplate: vm.IsTemplate,
+		})
+	}
+
+	return response, nil
+}
+
 func (s *ServiceImpl) ListServersStatus() ([]ListServersStatusResponse, error) {
 	var serversStatus []ListServersStatusResponse
 
-	for _, agentUrl := range s.serverAgentsURLs {
-		if err := s.checkIfServerAgentIsAlive(agentUrl); err != nil {
-			continue
-		}
+	agents, err := s.getAliveServerAgents()
+	if err != nil {
+		return nil, err
+	}
 
-		resourceStatus, err := s.getResourceStatus(agentUrl)
-		if err != nil {
-			continue
-		}
+	for _, agent := range agents {
+		// The resource status is the one sent in the last heartbeat
+		resourceStatus := agent.ResourceStatus
 
 		serverStatus := ListServersStatusResponse{
-			ServerIP:      agentUrl,
+			ServerIP:      agent.Url,
 			CpuLoad:       resourceStatus.CpuLoad,
 			TotalMemoryMB: resourceStatus.TotalMemoryMB,
 			FreeMemoryMB:  resourceStatus.FreeMemoryMB,
 			TotalDiskMB:   resourceStatus.TotalDiskMB,
 			FreeDiskMB:    resourceStatus.FreeDiskMB,
+			Cordoned:      agent.Cordoned,
+			Draining:      agent.Draining,
 		}
 
 		instancesStatus, err := s.ListInstancesStatus()
@@ -795,87 +993,569 @@ func (s *ServiceImpl) ListServersStatus() ([]ListServersStatusResponse, error) {
 	return serversStatus, nil
 }
 
-func (s *ServiceImpl) selectServerAgent() (string, error) {
-	var selectedAgent string
+func (s *ServiceImpl) MigrateInstance(instanceId string, request MigrateInstanceRequest) error {
+	if err := s.checkIfVmExists(instanceId); err != nil {
+		return err
+	}
+
+	// The internal networks of a lab only exist in its server agent
+	if err := s.checkIfVmIsNotInLab(instanceId); err != nil {
+		return err
+	}
 
-	bestScore := float64(math.Inf(-1))
+	if err := s.checkIfVmIsTemplateOrBase(instanceId); err != nil {
+		return err
+	}
 
-	for _, agentUrl := range s.serverAgentsURLs {
-		if err := s.checkIfServerAgentIsAlive(agentUrl); err != nil {
-			continue
-		}
+	// Cold migrations need the instance shut off, live migrations need it running
+	if err := s.checkIfVmIsRunning(instanceId, request.Live); err != nil {
+		return err
+	}
 
-		resourceStatus, err := s.getResourceStatus(agentUrl)
+	agentUrl, err := s.getVmServerAgent(instanceId)
+	if err != nil {
+		return err
+	}
+
+	if request.TargetServerAgentUrl != "" {
+		targetAgent, err := s.getRegisteredServerAgent(request.TargetServerAgentUrl)
 		if err != nil {
-			continue
+			return err
 		}
 
-		if resourceStatus.FreeMemoryMB < MIN_AVAILABLE_RAM_MB || resourceStatus.CpuLoad > MAX_CPU_USAGE {
-			continue
+		if targetAgent.Cordoned {
+			return NewHttpError(
+				http.StatusBadRequest,
+				fmt.Errorf("server agent '%s' is cordoned", request.TargetServerAgentUrl),
+			)
 		}
 
-		score := getServerAgentScore(resourceStatus)
+		if err := s.checkIfServerAgentIsAlive(request.TargetServerAgentUrl); err != nil {
+			return NewHttpError(
+				http.StatusServiceUnavailable,
+				fmt.Errorf("server agent '%s' is not available, please try again later", request.TargetServerAgentUrl),
+			)
+		}
 
-		if score > bestScore {
-			bestScore = score
-			selectedAgent = agentUrl
+		if agentUrl == request.TargetServerAgentUrl {
+			return NewHttpError(
+				http.StatusBadRequest,
+				fmt.Errorf("instance '%s' is already in server agent '%s'", instanceId, agentUrl),
+			)
 		}
 	}
 
-	if selectedAgent == "" {
-		return "", NewHttpError(
-			http.StatusInternalServerError,
-			fmt.Errorf("all servers are busy, please try again later"),
-		)
+	instance, err := s.db.GetVm(instanceId)
+	if err != nil {
+		return err
 	}
 
-	return selectedAgent, nil
-}
+	// The instance keeps its reservation in the source until it's moved in the database
+	schedulingRequest := SchedulingRequest{
+		VcpuCount:              instance.VcpuCount,
+		VramMB:                 instance.VramMB,
+		SizeMB:                 instance.SizeMB,
+		ServerAgentUrl:         request.TargetServerAgentUrl,
+		ExcludedServerAgentUrl: agentUrl,
+	}
+	if instance.SubjectId != nil {
+		schedulingRequest.SubjectId = getNetworkSegmentSubjectId(*instance.SubjectId)
+	}
 
-func (s *ServiceImpl) checkIfServerAgentIsAlive(agentUrl string) error {
-	resp, err := http.Get(agentUrl + s.serverAgentIsAliveEndpoint)
+	reservation, err := s.scheduler.Schedule(schedulingRequest)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer s.scheduler.Release(reservation)
+	request.TargetServerAgentUrl = reservation.ServerAgentUrl
 
-	if err := checkIfStatusCodeIsOk(resp); err != nil {
+	vlan, err := s.db.GetVlanByVmId(instanceId)
+	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func (s *ServiceImpl) getResourceStatus(agentUrl string) (GetResourceStatusAgentResponse, error) {
-	resp, err := http.Get(agentUrl + s.getResourceStatusEndpoint)
+	vmVlanIdentifier, err := s.db.GetVmVlanIdentifierByVmId(instanceId)
 	if err != nil {
-		return GetResourceStatusAgentResponse{}, err
+		return err
 	}
-	defer resp.Body.Close()
 
-	if err := checkIfStatusCodeIsOk(resp); err != nil {
-		return GetResourceStatusAgentResponse{}, err
+	// If the instance is the last one of its subject in the source server agent,
+	// the vlan has to be unassigned from the source server agent's bridge
+	isLastInstanceInSubjectInServerAgent, err := s.db.VmIsLastInstanceInSubjectInServerAgent(instanceId)
+	if err != nil {
+		return err
 	}
 
-	var resourceStatus GetResourceStatusAgentResponse
-	if err := json.NewDecoder(resp.Body).Decode(&resourceStatus); err != nil {
-		return GetResourceStatusAgentResponse{}, logAndReturnError("Error decoding get resource status response: ", err.Error())
-	}
+	backingTemplateId, err := s.getBackingTemplateToCopy(instanceId, request.TargetServerAgentUrl)
+	if err != nil {
+		return err
+	}
+
+	agentRequest := MigrateInstanceAgentRequest{
+		InstanceId:           instanceId,
+		TargetServerAgentUrl: request.TargetServerAgentUrl,
+		BackingTemplateId:    backingTemplateId,
+		Live:                 request.Live,
+		Vid:                  fmt.Sprintf("%d", vlan),
+		RemoveEtiquete:       isLastInstanceInSubjectInServerAgent,
+	}
+
+	jsonData, err := json.Marshal(agentRequest)
+	if err != nil {
+		return logAndReturnError("Error marshalling migrate instance agent request: ", err.Error())
+	}
+
+	vmMutex := s.getVmMutex(instanceId)
+	vmMutex.Lock()
+	defer vmMutex.Unlock()
+
+	log.Printf("Migrating instance %s from %s to %s", instanceId, agentUrl, request.TargetServerAgentUrl)
+
+	resp, err := s.agentClient.Post(
+		agentUrl+s.migrateInstanceEndpoint,
+		"application/json",
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		return logAndReturnError("Error sending migrate instance request: ", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if err := checkIfStatusCodeIsOk(resp); err != nil {
+		return err
+	}
 
-	return resourceStatus, nil
+	if backingTemplateId != "" {
+		s.addTemplateCopyToDb(backingTemplateId, request.TargetServerAgentUrl)
+	}
+	s.setVmServerAgentInDb(instanceId, request.TargetServerAgentUrl)
+
+	// A live migrated instance is already running in the target,
+	// so its interface has to be tagged there as StartInstance would do
+	if request.Live {
+		if err := s.setupInstanceNetworkInServerAgent(
+			request.TargetServerAgentUrl,
+			instanceId,
+			vlan,
+			vmVlanIdentifier,
+		); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Instance %s migrated successfully", instanceId)
+
+	return nil
 }
 
-func getServerAgentScore(resourceStatus GetResourceStatusAgentResponse) float64 {
-	return float64(resourceStatus.FreeMemoryMB) - (CPU_USAGE_PENALTY_FACTOR * resourceStatus.CpuLoad)
+func (s *ServiceImpl) CreateSnapshot(instanceId string) (CreateSnapshotResponse, error) {
+	if err := s.checkIfVmExists(instanceId); err != nil {
+		return CreateSnapshotResponse{}, err
+	}
+
+	if err := s.checkIfVmIsTemplateOrBase(instanceId); err != nil {
+		return CreateSnapshotResponse{}, err
+	}
+
+	// Snapshots are taken on the disk image, which can't be written while the instance is running
+	if err := s.checkIfVmIsRunning(instanceId, false); err != nil {
+		return CreateSnapshotResponse{}, err
+	}
+
+	agentUrl, err := s.getVmServerAgent(instanceId)
+	if err != nil {
+		return CreateSnapshotResponse{}, err
+	}
+
+	request := CreateSnapshotAgentRequest{
+		InstanceId: instanceId,
+		SnapshotId: uuid.New().String(),
+	}
+
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return CreateSnapshotResponse{}, logAndReturnError("Error marshalling create snapshot agent request: ", err.Error())
+	}
+
+	vmMutex := s.getVmMutex(instanceId)
+	vmMutex.Lock()
+	defer vmMutex.Unlock()
+
+	resp, err := s.agentClient.Post(
+		agentUrl+s.createSnapshotEndpoint,
+		"application/json",
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		return CreateSnapshotResponse{}, logAndReturnError("Error sending create snapshot request: ", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if err := checkIfStatusCodeIsOk(resp); err != nil {
+		return CreateSnapshotResponse{}, err
+	}
+
+	return CreateSnapshotResponse{SnapshotId: request.SnapshotId}, nil
+}
+
+func (s *ServiceImpl) ListSnapshots(instanceId string) ([]ListSnapshotsResponse, error) {
+	if err := s.checkIfVmExists(instanceId); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkIfVmIsTemplateOrBase(instanceId); err != nil {
+		return nil, err
+	}
+
+	agentUrl, err := s.getVmServerAgent(instanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.agentClient.Get(agentUrl + s.listSnapshotsEndpoint + "/" + instanceId)
+	if err != nil {
+		return nil, logAndReturnError("Error sending list snapshots request: ", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if err := checkIfStatusCodeIsOk(resp); err != nil {
+		return nil, err
+	}
+
+	var snapshots []ListSnapshotsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&snapshots); err != nil {
+		return nil, logAndReturnError("Error decoding list snapshots response: ", err.Error())
+	}
+
+	return snapshots, nil
+}
+
+func (s *ServiceImpl) RevertSnapshot(instanceId string, snapshotId string) error {
+	if err := s.checkIfVmExists(instanceId); err != nil {
+		return err
+	}
+
+	if err := s.checkIfVmIsTemplateOrBase(instanceId); err != nil {
+		return err
+	}
+
+	if err := s.checkIfVmIsRunning(instanceId, false); err != nil {
+		return err
+	}
+
+	agentUrl, err := s.getVmServerAgent(instanceId)
+	if err != nil {
+		return err
+	}
+
+	vmMutex := s.getVmMutex(instanceId)
+	vmMutex.Lock()
+	defer vmMutex.Unlock()
+
+	resp, err := s.agentClient.Post(
+		agentUrl+s.revertSnapshotEndpoint+"/"+instanceId+"/"+snapshotId,
+		"application/json",
+		nil,
+	)
+	if err != nil {
+		return logAndReturnError("Error sending revert snapshot request: ", err.Error())
+	}
+	defer resp.Body.Close()
+
+	return checkIfStatusCodeIsOk(resp)
+}
+
+func (s *ServiceImpl) DeleteSnapshot(instanceId string, snapshotId string) error {
+	if err := s.checkIfVmExists(instanceId); err != nil {
+		return err
+	}
+
+	if err := s.checkIfVmIsTemplateOrBase(instanceId); err != nil {
+		return err
+	}
+
+	if err := s.checkIfVmIsRunning(instanceId, false); err != nil {
+		return err
+	}
+
+	agentUrl, err := s.getVmServerAgent(instanceId)
+	if err != nil {
+		return err
+	}
+
+	vmMutex := s.getVmMutex(instanceId)
+	vmMutex.Lock()
+	defer vmMutex.Unlock()
+
+	req, err := http.NewRequest(
+		http.MethodDelete,
+		agentUrl+s.deleteSnapshotEndpoint+"/"+instanceId+"/"+snapshotId,
+		nil,
+	)
+	if err != nil {
+		return logAndReturnError("Error creating delete snapshot request: ", err.Error())
+	}
+
+	resp, err := s.agentClient.Do(req)
+	if err != nil {
+		return logAndReturnError("Error sending delete snapshot request: ", err.Error())
+	}
+	defer resp.Body.Close()
+
+	return checkIfStatusCodeIsOk(resp)
+}
+
+func (s *ServiceImpl) CreateConsoleTicket(instanceId string) (CreateConsoleTicketResponse, error) {
+	if err := s.checkIfVmExists(instanceId); err != nil {
+		return CreateConsoleTicketResponse{}, err
+	}
+
+	if err := s.checkIfVmIsTemplateOrBase(instanceId); err != nil {
+		return CreateConsoleTicketResponse{}, err
+	}
+
+	if err := s.checkIfVmIsRunning(instanceId, true); err != nil {
+		return CreateConsoleTicketResponse{}, err
+	}
+
+	s.consoleTicketsMutex.Lock()
+	defer s.consoleTicketsMutex.Unlock()
+
+	// Forget the tickets that were never used
+	for ticket, consoleTicket := range s.consoleTickets {
+		if time.Now().After(consoleTicket.ExpiresAt) {
+			delete(s.consoleTickets, ticket)
+		}
+	}
+
+	ticket := uuid.New().String()
+	expiresAt := time.Now().Add(CONSOLE_TICKET_TTL)
+	s.consoleTickets[ticket] = ConsoleTicket{
+		InstanceId: instanceId,
+		ExpiresAt:  expiresAt,
+	}
+
+	return CreateConsoleTicketResponse{
+		Ticket:    ticket,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (s *ServiceImpl) OpenInstanceConsole(ticket string) (*websocket.Conn, error) {
+	s.consoleTicketsMutex.Lock()
+	consoleTicket, ok := s.consoleTickets[ticket]
+	// Tickets can only be used once
+	delete(s.consoleTickets, ticket)
+	s.consoleTicketsMutex.Unlock()
+
+	if !ok || time.Now().After(consoleTicket.ExpiresAt) {
+		return nil, NewHttpError(http.StatusUnauthorized, fmt.Errorf("invalid or expired console ticket"))
+	}
+
+	agentUrl, err := s.getVmServerAgent(consoleTicket.InstanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, resp, err := s.agentClient.DialWebSocket(
+		consoleDialer,
+		toWebSocketUrl(agentUrl)+s.instanceConsoleEndpoint+"/"+consoleTicket.InstanceId,
+	)
+	if err != nil {
+		if resp != nil {
+			defer resp.Body.Close()
+			if err := checkIfStatusCodeIsOk(resp); err != nil {
+				return nil, err
+			}
+		}
+		return nil, logAndReturnError("Error opening console in server agent: ", err.Error())
+	}
+
+	log.Printf("Opened console of instance %s", consoleTicket.InstanceId)
+
+	return conn, nil
+}
+
+func (s *ServiceImpl) listInstancesStatusInServerAgent(agentUrl string) ([]ListInstancesStatusResponse, error) {
+	resp, err := s.agentClient.Get(agentUrl + s.listInstancesStatusEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkIfStatusCodeIsOk(resp); err != nil {
+		return nil, err
+	}
+
+	var statuses []ListInstancesStatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		return nil, logAndReturnError("Error decoding list instances status response: ", err.Error())
+	}
+
+	return statuses, nil
+}
+
+// getVmServerAgent returns the URL of the server agent that holds the given VM,
+// failing if that server agent is not reachable
+func (s *ServiceImpl) getVmServerAgent(vmId string) (string, error) {
+	serverAgentUrl, err := s.db.GetServerAgentUrlByVmId(vmId)
+	if err != nil {
+		return "", err
+	}
+
+	var agentUrl string
+	if serverAgentUrl == nil {
+		// VMs created before their placement was persisted don't have a server agent
+		// recorded, so we look for it and record it for the next calls
+		agentUrl, err = s.findServerAgentHostingVm(vmId)
+		if err != nil {
+			return "", err
+		}
+
+		if err := s.db.SetServerAgentUrl(vmId, agentUrl); err != nil {
+			return "", err
+		}
+	} else {
+		agentUrl = *serverAgentUrl
+	}
+
+	if err := s.checkIfServerAgentIsAlive(agentUrl); err != nil {
+		return "", NewHttpError(
+			http.StatusServiceUnavailable,
+			fmt.Errorf("server agent hosting VM '%s' is not available, please try again later", vmId),
+		)
+	}
+
+	return agentUrl, nil
+}
+
+func (s *ServiceImpl) findServerAgentHostingVm(vmId string) (string, error) {
+	agents, err := s.getAliveServerAgents()
+	if err != nil {
+		return "", err
+	}
+
+	for _, agent := range agents {
+		statuses, err := s.listInstancesStatusInServerAgent(agent.Url)
+		if err != nil {
+			continue
+		}
+
+		for _, status := range statuses {
+			if status.InstanceId == vmId {
+				return agent.Url, nil
+			}
+		}
+	}
+
+	return "", NewHttpError(
+		http.StatusServiceUnavailable,
+		fmt.Errorf("could not find the server agent hosting VM '%s', please try again later", vmId),
+	)
+}
+
+// getBackingTemplateToCopy returns the template backing the given instance if the target
+// server agent doesn't hold it yet, base images are expected to be in every server agent
+func (s *ServiceImpl) getBackingTemplateToCopy(instanceId string, targetAgentUrl string) (string, error) {
+	dependsOn, err := s.db.GetDependsOnByVmId(instanceId)
+	if err != nil {
+		return "", err
+	}
+
+	isTemplate, err := s.db.VmIsTemplate(dependsOn)
+	if err != nil {
+		return "", err
+	}
+	if !isTemplate {
+		return "", nil
+	}
+
+	templateAgentUrl, err := s.db.GetServerAgentUrlByVmId(dependsOn)
+	if err != nil {
+		return "", err
+	}
+	if templateAgentUrl != nil && *templateAgentUrl == targetAgentUrl {
+		return "", nil
+	}
+
+	copiesAgentsUrls, err := s.db.GetTemplateCopiesServerAgentUrls(dependsOn)
+	if err != nil {
+		return "", err
+	}
+	if slices.Contains(copiesAgentsUrls, targetAgentUrl) {
+		return "", nil
+	}
+
+	return dependsOn, nil
+}
+
+func (s *ServiceImpl) setupInstanceNetworkInServerAgent(agentUrl string, instanceId string, vlan int, vmVlanIdentifier int) error {
+	request := SetupInstanceNetworkAgentRequest{
+		InstanceId:   instanceId,
+		Vid:          fmt.Sprintf("%d", vlan),
+		VlanEtiquete: getVlanEtiquete(vlan, vmVlanIdentifier),
+	}
+
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return logAndReturnError("Error marshalling setup instance network agent request: ", err.Error())
+	}
+
+	resp, err := s.agentClient.Post(
+		agentUrl+s.setupInstanceNetworkEndpoint,
+		"application/json",
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		return logAndReturnError("Error sending setup instance network request: ", err.Error())
+	}
+	defer resp.Body.Close()
+
+	return checkIfStatusCodeIsOk(resp)
+}
+
+func (s *ServiceImpl) deleteVmInServerAgent(agentUrl string, request DeleteVmAgentRequest) error {
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return logAndReturnError("Error marshalling delete VM agent request: ", err.Error())
+	}
+
+	// Calling deleteInstaceEndpoint because the server agent
+	// makes no difference between a template and an instance
+	req, err := http.NewRequest(
+		http.MethodDelete,
+		agentUrl+s.deleteInstanceEndpoint,
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		return logAndReturnError("Error creating delete VM request: ", err.Error())
+	}
+
+	resp, err := s.agentClient.Do(req)
+	if err != nil {
+		return logAndReturnError("Error sending delete VM request: ", err.Error())
+	}
+	defer resp.Body.Close()
+
+	return checkIfStatusCodeIsOk(resp)
 }
 
 func (s *ServiceImpl) getBaseImagesNames() ([]string, error) {
-	agentUrl, err := s.selectServerAgent()
+	// Every server agent holds the same base images
+	agents, err := s.getAliveServerAgents()
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := http.Get(agentUrl + s.listBaseImagesEndpoint)
+	if len(agents) == 0 {
+		return nil, NewHttpError(
+			http.StatusServiceUnavailable,
+			fmt.Errorf("there are no server agents available, please try again later"),
+		)
+	}
+	agentUrl := agents[0].Url
+
+	resp, err := s.agentClient.Get(agentUrl + s.listBaseImagesEndpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -999,6 +1679,26 @@ func (s *ServiceImpl) toListBaseImagesResponse(baseImages []Vm) ([]ListBaseImage
 	return baseImagesList, nil
 }
 
+// postIdempotentAgentRequest sends the request again when the connection to the server agent fails, the idempotency
+// key of the request makes the server agent return the result of the first one instead of running it twice
+func (s *ServiceImpl) postIdempotentAgentRequest(url string, jsonData []byte) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	for attempt := 1; attempt <= IDEMPOTENT_AGENT_REQUEST_ATTEMPTS; attempt++ {
+		resp, err = s.agentClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
+		if err == nil {
+			return resp, nil
+		}
+
+		log.Printf("Error calling server agent at %s (attempt %d): %v", url, attempt, err)
+		if attempt < IDEMPOTENT_AGENT_REQUEST_ATTEMPTS {
+			time.Sleep(IDEMPOTENT_AGENT_REQUEST_RETRY_WAIT)
+		}
+	}
+
+	return nil, err
+}
+
 func checkIfStatusCodeIsOk(resp *http.Response) error {
 	if resp.StatusCode != http.StatusOK {
 		var apiErr ApiError
@@ -1034,13 +1734,48 @@ func (s *ServiceImpl) generateNewVmId() (string, error) {
 	return vmId, nil
 }
 
-func (s *ServiceImpl) addVmToDb(vm Vm, isTemplate bool) {
-	// Try to add the VM to the database until it succeeds
+func (s *ServiceImpl) addVmToDb(vm Vm, isTemplate bool) error {
+	// The only reason it might fail is if the DB has gone down
+	// All the other scenarios are checked before calling this function
+	return s.retryDbWrite("adding VM '"+vm.ID+"' to the database", func() error {
+		return s.db.AddVm(vm, false, isTemplate)
+	})
+}
+
+func (s *ServiceImpl) deleteVmFromDb(vmId string) error {
 	// The only reason it might fail is if the DB has gone down
 	// All the other scenarios are checked before calling this function
-	// In that case, the VM will be added to the database when the DB is back up
+	return s.retryDbWrite("deleting VM '"+vmId+"' from the database", func() error {
+		return s.db.DeleteVm(vmId)
+	})
+}
+
+// retryDbWrite runs the write until it succeeds or it has failed DB_WRITE_ATTEMPTS times,
+// then the error of the last attempt is returned so the job fails
+func (s *ServiceImpl) retryDbWrite(description string, write func() error) error {
+	wait := s.dbWriteRetryWait
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil {
+			return nil
+		}
+
+		if attempt == DB_WRITE_ATTEMPTS {
+			return logAndReturnError("Error "+description+": ", err.Error())
+		}
+
+		log.Printf("Error %s (attempt %d of %d), retrying in %s: %v", description, attempt, DB_WRITE_ATTEMPTS, wait, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (s *ServiceImpl) setVmServerAgentInDb(vmId string, serverAgentUrl string) {
+	// Try to update the VM placement until it succeeds
+	// The only reason it might fail is if the DB has gone down
+	// The VM is already in the new server agent, so the placement has to be updated
 	for {
-		if err := s.db.AddVm(vm, false, isTemplate); err != nil {
+		if err := s.db.SetServerAgentUrl(vmId, serverAgentUrl); err != nil {
 			log.Println(err.Error())
 		} else {
 			break
@@ -1048,13 +1783,12 @@ func (s *ServiceImpl) addVmToDb(vm Vm, isTemplate bool) {
 	}
 }
 
-func (s *ServiceImpl) deleteVmFromDb(vmId string) {
-	// Try to delete the VM from the database until it succeeds
+func (s *ServiceImpl) addTemplateCopyToDb(templateId string, serverAgentUrl string) {
+	// Try to add the template copy to the database until it succeeds
 	// The only reason it might fail is if the DB has gone down
-	// All the other scenarios are checked before calling this function
-	// In that case, the VM will be deleted from the database when the DB is back up
+	// Otherwise the copy would be left behind when the template is deleted
 	for {
-		if err := s.db.DeleteVm(vmId); err != nil {
+		if err := s.db.AddTemplateCopy(templateId, serverAgentUrl); err != nil {
 			log.Println(err.Error())
 		} else {
 			break
@@ -1084,166 +1818,78 @@ func (s *ServiceImpl) checkIfVmIsTemplateOrBase(vmId string) error {
 	return nil
 }
 
-func (s *ServiceImpl) getVmNetworkConfigFromSubjectId(subjectId string) (VmNetworkConfig, error) {
-	exists, err := s.db.SubjectExistsById(subjectId)
+// getVmNetworkConfig allocates the address of the instance in the subject network,
+// the subject network is allocated with the prefix length if the subject has none
+func (s *ServiceImpl) getVmNetworkConfig(
+	subjectId string,
+	instanceId string,
+	prefixLength int,
+	isolated bool,
+) (VmNetworkConfig, error) {
+	subjectNetwork, err := s.ipam.AllocateSubjectNetwork(subjectId, prefixLength, isolated)
 	if err != nil {
 		return VmNetworkConfig{}, err
 	}
 
-	var vlan int
-	if !exists {
-		vlan, err = s.getFirstAvailableVlan()
-		if err != nil {
-			return VmNetworkConfig{}, err
-		}
-
-		subject := Subject{
-			SubjectId: subjectId,
-			Vlan:      vlan,
-		}
-
-		s.addSubjectToDb(subject)
-	} else {
-		vlan, err = s.db.GetSubjectVlan(subjectId)
-		if err != nil {
-			return VmNetworkConfig{}, err
-		}
-	}
-
-	vmVlanIdentifier, err := s.getFirstAvailableVmVlanIdentifier(vlan)
+	vmVlanIdentifier, err := s.ipam.AllocateVm(subjectNetwork, instanceId)
 	if err != nil {
 		return VmNetworkConfig{}, err
 	}
 
-	gateway := getVlanGatewayIp(vlan)
-	ipAddWithSubnet := getIpAddWithSubnet(vlan, vmVlanIdentifier)
-	vlanEtiquete := getVlanEtiquete(vlan, vmVlanIdentifier)
-
-	return VmNetworkConfig{
-		IpAddWithSubnet:  ipAddWithSubnet,
-		Gateway:          gateway,
-		VlanEtiquete:     vlanEtiquete,
+	vlan := subjectNetwork.Vlan
+	vmNetworkConfig := VmNetworkConfig{
+		IpAddWithSubnet:  subjectNetwork.VmAddressWithSubnet(vmVlanIdentifier),
+		Gateway:          subjectNetwork.GatewayIp(),
+		VlanEtiquete:     getVlanEtiquete(vlan, vmVlanIdentifier),
 		VmVlanIdentifier: vmVlanIdentifier,
-	}, nil
-}
-
-func (s *ServiceImpl) getFirstAvailableVlan() (int, error) {
-	vlans, err := s.db.GetAllVlans()
-	if err != nil {
-		return 0, err
+		Network:          subjectNetwork.Network.String(),
+		VpnNetwork:       subjectNetwork.VpnNetwork.String(),
+		InterfaceAddress: subjectNetwork.InterfaceAddressWithSubnet(vmVlanIdentifier),
 	}
 
-	if len(vlans) == MAX_VLANS {
-		return 0, NewHttpError(
-			http.StatusInternalServerError,
-			fmt.Errorf("no more vlans available"),
-		)
-	}
-
-	auxVlan := FIRST_VLAN
-	for {
-		if !slices.Contains(vlans, auxVlan) {
-			return auxVlan, nil
-		}
-		auxVlan++
+	if s.isIpv6Enabled() {
+		vmNetworkConfig.Ipv6AddWithSubnet = s.getIpv6AddWithSubnet(vlan, vmVlanIdentifier)
+		vmNetworkConfig.Ipv6Gateway = s.getVlanIpv6GatewayIp(vlan)
+		vmNetworkConfig.Ipv6InterfaceAddress = s.getIpv6InterfaceAddressWithSubnet(vlan, vmVlanIdentifier)
 	}
-}
 
-func (s *ServiceImpl) addSubjectToDb(subject Subject) {
-	// Try to add the subject to the database until it succeeds
-	// The only reason it might fail is if the DB has gone down
-	// All the other scenarios are checked before calling this function
-	// In that case, the subject will be added to the database when the DB is back up
-	for {
-		if err := s.db.AddSubject(subject); err != nil {
-			log.Println(err.Error())
-		} else {
-			break
-		}
-	}
+	return vmNetworkConfig, nil
 }
 
-func (s *ServiceImpl) getFirstAvailableVmVlanIdentifier(vlan int) (int, error) {
-	vmsVlanIdentifiers, err := s.db.GetVmsVlanIdentifiers(vlan)
-	if err != nil {
-		return 0, err
-	}
-
-	if len(vmsVlanIdentifiers) == MAX_VMS_PER_VLAN {
-		return 0, NewHttpError(
-			http.StatusInternalServerError,
-			fmt.Errorf("maximum number of VMs per VLAN reached"),
+// getPeerAllowedIps returns the networks the WireGuard config of a device of the VLAN routes through the VPN
+func (s *ServiceImpl) getPeerAllowedIps(vlan int, network string, vpnNetwork string) []string {
+	peerAllowedIps := []string{network, vpnNetwork}
+	if s.isIpv6Enabled() {
+		peerAllowedIps = append(
+			peerAllowedIps,
+			s.getVlanIpv6NetworkWithSubnet(vlan),
+			s.getVpnIpv6NetworkWithSubnet(vlan),
 		)
 	}
 
-	auxVlanIdentifier := 1
-	for {
-		if !slices.Contains(vmsVlanIdentifiers, auxVlanIdentifier) {
-			return auxVlanIdentifier, nil
-		}
-		auxVlanIdentifier++
-	}
-}
-
-func getVlanGatewayIp(vlan int) string {
-	return fmt.Sprintf("10.0.%d.%d", mapVlanToThirdIpOctet(vlan), FIRST_IP_IN_SUBNET)
-}
-
-func getVpnGatewayIp(vlan int) string {
-	return fmt.Sprintf("10.1.%d.%d", mapVlanToThirdIpOctet(vlan), FIRST_IP_IN_SUBNET)
+	return peerAllowedIps
 }
 
-func getVlanNetworkIpWithSubnet(vlan int) string {
-	return fmt.Sprintf("10.0.%d.0/%d", mapVlanToThirdIpOctet(vlan), SUBNET_MASK)
-}
+// getNetworkSegmentId returns the subject for shared subjects. Isolated subjects give every owner
+// its own segment, with its own VLAN, network, VRF and VPN, so students can't reach each other
+func getNetworkSegmentId(subjectId string, isolated bool, ownerId string) string {
+	if !isolated {
+		return subjectId
+	}
 
-func getIpAddWithSubnet(vlan int, vmVlanIdentifier int) string {
-	return fmt.Sprintf(
-		"10.0.%d.%d/%d",
-		mapVlanToThirdIpOctet(vlan),
-		vmVlanIdentifier+FIRST_IP_IN_SUBNET,
-		SUBNET_MASK,
-	)
+	return subjectId + "/" + ownerId
 }
 
-func mapVlanToThirdIpOctet(vlan int) int {
-	return vlan - FIRST_VLAN
+// getNetworkSegmentSubjectId returns the subject the network segment belongs to
+func getNetworkSegmentSubjectId(segmentId string) string {
+	subjectId, _, _ := strings.Cut(segmentId, "/")
+	return subjectId
 }
 
 func getVlanEtiquete(vlan int, vmVlanIdentifier int) string {
 	return fmt.Sprintf("vlan%d-%d", vlan, vmVlanIdentifier)
 }
 
-func getPeerAllowedIps(vmIpAddWithSubnet string) []string {
-	return []string{
-		getNetworkAddressWithSubnet(vmIpAddWithSubnet),
-		getNetworkAddressWithSubnet(getInterfaceAddressWithSubnet(vmIpAddWithSubnet)),
-	}
-}
-
-func getInterfaceAddressWithSubnet(vmIpAddWithSubnet string) string {
-	ipParts := strings.Split(vmIpAddWithSubnet, ".")
-	return fmt.Sprintf(
-		"%s.%d.%s.%s/%d",
-		ipParts[0],
-		INTERFACE_ADDRESS_SECOND_OCTET,
-		ipParts[2],
-		strings.Split(ipParts[3], "/")[0],
-		INTERFACE_ADDRESS_SUBNET_MASK,
-	)
-}
-
-func getNetworkAddressWithSubnet(vmIpAddWithSubnet string) string {
-	ipParts := strings.Split(vmIpAddWithSubnet, ".")
-	return fmt.Sprintf(
-		"%s.%s.%s.0/%d",
-		ipParts[0],
-		ipParts[1],
-		ipParts[2],
-		SUBNET_MASK,
-	)
-}
-
 func (s *ServiceImpl) deleteSubjectFromDb(subjectId string) {
 	// Try to delete the subject from the database until it succeeds
 	// The only reason it might fail is if the DB has gone down
@@ -1286,33 +1932,18 @@ func (s *ServiceImpl) addVlanConfigIfNotExists(vlan int) error {
 	}
 
 	if !isConfigured {
-		if err := s.routerosService.ApplyVlanConfig(
-			vlan,
-			getVlanRouterPort(vlan),
-			s.routerosVlanBridge,
-			s.routerosTaggedBridges,
-			s.routerosExternalGateway,
-			SUBNET_MASK,
-		); err != nil {
+		config, err := s.getVlanNetworkConfig(vlan)
+		if err != nil {
+			return err
+		}
+
+		// Items applied before a failure are kept, the next attempt only applies the rest
+		if _, err := s.networkBackend.ApplyVlanConfig(config); err != nil {
 			log.Println("Error applying router vlan config: ", err.Error())
-			s.routerosService.RemoveVlanConfig(
-				vlan,
-				getVlanRouterPort(vlan),
-				s.routerosVlanBridge,
-				s.routerosExternalGateway,
-				SUBNET_MASK,
-			)
 			return err
 		}
 		if err := s.db.SetVlanAsConfigured(vlan); err != nil {
 			log.Println("Error setting vlan as configured: ", err.Error())
-			s.routerosService.RemoveVlanConfig(
-				vlan,
-				getVlanRouterPort(vlan),
-				s.routerosVlanBridge,
-				s.routerosExternalGateway,
-				SUBNET_MASK,
-			)
 			return err
 		}
 	}
@@ -1330,25 +1961,51 @@ func (s *ServiceImpl) deleteVlanConfigWhenAvailable(vlan int) error {
 	}
 
 	if isConfigured {
-		s.routerosService.RemoveVlanConfig(
-			vlan,
-			getVlanRouterPort(vlan),
-			s.routerosVlanBridge,
-			s.routerosExternalGateway,
-			SUBNET_MASK,
-		)
+		config, err := s.getVlanNetworkConfig(vlan)
+		if err != nil {
+			return err
+		}
+
+		if err := s.networkBackend.RemoveVlanConfig(config); err != nil {
+			log.Println("Error removing router vlan config: ", err.Error())
+		}
 	}
 
 	return nil
 }
 
+func (s *ServiceImpl) getVlanNetworkConfig(vlan int) (VlanNetworkConfig, error) {
+	subjectNetwork, err := s.ipam.GetSubjectNetworkByVlan(vlan)
+	if err != nil {
+		return VlanNetworkConfig{}, err
+	}
+
+	config := VlanNetworkConfig{
+		Vlan:              vlan,
+		WireguardPort:     getVlanRouterPort(vlan),
+		GatewayAddress:    fmt.Sprintf("%s/%d", subjectNetwork.GatewayIp(), subjectNetwork.Network.Bits()),
+		VpnGatewayAddress: fmt.Sprintf("%s/%d", subjectNetwork.VpnGatewayIp(), subjectNetwork.VpnNetwork.Bits()),
+		Network:           subjectNetwork.Network.String(),
+	}
+
+	if s.isIpv6Enabled() {
+		config.Ipv6GatewayAddress = fmt.Sprintf("%s/%d", s.getVlanIpv6GatewayIp(vlan), IPV6_SUBNET_MASK)
+		config.Ipv6VpnGatewayAddress = fmt.Sprintf("%s/%d", s.getVpnIpv6GatewayIp(vlan), IPV6_SUBNET_MASK)
+		config.Ipv6Network = s.getVlanIpv6NetworkWithSubnet(vlan)
+	}
+
+	return config, nil
+}
+
 func getVlanRouterPort(vlan int) int {
 	return vlan + VLAN_TO_ROUTER_PORT_OFFSET
 }
 
 func NewService(
 	db Database,
-	serverAgentsURLs []string,
+	agentClient *AgentClient,
+	scheduler Scheduler,
+	ipam IPAM,
 	listBaseImagesEndpoint string,
 	defineTemplateEndpoint string,
 	deleteTemplateEndpoint string,
@@ -1358,43 +2015,76 @@ func NewService(
 	stopInstanceEndpoint string,
 	restartInstanceEndpoint string,
 	listInstancesStatusEndpoint string,
-	getResourceStatusEndpoint string,
-	serverAgentIsAliveEndpoint string,
+	migrateInstanceEndpoint string,
+	setupInstanceNetworkEndpoint string,
+	createSnapshotEndpoint string,
+	listSnapshotsEndpoint string,
+	revertSnapshotEndpoint string,
+	deleteSnapshotEndpoint string,
+	instanceConsoleEndpoint string,
 	vmsDns1 string,
 	vmsDns2 string,
-	routerosService RouterOSService,
-	routerosVlanBridge string,
-	routerosTaggedBridges []string,
-	routerosExternalGateway string,
+	networkBackend NetworkBackend,
+	vmsIpv6Prefix string,
+	listVmDisksEndpoint string,
+	reconcilerInterval time.Duration,
+	reconcilerRepair bool,
 ) (Service, error) {
-	service := &ServiceImpl{
-		db:                          db,
-		serverAgentsURLs:            serverAgentsURLs,
-		listBaseImagesEndpoint:      listBaseImagesEndpoint,
-		defineTemplateEndpoint:      defineTemplateEndpoint,
-		deleteTemplateEndpoint:      deleteTemplateEndpoint,
-		createInstanceEndpoint:      createInstanceEndpoint,
-		deleteInstanceEndpoint:      deleteInstanceEndpoint,
-		startInstanceEndpoint:       startInstanceEndpoint,
-		stopInstanceEndpoint:        stopInstanceEndpoint,
-		restartInstanceEndpoint:     restartInstanceEndpoint,
-		listInstancesStatusEndpoint: listInstancesStatusEndpoint,
-		getResourceStatusEndpoint:   getResourceStatusEndpoint,
-		serverAgentIsAliveEndpoint:  serverAgentIsAliveEndpoint,
-		vmsDns1:                     vmsDns1,
-		vmsDns2:                     vmsDns2,
-		routerosService:             routerosService,
-		routerosVlanBridge:          routerosVlanBridge,
-		routerosTaggedBridges:       routerosTaggedBridges,
-		routerosExternalGateway:     routerosExternalGateway,
-		vmsMutexMap:                 make(map[string]*sync.Mutex),
-		mutex:                       sync.Mutex{},
-		routerVlanConfSharedMemory:  []int{},
-		routerVlanConfMutex:         sync.Mutex{},
+	ipv6Prefix, err := parseIpv6Prefix(vmsIpv6Prefix)
+	if err != nil {
+		return nil, logAndReturnError("Error parsing VMS_IPV6_PREFIX: ", err.Error())
 	}
 
+	service := &ServiceImpl{
+		db:                           db,
+		agentClient:                  agentClient,
+		scheduler:                    scheduler,
+		ipam:                         ipam,
+		listBaseImagesEndpoint:       listBaseImagesEndpoint,
+		defineTemplateEndpoint:       defineTemplateEndpoint,
+		deleteTemplateEndpoint:       deleteTemplateEndpoint,
+		createInstanceEndpoint:       createInstanceEndpoint,
+		deleteInstanceEndpoint:       deleteInstanceEndpoint,
+		startInstanceEndpoint:        startInstanceEndpoint,
+		stopInstanceEndpoint:         stopInstanceEndpoint,
+		restartInstanceEndpoint:      restartInstanceEndpoint,
+		listInstancesStatusEndpoint:  listInstancesStatusEndpoint,
+		migrateInstanceEndpoint:      migrateInstanceEndpoint,
+		setupInstanceNetworkEndpoint: setupInstanceNetworkEndpoint,
+		createSnapshotEndpoint:       createSnapshotEndpoint,
+		listSnapshotsEndpoint:        listSnapshotsEndpoint,
+		revertSnapshotEndpoint:       revertSnapshotEndpoint,
+		deleteSnapshotEndpoint:       deleteSnapshotEndpoint,
+		instanceConsoleEndpoint:      instanceConsoleEndpoint,
+		vmsDns1:                      vmsDns1,
+		vmsDns2:                      vmsDns2,
+		networkBackend:               networkBackend,
+		ipv6Prefix:                   ipv6Prefix,
+		vmsMutexMap:                  make(map[string]*sync.Mutex),
+		mutex:                        sync.Mutex{},
+		routerVlanConfSharedMemory:   []int{},
+		routerVlanConfMutex:          sync.Mutex{},
+		consoleTickets:               make(map[string]ConsoleTicket),
+		consoleTicketsMutex:          sync.Mutex{},
+		listVmDisksEndpoint:          listVmDisksEndpoint,
+		reconcilerInterval:           reconcilerInterval,
+		reconcilerRepair:             reconcilerRepair,
+		reconcilerMutex:              sync.Mutex{},
+		previousOrphans:              map[string]bool{},
+		instanceEvents:               NewInstanceEvents(),
+		dbWriteRetryWait:             DB_WRITE_RETRY_WAIT,
+	}
+
+	// Server agents may not have registered yet, base images are added again on every registration
 	if err := service.addBaseImagesToDb(); err != nil {
-		return nil, err
+		log.Printf("Could not add base images to the database yet: %v", err)
+	}
+
+	go service.monitorServerAgents()
+	go service.instanceEvents.pruneStaleAgents()
+	go service.expirePortForwards()
+	if reconcilerInterval > 0 {
+		go service.runReconciler()
 	}
 
 	return service, nil
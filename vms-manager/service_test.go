@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testBaseImageId = "0b6c9a52-3f0e-4d7b-8a1e-5c2d4f6a8b90"
+const testSubjectId = "networks"
+const testVlan = 100
+
+const testCreateInstanceEndpoint = "/instances/create"
+const testDeleteInstanceEndpoint = "/instances/delete"
+const testListInstancesStatusEndpoint = "/instances/status"
+
+// fakeServerAgent answers the server agent calls of the instance lifecycle, keeping the instances in memory
+type fakeServerAgent struct {
+	*httptest.Server
+	mutex     sync.Mutex
+	instances map[string]string
+}
+
+func newFakeServerAgent(t *testing.T) *fakeServerAgent {
+	t.Helper()
+
+	agent := &fakeServerAgent{instances: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+testCreateInstanceEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		var request CreateInstanceAgentRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		agent.mutex.Lock()
+		agent.instances[request.InstanceId] = SHUTOFF_STATUS
+		agent.mutex.Unlock()
+	})
+	mux.HandleFunc("DELETE "+testDeleteInstanceEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		var request DeleteVmAgentRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		agent.mutex.Lock()
+		delete(agent.instances, request.VmId)
+		agent.mutex.Unlock()
+	})
+	mux.HandleFunc("GET "+testListInstancesStatusEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		agent.mutex.Lock()
+		defer agent.mutex.Unlock()
+
+		statuses := []ListInstancesStatusResponse{}
+		for instanceId, status := range agent.instances {
+			statuses = append(statuses, ListInstancesStatusResponse{InstanceId: instanceId, Status: status})
+		}
+		json.NewEncoder(w).Encode(statuses)
+	})
+
+	agent.Server = httptest.NewServer(mux)
+	t.Cleanup(agent.Close)
+
+	return agent
+}
+
+func (agent *fakeServerAgent) hasInstance(instanceId string) bool {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+
+	_, found := agent.instances[instanceId]
+	return found
+}
+
+// newTestService returns a service with the RouterOS backend configuring the fake router, a server
+// agent with room for the test instances and a firewall policy in the test subject
+func newTestService(t *testing.T) (*ServiceImpl, *fakeDatabase, *FakeRouterOS, *fakeServerAgent) {
+	t.Helper()
+
+	router, err := NewFakeRouterOS("admin", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(router.Close)
+
+	backend, err := NewRouterOSService(router.Addr(), "admin", "secret", "bridge1", []string{"bridge1", "ether2"}, "192.0.2.1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(backend.Close)
+
+	agent := newFakeServerAgent(t)
+
+	db := newFakeDatabase()
+	description := "debian12"
+	db.vms[testBaseImageId] = DatabaseVM{ID: testBaseImageId, Description: &description, IsBase: true}
+	db.serverAgents = []ServerAgent{{
+		Url:             agent.URL,
+		VcpuCount:       16,
+		TotalMemoryMB:   32768,
+		TotalDiskMB:     512000,
+		ResourceStatus:  GetResourceStatusAgentResponse{FreeMemoryMB: 32768, FreeDiskMB: 512000},
+		State:           ServerAgentAlive,
+		LastHeartbeatAt: time.Now(),
+	}}
+	db.firewallPolicies = []DatabaseFirewallPolicy{{
+		ID:        "policy",
+		Name:      "no smtp",
+		SubjectId: testSubjectId,
+		Rules: []FirewallRule{
+			{Direction: FIREWALL_DIRECTION_EGRESS, Action: FIREWALL_ACTION_DROP, Protocol: "tcp", Ports: "25"},
+		},
+	}}
+
+	ipam, err := NewIPAM(
+		db,
+		strconv.Itoa(testVlan)+"-"+strconv.Itoa(testVlan+10),
+		DEFAULT_IPAM_VMS_SUPERNETS,
+		DEFAULT_IPAM_VPN_SUPERNETS,
+		DEFAULT_IPAM_PREFIX_LENGTH,
+		DEFAULT_IPAM_ISOLATED_PREFIX_LENGTH,
+		DEFAULT_IPAM_LAB_VLAN_RANGE,
+		DEFAULT_IPAM_PORT_FORWARD_RANGE,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := &ServiceImpl{
+		db:                          db,
+		agentClient:                 &AgentClient{Client: &http.Client{}},
+		scheduler:                   NewScheduler(db, DEFAULT_CPU_OVERCOMMIT_RATIO, DEFAULT_RAM_OVERCOMMIT_RATIO, DEFAULT_DISK_OVERCOMMIT_RATIO, 0),
+		ipam:                        ipam,
+		createInstanceEndpoint:      testCreateInstanceEndpoint,
+		deleteInstanceEndpoint:      testDeleteInstanceEndpoint,
+		listInstancesStatusEndpoint: testListInstancesStatusEndpoint,
+		networkBackend:              backend,
+		vmsMutexMap:                 map[string]*sync.Mutex{},
+		consoleTickets:              map[string]ConsoleTicket{},
+		instanceEvents:              NewInstanceEvents(),
+	}
+
+	return service, db, router, agent
+}
+
+// recordingScheduler keeps the requests it's asked to schedule
+type recordingScheduler struct {
+	Scheduler
+	requests []SchedulingRequest
+}
+
+func (s *recordingScheduler) Schedule(request SchedulingRequest) (Reservation, error) {
+	s.requests = append(s.requests, request)
+	return s.Scheduler.Schedule(request)
+}
+
+func newTestCreateInstanceRequest() CreateInstanceRequest {
+	return CreateInstanceRequest{
+		SourceVmId:   testBaseImageId,
+		SizeMB:       10240,
+		VcpuCount:    2,
+		VramMB:       2048,
+		Username:     "student",
+		Password:     "password",
+		SubjectId:    testSubjectId,
+		UserWgPubKey: randomWireguardKey(),
+	}
+}
+
+func expectRouterItem(t *testing.T, router *FakeRouterOS, menu string, match map[string]string) map[string]string {
+	t.Helper()
+
+	if err := router.ExpectItem(menu, match); err != nil {
+		t.Fatal(err)
+	}
+
+	return router.Items(menu, match)[0]
+}
+
+func expectNoRouterItem(t *testing.T, router *FakeRouterOS, menu string, match map[string]string) {
+	t.Helper()
+
+	if err := router.ExpectNoItem(menu, match); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkInstanceConfigured checks the VLAN, the WireGuard peer of the user and the firewall of the instance are in the router
+func checkInstanceConfigured(t *testing.T, router *FakeRouterOS, request CreateInstanceRequest, response CreateInstanceResponse, vmVlanIdentifier int) {
+	t.Helper()
+
+	expectRouterItem(t, router, "/interface/vlan", map[string]string{
+		"name":      getVlanInterfaceName(testVlan),
+		"vlan-id":   strconv.Itoa(testVlan),
+		"interface": "bridge1",
+	})
+	expectRouterItem(t, router, "/ip/vrf", map[string]string{"name": getVrfName(testVlan)})
+
+	wireguard := expectRouterItem(t, router, "/interface/wireguard", map[string]string{
+		"name":        getWireguardInterfaceName(testVlan),
+		"listen-port": strconv.Itoa(getVlanRouterPort(testVlan)),
+	})
+	if response.PeerPublicKey != wireguard["public-key"] {
+		t.Errorf("expected peer public key %s, got %s", wireguard["public-key"], response.PeerPublicKey)
+	}
+	if response.PeerEndpointPort != getVlanRouterPort(testVlan) {
+		t.Errorf("expected peer endpoint port %d, got %d", getVlanRouterPort(testVlan), response.PeerEndpointPort)
+	}
+
+	expectRouterItem(t, router, "/interface/wireguard/peers", map[string]string{
+		"name":       getWireguardPeerName(testVlan, vmVlanIdentifier),
+		"interface":  getWireguardInterfaceName(testVlan),
+		"public-key": request.UserWgPubKey,
+	})
+
+	expectRouterItem(t, router, "/ip/firewall/filter", map[string]string{
+		"comment":  getVmFirewallName(testVlan, vmVlanIdentifier),
+		"action":   FIREWALL_ACTION_DROP,
+		"protocol": "tcp",
+		"dst-port": "25",
+	})
+}
+
+func TestCreateAndDeleteInstanceConfiguresRouter(t *testing.T) {
+	service, db, router, agent := newTestService(t)
+	request := newTestCreateInstanceRequest()
+
+	response, err := service.CreateInstance(request, nil)
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+
+	if !agent.hasInstance(response.InstanceId) {
+		t.Fatalf("expected instance %s in the server agent", response.InstanceId)
+	}
+	if response.InterfaceAddress != "10.1.0.2/32" {
+		t.Errorf("expected interface address 10.1.0.2/32, got %s", response.InterfaceAddress)
+	}
+	checkInstanceConfigured(t, router, request, response, 1)
+
+	if err := service.DeleteInstance(response.InstanceId, nil); err != nil {
+		t.Fatalf("DeleteInstance returned error: %v", err)
+	}
+
+	if agent.hasInstance(response.InstanceId) {
+		t.Errorf("expected instance %s to be deleted in the server agent", response.InstanceId)
+	}
+	if exists, _ := db.VmExistsById(response.InstanceId); exists {
+		t.Errorf("expected instance %s to be deleted from the database", response.InstanceId)
+	}
+	if len(db.subjects) != 0 {
+		t.Errorf("expected the subject to be deleted with its last instance, got %v", db.subjects)
+	}
+	if err := router.ExpectEmpty(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteInstanceKeepsVlanOfOtherInstances(t *testing.T) {
+	service, _, router, _ := newTestService(t)
+	firstRequest := newTestCreateInstanceRequest()
+	secondRequest := newTestCreateInstanceRequest()
+
+	first, err := service.CreateInstance(firstRequest, nil)
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+	second, err := service.CreateInstance(secondRequest, nil)
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+	checkInstanceConfigured(t, router, secondRequest, second, 2)
+
+	if err := service.DeleteInstance(first.InstanceId, nil); err != nil {
+		t.Fatalf("DeleteInstance returned error: %v", err)
+	}
+
+	// Only the peer and the firewall of the deleted instance are removed
+	expectNoRouterItem(t, router, "/interface/wireguard/peers", map[string]string{"name": getWireguardPeerName(testVlan, 1)})
+	expectNoRouterItem(t, router, "/ip/firewall/filter", map[string]string{"comment": getVmFirewallName(testVlan, 1)})
+	checkInstanceConfigured(t, router, secondRequest, second, 2)
+
+	if err := service.DeleteInstance(second.InstanceId, nil); err != nil {
+		t.Fatalf("DeleteInstance returned error: %v", err)
+	}
+
+	if err := router.ExpectEmpty(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateInstanceRollsBackWhenRouterFails(t *testing.T) {
+	service, db, router, agent := newTestService(t)
+	router.FailNext("/interface/wireguard/peers/add", "failure: interface not found")
+
+	_, err := service.CreateInstance(newTestCreateInstanceRequest(), nil)
+	if err == nil {
+		t.Fatal("expected CreateInstance to fail")
+	}
+
+	agent.mutex.Lock()
+	instances := len(agent.instances)
+	agent.mutex.Unlock()
+	if instances != 0 {
+		t.Errorf("expected the instance to be deleted in the server agent, got %v", agent.instances)
+	}
+	if vmIds, _ := db.GetAllVmIds(); len(vmIds) != 0 {
+		t.Errorf("expected the instance to be deleted from the database, got %v", vmIds)
+	}
+	if len(db.vmAllocations) != 0 {
+		t.Errorf("expected the address of the instance to be released, got %v", db.vmAllocations)
+	}
+	if err := router.ExpectEmpty(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateInstanceRetriesDatabaseWrite(t *testing.T) {
+	service, db, _, agent := newTestService(t)
+	db.addVmFailures = DB_WRITE_ATTEMPTS - 1
+
+	response, err := service.CreateInstance(newTestCreateInstanceRequest(), nil)
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+
+	if !agent.hasInstance(response.InstanceId) {
+		t.Errorf("expected the instance to be created in the server agent")
+	}
+	if exists, _ := db.VmExistsById(response.InstanceId); !exists {
+		t.Errorf("expected the instance to be added to the database")
+	}
+}
+
+func TestCreateInstanceFailsWhenDatabaseIsDown(t *testing.T) {
+	service, db, router, agent := newTestService(t)
+	db.addVmFailures = DB_WRITE_ATTEMPTS
+
+	_, err := service.CreateInstance(newTestCreateInstanceRequest(), nil)
+	if err == nil {
+		t.Fatal("expected CreateInstance to fail")
+	}
+
+	agent.mutex.Lock()
+	instances := len(agent.instances)
+	agent.mutex.Unlock()
+	if instances != 0 {
+		t.Errorf("expected the instance to be deleted in the server agent, got %v", agent.instances)
+	}
+	if len(db.vmAllocations) != 0 {
+		t.Errorf("expected the address of the instance to be released, got %v", db.vmAllocations)
+	}
+	if err := router.ExpectEmpty(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateIsolatedInstanceSchedulesItsSubject(t *testing.T) {
+	service, db, router, _ := newTestService(t)
+	scheduler := &recordingScheduler{Scheduler: service.scheduler}
+	service.scheduler = scheduler
+
+	request := newTestCreateInstanceRequest()
+	request.SubjectIsolated = true
+	request.OwnerId = "alice"
+
+	response, err := service.CreateInstance(request, nil)
+	if err != nil {
+		t.Fatalf("CreateInstance returned error: %v", err)
+	}
+
+	// The instance lives in the segment of its owner but is spread and limited as one of the subject
+	if len(scheduler.requests) != 1 || scheduler.requests[0].SubjectId != testSubjectId {
+		t.Fatalf("expected the instance to be scheduled as subject %s, got %v", testSubjectId, scheduler.requests)
+	}
+	if subjectId, _ := db.GetSubjectIdByVmId(response.InstanceId); subjectId != testSubjectId+"/alice" {
+		t.Errorf("expected the instance in segment %s/alice, got %s", testSubjectId, subjectId)
+	}
+	checkInstanceConfigured(t, router, request, response, 1)
+}
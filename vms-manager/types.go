@@ -1,6 +1,67 @@
 package main
 
+import (
+	"encoding/json"
+	"time"
+)
+
+type JobType string
+
+const (
+	CreateInstanceJob JobType = "create_instance"
+	DeleteInstanceJob JobType = "delete_instance"
+	StopInstanceJob   JobType = "stop_instance"
+	DefineTemplateJob JobType = "define_template"
+	DeleteTemplateJob JobType = "delete_template"
+	DrainAgentJob     JobType = "drain_server_agent"
+	CreateLabJob      JobType = "create_lab"
+	StopLabJob        JobType = "stop_lab"
+	DeleteLabJob      JobType = "delete_lab"
+)
+
+type ServerAgentState string
+
+const (
+	ServerAgentAlive ServerAgentState = "alive"
+	// The server agent stopped sending heartbeats, it may come back at any time
+	ServerAgentLost ServerAgentState = "lost"
+)
+
+type NetworkDriftKind string
+
+const (
+	NetworkItemMissing NetworkDriftKind = "missing"
+	NetworkItemChanged NetworkDriftKind = "changed"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+type Job struct {
+	ID        string          `json:"jobId"`
+	Type      JobType         `json:"type"`
+	VmId      *string         `json:"vmId"`
+	Status    JobStatus       `json:"status"`
+	Step      string          `json:"step"`
+	Error     *string         `json:"error"`
+	Result    json.RawMessage `json:"result"`
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+	// Set when the request that started the job can be sent again without starting another one
+	IdempotencyKey *string `json:"idempotencyKey,omitempty"`
+}
+
 // VM Manager API
+type JobResponse struct {
+	JobId string `json:"jobId"`
+}
+
 type ListBaseImagesResponse struct {
 	BaseId      string `json:"baseId"`
 	Description string `json:"description"`
@@ -11,6 +72,8 @@ type DefineTemplateRequest struct {
 	SizeMB           int    `json:"sizeMB"`
 	VcpuCount        int    `json:"vcpuCount"`
 	VramMB           int    `json:"vramMB"`
+	// Requests sent again with the same key get the job of the first one instead of defining another template
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 type DefineTemplateResponse struct {
@@ -27,6 +90,13 @@ type CreateInstanceRequest struct {
 	PublicSshKeys []string `json:"publicSshKeys"`
 	SubjectId     string   `json:"subjectId"`
 	UserWgPubKey  string   `json:"userWgPubKey"` // User's WireGuard public key
+	// Prefix length of the subject network, only used when it's allocated with its first instance. 0 uses the default
+	SubjectPrefixLength int `json:"subjectPrefixLength,omitempty"`
+	// Instances of isolated subjects only share their network with the instances of the same owner
+	SubjectIsolated bool   `json:"subjectIsolated,omitempty"`
+	OwnerId         string `json:"ownerId,omitempty"`
+	// Requests sent again with the same key get the job of the first one instead of creating another instance
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 type CreateInstanceResponse struct {
@@ -37,11 +107,167 @@ type CreateInstanceResponse struct {
 	PeerEndpointPort int      `json:"peerEndpointPort"`
 }
 
+// CreateWireguardPeerRequest adds a device of the owner of the instance, e.g. a second computer
+type CreateWireguardPeerRequest struct {
+	InstanceId string `json:"instanceId"`
+	Name       string `json:"name"`
+	PublicKey  string `json:"publicKey"`
+}
+
+// CreateWireguardPeerResponse has what the device needs to connect, like CreateInstanceResponse
+type CreateWireguardPeerResponse struct {
+	PeerId           string   `json:"peerId"`
+	InterfaceAddress string   `json:"interfaceAddress"`
+	PeerPublicKey    string   `json:"peerPublicKey"`
+	PeerAllowedIps   []string `json:"peerAllowedIps"`
+	PeerEndpointPort int      `json:"peerEndpointPort"`
+}
+
+// RotateWireguardKeyRequest has the public key of the new key pair of the device
+type RotateWireguardKeyRequest struct {
+	PublicKey string `json:"publicKey"`
+}
+
+type WireguardPeerResponse struct {
+	Id               string    `json:"id"`
+	InstanceId       string    `json:"instanceId"`
+	Name             string    `json:"name"`
+	PublicKey        string    `json:"publicKey"`
+	InterfaceAddress string    `json:"interfaceAddress"`
+	CreatedAt        time.Time `json:"createdAt"`
+}
+
+// A lab is a set of instances of the same owner placed in one server agent and linked by internal
+// networks, e.g. a router, a client and a server. Internal networks have no gateway, their VLANs are
+// only bridged in the server agent. Every node still gets its address and WireGuard peer in the subject network
+type CreateLabRequest struct {
+	SubjectId           string           `json:"subjectId"`
+	SubjectPrefixLength int              `json:"subjectPrefixLength,omitempty"`
+	SubjectIsolated     bool             `json:"subjectIsolated,omitempty"`
+	OwnerId             string           `json:"ownerId,omitempty"`
+	Username            string           `json:"username"`
+	Password            string           `json:"password"`
+	PublicSshKeys       []string         `json:"publicSshKeys"`
+	Networks            []string         `json:"networks"`
+	Nodes               []LabNodeRequest `json:"nodes"`
+}
+
+type LabNodeRequest struct {
+	Name         string `json:"name"`
+	SourceVmId   string `json:"sourceVmId"`
+	SizeMB       int    `json:"sizeMB"`
+	VcpuCount    int    `json:"vcpuCount"`
+	VramMB       int    `json:"vramMB"`
+	UserWgPubKey string `json:"userWgPubKey"` // User's WireGuard public key for this node
+	// Attached in this order, the guest names them lab0, lab1...
+	Interfaces []LabInterfaceRequest `json:"interfaces"`
+}
+
+type LabInterfaceRequest struct {
+	Network         string `json:"network"`
+	IpAddWithSubnet string `json:"ipAddWithSubnet,omitempty"` // Left unconfigured when empty
+}
+
+type CreateLabResponse struct {
+	LabId     string                `json:"labId"`
+	Instances []LabInstanceResponse `json:"instances"`
+}
+
+type LabInstanceResponse struct {
+	Name string `json:"name"`
+	CreateInstanceResponse
+}
+
+// FirewallRule filters the connections opened between an instance and the external network,
+// rules are evaluated in order and the first one matching decides
+type FirewallRule struct {
+	Direction string `json:"direction"`          // egress (opened by the instance) or ingress (opened to it)
+	Action    string `json:"action"`             // accept or drop
+	Protocol  string `json:"protocol,omitempty"` // tcp, udp or icmp, any protocol when empty
+	Ports     string `json:"ports,omitempty"`    // Destination ports of tcp and udp rules, e.g. 80,443,8000-8080
+	Remote    string `json:"remote,omitempty"`   // External network, any when empty, e.g. 192.0.2.0/24
+}
+
+// CreateFirewallPolicyRequest applies to every instance of the subject, or only
+// to the ones created from the template when templateId is set
+type CreateFirewallPolicyRequest struct {
+	Name       string         `json:"name"`
+	SubjectId  string         `json:"subjectId"`
+	TemplateId *string        `json:"templateId,omitempty"`
+	Rules      []FirewallRule `json:"rules"`
+}
+
+type CreateFirewallPolicyResponse struct {
+	PolicyId string `json:"policyId"`
+}
+
+type UpdateFirewallPolicyRequest struct {
+	Name  string         `json:"name"`
+	Rules []FirewallRule `json:"rules"`
+}
+
+type FirewallPolicyResponse struct {
+	Id         string         `json:"id"`
+	Name       string         `json:"name"`
+	SubjectId  string         `json:"subjectId"`
+	TemplateId *string        `json:"templateId,omitempty"`
+	Rules      []FirewallRule `json:"rules"`
+	CreatedAt  time.Time      `json:"createdAt"`
+}
+
+type CreatePortForwardRequest struct {
+	InstanceId   string     `json:"instanceId"`
+	Protocol     string     `json:"protocol"` // tcp or udp
+	InternalPort int        `json:"internalPort"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"` // Never expires when empty
+}
+
+type CreatePortForwardResponse struct {
+	PortForwardId string `json:"portForwardId"`
+	ExternalPort  int    `json:"externalPort"`
+}
+
+type PortForwardResponse struct {
+	Id           string     `json:"id"`
+	InstanceId   string     `json:"instanceId"`
+	Protocol     string     `json:"protocol"`
+	ExternalPort int        `json:"externalPort"`
+	InternalPort int        `json:"internalPort"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt"`
+}
+
+type MigrateInstanceRequest struct {
+	TargetServerAgentUrl string `json:"targetServerAgentUrl"` // Selected by the scheduler when empty
+	Live                 bool   `json:"live"`                 // Migrate the instance while it's running
+}
+
+type CreateSnapshotResponse struct {
+	SnapshotId string `json:"snapshotId"`
+}
+
+type ListSnapshotsResponse struct {
+	SnapshotId string `json:"snapshotId"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+type CreateConsoleTicketResponse struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
 type ListInstancesStatusResponse struct {
 	InstanceId string `json:"instanceId"`
 	Status     string `json:"status"`
 }
 
+// Templates have no subject in the vms manager
+type ListVmsResponse struct {
+	VmId       string `json:"vmId"`
+	SubjectId  string `json:"subjectId,omitempty"`
+	IsTemplate bool   `json:"isTemplate"`
+}
+
 type ListServersStatusResponse struct {
 	ServerIP         string   `json:"serverIp"`
 	CpuLoad          float64  `json:"cpuLoad"`
@@ -50,6 +276,87 @@ type ListServersStatusResponse struct {
 	TotalDiskMB      int      `json:"totalDiskMB"`
 	FreeDiskMB       int      `json:"freeDiskMB"`
 	RunningInstances []string `json:"runningInstances"`
+	Cordoned         bool     `json:"cordoned"`
+	Draining         bool     `json:"draining"`
+}
+
+// NetworkDrift is an item of the desired gateway config that is missing or has different properties
+// in the network backend, e.g. a RouterOS menu entry. Expected and Actual only contain the properties that differ
+type NetworkDrift struct {
+	Resource string            `json:"resource"`
+	Key      map[string]string `json:"key"`
+	Kind     NetworkDriftKind  `json:"kind"`
+	Expected map[string]string `json:"expected,omitempty"`
+	Actual   map[string]string `json:"actual,omitempty"`
+}
+
+type VlanDriftResponse struct {
+	Vlan   int            `json:"vlan"`
+	InSync bool           `json:"inSync"`
+	Drifts []NetworkDrift `json:"drifts"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// Sent by the server agents when they boot
+type RegisterServerAgentRequest struct {
+	Url           string            `json:"url"`
+	Version       string            `json:"version"`
+	Labels        map[string]string `json:"labels"`
+	VcpuCount     int               `json:"vcpuCount"`
+	TotalMemoryMB int               `json:"totalMemoryMB"`
+	TotalDiskMB   int               `json:"totalDiskMB"`
+}
+
+// Sent periodically by the server agents once registered
+type ServerAgentHeartbeatRequest struct {
+	Url            string                         `json:"url"`
+	ResourceStatus GetResourceStatusAgentResponse `json:"resourceStatus"`
+}
+
+// DomainEventsRequest carries the domains of a server agent whose state changed since its last report,
+// or all of them when Full is set
+type DomainEventsRequest struct {
+	Url            string                        `json:"url"`
+	Full           bool                          `json:"full"`
+	Domains        []ListInstancesStatusResponse `json:"domains"`
+	RemovedDomains []string                      `json:"removedDomains"`
+}
+
+// InstanceEvent is sent to the subscribers of the instance events when the status of an instance changes
+type InstanceEvent struct {
+	InstanceId string `json:"instanceId"`
+	Status     string `json:"status"`
+}
+
+type SetServerAgentCordonRequest struct {
+	ServerAgentUrl string `json:"serverAgentUrl"`
+	Cordoned       bool   `json:"cordoned"`
+}
+
+type ServerAgentRequest struct {
+	ServerAgentUrl string `json:"serverAgentUrl"`
+}
+
+type DrainServerAgentResponse struct {
+	MigratedInstances []string          `json:"migratedInstances"`
+	FailedInstances   map[string]string `json:"failedInstances"`
+	// Templates can't be migrated, the server agent can't be deregistered while it holds them
+	RemainingTemplates []string `json:"remainingTemplates"`
+}
+
+type ServerAgentResponse struct {
+	Url             string                         `json:"url"`
+	Version         string                         `json:"version"`
+	Labels          map[string]string              `json:"labels"`
+	VcpuCount       int                            `json:"vcpuCount"`
+	TotalMemoryMB   int                            `json:"totalMemoryMB"`
+	TotalDiskMB     int                            `json:"totalDiskMB"`
+	ResourceStatus  GetResourceStatusAgentResponse `json:"resourceStatus"`
+	State           ServerAgentState               `json:"state"`
+	Cordoned        bool                           `json:"cordoned"`
+	Draining        bool                           `json:"draining"`
+	RegisteredAt    time.Time                      `json:"registeredAt"`
+	LastHeartbeatAt time.Time                      `json:"lastHeartbeatAt"`
 }
 
 type ApiError struct {
@@ -67,6 +374,7 @@ type DefineTemplateAgentRequest struct {
 	SizeMB           int    `json:"sizeMB"`
 	VcpuCount        int    `json:"vcpuCount"`
 	VramMB           int    `json:"vramMB"`
+	IdempotencyKey   string `json:"idempotencyKey,omitempty"`
 }
 
 type CreateInstanceAgentRequest struct {
@@ -84,14 +392,72 @@ type CreateInstanceAgentRequest struct {
 	Dns2            string   `json:"dns2"`
 	Gateway         string   `json:"gateway"`
 	VlanEtiquete    string   `json:"vlanEtiquete"`
+	// Empty when IPv6 is disabled
+	Ipv6AddWithSubnet string `json:"ipv6AddWithSubnet,omitempty"`
+	Ipv6Gateway       string `json:"ipv6Gateway,omitempty"`
+	// Only set for instances of a lab
+	LabInterfaces  []LabInterfaceAgentRequest `json:"labInterfaces,omitempty"`
+	IdempotencyKey string                     `json:"idempotencyKey,omitempty"`
 }
 
 type StartInstanceAgentRequest struct {
+	InstanceId    string                     `json:"instanceId"`
+	Vid           string                     `json:"vid"`
+	VlanEtiquete  string                     `json:"vlanEtiquete"`
+	LabInterfaces []LabInterfaceAgentRequest `json:"labInterfaces,omitempty"`
+}
+
+// Interface of a lab instance in an internal network, its VLAN is only bridged inside the server agent
+type LabInterfaceAgentRequest struct {
+	Vid             string `json:"vid"`
+	VlanEtiquete    string `json:"vlanEtiquete"`
+	IpAddWithSubnet string `json:"ipAddWithSubnet,omitempty"`
+}
+
+type SetupInstanceNetworkAgentRequest struct {
 	InstanceId   string `json:"instanceId"`
 	Vid          string `json:"vid"`
 	VlanEtiquete string `json:"vlanEtiquete"`
 }
 
+type MigrateInstanceAgentRequest struct {
+	InstanceId           string `json:"instanceId"`
+	TargetServerAgentUrl string `json:"targetServerAgentUrl"`
+	BackingTemplateId    string `json:"backingTemplateId"` // Empty if the target already holds the backing template
+	Live                 bool   `json:"live"`
+	Vid                  string `json:"vid"`
+	RemoveEtiquete       bool   `json:"removeEtiquete"`
+}
+
+type CreateSnapshotAgentRequest struct {
+	InstanceId string `json:"instanceId"`
+	SnapshotId string `json:"snapshotId"`
+}
+
+type ListVmDisksResponse struct {
+	VmId string `json:"vmId"`
+}
+
+// ReconciliationOrphan is something found in the database, a server agent or the gateway without its
+// counterpart in the others. It's only repaired when repairing is enabled and the previous run found it too
+type ReconciliationOrphan struct {
+	Kind           string `json:"kind"`
+	Id             string `json:"id"`
+	ServerAgentUrl string `json:"serverAgentUrl,omitempty"`
+	Detail         string `json:"detail"`
+	Repaired       bool   `json:"repaired"`
+	RepairError    string `json:"repairError,omitempty"`
+}
+
+type ReconciliationReport struct {
+	StartedAt     time.Time              `json:"startedAt"`
+	FinishedAt    time.Time              `json:"finishedAt"`
+	RepairEnabled bool                   `json:"repairEnabled"`
+	Orphans       []ReconciliationOrphan `json:"orphans"`
+	// Parts that could not be checked or repaired
+	Warnings []string `json:"warnings"`
+}
+
 type DeleteVmAgentRequest struct {
 	VmId           string `json:"vmId"`
 	RemoveEtiquete bool   `json:"removeEtiquete"`
@@ -113,9 +479,28 @@ type Vm struct {
 	DependsOn        *string
 	SubjectId        *string
 	VmVlanIdentifier *int
+	ServerAgentUrl   *string
+	VcpuCount        int
+	VramMB           int
+	SizeMB           int
+}
+
+type ServerAgent struct {
+	Url             string
+	Version         string
+	Labels          map[string]string
+	VcpuCount       int
+	TotalMemoryMB   int
+	TotalDiskMB     int
+	ResourceStatus  GetResourceStatusAgentResponse
+	State           ServerAgentState
+	Cordoned        bool
+	Draining        bool
+	RegisteredAt    time.Time
+	LastHeartbeatAt time.Time
 }
 
-type Subject struct {
-	SubjectId string
-	Vlan      int
+type ConsoleTicket struct {
+	InstanceId string
+	ExpiresAt  time.Time
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// WireGuard keys are 32 bytes encoded in base64
+const WIREGUARD_KEY_LENGTH = 32
+
+func (s *ServiceImpl) CreateWireguardPeer(request CreateWireguardPeerRequest) (CreateWireguardPeerResponse, error) {
+	if request.InstanceId == "" || request.Name == "" {
+		return CreateWireguardPeerResponse{}, NewHttpError(
+			http.StatusBadRequest,
+			fmt.Errorf("invalid request: instanceId and name must be non-empty"),
+		)
+	}
+
+	if !isValidWireguardKey(request.PublicKey) {
+		return CreateWireguardPeerResponse{}, NewHttpError(
+			http.StatusBadRequest,
+			fmt.Errorf("invalid request: publicKey must be a WireGuard public key"),
+		)
+	}
+
+	if err := s.checkIfVmExists(request.InstanceId); err != nil {
+		return CreateWireguardPeerResponse{}, err
+	}
+
+	if err := s.checkIfVmIsTemplateOrBase(request.InstanceId); err != nil {
+		return CreateWireguardPeerResponse{}, err
+	}
+
+	vlan, err := s.db.GetVlanByVmId(request.InstanceId)
+	if err != nil {
+		return CreateWireguardPeerResponse{}, err
+	}
+
+	subjectNetwork, err := s.ipam.GetSubjectNetworkByVlan(vlan)
+	if err != nil {
+		return CreateWireguardPeerResponse{}, err
+	}
+
+	peerPublicKey, err := s.networkBackend.GetWireguardPublicKey(vlan)
+	if err != nil {
+		return CreateWireguardPeerResponse{}, err
+	}
+
+	peer := DatabaseWireguardPeer{
+		ID:         uuid.New().String(),
+		InstanceId: request.InstanceId,
+		Name:       request.Name,
+		PublicKey:  request.PublicKey,
+	}
+
+	peer.PeerIdentifier, err = s.ipam.AllocateWireguardPeer(subjectNetwork, peer)
+	if err != nil {
+		return CreateWireguardPeerResponse{}, err
+	}
+
+	interfaceAddresses := s.getPeerInterfaceAddresses(subjectNetwork, peer.PeerIdentifier)
+	if err := s.networkBackend.AddWireguardPeer(WireguardPeerConfig{
+		Vlan:               vlan,
+		PeerIdentifier:     peer.PeerIdentifier,
+		PublicKey:          peer.PublicKey,
+		InterfaceAddresses: interfaceAddresses,
+	}); err != nil {
+		s.deleteWireguardPeerFromDb(peer.ID)
+		return CreateWireguardPeerResponse{}, err
+	}
+
+	log.Printf("Wireguard peer %s added to instance %s", peer.ID, peer.InstanceId)
+
+	return CreateWireguardPeerResponse{
+		PeerId: peer.ID,
+		// WireGuard configs take a comma separated list of interface addresses
+		InterfaceAddress: strings.Join(interfaceAddresses, ", "),
+		PeerPublicKey:    peerPublicKey,
+		PeerAllowedIps:   s.getPeerAllowedIps(vlan, subjectNetwork.Network.String(), subjectNetwork.VpnNetwork.String()),
+		PeerEndpointPort: getVlanRouterPort(vlan),
+	}, nil
+}
+
+func (s *ServiceImpl) ListWireguardPeers(instanceId string) ([]WireguardPeerResponse, error) {
+	if err := s.checkIfVmExists(instanceId); err != nil {
+		return nil, err
+	}
+
+	peers, err := s.db.GetWireguardPeersByVmId(instanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	response := []WireguardPeerResponse{}
+	if len(peers) == 0 {
+		return response, nil
+	}
+
+	vlan, err := s.db.GetVlanByVmId(instanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	subjectNetwork, err := s.ipam.GetSubjectNetworkByVlan(vlan)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, peer := range peers {
+		response = append(response, WireguardPeerResponse{
+			Id:               peer.ID,
+			InstanceId:       peer.InstanceId,
+			Name:             peer.Name,
+			PublicKey:        peer.PublicKey,
+			InterfaceAddress: strings.Join(s.getPeerInterfaceAddresses(subjectNetwork, peer.PeerIdentifier), ", "),
+			CreatedAt:        peer.CreatedAt,
+		})
+	}
+
+	return response, nil
+}
+
+func (s *ServiceImpl) DeleteWireguardPeer(peerId string) error {
+	peer, exists, err := s.db.GetWireguardPeer(peerId)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return NewHttpError(http.StatusNotFound, fmt.Errorf("wireguard peer '%s' not found", peerId))
+	}
+
+	vlan, err := s.db.GetVlanByVmId(peer.InstanceId)
+	if err != nil {
+		return err
+	}
+
+	if err := s.networkBackend.RemoveWireguardPeer(vlan, peer.PeerIdentifier); err != nil {
+		return err
+	}
+
+	if err := s.db.DeleteWireguardPeer(peerId); err != nil {
+		return err
+	}
+
+	log.Printf("Wireguard peer %s of instance %s revoked", peerId, peer.InstanceId)
+
+	return nil
+}
+
+// RotateInstanceWireguardKey swaps the key of the peer of the instance owner's first device,
+// the extra devices keep theirs
+func (s *ServiceImpl) RotateInstanceWireguardKey(instanceId string, request RotateWireguardKeyRequest) error {
+	if !isValidWireguardKey(request.PublicKey) {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("invalid request: publicKey must be a WireGuard public key"))
+	}
+
+	if err := s.checkIfVmExists(instanceId); err != nil {
+		return err
+	}
+
+	if err := s.checkIfVmIsTemplateOrBase(instanceId); err != nil {
+		return err
+	}
+
+	vlan, err := s.db.GetVlanByVmId(instanceId)
+	if err != nil {
+		return err
+	}
+
+	vmVlanIdentifier, err := s.db.GetVmVlanIdentifierByVmId(instanceId)
+	if err != nil {
+		return err
+	}
+
+	subjectNetwork, err := s.ipam.GetSubjectNetworkByVlan(vlan)
+	if err != nil {
+		return err
+	}
+
+	vmNetworkConfig := VmNetworkConfig{
+		VmVlanIdentifier: vmVlanIdentifier,
+		Network:          subjectNetwork.Network.String(),
+		VpnNetwork:       subjectNetwork.VpnNetwork.String(),
+		InterfaceAddress: subjectNetwork.InterfaceAddressWithSubnet(vmVlanIdentifier),
+	}
+	if s.isIpv6Enabled() {
+		vmNetworkConfig.Ipv6InterfaceAddress = s.getIpv6InterfaceAddressWithSubnet(vlan, vmVlanIdentifier)
+	}
+
+	if err := s.networkBackend.RotateVmWireguardKey(vmNetworkConfig, vlan, request.PublicKey); err != nil {
+		return err
+	}
+
+	log.Printf("Wireguard key of instance %s rotated", instanceId)
+
+	return nil
+}
+
+// removeInstanceWireguardPeers removes the peers of the instance from the gateway,
+// they are deleted from the database with the instance
+func (s *ServiceImpl) removeInstanceWireguardPeers(instanceId string, vlan int) error {
+	peers, err := s.db.GetWireguardPeersByVmId(instanceId)
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range peers {
+		if err := s.networkBackend.RemoveWireguardPeer(vlan, peer.PeerIdentifier); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getPeerInterfaceAddresses returns the addresses of the device in the VPN network, the IPv4 one first
+func (s *ServiceImpl) getPeerInterfaceAddresses(subjectNetwork SubjectNetwork, peerIdentifier int) []string {
+	addresses := []string{subjectNetwork.InterfaceAddressWithSubnet(peerIdentifier)}
+	if s.isIpv6Enabled() {
+		addresses = append(addresses, s.getIpv6InterfaceAddressWithSubnet(subjectNetwork.Vlan, peerIdentifier))
+	}
+
+	return addresses
+}
+
+func isValidWireguardKey(key string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(decoded) == WIREGUARD_KEY_LENGTH
+}
+
+func (s *ServiceImpl) deleteWireguardPeerFromDb(peerId string) {
+	if err := s.db.DeleteWireguardPeer(peerId); err != nil {
+		log.Printf("Error deleting wireguard peer %s: %v", peerId, err)
+	}
+}
@@ -4,14 +4,21 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/jackc/pgx/v5"
 )
 
+// Comments are sent on idle event streams so proxies don't close them
+const INSTANCE_EVENTS_KEEPALIVE_INTERVAL = 30 * time.Second
+
 type apiFunc func(w http.ResponseWriter, r *http.Request) error
 
 type ApiServer struct {
@@ -20,6 +27,7 @@ type ApiServer struct {
 	subjectService  SubjectService
 	emailService    EmailService
 	instanceService InstanceService
+	authService     AuthService
 	frontendUrl     string
 }
 
@@ -122,6 +130,10 @@ func (server *ApiServer) handleUpdateUser(w http.ResponseWriter, r *http.Request
 		return NewHttpError(http.StatusBadRequest, err)
 	}
 
+	if err := server.authService.CheckSelf(getCaller(r), request.UserId); err != nil {
+		return err
+	}
+
 	if err := server.userService.UpdateUser(request); err != nil {
 		return err
 	}
@@ -136,6 +148,12 @@ func (server *ApiServer) handleCreateSubject(w http.ResponseWriter, r *http.Requ
 		return NewHttpError(http.StatusBadRequest, err)
 	}
 
+	// Professors can only create subjects they are the main professor of
+	caller := getCaller(r)
+	if caller.Role == Professor && request.MainProfessor != caller.Mail {
+		return forbidden()
+	}
+
 	subjectId, err := server.subjectService.CreateSubject(request)
 	if err != nil {
 		return err
@@ -151,6 +169,11 @@ func (server *ApiServer) handleGetSubjectById(w http.ResponseWriter, r *http.Req
 	if subjectId == "" {
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing subject id"))
 	}
+
+	if err := server.authService.CheckSubjectMember(getCaller(r), subjectId); err != nil {
+		return err
+	}
+
 	subject, err := server.subjectService.GetSubjectById(subjectId)
 	if err != nil {
 		return err
@@ -164,6 +187,10 @@ func (server *ApiServer) handleListAllSubjectsByUserId(w http.ResponseWriter, r
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing user id"))
 	}
 
+	if err := server.authService.CheckSelf(getCaller(r), userId); err != nil {
+		return err
+	}
+
 	subjects, err := server.subjectService.ListAllSubjectsByUserId(userId)
 	if err != nil {
 		return err
@@ -178,6 +205,10 @@ func (server *ApiServer) handleListAllUsersBySubjectId(w http.ResponseWriter, r
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing subject id"))
 	}
 
+	if err := server.authService.CheckSubjectProfessor(getCaller(r), subjectId); err != nil {
+		return err
+	}
+
 	users, err := server.userService.ListAllUsersBySubjectId(subjectId)
 	if err != nil {
 		return err
@@ -197,15 +228,54 @@ func (server *ApiServer) handleValidateUserCredentials(w http.ResponseWriter, r
 		return err
 	}
 
+	session, err := server.authService.CreateSession(validateUserResponse.ID.String())
+	if err != nil {
+		return err
+	}
+
+	validateUserResponse.Token = session.Token
+	validateUserResponse.ExpiresAt = session.ExpiresAt
+
+	// The cookie lets the frontend authenticate without handling the token itself
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE_NAME,
+		Value:    session.Token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(server.frontendUrl, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
 	return writeResponse(w, http.StatusOK, validateUserResponse)
 }
 
+func (server *ApiServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	if err := server.authService.Logout(getSessionToken(r)); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE_NAME,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	return writeResponse(w, http.StatusOK, "Logged out successfully")
+}
+
 func (server *ApiServer) handleGetUserInfo(w http.ResponseWriter, r *http.Request) error {
 	userId := r.PathValue("id")
 	if userId == "" {
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing user id"))
 	}
 
+	if err := server.authService.CheckSelf(getCaller(r), userId); err != nil {
+		return err
+	}
+
 	user, err := server.userService.GetUser(userId)
 	if err != nil {
 		return err
@@ -222,6 +292,10 @@ func (server *ApiServer) handleEnrollUserInSubject(w http.ResponseWriter, r *htt
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing subject or user email"))
 	}
 
+	if err := server.authService.CheckSubjectProfessor(getCaller(r), subjectId); err != nil {
+		return err
+	}
+
 	if err := server.subjectService.EnrollUserInSubject(userEmail, subjectId); err != nil {
 		return err
 	}
@@ -237,6 +311,10 @@ func (server *ApiServer) handleRemoveUserFromSubject(w http.ResponseWriter, r *h
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing subject or user email"))
 	}
 
+	if err := server.authService.CheckSubjectProfessor(getCaller(r), subjectId); err != nil {
+		return err
+	}
+
 	if err := server.subjectService.RemoveUserFromSubject(userEmail, subjectId); err != nil {
 		return err
 	}
@@ -250,6 +328,10 @@ func (server *ApiServer) handleDeleteSubject(w http.ResponseWriter, r *http.Requ
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing subject id"))
 	}
 
+	if err := server.authService.CheckSubjectProfessor(getCaller(r), subjectId); err != nil {
+		return err
+	}
+
 	if err := server.subjectService.DeleteSubject(subjectId); err != nil {
 		return err
 	}
@@ -346,6 +428,15 @@ func (server *ApiServer) handleCreateInstance(w http.ResponseWriter, r *http.Req
 		return NewHttpError(http.StatusBadRequest, err)
 	}
 
+	caller := getCaller(r)
+	if err := server.authService.CheckSelf(caller, request.UserId); err != nil {
+		return err
+	}
+
+	if err := server.authService.CheckSubjectMember(caller, request.SubjectId); err != nil {
+		return err
+	}
+
 	response, err := server.instanceService.CreateInstance(request)
 	if err != nil {
 		return err
@@ -360,6 +451,10 @@ func (server *ApiServer) handleStartInstance(w http.ResponseWriter, r *http.Requ
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing instance id"))
 	}
 
+	if err := server.authService.CheckInstanceAccess(getCaller(r), instanceId); err != nil {
+		return err
+	}
+
 	if err := server.instanceService.StartInstance(instanceId); err != nil {
 		return err
 	}
@@ -373,6 +468,10 @@ func (server *ApiServer) handleStopInstance(w http.ResponseWriter, r *http.Reque
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing instance id"))
 	}
 
+	if err := server.authService.CheckInstanceAccess(getCaller(r), instanceId); err != nil {
+		return err
+	}
+
 	if err := server.instanceService.StopInstance(instanceId); err != nil {
 		return err
 	}
@@ -386,6 +485,10 @@ func (server *ApiServer) handleDeleteInstance(w http.ResponseWriter, r *http.Req
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing instance id"))
 	}
 
+	if err := server.authService.CheckInstanceAccess(getCaller(r), instanceId); err != nil {
+		return err
+	}
+
 	if err := server.instanceService.DeleteInstance(instanceId); err != nil {
 		return err
 	}
@@ -421,6 +524,24 @@ func (server *ApiServer) handleDefineTemplate(w http.ResponseWriter, r *http.Req
 		return NewHttpError(http.StatusBadRequest, err)
 	}
 
+	caller := getCaller(r)
+	if err := server.authService.CheckSubjectProfessor(caller, request.SubjectId); err != nil {
+		return err
+	}
+
+	bases, err := server.instanceService.Bases()
+	if err != nil {
+		return err
+	}
+
+	// Bases are available to every subject, only instances must be accessible by the caller
+	isBase := slices.ContainsFunc(bases, func(base Base) bool { return base.Id == request.SourceInstanceId })
+	if !isBase {
+		if err := server.authService.CheckInstanceAccess(caller, request.SourceInstanceId); err != nil {
+			return err
+		}
+	}
+
 	if err := server.instanceService.DefineTemplate(request); err != nil {
 		return err
 	}
@@ -439,6 +560,10 @@ func (server *ApiServer) handleDeleteTemplate(w http.ResponseWriter, r *http.Req
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing subject id"))
 	}
 
+	if err := server.authService.CheckTemplateAccess(getCaller(r), templateId, subjectId); err != nil {
+		return err
+	}
+
 	if err := server.instanceService.DeleteTemplate(templateId, subjectId); err != nil {
 		return err
 	}
@@ -452,6 +577,10 @@ func (server *ApiServer) handleGetInstanceStatusByUserId(w http.ResponseWriter,
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing user id"))
 	}
 
+	if err := server.authService.CheckSelf(getCaller(r), userId); err != nil {
+		return err
+	}
+
 	statuses, err := server.instanceService.GetInstanceStatusByUserId(userId)
 	if err != nil {
 		return err
@@ -460,12 +589,65 @@ func (server *ApiServer) handleGetInstanceStatusByUserId(w http.ResponseWriter,
 	return writeResponse(w, http.StatusOK, statuses)
 }
 
+// handleInstanceEvents streams the status changes of the instances of the user as server-sent events,
+// browsers send the session cookie since EventSource can't set the Authorization header
+func (server *ApiServer) handleInstanceEvents(w http.ResponseWriter, r *http.Request) error {
+	userId := r.PathValue("userId")
+	if userId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing user id"))
+	}
+
+	if err := server.authService.CheckSelf(getCaller(r), userId); err != nil {
+		return err
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming is not supported")
+	}
+
+	events := server.instanceService.SubscribeInstanceEvents(userId)
+	defer server.instanceService.UnsubscribeInstanceEvents(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(INSTANCE_EVENTS_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+
+	// Once the stream started errors can't be answered, the browser reconnects when it's closed
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case event, open := <-events:
+			if !open {
+				return nil
+			}
+			if err := writeServerSentEvent(w, event); err != nil {
+				return nil
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+		}
+		flusher.Flush()
+	}
+}
+
 func (server *ApiServer) handleGetTemplatesBySubjectId(w http.ResponseWriter, r *http.Request) error {
 	subjectId := r.PathValue("subjectId")
 	if subjectId == "" {
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing subject id"))
 	}
 
+	if err := server.authService.CheckSubjectMember(getCaller(r), subjectId); err != nil {
+		return err
+	}
+
 	templates, err := server.instanceService.GetTemplatesBySubjectId(subjectId)
 	if err != nil {
 		return err
@@ -480,6 +662,10 @@ func (server *ApiServer) handleWireguard(w http.ResponseWriter, r *http.Request)
 		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing instance id"))
 	}
 
+	if err := server.authService.CheckInstanceOwner(getCaller(r), instanceId); err != nil {
+		return err
+	}
+
 	wireguardConfig, err := server.instanceService.GetWireguardConfig(instanceId)
 	if err != nil {
 		return err
@@ -488,6 +674,222 @@ func (server *ApiServer) handleWireguard(w http.ResponseWriter, r *http.Request)
 	return writeResponse(w, http.StatusOK, wireguardConfig)
 }
 
+// handleRotateWireguardKey takes an optional body with the public key of a pair generated client-side
+func (server *ApiServer) handleRotateWireguardKey(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+	if instanceId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing instance id"))
+	}
+
+	if err := server.authService.CheckInstanceOwner(getCaller(r), instanceId); err != nil {
+		return err
+	}
+
+	var request RotateWireguardKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	wireguardConfig, err := server.instanceService.RotateWireguardKey(instanceId, request)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, wireguardConfig)
+}
+
+func (server *ApiServer) handleAddWireguardPeer(w http.ResponseWriter, r *http.Request) error {
+	var request AddWireguardPeerRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.authService.CheckInstanceOwner(getCaller(r), request.InstanceId); err != nil {
+		return err
+	}
+
+	peer, err := server.instanceService.AddWireguardPeer(request)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, peer)
+}
+
+func (server *ApiServer) handleGetWireguardPeers(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+	if instanceId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing instance id"))
+	}
+
+	if err := server.authService.CheckInstanceAccess(getCaller(r), instanceId); err != nil {
+		return err
+	}
+
+	peers, err := server.instanceService.GetWireguardPeersByInstanceId(instanceId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, peers)
+}
+
+func (server *ApiServer) handleGetWireguardPeerConfig(w http.ResponseWriter, r *http.Request) error {
+	peerId := r.PathValue("peerId")
+	if peerId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing peer id"))
+	}
+
+	peer, err := server.instanceService.GetWireguardPeer(peerId)
+	if err != nil {
+		return err
+	}
+
+	// The config has the private key of the device, like the one of the instance
+	if err := server.authService.CheckInstanceOwner(getCaller(r), peer.InstanceId); err != nil {
+		return err
+	}
+
+	wireguardConfig, err := server.instanceService.GetWireguardPeerConfig(peerId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, wireguardConfig)
+}
+
+// handleDeleteWireguardPeer lets the professors of the subject revoke a device too
+func (server *ApiServer) handleDeleteWireguardPeer(w http.ResponseWriter, r *http.Request) error {
+	peerId := r.PathValue("peerId")
+	if peerId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing peer id"))
+	}
+
+	peer, err := server.instanceService.GetWireguardPeer(peerId)
+	if err != nil {
+		return err
+	}
+
+	if err := server.authService.CheckInstanceAccess(getCaller(r), peer.InstanceId); err != nil {
+		return err
+	}
+
+	if err := server.instanceService.DeleteWireguardPeer(peerId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, "Wireguard peer revoked successfully")
+}
+
+func (server *ApiServer) handleCreateSnapshot(w http.ResponseWriter, r *http.Request) error {
+	var request CreateSnapshotFrontendRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	caller := getCaller(r)
+	if err := server.authService.CheckSelf(caller, request.UserId); err != nil {
+		return err
+	}
+
+	if err := server.authService.CheckInstanceAccess(caller, request.InstanceId); err != nil {
+		return err
+	}
+
+	response, err := server.instanceService.CreateSnapshot(request)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, response)
+}
+
+func (server *ApiServer) handleListSnapshots(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+	if instanceId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing instance id"))
+	}
+
+	if err := server.authService.CheckInstanceAccess(getCaller(r), instanceId); err != nil {
+		return err
+	}
+
+	snapshots, err := server.instanceService.ListSnapshots(instanceId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, snapshots)
+}
+
+func (server *ApiServer) handleRevertSnapshot(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+	if instanceId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing instance id"))
+	}
+
+	snapshotId := r.PathValue("snapshotId")
+	if snapshotId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing snapshot id"))
+	}
+
+	if err := server.authService.CheckInstanceAccess(getCaller(r), instanceId); err != nil {
+		return err
+	}
+
+	if err := server.instanceService.RevertSnapshot(instanceId, snapshotId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, "Instance reverted successfully")
+}
+
+func (server *ApiServer) handleDeleteSnapshot(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+	if instanceId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing instance id"))
+	}
+
+	snapshotId := r.PathValue("snapshotId")
+	if snapshotId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing snapshot id"))
+	}
+
+	if err := server.authService.CheckInstanceAccess(getCaller(r), instanceId); err != nil {
+		return err
+	}
+
+	if err := server.instanceService.DeleteSnapshot(instanceId, snapshotId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, "Snapshot deleted successfully")
+}
+
+func (server *ApiServer) handleSetSnapshotQuota(w http.ResponseWriter, r *http.Request) error {
+	subjectId := r.PathValue("subjectId")
+	if subjectId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing subject id"))
+	}
+
+	if err := server.authService.CheckSubjectProfessor(getCaller(r), subjectId); err != nil {
+		return err
+	}
+
+	var request SetSnapshotQuotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.subjectService.SetSnapshotQuota(subjectId, request.Quota); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, "Snapshot quota updated successfully")
+}
+
 func (server *ApiServer) handleForgotPassword(w http.ResponseWriter, r *http.Request) error {
 	var req ForgotPasswordRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -560,7 +962,23 @@ func (server *ApiServer) handleGetServerStatus(w http.ResponseWriter, r *http.Re
 	return writeResponse(w, http.StatusOK, status)
 }
 
-func (server *ApiServer) handleRenewSession(w http.ResponseWriter, r *http.Request) error {
+func (server *ApiServer) handleGetVmManagerSyncReport(w http.ResponseWriter, r *http.Request) error {
+	report, err := server.instanceService.GetVmManagerSyncReport()
+	if err != nil {
+		return err
+	}
+	return writeResponse(w, http.StatusOK, report)
+}
+
+func (server *ApiServer) handleRunVmManagerSync(w http.ResponseWriter, r *http.Request) error {
+	report, err := server.instanceService.RunVmManagerSync()
+	if err != nil {
+		return err
+	}
+	return writeResponse(w, http.StatusOK, report)
+}
+
+func (server *ApiServer) handleRenewSession(w http.ResponseWriter, r *http.Request) error {
 	// Get token from URL path
 	parts := strings.Split(r.URL.Path, "/")
 	if len(parts) != 4 {
@@ -604,6 +1022,33 @@ func writeResponse(w http.ResponseWriter, status int, value any) error {
 	return json.NewEncoder(w).Encode(value)
 }
 
+func writeServerSentEvent(w http.ResponseWriter, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
+
+// authenticated resolves the caller from the session token and, when roles are given,
+// only lets those roles through. Handlers read the caller with getCaller
+func (server *ApiServer) authenticated(fn apiFunc, roles ...Role) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		caller, err := server.authService.Authenticate(getSessionToken(r))
+		if err != nil {
+			return err
+		}
+
+		if len(roles) > 0 && !slices.Contains(roles, caller.Role) {
+			return forbidden()
+		}
+
+		return fn(w, withCaller(r, caller))
+	}
+}
+
 func createHttpHandler(fn apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := fn(w, r); err != nil {
@@ -618,13 +1063,438 @@ func createHttpHandler(fn apiFunc) http.HandlerFunc {
 	}
 }
 
-func NewApiServer(listenAddr string, userService UserService, subjectService SubjectService, emailService EmailService, instanceService InstanceService, frontendUrl string) *ApiServer {
+func (server *ApiServer) handleCreateConsoleTicket(w http.ResponseWriter, r *http.Request) error {
+	var request CreateConsoleTicketFrontendRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.authService.CheckSelf(getCaller(r), request.UserId); err != nil {
+		return err
+	}
+
+	response, err := server.instanceService.CreateConsoleTicket(request)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, response)
+}
+
+func (server *ApiServer) handleConsole(w http.ResponseWriter, r *http.Request) error {
+	ticket := r.PathValue("ticket")
+	if ticket == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing ticket"))
+	}
+
+	// Connect to the VM manager before upgrading so errors can still be answered as HTTP
+	upstream, err := server.instanceService.OpenConsole(ticket)
+	if err != nil {
+		return err
+	}
+
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{"binary"},
+		CheckOrigin: func(r *http.Request) bool {
+			return r.Header.Get("Origin") == server.frontendUrl
+		},
+	}
+
+	client, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		upstream.Close()
+		// The upgrader already answered the request
+		log.Printf("Error upgrading console connection: %v", err)
+		return nil
+	}
+
+	relayWebSockets(client, upstream)
+
+	return nil
+}
+
+func (server *ApiServer) handleCreateLabTopology(w http.ResponseWriter, r *http.Request) error {
+	var request CreateLabTopologyRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.authService.CheckSubjectProfessor(getCaller(r), request.SubjectId); err != nil {
+		return err
+	}
+
+	response, err := server.instanceService.CreateLabTopology(request)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, response)
+}
+
+func (server *ApiServer) handleGetLabTopologiesBySubjectId(w http.ResponseWriter, r *http.Request) error {
+	subjectId := r.PathValue("subjectId")
+	if subjectId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing subject id"))
+	}
+
+	if err := server.authService.CheckSubjectMember(getCaller(r), subjectId); err != nil {
+		return err
+	}
+
+	topologies, err := server.instanceService.GetLabTopologiesBySubjectId(subjectId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, topologies)
+}
+
+func (server *ApiServer) handleDeleteLabTopology(w http.ResponseWriter, r *http.Request) error {
+	topologyId := r.PathValue("topologyId")
+	if topologyId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing topology id"))
+	}
+
+	topology, err := server.instanceService.GetLabTopology(topologyId)
+	if err != nil {
+		return err
+	}
+
+	if err := server.authService.CheckSubjectProfessor(getCaller(r), topology.SubjectId); err != nil {
+		return err
+	}
+
+	if err := server.instanceService.DeleteLabTopology(topologyId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, "Lab topology deleted successfully")
+}
+
+func (server *ApiServer) handleCreateFirewallPolicy(w http.ResponseWriter, r *http.Request) error {
+	var request CreateFirewallPolicyRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	if err := server.authService.CheckSubjectProfessor(getCaller(r), request.SubjectId); err != nil {
+		return err
+	}
+
+	response, err := server.instanceService.CreateFirewallPolicy(request)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, response)
+}
+
+func (server *ApiServer) handleGetFirewallPoliciesBySubjectId(w http.ResponseWriter, r *http.Request) error {
+	subjectId := r.PathValue("subjectId")
+	if subjectId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing subject id"))
+	}
+
+	// Students can see the rules their instances are under
+	if err := server.authService.CheckSubjectMember(getCaller(r), subjectId); err != nil {
+		return err
+	}
+
+	policies, err := server.instanceService.GetFirewallPoliciesBySubjectId(subjectId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, policies)
+}
+
+func (server *ApiServer) handleUpdateFirewallPolicy(w http.ResponseWriter, r *http.Request) error {
+	policyId := r.PathValue("policyId")
+	if policyId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing policy id"))
+	}
+
+	var request UpdateFirewallPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	policy, err := server.instanceService.GetFirewallPolicy(policyId)
+	if err != nil {
+		return err
+	}
+
+	if err := server.authService.CheckSubjectProfessor(getCaller(r), policy.SubjectId); err != nil {
+		return err
+	}
+
+	if err := server.instanceService.UpdateFirewallPolicy(policyId, request); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, "Firewall policy updated successfully")
+}
+
+func (server *ApiServer) handleDeleteFirewallPolicy(w http.ResponseWriter, r *http.Request) error {
+	policyId := r.PathValue("policyId")
+	if policyId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing policy id"))
+	}
+
+	policy, err := server.instanceService.GetFirewallPolicy(policyId)
+	if err != nil {
+		return err
+	}
+
+	if err := server.authService.CheckSubjectProfessor(getCaller(r), policy.SubjectId); err != nil {
+		return err
+	}
+
+	if err := server.instanceService.DeleteFirewallPolicy(policyId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, "Firewall policy deleted successfully")
+}
+
+func (server *ApiServer) handleRequestPortForward(w http.ResponseWriter, r *http.Request) error {
+	var request RequestPortForwardRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	caller := getCaller(r)
+	if err := server.authService.CheckSelf(caller, request.UserId); err != nil {
+		return err
+	}
+
+	// Only the owner can ask for its instance to be public
+	if err := server.authService.CheckInstanceOwner(caller, request.InstanceId); err != nil {
+		return err
+	}
+
+	response, err := server.instanceService.RequestPortForward(request)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, response)
+}
+
+func (server *ApiServer) handleGetPortForwardRequestsByInstanceId(w http.ResponseWriter, r *http.Request) error {
+	instanceId := r.PathValue("instanceId")
+	if instanceId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing instance id"))
+	}
+
+	if err := server.authService.CheckInstanceAccess(getCaller(r), instanceId); err != nil {
+		return err
+	}
+
+	requests, err := server.instanceService.GetPortForwardRequestsByInstanceId(instanceId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, requests)
+}
+
+func (server *ApiServer) handleGetPortForwardRequestsBySubjectId(w http.ResponseWriter, r *http.Request) error {
+	subjectId := r.PathValue("subjectId")
+	if subjectId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing subject id"))
+	}
+
+	if err := server.authService.CheckSubjectProfessor(getCaller(r), subjectId); err != nil {
+		return err
+	}
+
+	requests, err := server.instanceService.GetPortForwardRequestsBySubjectId(subjectId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, requests)
+}
+
+func (server *ApiServer) handleApprovePortForwardRequest(w http.ResponseWriter, r *http.Request) error {
+	requestId := r.PathValue("requestId")
+	if requestId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing request id"))
+	}
+
+	if err := server.checkPortForwardRequestProfessor(r, requestId); err != nil {
+		return err
+	}
+
+	response, err := server.instanceService.ApprovePortForwardRequest(requestId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, response)
+}
+
+func (server *ApiServer) handleRejectPortForwardRequest(w http.ResponseWriter, r *http.Request) error {
+	requestId := r.PathValue("requestId")
+	if requestId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing request id"))
+	}
+
+	if err := server.checkPortForwardRequestProfessor(r, requestId); err != nil {
+		return err
+	}
+
+	if err := server.instanceService.RejectPortForwardRequest(requestId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, "Port forward request rejected successfully")
+}
+
+// handleDeletePortForwardRequest lets the owner withdraw the request and the professors close the forward early
+func (server *ApiServer) handleDeletePortForwardRequest(w http.ResponseWriter, r *http.Request) error {
+	requestId := r.PathValue("requestId")
+	if requestId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing request id"))
+	}
+
+	request, err := server.instanceService.GetPortForwardRequest(requestId)
+	if err != nil {
+		return err
+	}
+
+	if err := server.authService.CheckInstanceAccess(getCaller(r), request.InstanceId); err != nil {
+		return err
+	}
+
+	if err := server.instanceService.DeletePortForwardRequest(requestId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, "Port forward request deleted successfully")
+}
+
+// checkPortForwardRequestProfessor only allows the professors of the subject of the requested instance
+func (server *ApiServer) checkPortForwardRequestProfessor(r *http.Request, requestId string) error {
+	request, err := server.instanceService.GetPortForwardRequest(requestId)
+	if err != nil {
+		return err
+	}
+
+	return server.authService.CheckSubjectProfessor(getCaller(r), request.SubjectId)
+}
+
+func (server *ApiServer) handleCreateLab(w http.ResponseWriter, r *http.Request) error {
+	var request CreateLabFrontendRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return NewHttpError(http.StatusBadRequest, err)
+	}
+
+	caller := getCaller(r)
+	if err := server.authService.CheckSelf(caller, request.UserId); err != nil {
+		return err
+	}
+
+	topology, err := server.instanceService.GetLabTopology(request.TopologyId)
+	if err != nil {
+		return err
+	}
+
+	if err := server.authService.CheckSubjectMember(caller, topology.SubjectId); err != nil {
+		return err
+	}
+
+	response, err := server.instanceService.CreateLab(request)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, response)
+}
+
+func (server *ApiServer) handleGetLabsByUserId(w http.ResponseWriter, r *http.Request) error {
+	userId := r.PathValue("userId")
+	if userId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing user id"))
+	}
+
+	if err := server.authService.CheckSelf(getCaller(r), userId); err != nil {
+		return err
+	}
+
+	labs, err := server.instanceService.GetLabsByUserId(userId)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, labs)
+}
+
+func (server *ApiServer) handleStartLab(w http.ResponseWriter, r *http.Request) error {
+	labId := r.PathValue("labId")
+	if labId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing lab id"))
+	}
+
+	if err := server.authService.CheckLabAccess(getCaller(r), labId); err != nil {
+		return err
+	}
+
+	if err := server.instanceService.StartLab(labId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, "Lab started successfully")
+}
+
+func (server *ApiServer) handleStopLab(w http.ResponseWriter, r *http.Request) error {
+	labId := r.PathValue("labId")
+	if labId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing lab id"))
+	}
+
+	if err := server.authService.CheckLabAccess(getCaller(r), labId); err != nil {
+		return err
+	}
+
+	if err := server.instanceService.StopLab(labId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, "Lab stopped successfully")
+}
+
+func (server *ApiServer) handleDeleteLab(w http.ResponseWriter, r *http.Request) error {
+	labId := r.PathValue("labId")
+	if labId == "" {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("missing lab id"))
+	}
+
+	if err := server.authService.CheckLabAccess(getCaller(r), labId); err != nil {
+		return err
+	}
+
+	if err := server.instanceService.DeleteLab(labId); err != nil {
+		return err
+	}
+
+	return writeResponse(w, http.StatusOK, "Lab deleted successfully")
+}
+
+func NewApiServer(listenAddr string, userService UserService, subjectService SubjectService, emailService EmailService, instanceService InstanceService, authService AuthService, frontendUrl string) *ApiServer {
 	return &ApiServer{
 		listenAddr:      listenAddr,
 		userService:     userService,
 		subjectService:  subjectService,
 		emailService:    emailService,
 		instanceService: instanceService,
+		authService:     authService,
 		frontendUrl:     frontendUrl,
 	}
 }
@@ -633,6 +1503,7 @@ func (server *ApiServer) enableCors(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", server.frontendUrl)
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, DELETE, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
 }
 
 func (server *ApiServer) corsMiddleware(next http.Handler) http.Handler {
@@ -648,40 +1519,74 @@ func (server *ApiServer) corsMiddleware(next http.Handler) http.Handler {
 
 func (server *ApiServer) Run() {
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /subjects", createHttpHandler(server.handleGetAllSubjects))
-	mux.HandleFunc("GET /users", createHttpHandler(server.handleGetAllUsers))
+	mux.HandleFunc("GET /subjects", createHttpHandler(server.authenticated(server.handleGetAllSubjects, Admin)))
+	mux.HandleFunc("GET /users", createHttpHandler(server.authenticated(server.handleGetAllUsers, Admin)))
 	mux.HandleFunc("POST /users", createHttpHandler(server.handleCreateUser))
-	mux.HandleFunc("POST /users/professors", createHttpHandler(server.handleCreateProfessor))
-	mux.HandleFunc("PUT /users/update", createHttpHandler(server.handleUpdateUser))
-	mux.HandleFunc("POST /subjects", createHttpHandler(server.handleCreateSubject))
-	mux.HandleFunc("GET /users/{id}/subjects", createHttpHandler(server.handleListAllSubjectsByUserId))
-	mux.HandleFunc("GET /subjects/{id}/users", createHttpHandler(server.handleListAllUsersBySubjectId))
-	mux.HandleFunc("GET /subjects/{id}", createHttpHandler(server.handleGetSubjectById))
+	mux.HandleFunc("POST /users/professors", createHttpHandler(server.authenticated(server.handleCreateProfessor, Admin)))
+	mux.HandleFunc("PUT /users/update", createHttpHandler(server.authenticated(server.handleUpdateUser)))
+	mux.HandleFunc("POST /subjects", createHttpHandler(server.authenticated(server.handleCreateSubject, Admin, Professor)))
+	mux.HandleFunc("GET /users/{id}/subjects", createHttpHandler(server.authenticated(server.handleListAllSubjectsByUserId)))
+	mux.HandleFunc("GET /subjects/{id}/users", createHttpHandler(server.authenticated(server.handleListAllUsersBySubjectId, Admin, Professor)))
+	mux.HandleFunc("GET /subjects/{id}", createHttpHandler(server.authenticated(server.handleGetSubjectById)))
 
 	mux.HandleFunc("POST /users/validate", createHttpHandler(server.handleValidateUserCredentials))
-	mux.HandleFunc("GET /users/{id}", createHttpHandler(server.handleGetUserInfo))
-	mux.HandleFunc("PUT /subjects/{subjectId}/add/users/{userEmail}", createHttpHandler(server.handleEnrollUserInSubject))
-	mux.HandleFunc("DELETE /subjects/{subjectId}/remove/users/{userEmail}", createHttpHandler(server.handleRemoveUserFromSubject))
-	mux.HandleFunc("DELETE /subjects/{id}", createHttpHandler(server.handleDeleteSubject))
-	mux.HandleFunc("DELETE /users/delete/{id}", createHttpHandler(server.handleDeleteUser))
-	mux.HandleFunc("POST /test-email", createHttpHandler(server.handleTestEmail))
+	mux.HandleFunc("GET /users/{id}", createHttpHandler(server.authenticated(server.handleGetUserInfo)))
+	mux.HandleFunc("PUT /subjects/{subjectId}/add/users/{userEmail}", createHttpHandler(server.authenticated(server.handleEnrollUserInSubject, Admin, Professor)))
+	mux.HandleFunc("DELETE /subjects/{subjectId}/remove/users/{userEmail}", createHttpHandler(server.authenticated(server.handleRemoveUserFromSubject, Admin, Professor)))
+	mux.HandleFunc("DELETE /subjects/{id}", createHttpHandler(server.authenticated(server.handleDeleteSubject, Admin, Professor)))
+	mux.HandleFunc("DELETE /users/delete/{id}", createHttpHandler(server.authenticated(server.handleDeleteUser, Admin)))
+	mux.HandleFunc("POST /test-email", createHttpHandler(server.authenticated(server.handleTestEmail, Admin)))
 	mux.HandleFunc("POST /verify-email", createHttpHandler(server.handleVerifyEmail))
 	mux.HandleFunc("GET /verify-email/{token}", createHttpHandler(server.handleVerifyUser))
-	mux.HandleFunc("POST /instances/create", createHttpHandler(server.handleCreateInstance))
-	mux.HandleFunc("POST /instances/start/{instanceId}", createHttpHandler(server.handleStartInstance))
-	mux.HandleFunc("POST /instances/stop/{instanceId}", createHttpHandler(server.handleStopInstance))
-	mux.HandleFunc("DELETE /instances/delete/{instanceId}", createHttpHandler(server.handleDeleteInstance))
-	mux.HandleFunc("GET /instances/status", createHttpHandler(server.handleGetInstanceStatus))
-	mux.HandleFunc("GET /bases", createHttpHandler(server.handleBases))
-	mux.HandleFunc("POST /templates/define", createHttpHandler(server.handleDefineTemplate))
-	mux.HandleFunc("DELETE /templates/delete/{templateId}/{subjectId}", createHttpHandler(server.handleDeleteTemplate))
-	mux.HandleFunc("GET /templates/subjects/{subjectId}", createHttpHandler(server.handleGetTemplatesBySubjectId))
-	mux.HandleFunc("GET /instances/status/{userId}", createHttpHandler(server.handleGetInstanceStatusByUserId))
-	mux.HandleFunc("GET /instances/wireguard/{instanceId}", createHttpHandler(server.handleWireguard))
+	mux.HandleFunc("POST /instances/create", createHttpHandler(server.authenticated(server.handleCreateInstance)))
+	mux.HandleFunc("POST /instances/start/{instanceId}", createHttpHandler(server.authenticated(server.handleStartInstance)))
+	mux.HandleFunc("POST /instances/stop/{instanceId}", createHttpHandler(server.authenticated(server.handleStopInstance)))
+	mux.HandleFunc("DELETE /instances/delete/{instanceId}", createHttpHandler(server.authenticated(server.handleDeleteInstance)))
+	mux.HandleFunc("GET /instances/status", createHttpHandler(server.authenticated(server.handleGetInstanceStatus, Admin)))
+	mux.HandleFunc("GET /bases", createHttpHandler(server.authenticated(server.handleBases, Admin, Professor)))
+	mux.HandleFunc("POST /templates/define", createHttpHandler(server.authenticated(server.handleDefineTemplate, Admin, Professor)))
+	mux.HandleFunc("DELETE /templates/delete/{templateId}/{subjectId}", createHttpHandler(server.authenticated(server.handleDeleteTemplate, Admin, Professor)))
+	mux.HandleFunc("GET /templates/subjects/{subjectId}", createHttpHandler(server.authenticated(server.handleGetTemplatesBySubjectId)))
+	mux.HandleFunc("GET /instances/status/{userId}", createHttpHandler(server.authenticated(server.handleGetInstanceStatusByUserId)))
+	mux.HandleFunc("GET /instances/events/{userId}", createHttpHandler(server.authenticated(server.handleInstanceEvents)))
+	mux.HandleFunc("GET /instances/wireguard/{instanceId}", createHttpHandler(server.authenticated(server.handleWireguard)))
+	mux.HandleFunc("POST /instances/wireguard/rotate/{instanceId}", createHttpHandler(server.authenticated(server.handleRotateWireguardKey)))
+	mux.HandleFunc("POST /instances/wireguard/peers", createHttpHandler(server.authenticated(server.handleAddWireguardPeer)))
+	mux.HandleFunc("GET /instances/wireguard/peers/{instanceId}", createHttpHandler(server.authenticated(server.handleGetWireguardPeers)))
+	mux.HandleFunc("GET /instances/wireguard/peers/config/{peerId}", createHttpHandler(server.authenticated(server.handleGetWireguardPeerConfig)))
+	mux.HandleFunc("DELETE /instances/wireguard/peers/delete/{peerId}", createHttpHandler(server.authenticated(server.handleDeleteWireguardPeer)))
+	mux.HandleFunc("POST /instances/snapshots/create", createHttpHandler(server.authenticated(server.handleCreateSnapshot)))
+	mux.HandleFunc("GET /instances/snapshots/{instanceId}", createHttpHandler(server.authenticated(server.handleListSnapshots)))
+	mux.HandleFunc("POST /instances/snapshots/revert/{instanceId}/{snapshotId}", createHttpHandler(server.authenticated(server.handleRevertSnapshot)))
+	mux.HandleFunc("DELETE /instances/snapshots/delete/{instanceId}/{snapshotId}", createHttpHandler(server.authenticated(server.handleDeleteSnapshot)))
+	mux.HandleFunc("POST /instances/console/tickets", createHttpHandler(server.authenticated(server.handleCreateConsoleTicket)))
+	mux.HandleFunc("GET /instances/console/{ticket}", createHttpHandler(server.handleConsole))
+	mux.HandleFunc("PUT /subjects/{subjectId}/snapshot-quota", createHttpHandler(server.authenticated(server.handleSetSnapshotQuota, Admin, Professor)))
 	mux.HandleFunc("POST /auth/forgot-password", createHttpHandler(server.handleForgotPassword))
 	mux.HandleFunc("POST /auth/reset-password", createHttpHandler(server.handleResetPassword))
-	mux.HandleFunc("GET /servers/status", createHttpHandler(server.handleGetServerStatus))
+	mux.HandleFunc("POST /auth/logout", createHttpHandler(server.authenticated(server.handleLogout)))
+	mux.HandleFunc("GET /servers/status", createHttpHandler(server.authenticated(server.handleGetServerStatus, Admin)))
+	mux.HandleFunc("GET /vm-manager/sync", createHttpHandler(server.authenticated(server.handleGetVmManagerSyncReport, Admin)))
+	mux.HandleFunc("POST /vm-manager/sync/run", createHttpHandler(server.authenticated(server.handleRunVmManagerSync, Admin)))
 	mux.HandleFunc("PUT /sessions/renew/{token}", createHttpHandler(server.handleRenewSession))
+	mux.HandleFunc("POST /labs/topologies", createHttpHandler(server.authenticated(server.handleCreateLabTopology, Admin, Professor)))
+	mux.HandleFunc("GET /labs/topologies/subjects/{subjectId}", createHttpHandler(server.authenticated(server.handleGetLabTopologiesBySubjectId)))
+	mux.HandleFunc("DELETE /labs/topologies/delete/{topologyId}", createHttpHandler(server.authenticated(server.handleDeleteLabTopology, Admin, Professor)))
+	mux.HandleFunc("POST /labs/create", createHttpHandler(server.authenticated(server.handleCreateLab)))
+	mux.HandleFunc("GET /labs/users/{userId}", createHttpHandler(server.authenticated(server.handleGetLabsByUserId)))
+	mux.HandleFunc("POST /labs/start/{labId}", createHttpHandler(server.authenticated(server.handleStartLab)))
+	mux.HandleFunc("POST /labs/stop/{labId}", createHttpHandler(server.authenticated(server.handleStopLab)))
+	mux.HandleFunc("DELETE /labs/delete/{labId}", createHttpHandler(server.authenticated(server.handleDeleteLab)))
+	mux.HandleFunc("POST /firewall-policies/create", createHttpHandler(server.authenticated(server.handleCreateFirewallPolicy, Admin, Professor)))
+	mux.HandleFunc("GET /firewall-policies/subjects/{subjectId}", createHttpHandler(server.authenticated(server.handleGetFirewallPoliciesBySubjectId)))
+	mux.HandleFunc("PUT /firewall-policies/update/{policyId}", createHttpHandler(server.authenticated(server.handleUpdateFirewallPolicy, Admin, Professor)))
+	mux.HandleFunc("DELETE /firewall-policies/delete/{policyId}", createHttpHandler(server.authenticated(server.handleDeleteFirewallPolicy, Admin, Professor)))
+	mux.HandleFunc("POST /port-forwards/request", createHttpHandler(server.authenticated(server.handleRequestPortForward)))
+	mux.HandleFunc("GET /port-forwards/instances/{instanceId}", createHttpHandler(server.authenticated(server.handleGetPortForwardRequestsByInstanceId)))
+	mux.HandleFunc("GET /port-forwards/subjects/{subjectId}", createHttpHandler(server.authenticated(server.handleGetPortForwardRequestsBySubjectId, Admin, Professor)))
+	mux.HandleFunc("POST /port-forwards/approve/{requestId}", createHttpHandler(server.authenticated(server.handleApprovePortForwardRequest, Admin, Professor)))
+	mux.HandleFunc("POST /port-forwards/reject/{requestId}", createHttpHandler(server.authenticated(server.handleRejectPortForwardRequest, Admin, Professor)))
+	mux.HandleFunc("DELETE /port-forwards/delete/{requestId}", createHttpHandler(server.authenticated(server.handleDeletePortForwardRequest)))
 
 	log.Println("Starting server on port", server.listenAddr)
 
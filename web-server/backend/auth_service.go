@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SESSION_COOKIE_NAME = "session"
+const DEFAULT_AUTH_SESSION_DURATION_HOURS = 12
+
+type callerContextKey struct{}
+
+// Caller is the authenticated user doing the request
+type Caller struct {
+	ID   string
+	Role Role
+	Mail string
+}
+
+type AuthSession struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+type AuthService interface {
+	CreateSession(userId string) (AuthSession, error)
+	Authenticate(token string) (Caller, error)
+	Logout(token string) error
+	CheckSelf(caller Caller, userId string) error
+	CheckSubjectMember(caller Caller, subjectId string) error
+	CheckSubjectProfessor(caller Caller, subjectId string) error
+	CheckInstanceAccess(caller Caller, instanceId string) error
+	CheckInstanceOwner(caller Caller, instanceId string) error
+	CheckLabAccess(caller Caller, labId string) error
+	CheckTemplateAccess(caller Caller, templateId string, subjectId string) error
+}
+
+type AuthServiceImpl struct {
+	db              Database
+	sessionDuration time.Duration
+}
+
+func NewAuthService(db Database) AuthService {
+	// Get auth session duration from environment variable (in hours)
+	sessionDurationHours := DEFAULT_AUTH_SESSION_DURATION_HOURS
+	if value := os.Getenv("AUTH_SESSION_DURATION_HOURS"); value != "" {
+		hours, err := strconv.Atoi(value)
+		if err != nil || hours <= 0 {
+			log.Printf("Invalid AUTH_SESSION_DURATION_HOURS %q, using %d hours", value, DEFAULT_AUTH_SESSION_DURATION_HOURS)
+		} else {
+			sessionDurationHours = hours
+		}
+	}
+
+	return &AuthServiceImpl{
+		db:              db,
+		sessionDuration: time.Duration(sessionDurationHours) * time.Hour,
+	}
+}
+
+func (s *AuthServiceImpl) CreateSession(userId string) (AuthSession, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return AuthSession{}, fmt.Errorf("error generating session token: %w", err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+	expiresAt := time.Now().Add(s.sessionDuration)
+
+	// Expired sessions are useless, this keeps the table small
+	if err := s.db.DeleteExpiredAuthSessions(); err != nil {
+		log.Printf("Error deleting expired auth sessions: %v", err)
+	}
+
+	// Only the hash is stored so a leaked database doesn't leak usable tokens
+	if err := s.db.CreateAuthSession(hashToken(token), userId, expiresAt); err != nil {
+		return AuthSession{}, err
+	}
+
+	return AuthSession{Token: token, ExpiresAt: expiresAt}, nil
+}
+
+func (s *AuthServiceImpl) Authenticate(token string) (Caller, error) {
+	if token == "" {
+		return Caller{}, NewHttpError(http.StatusUnauthorized, fmt.Errorf("missing session token"))
+	}
+
+	user, err := s.db.GetUserByAuthSession(hashToken(token))
+	if err != nil {
+		return Caller{}, NewHttpError(http.StatusUnauthorized, fmt.Errorf("invalid or expired session"))
+	}
+
+	return Caller{ID: user.ID.String(), Role: user.Role, Mail: user.Mail}, nil
+}
+
+func (s *AuthServiceImpl) Logout(token string) error {
+	return s.db.DeleteAuthSession(hashToken(token))
+}
+
+func (s *AuthServiceImpl) CheckSelf(caller Caller, userId string) error {
+	if caller.Role == Admin || caller.ID == userId {
+		return nil
+	}
+
+	return forbidden()
+}
+
+func (s *AuthServiceImpl) CheckSubjectMember(caller Caller, subjectId string) error {
+	if caller.Role == Admin {
+		return nil
+	}
+
+	if s.db.IsUserInSubject(caller.ID, subjectId) || s.db.IsMainProfessorOfSubject(caller.ID, subjectId) {
+		return nil
+	}
+
+	return forbidden()
+}
+
+func (s *AuthServiceImpl) CheckSubjectProfessor(caller Caller, subjectId string) error {
+	if caller.Role == Admin {
+		return nil
+	}
+
+	if caller.Role != Professor {
+		return forbidden()
+	}
+
+	return s.CheckSubjectMember(caller, subjectId)
+}
+
+// CheckInstanceAccess allows the owner of the instance and the professors of its subject
+func (s *AuthServiceImpl) CheckInstanceAccess(caller Caller, instanceId string) error {
+	if caller.Role == Admin {
+		return nil
+	}
+
+	info, err := s.db.GetInstanceInfo(instanceId)
+	if err != nil {
+		return NewHttpError(http.StatusNotFound, fmt.Errorf("instance %s not found", instanceId))
+	}
+
+	if info.UserId == caller.ID {
+		return nil
+	}
+
+	return s.CheckSubjectProfessor(caller, info.SubjectId)
+}
+
+// CheckInstanceOwner only allows the owner of the instance, e.g. for its WireGuard keys
+func (s *AuthServiceImpl) CheckInstanceOwner(caller Caller, instanceId string) error {
+	if caller.Role == Admin {
+		return nil
+	}
+
+	info, err := s.db.GetInstanceInfo(instanceId)
+	if err != nil {
+		return NewHttpError(http.StatusNotFound, fmt.Errorf("instance %s not found", instanceId))
+	}
+
+	if info.UserId != caller.ID {
+		return forbidden()
+	}
+
+	return nil
+}
+
+// CheckLabAccess allows the owner of the lab and the professors of its subject, like CheckInstanceAccess
+func (s *AuthServiceImpl) CheckLabAccess(caller Caller, labId string) error {
+	if caller.Role == Admin {
+		return nil
+	}
+
+	lab, err := s.db.GetLab(labId)
+	if err != nil {
+		return err
+	}
+
+	if lab.UserId == caller.ID {
+		return nil
+	}
+
+	return s.CheckSubjectProfessor(caller, lab.SubjectId)
+}
+
+// CheckTemplateAccess allows the professors of the subject the template belongs to. Templates defined
+// from a base share its ID, so the record is looked up in the given subject
+func (s *AuthServiceImpl) CheckTemplateAccess(caller Caller, templateId string, subjectId string) error {
+	templates, err := s.db.GetTemplatesById(templateId)
+	if err != nil {
+		return err
+	}
+
+	for _, template := range templates {
+		if template.SubjectId == subjectId {
+			return s.CheckSubjectProfessor(caller, template.SubjectId)
+		}
+	}
+
+	return NewHttpError(http.StatusNotFound, fmt.Errorf("template %s not found in subject %s", templateId, subjectId))
+}
+
+func forbidden() error {
+	return NewHttpError(http.StatusForbidden, fmt.Errorf("you are not allowed to perform this action"))
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// getSessionToken reads the session token from the Authorization header,
+// falling back to the session cookie set at login
+func getSessionToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+
+	if cookie, err := r.Cookie(SESSION_COOKIE_NAME); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+func withCaller(r *http.Request, caller Caller) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), callerContextKey{}, caller))
+}
+
+// getCaller returns the caller resolved by the authentication middleware
+func getCaller(r *http.Request) Caller {
+	caller, _ := r.Context().Value(callerContextKey{}).(Caller)
+	return caller
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const CONSOLE_TICKET_TTL = 30 * time.Second
+
+var consoleDialer = websocket.Dialer{
+	Subprotocols:     []string{"binary"},
+	HandshakeTimeout: 10 * time.Second,
+}
+
+// ConsoleTicket is handed to a single user to open the console of one of their instances
+type ConsoleTicket struct {
+	UserId          string
+	InstanceId      string
+	VmManagerTicket string
+	ExpiresAt       time.Time
+}
+
+// relayWebSockets copies the messages between both connections until one of them closes
+func relayWebSockets(client *websocket.Conn, upstream *websocket.Conn) {
+	defer client.Close()
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	relay := func(from *websocket.Conn, to *websocket.Conn) {
+		defer func() { done <- struct{}{} }()
+		for {
+			messageType, message, err := from.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := to.WriteMessage(messageType, message); err != nil {
+				return
+			}
+		}
+	}
+
+	go relay(client, upstream)
+	go relay(upstream, client)
+
+	<-done
+}
+
+func toWebSocketUrl(httpUrl string) string {
+	if strings.HasPrefix(httpUrl, "https://") {
+		return "wss://" + strings.TrimPrefix(httpUrl, "https://")
+	}
+	return "ws://" + strings.TrimPrefix(httpUrl, "http://")
+}
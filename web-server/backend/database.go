@@ -48,12 +48,56 @@ type Database interface {
 	GetInstanceInfo(instanceId string) (InstanceInfo, error)
 	GetInstanceIdsByUserId(userId string) ([]string, error)
 	GetTemplatesBySubjectId(subjectId string) ([]TemplateDb, error)
+	GetTemplatesById(templateId string) ([]TemplateDb, error)
 	GetSubjectById(subjectId string) (Subject, error)
 	GetWireguardConfig(instanceId string) (wireguardConfig, error)
 	CreatePasswordResetToken(email string, token uuid.UUID) error
 	ValidatePasswordResetToken(token string) (string, error)
 	UpdatePassword(userId string, password string) error
 	GetAllSubjects() ([]Subject, error)
+	CreateSnapshot(snapshotId string, instanceId string, userId string, description string) error
+	GetSnapshotsByInstanceId(instanceId string) ([]SnapshotDb, error)
+	DeleteSnapshot(snapshotId string) error
+	GetSubjectSnapshotQuota(subjectId string) (int, error)
+	SetSubjectSnapshotQuota(subjectId string, quota int) error
+	IsUserInSubject(userId, subjectId string) bool
+	CreateAuthSession(tokenHash string, userId string, expiresAt time.Time) error
+	GetUserByAuthSession(tokenHash string) (User, error)
+	DeleteAuthSession(tokenHash string) error
+	DeleteExpiredAuthSessions() error
+	CreateLabTopology(topology LabTopologyDb) error
+	GetLabTopology(topologyId string) (LabTopologyDb, error)
+	GetLabTopologiesBySubjectId(subjectId string) ([]LabTopologyDb, error)
+	DeleteLabTopology(topologyId string) error
+	CreateLab(labId string, topologyId string, userId string, subjectId string) error
+	GetLab(labId string) (LabDb, error)
+	GetLabsByUserId(userId string) ([]LabDb, error)
+	SetInstanceLab(instanceId string, labId string, nodeName string) error
+	GetLabInstances(labId string) ([]LabInstanceDb, error)
+	DeleteLab(labId string) error
+	CreatePortForwardRequest(request PortForwardRequestDb) error
+	GetPortForwardRequest(requestId string) (PortForwardRequestDb, error)
+	GetPortForwardRequestsByInstanceId(instanceId string) ([]PortForwardRequestDb, error)
+	GetPortForwardRequestsBySubjectId(subjectId string) ([]PortForwardRequestDb, error)
+	ApprovePortForwardRequest(requestId string, portForwardId string, externalPort int, expiresAt time.Time) (bool, error)
+	RejectPortForwardRequest(requestId string) (bool, error)
+	DeletePortForwardRequest(requestId string) error
+	CreateWireguardPeer(peer WireguardPeerDb) error
+	GetWireguardPeer(peerId string) (WireguardPeerDb, error)
+	GetWireguardPeersByInstanceId(instanceId string) ([]WireguardPeerDb, error)
+	GetWireguardPeerConfig(peerId string) (wireguardConfig, error)
+	DeleteWireguardPeer(peerId string) error
+	UpdateInstanceWireguardKeys(instanceId string, wgPrivateKey string, wgPublicKey string) error
+	GetPlaintextWireguardKeys(encryptedPrefix string) ([]StoredWireguardKey, error)
+	UpdateWireguardPrivateKey(storedKey StoredWireguardKey, wgPrivateKey string) error
+	GetAllInstanceIds() ([]string, error)
+	GetAllTemplates() ([]TemplateDb, error)
+	CreateVmManagerOperation(operation VmManagerOperationDb) error
+	SetVmManagerOperationVmId(operationId string, vmId string) error
+	FinishVmManagerOperation(operationId string, status string, lastError string) error
+	RecordVmManagerOperationError(operationId string, lastError string) error
+	GetPendingVmManagerOperations(gracePeriod time.Duration) ([]VmManagerOperationDb, error)
+	DeleteFinishedVmManagerOperations() error
 }
 
 type PostgresDatabase struct {
@@ -74,6 +118,7 @@ type DatabaseSubject struct {
 	Name          string
 	Code          string
 	ProfessorMail string
+	Isolated      bool
 }
 
 type InstanceInfo struct {
@@ -98,6 +143,91 @@ type TemplateDb struct {
 	VramMB      int
 }
 
+// VmManagerOperationDb is a call to the VM manager recorded in the outbox, VmId is empty until the VM manager
+// returns the ID of a new VM
+type VmManagerOperationDb struct {
+	ID        string
+	Kind      string
+	VmId      *string
+	SubjectId *string
+	Status    string
+	Attempts  int
+	LastError *string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Still pending after the grace period, the request that started it gave up
+	Abandoned bool
+}
+
+type SnapshotDb struct {
+	ID          string
+	InstanceId  string
+	UserId      string
+	Description string
+	CreatedAt   time.Time
+}
+
+type LabTopologyDb struct {
+	ID         string
+	SubjectId  string
+	Name       string
+	Definition LabTopologyDefinition
+	CreatedAt  time.Time
+}
+
+type LabDb struct {
+	ID           string
+	TopologyId   string
+	TopologyName string
+	UserId       string
+	SubjectId    string
+	CreatedAt    time.Time
+}
+
+type LabInstanceDb struct {
+	InstanceId string
+	NodeName   string
+}
+
+type PortForwardRequestDb struct {
+	ID            string
+	InstanceId    string
+	SubjectId     string
+	UserId        string
+	UserMail      string
+	Protocol      string
+	InternalPort  int
+	DurationHours int
+	Reason        string
+	Status        string
+	PortForwardId *string
+	ExternalPort  *int
+	ExpiresAt     *time.Time
+	CreatedAt     time.Time
+	DecidedAt     *time.Time
+}
+
+// WireguardPeerDb is an extra device of the owner of an instance, with its own keys and interface address
+type WireguardPeerDb struct {
+	ID               string
+	InstanceId       string
+	Name             string
+	WgPrivateKey     string
+	WgPublicKey      string
+	InterfaceIp      string
+	PeerPublicKey    string
+	PeerAllowedIps   []string
+	PeerEndpointPort int
+	CreatedAt        time.Time
+}
+
+// StoredWireguardKey is a private key of an instance or, if IsPeer, of an extra device
+type StoredWireguardKey struct {
+	Id         string
+	IsPeer     bool
+	PrivateKey string
+}
+
 type wireguardConfig struct {
 	PrivateKey     string   `json:"private_key"`
 	PublicKey      string   `json:"public_key"`
@@ -109,7 +239,7 @@ type wireguardConfig struct {
 
 func (postgres *PostgresDatabase) GetAllSubjects() ([]Subject, error) {
 	query := `
-	SELECT s.id, s.name, s.code, u.name as professor_name, u.mail as professor_mail
+	SELECT s.id, s.name, s.code, u.name as professor_name, u.mail as professor_mail, s.isolated
 	FROM subjects s
 	JOIN users u ON s.main_professor_id = u.id`
 
@@ -123,7 +253,7 @@ func (postgres *PostgresDatabase) GetAllSubjects() ([]Subject, error) {
 	var subjects []Subject
 	for rows.Next() {
 		var subject Subject
-		if err := rows.Scan(&subject.ID, &subject.Name, &subject.Code, &subject.ProfessorName, &subject.ProfessorMail); err != nil {
+		if err := rows.Scan(&subject.ID, &subject.Name, &subject.Code, &subject.ProfessorName, &subject.ProfessorMail, &subject.Isolated); err != nil {
 			return nil, fmt.Errorf("error scanning subject: %w", err)
 		}
 		subjects = append(subjects, subject)
@@ -138,7 +268,7 @@ func (postgres *PostgresDatabase) GetAllSubjects() ([]Subject, error) {
 
 func (postgres *PostgresDatabase) GetWireguardConfig(instanceId string) (wireguardConfig, error) {
 	query := `
-	SELECT wg_private_key, wg_public_key, interface_ip, peer_public_key, peer_allowed_ips, peer_endpoint_port
+	SELECT COALESCE(wg_private_key, ''), wg_public_key, interface_ip, peer_public_key, peer_allowed_ips, peer_endpoint_port
 	FROM instances
 	WHERE id = @id`
 	args := pgx.NamedArgs{"id": instanceId}
@@ -153,13 +283,13 @@ func (postgres *PostgresDatabase) GetWireguardConfig(instanceId string) (wiregua
 
 func (postgres *PostgresDatabase) GetSubjectById(subjectId string) (Subject, error) {
 	query := `
-	SELECT s.id, s.name, s.code, s.main_professor_id
+	SELECT s.id, s.name, s.code, s.main_professor_id, s.isolated
 	FROM subjects s
 	WHERE s.id = @id`
 	args := pgx.NamedArgs{"id": subjectId}
 
 	var dbSubject DatabaseSubject
-	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&dbSubject.ID, &dbSubject.Name, &dbSubject.Code, &dbSubject.ProfessorMail); err != nil {
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&dbSubject.ID, &dbSubject.Name, &dbSubject.Code, &dbSubject.ProfessorMail, &dbSubject.Isolated); err != nil {
 		return Subject{}, fmt.Errorf("error getting subject: %w", err)
 	}
 
@@ -214,6 +344,40 @@ func (postgres *PostgresDatabase) GetTemplatesBySubjectId(subjectId string) ([]T
 	return templates, nil
 }
 
+// GetTemplatesById returns a record per subject, templates defined from a base share its ID
+func (postgres *PostgresDatabase) GetTemplatesById(templateId string) ([]TemplateDb, error) {
+	query := "SELECT id, subject_id, description, size_mb, vcpu_count, vram_mb FROM templates WHERE id = @id"
+	args := pgx.NamedArgs{"id": templateId}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, fmt.Errorf("error getting templates: %w", err)
+	}
+	defer rows.Close()
+
+	var templates []TemplateDb
+	for rows.Next() {
+		var template TemplateDb
+		if err := rows.Scan(
+			&template.ID,
+			&template.SubjectId,
+			&template.Description,
+			&template.SizeMB,
+			&template.VcpuCount,
+			&template.VramMB,
+		); err != nil {
+			return nil, fmt.Errorf("error scanning template: %w", err)
+		}
+		templates = append(templates, template)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating template rows: %w", rows.Err())
+	}
+
+	return templates, nil
+}
+
 func (postgres *PostgresDatabase) GetInstanceIdsByUserId(userId string) ([]string, error) {
 	query := "SELECT id FROM instances WHERE user_id = $1"
 
@@ -428,7 +592,7 @@ func (postgres *PostgresDatabase) CreateInstance(instanceId string, userId strin
 
 	query := `
 	INSERT INTO instances (id, user_id, subject_id, template_id, wg_private_key, wg_public_key, interface_ip, peer_public_key, peer_allowed_ips, peer_endpoint_port)
-	VALUES (@id, @user_id, @subject_id, @template_id, @wg_private_key, @wg_public_key, @interface_ip, @peer_public_key, @peer_allowed_ips, @peer_endpoint_port)`
+	VALUES (@id, @user_id, @subject_id, @template_id, NULLIF(@wg_private_key, ''), @wg_public_key, @interface_ip, @peer_public_key, @peer_allowed_ips, @peer_endpoint_port)`
 	args := pgx.NamedArgs{
 		"id":                 instanceUUID,
 		"user_id":            userUUID,
@@ -546,17 +710,19 @@ func (postgres *PostgresDatabase) UserExistsByMail(mail string) error {
 func (postgres *PostgresDatabase) CreateSubject(subject Subject) (string, error) {
 	dbSubject := subject.toDatabaseSubject()
 	query := `
-	INSERT INTO subjects (id, name, code, main_professor_id)
+	INSERT INTO subjects (id, name, code, main_professor_id, isolated)
 	VALUES (
 		@id, 
 		@name, 
 		@code, 
-		(SELECT id FROM users WHERE mail = @professor_mail))`
+		(SELECT id FROM users WHERE mail = @professor_mail),
+		@isolated)`
 	args := pgx.NamedArgs{
 		"id":             dbSubject.ID,
 		"name":           dbSubject.Name,
 		"code":           dbSubject.Code,
 		"professor_mail": dbSubject.ProfessorMail,
+		"isolated":       dbSubject.Isolated,
 	}
 
 	_, err := postgres.db.Exec(context.Background(), query, args)
@@ -585,7 +751,7 @@ func (postgres *PostgresDatabase) UserExistsByEmailorError(userEmail string) err
 
 func (postgres *PostgresDatabase) ListAllSubjectsByUserId(userId string) ([]Subject, error) {
 	query := `
-	SELECT s.id, s.name, s.code, s.main_professor_id
+	SELECT s.id, s.name, s.code, s.main_professor_id, s.isolated
 	FROM subjects s
 	JOIN user_subjects us ON s.id = us.subject_id
 	WHERE us.user_id = @id`
@@ -600,7 +766,7 @@ func (postgres *PostgresDatabase) ListAllSubjectsByUserId(userId string) ([]Subj
 	var subjects []Subject
 	for rows.Next() {
 		var dbSubject DatabaseSubject
-		if err := rows.Scan(&dbSubject.ID, &dbSubject.Name, &dbSubject.Code, &dbSubject.ProfessorMail); err != nil {
+		if err := rows.Scan(&dbSubject.ID, &dbSubject.Name, &dbSubject.Code, &dbSubject.ProfessorMail, &dbSubject.Isolated); err != nil {
 			return nil, fmt.Errorf("error scanning subject: %w", err)
 		}
 
@@ -876,6 +1042,7 @@ func (subject *Subject) toDatabaseSubject() DatabaseSubject {
 		Name:          subject.Name,
 		Code:          subject.Code,
 		ProfessorMail: subject.ProfessorMail,
+		Isolated:      subject.Isolated,
 	}
 }
 
@@ -885,6 +1052,7 @@ func (dbSubject *DatabaseSubject) toSubject() Subject {
 		Name:          dbSubject.Name,
 		Code:          dbSubject.Code,
 		ProfessorMail: dbSubject.ProfessorMail,
+		Isolated:      dbSubject.Isolated,
 	}
 }
 
@@ -1020,6 +1188,96 @@ func getDDLStatements() string {
 			subject_id UUID NOT NULL REFERENCES subjects(id),
 			PRIMARY KEY (user_id, subject_id)
 		);
+
+		-- Maximum number of snapshots each instance of the subject can keep
+		ALTER TABLE subjects ADD COLUMN IF NOT EXISTS snapshot_quota INTEGER NOT NULL DEFAULT 3;
+
+		-- Isolated subjects give every student its own network, so students can't reach each other's VMs
+		ALTER TABLE subjects ADD COLUMN IF NOT EXISTS isolated BOOLEAN NOT NULL DEFAULT false;
+
+		CREATE TABLE IF NOT EXISTS snapshots (
+			id VARCHAR(100) PRIMARY KEY,
+			instance_id VARCHAR(100) NOT NULL REFERENCES instances(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id),
+			description TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS auth_sessions (
+			token_hash VARCHAR(64) PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			expires_at TIMESTAMP NOT NULL
+		);
+
+		-- Lab topologies are the VMs and internal networks professors define, every student instantiates them as labs
+		CREATE TABLE IF NOT EXISTS lab_topologies (
+			id UUID PRIMARY KEY,
+			subject_id UUID NOT NULL REFERENCES subjects(id) ON DELETE CASCADE,
+			name VARCHAR(100) NOT NULL,
+			definition JSONB NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS labs (
+			id VARCHAR(100) PRIMARY KEY,
+			topology_id UUID NOT NULL REFERENCES lab_topologies(id),
+			user_id UUID NOT NULL REFERENCES users(id),
+			subject_id UUID NOT NULL REFERENCES subjects(id),
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		-- The instances of a lab are deleted with it
+		ALTER TABLE instances ADD COLUMN IF NOT EXISTS lab_id VARCHAR(100) REFERENCES labs(id) ON DELETE CASCADE;
+		ALTER TABLE instances ADD COLUMN IF NOT EXISTS lab_node VARCHAR(100);
+
+		-- Students ask for ports of their instances to be public, the VM manager forwards them once a professor approves
+		CREATE TABLE IF NOT EXISTS port_forward_requests (
+			id UUID PRIMARY KEY,
+			instance_id VARCHAR(100) NOT NULL REFERENCES instances(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id),
+			protocol VARCHAR(10) NOT NULL,
+			internal_port INTEGER NOT NULL,
+			duration_hours INTEGER NOT NULL,
+			reason TEXT NOT NULL,
+			status VARCHAR(20) NOT NULL DEFAULT 'pending',
+			port_forward_id VARCHAR(100),
+			external_port INTEGER,
+			expires_at TIMESTAMP,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			decided_at TIMESTAMP
+		);
+
+		-- Extra devices of the owner of an instance, the instance row keeps the first one
+		CREATE TABLE IF NOT EXISTS wireguard_peers (
+			id VARCHAR(100) PRIMARY KEY,
+			instance_id VARCHAR(100) NOT NULL REFERENCES instances(id) ON DELETE CASCADE,
+			name VARCHAR(100) NOT NULL,
+			wg_private_key TEXT NOT NULL,
+			wg_public_key TEXT NOT NULL,
+			interface_ip TEXT NOT NULL,
+			peer_public_key TEXT NOT NULL,
+			peer_allowed_ips TEXT[] NOT NULL,
+			peer_endpoint_port INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		-- Devices with keys generated client-side only register their public key
+		ALTER TABLE instances ALTER COLUMN wg_private_key DROP NOT NULL;
+		ALTER TABLE wireguard_peers ALTER COLUMN wg_private_key DROP NOT NULL;
+
+		-- Outbox of the calls that create or delete VMs in the VM manager. They are recorded before the call and
+		-- finished with the local change, the sync job completes or undoes the ones left pending
+		CREATE TABLE IF NOT EXISTS vm_manager_operations (
+			id UUID PRIMARY KEY,
+			kind VARCHAR(30) NOT NULL,
+			vm_id VARCHAR(100),
+			subject_id UUID,
+			status VARCHAR(20) NOT NULL DEFAULT 'pending',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
 	`
 }
 
@@ -1208,3 +1466,888 @@ func (postgres *PostgresDatabase) GetAllUsers() ([]User, error) {
 
 	return users, nil
 }
+
+func (postgres *PostgresDatabase) CreateSnapshot(snapshotId string, instanceId string, userId string, description string) error {
+	query := `
+	INSERT INTO snapshots (id, instance_id, user_id, description)
+	VALUES (@id, @instance_id, @user_id, @description)`
+	args := pgx.NamedArgs{
+		"id":          snapshotId,
+		"instance_id": instanceId,
+		"user_id":     userId,
+		"description": description,
+	}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error creating snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) GetSnapshotsByInstanceId(instanceId string) ([]SnapshotDb, error) {
+	query := `
+	SELECT id, instance_id, user_id, description, created_at
+	FROM snapshots
+	WHERE instance_id = @instance_id
+	ORDER BY created_at`
+	args := pgx.NamedArgs{"instance_id": instanceId}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, fmt.Errorf("error getting snapshots: %w", err)
+	}
+	defer rows.Close()
+
+	var snapshots []SnapshotDb
+	for rows.Next() {
+		var snapshot SnapshotDb
+		if err := rows.Scan(&snapshot.ID, &snapshot.InstanceId, &snapshot.UserId, &snapshot.Description, &snapshot.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning snapshot: %w", err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating snapshot rows: %w", rows.Err())
+	}
+
+	return snapshots, nil
+}
+
+func (postgres *PostgresDatabase) DeleteSnapshot(snapshotId string) error {
+	query := "DELETE FROM snapshots WHERE id = @id"
+	args := pgx.NamedArgs{"id": snapshotId}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error deleting snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) GetSubjectSnapshotQuota(subjectId string) (int, error) {
+	query := "SELECT snapshot_quota FROM subjects WHERE id = @id"
+	args := pgx.NamedArgs{"id": subjectId}
+
+	var quota int
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&quota); err != nil {
+		return 0, fmt.Errorf("error getting subject snapshot quota: %w", err)
+	}
+
+	return quota, nil
+}
+
+func (postgres *PostgresDatabase) SetSubjectSnapshotQuota(subjectId string, quota int) error {
+	query := "UPDATE subjects SET snapshot_quota = @quota WHERE id = @id"
+	args := pgx.NamedArgs{"id": subjectId, "quota": quota}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error setting subject snapshot quota: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) IsUserInSubject(userId, subjectId string) bool {
+	query := "SELECT EXISTS(SELECT 1 FROM user_subjects WHERE user_id = @user_id AND subject_id = @subject_id)"
+	args := pgx.NamedArgs{"user_id": userId, "subject_id": subjectId}
+
+	var isInSubject bool
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&isInSubject); err != nil {
+		return false
+	}
+
+	return isInSubject
+}
+
+func (postgres *PostgresDatabase) CreateAuthSession(tokenHash string, userId string, expiresAt time.Time) error {
+	query := `
+	INSERT INTO auth_sessions (token_hash, user_id, expires_at)
+	VALUES (@token_hash, @user_id, @expires_at)`
+	args := pgx.NamedArgs{
+		"token_hash": tokenHash,
+		"user_id":    userId,
+		"expires_at": expiresAt,
+	}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error creating auth session: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) GetUserByAuthSession(tokenHash string) (User, error) {
+	query := `
+	SELECT u.id, r.role, u.name, u.mail, u.password, u.public_ssh_keys
+	FROM auth_sessions s
+	JOIN users u ON s.user_id = u.id
+	JOIN roles r ON u.role_id = r.id
+	WHERE s.token_hash = @token_hash AND s.expires_at > NOW()`
+	args := pgx.NamedArgs{"token_hash": tokenHash}
+
+	var dbUser DatabaseUser
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&dbUser.ID, &dbUser.Role, &dbUser.Name, &dbUser.Mail, &dbUser.Password, &dbUser.PublicSshKeys); err != nil {
+		return User{}, fmt.Errorf("error getting user by auth session: %w", err)
+	}
+
+	return dbUser.toUser(), nil
+}
+
+func (postgres *PostgresDatabase) DeleteAuthSession(tokenHash string) error {
+	query := "DELETE FROM auth_sessions WHERE token_hash = @token_hash"
+	args := pgx.NamedArgs{"token_hash": tokenHash}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error deleting auth session: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) DeleteExpiredAuthSessions() error {
+	query := "DELETE FROM auth_sessions WHERE expires_at <= NOW()"
+
+	_, err := postgres.db.Exec(context.Background(), query)
+	if err != nil {
+		return fmt.Errorf("error deleting expired auth sessions: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) CreateLabTopology(topology LabTopologyDb) error {
+	query := `
+	INSERT INTO lab_topologies (id, subject_id, name, definition)
+	VALUES (@id, @subject_id, @name, @definition)`
+	args := pgx.NamedArgs{
+		"id":         topology.ID,
+		"subject_id": topology.SubjectId,
+		"name":       topology.Name,
+		"definition": topology.Definition,
+	}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error creating lab topology: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) GetLabTopology(topologyId string) (LabTopologyDb, error) {
+	query := `
+	SELECT id, subject_id, name, definition, created_at
+	FROM lab_topologies
+	WHERE id = @id`
+	args := pgx.NamedArgs{"id": topologyId}
+
+	var topology LabTopologyDb
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&topology.ID, &topology.SubjectId, &topology.Name, &topology.Definition, &topology.CreatedAt); err != nil {
+		if err == pgx.ErrNoRows {
+			return LabTopologyDb{}, NewHttpError(http.StatusNotFound, fmt.Errorf("lab topology %s not found", topologyId))
+		}
+		return LabTopologyDb{}, fmt.Errorf("error getting lab topology: %w", err)
+	}
+
+	return topology, nil
+}
+
+func (postgres *PostgresDatabase) GetLabTopologiesBySubjectId(subjectId string) ([]LabTopologyDb, error) {
+	query := `
+	SELECT id, subject_id, name, definition, created_at
+	FROM lab_topologies
+	WHERE subject_id = @subject_id
+	ORDER BY created_at`
+	args := pgx.NamedArgs{"subject_id": subjectId}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, fmt.Errorf("error getting lab topologies: %w", err)
+	}
+	defer rows.Close()
+
+	var topologies []LabTopologyDb
+	for rows.Next() {
+		var topology LabTopologyDb
+		if err := rows.Scan(&topology.ID, &topology.SubjectId, &topology.Name, &topology.Definition, &topology.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning lab topology: %w", err)
+		}
+		topologies = append(topologies, topology)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating lab topology rows: %w", rows.Err())
+	}
+
+	return topologies, nil
+}
+
+func (postgres *PostgresDatabase) DeleteLabTopology(topologyId string) error {
+	query := "DELETE FROM lab_topologies WHERE id = @id"
+	args := pgx.NamedArgs{"id": topologyId}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error deleting lab topology: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) CreateLab(labId string, topologyId string, userId string, subjectId string) error {
+	query := `
+	INSERT INTO labs (id, topology_id, user_id, subject_id)
+	VALUES (@id, @topology_id, @user_id, @subject_id)`
+	args := pgx.NamedArgs{
+		"id":          labId,
+		"topology_id": topologyId,
+		"user_id":     userId,
+		"subject_id":  subjectId,
+	}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error creating lab: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) GetLab(labId string) (LabDb, error) {
+	query := `
+	SELECT l.id, l.topology_id, t.name, l.user_id, l.subject_id, l.created_at
+	FROM labs l
+	JOIN lab_topologies t ON l.topology_id = t.id
+	WHERE l.id = @id`
+	args := pgx.NamedArgs{"id": labId}
+
+	var lab LabDb
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&lab.ID, &lab.TopologyId, &lab.TopologyName, &lab.UserId, &lab.SubjectId, &lab.CreatedAt); err != nil {
+		if err == pgx.ErrNoRows {
+			return LabDb{}, NewHttpError(http.StatusNotFound, fmt.Errorf("lab %s not found", labId))
+		}
+		return LabDb{}, fmt.Errorf("error getting lab: %w", err)
+	}
+
+	return lab, nil
+}
+
+func (postgres *PostgresDatabase) GetLabsByUserId(userId string) ([]LabDb, error) {
+	query := `
+	SELECT l.id, l.topology_id, t.name, l.user_id, l.subject_id, l.created_at
+	FROM labs l
+	JOIN lab_topologies t ON l.topology_id = t.id
+	WHERE l.user_id = @user_id
+	ORDER BY l.created_at`
+	args := pgx.NamedArgs{"user_id": userId}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, fmt.Errorf("error getting labs: %w", err)
+	}
+	defer rows.Close()
+
+	var labs []LabDb
+	for rows.Next() {
+		var lab LabDb
+		if err := rows.Scan(&lab.ID, &lab.TopologyId, &lab.TopologyName, &lab.UserId, &lab.SubjectId, &lab.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning lab: %w", err)
+		}
+		labs = append(labs, lab)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating lab rows: %w", rows.Err())
+	}
+
+	return labs, nil
+}
+
+func (postgres *PostgresDatabase) SetInstanceLab(instanceId string, labId string, nodeName string) error {
+	query := "UPDATE instances SET lab_id = @lab_id, lab_node = @lab_node WHERE id = @id"
+	args := pgx.NamedArgs{
+		"id":       instanceId,
+		"lab_id":   labId,
+		"lab_node": nodeName,
+	}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error setting instance lab: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) GetLabInstances(labId string) ([]LabInstanceDb, error) {
+	query := `
+	SELECT id, lab_node
+	FROM instances
+	WHERE lab_id = @lab_id
+	ORDER BY lab_node`
+	args := pgx.NamedArgs{"lab_id": labId}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, fmt.Errorf("error getting lab instances: %w", err)
+	}
+	defer rows.Close()
+
+	var instances []LabInstanceDb
+	for rows.Next() {
+		var instance LabInstanceDb
+		if err := rows.Scan(&instance.InstanceId, &instance.NodeName); err != nil {
+			return nil, fmt.Errorf("error scanning lab instance: %w", err)
+		}
+		instances = append(instances, instance)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating lab instance rows: %w", rows.Err())
+	}
+
+	return instances, nil
+}
+
+// DeleteLab deletes the lab along with its instances
+func (postgres *PostgresDatabase) DeleteLab(labId string) error {
+	query := "DELETE FROM labs WHERE id = @id"
+	args := pgx.NamedArgs{"id": labId}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error deleting lab: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) CreatePortForwardRequest(request PortForwardRequestDb) error {
+	query := `
+	INSERT INTO port_forward_requests (id, instance_id, user_id, protocol, internal_port, duration_hours, reason)
+	VALUES (@id, @instance_id, @user_id, @protocol, @internal_port, @duration_hours, @reason)`
+	args := pgx.NamedArgs{
+		"id":             request.ID,
+		"instance_id":    request.InstanceId,
+		"user_id":        request.UserId,
+		"protocol":       request.Protocol,
+		"internal_port":  request.InternalPort,
+		"duration_hours": request.DurationHours,
+		"reason":         request.Reason,
+	}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error creating port forward request: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) GetPortForwardRequest(requestId string) (PortForwardRequestDb, error) {
+	query := `
+	SELECT ` + portForwardRequestColumns + `
+	FROM port_forward_requests p
+	JOIN instances i ON p.instance_id = i.id
+	JOIN users u ON p.user_id = u.id
+	WHERE p.id = @id`
+	args := pgx.NamedArgs{"id": requestId}
+
+	request, err := scanPortForwardRequest(postgres.db.QueryRow(context.Background(), query, args))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return PortForwardRequestDb{}, NewHttpError(http.StatusNotFound, fmt.Errorf("port forward request %s not found", requestId))
+		}
+		return PortForwardRequestDb{}, fmt.Errorf("error getting port forward request: %w", err)
+	}
+
+	return request, nil
+}
+
+func (postgres *PostgresDatabase) GetPortForwardRequestsByInstanceId(instanceId string) ([]PortForwardRequestDb, error) {
+	query := `
+	SELECT ` + portForwardRequestColumns + `
+	FROM port_forward_requests p
+	JOIN instances i ON p.instance_id = i.id
+	JOIN users u ON p.user_id = u.id
+	WHERE p.instance_id = @instance_id
+	ORDER BY p.created_at`
+
+	return postgres.queryPortForwardRequests(query, pgx.NamedArgs{"instance_id": instanceId})
+}
+
+func (postgres *PostgresDatabase) GetPortForwardRequestsBySubjectId(subjectId string) ([]PortForwardRequestDb, error) {
+	query := `
+	SELECT ` + portForwardRequestColumns + `
+	FROM port_forward_requests p
+	JOIN instances i ON p.instance_id = i.id
+	JOIN users u ON p.user_id = u.id
+	WHERE i.subject_id = @subject_id
+	ORDER BY p.created_at`
+
+	return postgres.queryPortForwardRequests(query, pgx.NamedArgs{"subject_id": subjectId})
+}
+
+// ApprovePortForwardRequest returns false when the request was no longer pending
+func (postgres *PostgresDatabase) ApprovePortForwardRequest(requestId string, portForwardId string, externalPort int, expiresAt time.Time) (bool, error) {
+	query := `
+	UPDATE port_forward_requests
+	SET status = 'approved', port_forward_id = @port_forward_id, external_port = @external_port,
+	    expires_at = @expires_at, decided_at = CURRENT_TIMESTAMP
+	WHERE id = @id AND status = 'pending'`
+	args := pgx.NamedArgs{
+		"id":              requestId,
+		"port_forward_id": portForwardId,
+		"external_port":   externalPort,
+		"expires_at":      expiresAt,
+	}
+
+	result, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return false, fmt.Errorf("error approving port forward request: %w", err)
+	}
+
+	return result.RowsAffected() > 0, nil
+}
+
+// RejectPortForwardRequest returns false when the request was no longer pending
+func (postgres *PostgresDatabase) RejectPortForwardRequest(requestId string) (bool, error) {
+	query := `
+	UPDATE port_forward_requests
+	SET status = 'rejected', decided_at = CURRENT_TIMESTAMP
+	WHERE id = @id AND status = 'pending'`
+	args := pgx.NamedArgs{"id": requestId}
+
+	result, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return false, fmt.Errorf("error rejecting port forward request: %w", err)
+	}
+
+	return result.RowsAffected() > 0, nil
+}
+
+func (postgres *PostgresDatabase) DeletePortForwardRequest(requestId string) error {
+	query := "DELETE FROM port_forward_requests WHERE id = @id"
+	args := pgx.NamedArgs{"id": requestId}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error deleting port forward request: %w", err)
+	}
+
+	return nil
+}
+
+const portForwardRequestColumns = `p.id, p.instance_id, i.subject_id, p.user_id, u.mail, p.protocol, p.internal_port, p.duration_hours,
+	p.reason, p.status, p.port_forward_id, p.external_port, p.expires_at, p.created_at, p.decided_at`
+
+func scanPortForwardRequest(row pgx.Row) (PortForwardRequestDb, error) {
+	var request PortForwardRequestDb
+	err := row.Scan(
+		&request.ID,
+		&request.InstanceId,
+		&request.SubjectId,
+		&request.UserId,
+		&request.UserMail,
+		&request.Protocol,
+		&request.InternalPort,
+		&request.DurationHours,
+		&request.Reason,
+		&request.Status,
+		&request.PortForwardId,
+		&request.ExternalPort,
+		&request.ExpiresAt,
+		&request.CreatedAt,
+		&request.DecidedAt,
+	)
+	return request, err
+}
+
+func (postgres *PostgresDatabase) queryPortForwardRequests(query string, args pgx.NamedArgs) ([]PortForwardRequestDb, error) {
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, fmt.Errorf("error getting port forward requests: %w", err)
+	}
+	defer rows.Close()
+
+	var requests []PortForwardRequestDb
+	for rows.Next() {
+		request, err := scanPortForwardRequest(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning port forward request: %w", err)
+		}
+		requests = append(requests, request)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating port forward request rows: %w", rows.Err())
+	}
+
+	return requests, nil
+}
+
+func (postgres *PostgresDatabase) CreateWireguardPeer(peer WireguardPeerDb) error {
+	query := `
+	INSERT INTO wireguard_peers (id, instance_id, name, wg_private_key, wg_public_key, interface_ip, peer_public_key, peer_allowed_ips, peer_endpoint_port)
+	VALUES (@id, @instance_id, @name, NULLIF(@wg_private_key, ''), @wg_public_key, @interface_ip, @peer_public_key, @peer_allowed_ips, @peer_endpoint_port)`
+	args := pgx.NamedArgs{
+		"id":                 peer.ID,
+		"instance_id":        peer.InstanceId,
+		"name":               peer.Name,
+		"wg_private_key":     peer.WgPrivateKey,
+		"wg_public_key":      peer.WgPublicKey,
+		"interface_ip":       peer.InterfaceIp,
+		"peer_public_key":    peer.PeerPublicKey,
+		"peer_allowed_ips":   peer.PeerAllowedIps,
+		"peer_endpoint_port": peer.PeerEndpointPort,
+	}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error creating wireguard peer: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) GetWireguardPeer(peerId string) (WireguardPeerDb, error) {
+	query := `
+	SELECT id, instance_id, name, wg_public_key, interface_ip, created_at
+	FROM wireguard_peers
+	WHERE id = @id`
+	args := pgx.NamedArgs{"id": peerId}
+
+	var peer WireguardPeerDb
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&peer.ID, &peer.InstanceId, &peer.Name, &peer.WgPublicKey, &peer.InterfaceIp, &peer.CreatedAt); err != nil {
+		if err == pgx.ErrNoRows {
+			return WireguardPeerDb{}, NewHttpError(http.StatusNotFound, fmt.Errorf("wireguard peer %s not found", peerId))
+		}
+		return WireguardPeerDb{}, fmt.Errorf("error getting wireguard peer: %w", err)
+	}
+
+	return peer, nil
+}
+
+// GetWireguardPeersByInstanceId leaves out the private keys, they are only read to render the configs
+func (postgres *PostgresDatabase) GetWireguardPeersByInstanceId(instanceId string) ([]WireguardPeerDb, error) {
+	query := `
+	SELECT id, instance_id, name, wg_public_key, interface_ip, created_at
+	FROM wireguard_peers
+	WHERE instance_id = @instance_id
+	ORDER BY created_at`
+	args := pgx.NamedArgs{"instance_id": instanceId}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, fmt.Errorf("error getting wireguard peers: %w", err)
+	}
+	defer rows.Close()
+
+	var peers []WireguardPeerDb
+	for rows.Next() {
+		var peer WireguardPeerDb
+		if err := rows.Scan(&peer.ID, &peer.InstanceId, &peer.Name, &peer.WgPublicKey, &peer.InterfaceIp, &peer.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning wireguard peer: %w", err)
+		}
+		peers = append(peers, peer)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating wireguard peer rows: %w", rows.Err())
+	}
+
+	return peers, nil
+}
+
+func (postgres *PostgresDatabase) GetWireguardPeerConfig(peerId string) (wireguardConfig, error) {
+	query := `
+	SELECT COALESCE(wg_private_key, ''), wg_public_key, interface_ip, peer_public_key, peer_allowed_ips, peer_endpoint_port
+	FROM wireguard_peers
+	WHERE id = @id`
+	args := pgx.NamedArgs{"id": peerId}
+
+	var config wireguardConfig
+	if err := postgres.db.QueryRow(context.Background(), query, args).Scan(&config.PrivateKey, &config.PublicKey, &config.InterfaceIp, &config.PeerPublicKey, &config.PeerAllowedIps, &config.PeerPort); err != nil {
+		return wireguardConfig{}, fmt.Errorf("error getting wireguard peer config: %w", err)
+	}
+
+	return config, nil
+}
+
+func (postgres *PostgresDatabase) DeleteWireguardPeer(peerId string) error {
+	query := "DELETE FROM wireguard_peers WHERE id = @id"
+	args := pgx.NamedArgs{"id": peerId}
+
+	_, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error deleting wireguard peer: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateInstanceWireguardKeys stores the keys of a rotation, the private key is empty when it was generated client-side
+func (postgres *PostgresDatabase) UpdateInstanceWireguardKeys(instanceId string, wgPrivateKey string, wgPublicKey string) error {
+	query := `
+	UPDATE instances
+	SET wg_private_key = NULLIF(@wg_private_key, ''), wg_public_key = @wg_public_key
+	WHERE id = @id`
+	args := pgx.NamedArgs{
+		"id":             instanceId,
+		"wg_private_key": wgPrivateKey,
+		"wg_public_key":  wgPublicKey,
+	}
+
+	result, err := postgres.db.Exec(context.Background(), query, args)
+	if err != nil {
+		return fmt.Errorf("error updating wireguard keys: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return NewHttpError(http.StatusNotFound, fmt.Errorf("instance %s not found", instanceId))
+	}
+
+	return nil
+}
+
+// GetPlaintextWireguardKeys returns the stored private keys that aren't encrypted yet
+func (postgres *PostgresDatabase) GetPlaintextWireguardKeys(encryptedPrefix string) ([]StoredWireguardKey, error) {
+	query := `
+	SELECT id, false, wg_private_key FROM instances
+	WHERE wg_private_key IS NOT NULL AND wg_private_key NOT LIKE @prefix || '%'
+	UNION ALL
+	SELECT id, true, wg_private_key FROM wireguard_peers
+	WHERE wg_private_key IS NOT NULL AND wg_private_key NOT LIKE @prefix || '%'`
+	args := pgx.NamedArgs{"prefix": encryptedPrefix}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, fmt.Errorf("error getting wireguard keys: %w", err)
+	}
+	defer rows.Close()
+
+	var storedKeys []StoredWireguardKey
+	for rows.Next() {
+		var storedKey StoredWireguardKey
+		if err := rows.Scan(&storedKey.Id, &storedKey.IsPeer, &storedKey.PrivateKey); err != nil {
+			return nil, fmt.Errorf("error scanning wireguard key: %w", err)
+		}
+		storedKeys = append(storedKeys, storedKey)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating wireguard key rows: %w", rows.Err())
+	}
+
+	return storedKeys, nil
+}
+
+// UpdateWireguardPrivateKey replaces a stored private key only if it didn't change since it was read
+func (postgres *PostgresDatabase) UpdateWireguardPrivateKey(storedKey StoredWireguardKey, wgPrivateKey string) error {
+	query := "UPDATE instances SET wg_private_key = @wg_private_key WHERE id = @id AND wg_private_key = @old_wg_private_key"
+	if storedKey.IsPeer {
+		query = "UPDATE wireguard_peers SET wg_private_key = @wg_private_key WHERE id = @id AND wg_private_key = @old_wg_private_key"
+	}
+	args := pgx.NamedArgs{
+		"id":                 storedKey.Id,
+		"wg_private_key":     wgPrivateKey,
+		"old_wg_private_key": storedKey.PrivateKey,
+	}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return fmt.Errorf("error updating wireguard private key: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) GetAllInstanceIds() ([]string, error) {
+	query := "SELECT id FROM instances"
+
+	rows, err := postgres.db.Query(context.Background(), query)
+	if err != nil {
+		return nil, fmt.Errorf("error getting instance ids: %w", err)
+	}
+
+	defer rows.Close()
+
+	var instanceIds []string
+	for rows.Next() {
+		var instanceId string
+		if err := rows.Scan(&instanceId); err != nil {
+			return nil, fmt.Errorf("error scanning instance id: %w", err)
+		}
+		instanceIds = append(instanceIds, instanceId)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating instance id rows: %w", rows.Err())
+	}
+
+	return instanceIds, nil
+}
+
+func (postgres *PostgresDatabase) GetAllTemplates() ([]TemplateDb, error) {
+	query := "SELECT id, subject_id, description, size_mb, vcpu_count, vram_mb FROM templates"
+
+	rows, err := postgres.db.Query(context.Background(), query)
+	if err != nil {
+		return nil, fmt.Errorf("error getting templates: %w", err)
+	}
+	defer rows.Close()
+
+	var templates []TemplateDb
+	for rows.Next() {
+		var template TemplateDb
+		if err := rows.Scan(
+			&template.ID,
+			&template.SubjectId,
+			&template.Description,
+			&template.SizeMB,
+			&template.VcpuCount,
+			&template.VramMB,
+		); err != nil {
+			return nil, fmt.Errorf("error scanning template: %w", err)
+		}
+		templates = append(templates, template)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating template rows: %w", rows.Err())
+	}
+
+	return templates, nil
+}
+
+func (postgres *PostgresDatabase) CreateVmManagerOperation(operation VmManagerOperationDb) error {
+	query := `
+	INSERT INTO vm_manager_operations (id, kind, vm_id, subject_id)
+	VALUES (@id, @kind, @vm_id, @subject_id)`
+	args := pgx.NamedArgs{
+		"id":         operation.ID,
+		"kind":       operation.Kind,
+		"vm_id":      operation.VmId,
+		"subject_id": operation.SubjectId,
+	}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return fmt.Errorf("error creating VM manager operation: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) SetVmManagerOperationVmId(operationId string, vmId string) error {
+	query := `
+	UPDATE vm_manager_operations
+	SET vm_id = @vm_id, updated_at = CURRENT_TIMESTAMP
+	WHERE id = @id`
+	args := pgx.NamedArgs{
+		"id":    operationId,
+		"vm_id": vmId,
+	}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return fmt.Errorf("error updating VM manager operation: %w", err)
+	}
+
+	return nil
+}
+
+// FinishVmManagerOperation only finishes pending operations, so the sync job and the request
+// that started the operation can't both finish it
+func (postgres *PostgresDatabase) FinishVmManagerOperation(operationId string, status string, lastError string) error {
+	query := `
+	UPDATE vm_manager_operations
+	SET status = @status, last_error = NULLIF(@last_error, ''), updated_at = CURRENT_TIMESTAMP
+	WHERE id = @id AND status = 'pending'`
+	args := pgx.NamedArgs{
+		"id":         operationId,
+		"status":     status,
+		"last_error": lastError,
+	}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return fmt.Errorf("error finishing VM manager operation: %w", err)
+	}
+
+	return nil
+}
+
+// RecordVmManagerOperationError keeps the operation pending so it's retried
+func (postgres *PostgresDatabase) RecordVmManagerOperationError(operationId string, lastError string) error {
+	query := `
+	UPDATE vm_manager_operations
+	SET attempts = attempts + 1, last_error = @last_error, updated_at = CURRENT_TIMESTAMP
+	WHERE id = @id`
+	args := pgx.NamedArgs{
+		"id":         operationId,
+		"last_error": lastError,
+	}
+
+	if _, err := postgres.db.Exec(context.Background(), query, args); err != nil {
+		return fmt.Errorf("error updating VM manager operation: %w", err)
+	}
+
+	return nil
+}
+
+func (postgres *PostgresDatabase) GetPendingVmManagerOperations(gracePeriod time.Duration) ([]VmManagerOperationDb, error) {
+	query := `
+	SELECT id, kind, vm_id, subject_id, status, attempts, last_error, created_at, updated_at,
+	       created_at < NOW() - make_interval(secs => @grace_seconds)
+	FROM vm_manager_operations
+	WHERE status = 'pending'
+	ORDER BY created_at`
+	args := pgx.NamedArgs{"grace_seconds": gracePeriod.Seconds()}
+
+	rows, err := postgres.db.Query(context.Background(), query, args)
+	if err != nil {
+		return nil, fmt.Errorf("error getting VM manager operations: %w", err)
+	}
+	defer rows.Close()
+
+	var operations []VmManagerOperationDb
+	for rows.Next() {
+		var operation VmManagerOperationDb
+		if err := rows.Scan(
+			&operation.ID,
+			&operation.Kind,
+			&operation.VmId,
+			&operation.SubjectId,
+			&operation.Status,
+			&operation.Attempts,
+			&operation.LastError,
+			&operation.CreatedAt,
+			&operation.UpdatedAt,
+			&operation.Abandoned,
+		); err != nil {
+			return nil, fmt.Errorf("error scanning VM manager operation: %w", err)
+		}
+		operations = append(operations, operation)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating VM manager operation rows: %w", rows.Err())
+	}
+
+	return operations, nil
+}
+
+// DeleteFinishedVmManagerOperations keeps the finished operations for a month
+func (postgres *PostgresDatabase) DeleteFinishedVmManagerOperations() error {
+	query := "DELETE FROM vm_manager_operations WHERE status <> 'pending' AND updated_at < NOW() - INTERVAL '30 days'"
+
+	if _, err := postgres.db.Exec(context.Background(), query); err != nil {
+		return fmt.Errorf("error deleting finished VM manager operations: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+)
+
+func (s *InstanceServiceImpl) CreateFirewallPolicy(request CreateFirewallPolicyRequest) (CreateFirewallPolicyResponse, error) {
+	if err := s.db.SubjectExistsById(request.SubjectId); err != nil {
+		return CreateFirewallPolicyResponse{}, err
+	}
+
+	// Professors can only scope policies to the templates of their subject
+	if request.TemplateId != nil {
+		templates, err := s.db.ListAllTemplatesBySubjectId(request.SubjectId)
+		if err != nil {
+			return CreateFirewallPolicyResponse{}, err
+		}
+
+		if !slices.Contains(templates, *request.TemplateId) {
+			return CreateFirewallPolicyResponse{}, NewHttpError(
+				http.StatusBadRequest,
+				fmt.Errorf("template %s does not belong to subject %s", *request.TemplateId, request.SubjectId),
+			)
+		}
+	}
+
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return CreateFirewallPolicyResponse{}, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	resp, err := http.Post(
+		fmt.Sprintf("%s/firewall-policies/create", s.vmManagerBaseUrl),
+		"application/json",
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		return CreateFirewallPolicyResponse{}, fmt.Errorf("error calling VM manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return CreateFirewallPolicyResponse{}, fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var response CreateFirewallPolicyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return CreateFirewallPolicyResponse{}, fmt.Errorf("error decoding VM manager response: %w", err)
+	}
+
+	log.Printf("Firewall policy %s created for subject %s", response.PolicyId, request.SubjectId)
+
+	return response, nil
+}
+
+func (s *InstanceServiceImpl) GetFirewallPolicy(policyId string) (FirewallPolicyResponse, error) {
+	var policy FirewallPolicyResponse
+	if err := s.getFromVmManager(fmt.Sprintf("/firewall-policies/%s", policyId), &policy); err != nil {
+		return FirewallPolicyResponse{}, err
+	}
+
+	return policy, nil
+}
+
+func (s *InstanceServiceImpl) GetFirewallPoliciesBySubjectId(subjectId string) ([]FirewallPolicyResponse, error) {
+	policies := []FirewallPolicyResponse{}
+	if err := s.getFromVmManager(fmt.Sprintf("/firewall-policies/subjects/%s", subjectId), &policies); err != nil {
+		return nil, err
+	}
+
+	return policies, nil
+}
+
+func (s *InstanceServiceImpl) UpdateFirewallPolicy(policyId string, request UpdateFirewallPolicyRequest) error {
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	req, err := http.NewRequest(
+		http.MethodPut,
+		fmt.Sprintf("%s/firewall-policies/update/%s", s.vmManagerBaseUrl, policyId),
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager API: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return s.doVmManagerRequest(req)
+}
+
+func (s *InstanceServiceImpl) DeleteFirewallPolicy(policyId string) error {
+	req, err := http.NewRequest(
+		http.MethodDelete,
+		fmt.Sprintf("%s/firewall-policies/delete/%s", s.vmManagerBaseUrl, policyId),
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager API: %w", err)
+	}
+
+	return s.doVmManagerRequest(req)
+}
+
+// getFromVmManager decodes the response of a GET to the VM manager, keeping its not found status
+func (s *InstanceServiceImpl) getFromVmManager(path string, response any) error {
+	resp, err := http.Get(s.vmManagerBaseUrl + path)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return NewHttpError(http.StatusNotFound, fmt.Errorf("%s not found", path))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("error decoding VM manager response: %w", err)
+	}
+
+	return nil
+}
+
+func (s *InstanceServiceImpl) doVmManagerRequest(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The VM manager closes the stream when it restarts, it's followed again after a pause
+const VM_MANAGER_EVENTS_RECONNECT_INTERVAL = 5 * time.Second
+
+// Subscribers that don't keep up are dropped, the browser reconnects and fetches the instances again
+const INSTANCE_EVENTS_SUBSCRIBER_BUFFER = 64
+
+// SubscribeInstanceEvents returns the channel where the status changes of the instances of the user are sent,
+// it's closed if the subscriber falls behind
+func (s *InstanceServiceImpl) SubscribeInstanceEvents(userId string) chan InstanceEvent {
+	s.eventsMutex.Lock()
+	defer s.eventsMutex.Unlock()
+
+	events := make(chan InstanceEvent, INSTANCE_EVENTS_SUBSCRIBER_BUFFER)
+	s.eventSubscribers[events] = userId
+
+	return events
+}
+
+func (s *InstanceServiceImpl) UnsubscribeInstanceEvents(events chan InstanceEvent) {
+	s.eventsMutex.Lock()
+	defer s.eventsMutex.Unlock()
+
+	if _, found := s.eventSubscribers[events]; found {
+		delete(s.eventSubscribers, events)
+		close(events)
+	}
+}
+
+// followVmManagerInstanceEvents relays the status changes the VM manager streams to the subscribers.
+// When it connects it gets the status of every instance, so subscribers catch up after a reconnection
+func (s *InstanceServiceImpl) followVmManagerInstanceEvents() {
+	for {
+		if err := s.readVmManagerInstanceEvents(); err != nil {
+			log.Printf("Error following VM manager instance events: %v", err)
+		}
+
+		time.Sleep(VM_MANAGER_EVENTS_RECONNECT_INTERVAL)
+	}
+}
+
+func (s *InstanceServiceImpl) readVmManagerInstanceEvents() error {
+	// The default client has no timeout, the stream is kept open
+	resp, err := http.Get(fmt.Sprintf("%s/instances/events", s.vmManagerBaseUrl))
+	if err != nil {
+		return fmt.Errorf("error calling VM manager API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("VM manager API returned status code %d", resp.StatusCode)
+	}
+
+	log.Printf("Following VM manager instance events")
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		// Lines without data are keepalive comments or separate the events
+		data, found := strings.CutPrefix(scanner.Text(), "data: ")
+		if !found {
+			continue
+		}
+
+		var event InstanceEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			log.Printf("Error decoding VM manager instance event: %v", err)
+			continue
+		}
+
+		s.publishInstanceEvent(event)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading instance events: %w", err)
+	}
+
+	return fmt.Errorf("VM manager closed the instance events stream")
+}
+
+func (s *InstanceServiceImpl) publishInstanceEvent(event InstanceEvent) {
+	s.eventsMutex.Lock()
+	subscribers := len(s.eventSubscribers)
+	s.eventsMutex.Unlock()
+
+	if subscribers == 0 {
+		return
+	}
+
+	// Templates and instances the web server doesn't know about have no owner to tell
+	info, err := s.db.GetInstanceInfo(event.InstanceId)
+	if err != nil {
+		return
+	}
+
+	s.eventsMutex.Lock()
+	defer s.eventsMutex.Unlock()
+
+	for events, userId := range s.eventSubscribers {
+		if userId != info.UserId {
+			continue
+		}
+
+		select {
+		case events <- event:
+		default:
+			log.Printf("Instance events subscriber of user %s fell behind, dropping it", userId)
+			delete(s.eventSubscribers, events)
+			close(events)
+		}
+	}
+}
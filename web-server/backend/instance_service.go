@@ -12,8 +12,11 @@ import (
 	"os"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"golang.org/x/crypto/curve25519"
 )
 
@@ -29,7 +32,44 @@ type InstanceService interface {
 	DeleteTemplate(templateId string, subjectId string) error
 	GetTemplatesBySubjectId(subjectId string) ([]Template, error)
 	GetWireguardConfig(instanceId string) (string, error)
+	RotateWireguardKey(instanceId string, request RotateWireguardKeyRequest) (string, error)
 	GetServerStatus() ([]ServerStatus, error)
+	CreateSnapshot(request CreateSnapshotFrontendRequest) (CreateSnapshotFrontendResponse, error)
+	ListSnapshots(instanceId string) ([]Snapshot, error)
+	RevertSnapshot(instanceId string, snapshotId string) error
+	DeleteSnapshot(instanceId string, snapshotId string) error
+	CreateConsoleTicket(request CreateConsoleTicketFrontendRequest) (CreateConsoleTicketFrontendResponse, error)
+	OpenConsole(ticket string) (*websocket.Conn, error)
+	CreateLabTopology(request CreateLabTopologyRequest) (CreateLabTopologyResponse, error)
+	GetLabTopology(topologyId string) (LabTopologyResponse, error)
+	GetLabTopologiesBySubjectId(subjectId string) ([]LabTopologyResponse, error)
+	DeleteLabTopology(topologyId string) error
+	CreateLab(request CreateLabFrontendRequest) (LabResponse, error)
+	GetLabsByUserId(userId string) ([]LabResponse, error)
+	StartLab(labId string) error
+	StopLab(labId string) error
+	DeleteLab(labId string) error
+	CreateFirewallPolicy(request CreateFirewallPolicyRequest) (CreateFirewallPolicyResponse, error)
+	GetFirewallPolicy(policyId string) (FirewallPolicyResponse, error)
+	GetFirewallPoliciesBySubjectId(subjectId string) ([]FirewallPolicyResponse, error)
+	UpdateFirewallPolicy(policyId string, request UpdateFirewallPolicyRequest) error
+	DeleteFirewallPolicy(policyId string) error
+	RequestPortForward(request RequestPortForwardRequest) (RequestPortForwardResponse, error)
+	GetPortForwardRequest(requestId string) (PortForwardRequestResponse, error)
+	GetPortForwardRequestsByInstanceId(instanceId string) ([]PortForwardRequestResponse, error)
+	GetPortForwardRequestsBySubjectId(subjectId string) ([]PortForwardRequestResponse, error)
+	ApprovePortForwardRequest(requestId string) (PortForwardRequestResponse, error)
+	RejectPortForwardRequest(requestId string) error
+	DeletePortForwardRequest(requestId string) error
+	AddWireguardPeer(request AddWireguardPeerRequest) (WireguardPeer, error)
+	GetWireguardPeer(peerId string) (WireguardPeer, error)
+	GetWireguardPeersByInstanceId(instanceId string) ([]WireguardPeer, error)
+	GetWireguardPeerConfig(peerId string) (string, error)
+	DeleteWireguardPeer(peerId string) error
+	GetVmManagerSyncReport() (VmManagerSyncReport, error)
+	RunVmManagerSync() (VmManagerSyncReport, error)
+	SubscribeInstanceEvents(userId string) chan InstanceEvent
+	UnsubscribeInstanceEvents(events chan InstanceEvent)
 }
 
 type InstanceStatus struct {
@@ -57,15 +97,41 @@ type InstanceServiceImpl struct {
 	vmManagerBaseUrl string
 	sessionManager   SessionManager
 	emailService     EmailService
+	keyEncryptor     KeyEncryptor
+	consoleTickets   map[string]ConsoleTicket
+	ticketsMutex     sync.Mutex
+	// Zero disables the periodic sync with the VM manager, it can still be run on demand
+	syncInterval   time.Duration
+	syncRepair     bool
+	syncMutex      sync.Mutex
+	lastSyncReport *VmManagerSyncReport
+	// Findings of the last sync, only the ones found twice in a row are repaired
+	previousSyncFindings map[string]bool
+	// Channels of the dashboards following the status of the instances, with the user they belong to
+	eventSubscribers map[chan InstanceEvent]string
+	eventsMutex      sync.Mutex
 }
 
-func NewInstanceService(db Database, vmManagerBaseUrl string, emailService EmailService) InstanceService {
+func NewInstanceService(db Database, vmManagerBaseUrl string, emailService EmailService, keyEncryptor KeyEncryptor) InstanceService {
 	service := &InstanceServiceImpl{
-		db:               db,
-		vmManagerBaseUrl: vmManagerBaseUrl,
-		emailService:     emailService,
+		db:                   db,
+		vmManagerBaseUrl:     vmManagerBaseUrl,
+		emailService:         emailService,
+		keyEncryptor:         keyEncryptor,
+		consoleTickets:       make(map[string]ConsoleTicket),
+		syncInterval:         getVmManagerSyncInterval(),
+		syncRepair:           os.Getenv("VM_MANAGER_SYNC_REPAIR") == "true",
+		previousSyncFindings: map[string]bool{},
+		eventSubscribers:     make(map[chan InstanceEvent]string),
 	}
 	service.sessionManager = NewSessionManager(db, emailService, vmManagerBaseUrl)
+
+	go service.followVmManagerInstanceEvents()
+
+	if service.syncInterval > 0 {
+		go service.runVmManagerSync()
+	}
+
 	return service
 }
 
@@ -80,6 +146,11 @@ type CreateInstanceRequest struct {
 	PublicSshKeys []string `json:"publicSshKeys"`
 	SubjectId     string   `json:"subjectId"`
 	UserWgPubKey  string   `json:"userWgPubKey"` // User's WireGuard public key
+	// Isolated subjects get a network per owner in the VM manager
+	SubjectIsolated bool   `json:"subjectIsolated,omitempty"`
+	OwnerId         string `json:"ownerId,omitempty"`
+	// Set to the VM manager operation id, so retried requests don't create the instance twice
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 type CreateInstanceResponse struct {
@@ -94,11 +165,47 @@ type DefineTemplateResponse struct {
 	TemplateId string `json:"templateId"`
 }
 
+// Long running operations in the VM manager are run as jobs that have to be polled until they finish
+const (
+	VM_MANAGER_JOB_POLL_INTERVAL = 2 * time.Second
+	VM_MANAGER_JOB_TIMEOUT       = 30 * time.Minute
+)
+
+// Requests with an idempotency key are sent again when the connection to the VM manager fails
+const (
+	IDEMPOTENT_VM_MANAGER_REQUEST_ATTEMPTS   = 3
+	IDEMPOTENT_VM_MANAGER_REQUEST_RETRY_WAIT = 5 * time.Second
+)
+
+type vmManagerJob struct {
+	JobId  string          `json:"jobId"`
+	Status string          `json:"status"`
+	Step   string          `json:"step"`
+	Error  *string         `json:"error"`
+	Result json.RawMessage `json:"result"`
+}
+
 type vmManagerStatus struct {
 	InstanceId string `json:"instanceId"`
 	Status     string `json:"status"`
 }
 
+type Snapshot struct {
+	Id          string `json:"id"`
+	InstanceId  string `json:"instanceId"`
+	UserId      string `json:"userId"`
+	Description string `json:"description"`
+	CreatedAt   string `json:"createdAt"`
+}
+
+type vmManagerConsoleTicket struct {
+	Ticket string `json:"ticket"`
+}
+
+type vmManagerSnapshot struct {
+	SnapshotId string `json:"snapshotId"`
+}
+
 type Template struct {
 	Id          string `json:"id"`
 	Description string `json:"description"`
@@ -162,13 +269,18 @@ func (s *InstanceServiceImpl) CreateInstance(request CreateInstanceFrontendReque
 
 	log.Printf("Template configuration: %+v", templateConfig)
 
-	// Generate a new WireGuard key pair
-	wgPrivateKey, wgPublicKey, err := GenerateKeyPair()
+	subject, err := s.db.GetSubjectById(request.SubjectId)
+	if err != nil {
+		log.Printf("Error fetching subject: %v", err)
+		return CreateInstanceFrontendResponse{}, fmt.Errorf("error fetching subject: %w", err)
+	}
+
+	// Use the key pair generated client-side, if any, or generate a new one
+	wgPrivateKey, wgPublicKey, err := s.getWireguardKeyPair(request.WgPublicKey)
 	if err != nil {
-		log.Printf("Error generating WireGuard key pair: %v", err)
-		return CreateInstanceFrontendResponse{}, fmt.Errorf("error generating WireGuard key pair: %w", err)
+		log.Printf("Error getting WireGuard key pair: %v", err)
+		return CreateInstanceFrontendResponse{}, err
 	}
-	log.Printf("Generated WireGuard key pair: PrivateKey: %s, PublicKey: %s", wgPrivateKey, wgPublicKey)
 
 	// Hash password
 	hashedPassword, err := HashPassword(request.Password)
@@ -178,48 +290,58 @@ func (s *InstanceServiceImpl) CreateInstance(request CreateInstanceFrontendReque
 	}
 
 	createInstanceRequest := CreateInstanceRequest{
-		SourceVmId:    request.SourceVmId,
-		SizeMB:        templateConfig.SizeMB,
-		VcpuCount:     templateConfig.VcpuCount,
-		VramMB:        templateConfig.VramMB,
-		Username:      request.Username,
-		Password:      hashedPassword,
-		PublicSshKeys: request.PublicSshKeys,
-		SubjectId:     request.SubjectId,
-		UserWgPubKey:  wgPublicKey,
+		SourceVmId:      request.SourceVmId,
+		SizeMB:          templateConfig.SizeMB,
+		VcpuCount:       templateConfig.VcpuCount,
+		VramMB:          templateConfig.VramMB,
+		Username:        request.Username,
+		Password:        hashedPassword,
+		PublicSshKeys:   request.PublicSshKeys,
+		SubjectId:       request.SubjectId,
+		UserWgPubKey:    wgPublicKey,
+		SubjectIsolated: subject.Isolated,
+		OwnerId:         request.UserId,
+	}
+
+	operationId, err := s.startVmManagerOperation(VM_MANAGER_OPERATION_CREATE_INSTANCE, "", request.SubjectId)
+	if err != nil {
+		log.Printf("Error recording instance creation: %v", err)
+		return CreateInstanceFrontendResponse{}, err
 	}
+	createInstanceRequest.IdempotencyKey = operationId
 
 	jsonData, err := json.Marshal(createInstanceRequest)
 	if err != nil {
 		log.Printf("Error marshaling request: %v", err)
+		s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_FAILED, err)
 		return CreateInstanceFrontendResponse{}, fmt.Errorf("error marshaling request: %w", err)
 	}
 
 	log.Printf("Sending request to VM manager at %s/instances/create", s.vmManagerBaseUrl)
-	resp, err := http.Post(
-		fmt.Sprintf("%s/instances/create", s.vmManagerBaseUrl),
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
+	resp, err := s.postIdempotentVmManagerRequest(fmt.Sprintf("%s/instances/create", s.vmManagerBaseUrl), jsonData)
 	if err != nil {
 		log.Printf("Error calling VM manager: %v", err)
+		s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_FAILED, err)
 		return CreateInstanceFrontendResponse{}, fmt.Errorf("error calling VM manager: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
-		return CreateInstanceFrontendResponse{}, fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	result, err := s.waitForVmManagerJob(resp)
+	if err != nil {
+		log.Printf("Error creating instance in VM manager: %v", err)
+		s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_FAILED, err)
+		return CreateInstanceFrontendResponse{}, err
 	}
 
 	var response CreateInstanceResponse
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+	if err := json.Unmarshal(result, &response); err != nil {
 		log.Printf("Error decoding VM manager response: %v", err)
+		s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_FAILED, err)
 		return CreateInstanceFrontendResponse{}, fmt.Errorf("error decoding VM manager response: %w", err)
 	}
 
 	log.Printf("VM manager response: %+v", response)
+	s.setVmManagerOperationVmId(operationId, response.InstanceId)
 
 	// Create the instance record in the database
 	var templateId *string
@@ -230,10 +352,13 @@ func (s *InstanceServiceImpl) CreateInstance(request CreateInstanceFrontendReque
 	err = s.db.CreateInstance(response.InstanceId, request.UserId, request.SubjectId, templateId, wgPrivateKey, wgPublicKey, response.InterfaceAddress, response.PeerPublicKey, response.PeerAllowedIps, response.PeerEndpointPort)
 	if err != nil {
 		log.Printf("Error creating instance record in database: %v", err)
+		// Nobody could use the VM without its record, so it's deleted
+		go s.compensateVmManagerOperation(operationId, response.InstanceId, false, err)
 		return CreateInstanceFrontendResponse{}, fmt.Errorf("error creating instance record: %w", err)
 	}
 
 	log.Printf("Instance record created successfully in database")
+	s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_DONE, nil)
 
 	return CreateInstanceFrontendResponse{
 		InstanceId: response.InstanceId,
@@ -287,13 +412,9 @@ func (s *InstanceServiceImpl) StopInstance(instanceId string) error {
 	}
 	defer resp.Body.Close()
 
-	// Read response body for logging
-	body, _ := io.ReadAll(resp.Body)
-	log.Printf("[InstanceService] VM manager response status: %d, body: %s", resp.StatusCode, string(body))
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("[InstanceService] VM manager returned error status %d", resp.StatusCode)
-		return fmt.Errorf("VM manager returned status code %d: %s", resp.StatusCode, string(body))
+	if _, err := s.waitForVmManagerJob(resp); err != nil {
+		log.Printf("[InstanceService] Error stopping instance in VM manager: %v", err)
+		return err
 	}
 
 	log.Printf("[InstanceService] Successfully stopped instance %s", instanceId)
@@ -301,6 +422,28 @@ func (s *InstanceServiceImpl) StopInstance(instanceId string) error {
 }
 
 func (s *InstanceServiceImpl) DeleteInstance(instanceId string) error {
+	operationId, err := s.startVmManagerOperation(VM_MANAGER_OPERATION_DELETE_INSTANCE, instanceId, "")
+	if err != nil {
+		return err
+	}
+
+	if err := s.deleteInstanceInVmManager(instanceId); err != nil {
+		s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_FAILED, err)
+		return err
+	}
+
+	err = s.db.DeleteInstance(instanceId)
+	if err != nil {
+		// The VM is already gone, the sync job deletes the record
+		s.recordVmManagerOperationError(operationId, err)
+		return fmt.Errorf("error deleting instance: %w", err)
+	}
+
+	s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_DONE, nil)
+	return nil
+}
+
+func (s *InstanceServiceImpl) deleteInstanceInVmManager(instanceId string) error {
 	req, err := http.NewRequest(
 		http.MethodDelete,
 		fmt.Sprintf("%s/instances/delete/%s", s.vmManagerBaseUrl, instanceId),
@@ -317,16 +460,8 @@ func (s *InstanceServiceImpl) DeleteInstance(instanceId string) error {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("VM manager API returned status code %d", resp.StatusCode)
-	}
-
-	err = s.db.DeleteInstance(instanceId)
-	if err != nil {
-		return fmt.Errorf("error deleting instance: %w", err)
-	}
-
-	return nil
+	_, err = s.waitForVmManagerJob(resp)
+	return err
 }
 
 func (s *InstanceServiceImpl) GetInstanceStatus() ([]InstanceStatus, error) {
@@ -467,34 +602,42 @@ func (s *InstanceServiceImpl) DefineTemplate(request DefineTemplateRequest) erro
 
 	log.Printf("Creating template from instance %s", request.SourceInstanceId)
 	// If it's not a base, proceed with the normal template definition process
+	operationId, err := s.startVmManagerOperation(VM_MANAGER_OPERATION_DEFINE_TEMPLATE, "", request.SubjectId)
+	if err != nil {
+		log.Printf("Error recording template definition: %v", err)
+		return err
+	}
+	request.IdempotencyKey = operationId
+
 	jsonData, err := json.Marshal(request)
 	if err != nil {
 		log.Printf("Error marshaling request: %v", err)
+		s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_FAILED, err)
 		return fmt.Errorf("error marshaling define template request: %w", err)
 	}
 
-	resp, err := http.Post(
-		fmt.Sprintf("%s/templates/define", s.vmManagerBaseUrl),
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
+	resp, err := s.postIdempotentVmManagerRequest(fmt.Sprintf("%s/templates/define", s.vmManagerBaseUrl), jsonData)
 	if err != nil {
 		log.Printf("Error calling VM manager API: %v", err)
+		s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_FAILED, err)
 		return fmt.Errorf("error calling VM manager API: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("VM manager API returned status code %d with body: %s", resp.StatusCode, string(body))
-		return fmt.Errorf("VM manager API returned status code %d", resp.StatusCode)
+	result, err := s.waitForVmManagerJob(resp)
+	if err != nil {
+		log.Printf("Error defining template in VM manager: %v", err)
+		s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_FAILED, err)
+		return err
 	}
 
 	var response DefineTemplateResponse
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+	if err := json.Unmarshal(result, &response); err != nil {
 		log.Printf("Error decoding response: %v", err)
+		s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_FAILED, err)
 		return fmt.Errorf("error decoding response: %w", err)
 	}
+	s.setVmManagerOperationVmId(operationId, response.TemplateId)
 
 	log.Printf("Creating template in database with ID %s", response.TemplateId)
 	err = s.db.CreateTemplate(
@@ -508,9 +651,11 @@ func (s *InstanceServiceImpl) DefineTemplate(request DefineTemplateRequest) erro
 	)
 	if err != nil {
 		log.Printf("Error creating template in database: %v", err)
+		go s.compensateVmManagerOperation(operationId, response.TemplateId, true, err)
 		return fmt.Errorf("error creating template: %w", err)
 	}
 
+	s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_DONE, nil)
 	log.Printf("Successfully created template")
 	return nil
 }
@@ -538,6 +683,30 @@ func (s *InstanceServiceImpl) DeleteTemplate(templateId string, subjectId string
 	}
 
 	// Si no es base, eliminar también en el VM manager
+	operationId, err := s.startVmManagerOperation(VM_MANAGER_OPERATION_DELETE_TEMPLATE, templateId, subjectId)
+	if err != nil {
+		log.Printf("[DeleteTemplate] Error recording template deletion: %v", err)
+		return err
+	}
+
+	if err := s.deleteTemplateInVmManager(templateId); err != nil {
+		log.Printf("[DeleteTemplate] Error deleting template in VM manager: %v", err)
+		s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_FAILED, err)
+		return err
+	}
+
+	err = s.db.DeleteTemplate(templateId, subjectId)
+	if err != nil {
+		log.Printf("[DeleteTemplate] Error deleting template in DB: %v", err)
+		s.recordVmManagerOperationError(operationId, err)
+		return fmt.Errorf("error deleting template: %w", err)
+	}
+	s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_DONE, nil)
+	log.Printf("[DeleteTemplate] Successfully deleted template %s from subject %s", templateId, subjectId)
+	return nil
+}
+
+func (s *InstanceServiceImpl) deleteTemplateInVmManager(templateId string) error {
 	req, err := http.NewRequest(
 		http.MethodDelete,
 		fmt.Sprintf("%s/templates/delete/%s", s.vmManagerBaseUrl, templateId),
@@ -557,19 +726,8 @@ func (s *InstanceServiceImpl) DeleteTemplate(templateId string, subjectId string
 	defer resp.Body.Close()
 
 	log.Printf("[DeleteTemplate] VM manager response status: %d", resp.StatusCode)
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("[DeleteTemplate] VM manager API returned status code %d with body: %s", resp.StatusCode, string(body))
-		return fmt.Errorf("VM manager API returned status code %d", resp.StatusCode)
-	}
-
-	err = s.db.DeleteTemplate(templateId, subjectId)
-	if err != nil {
-		log.Printf("[DeleteTemplate] Error deleting template in DB: %v", err)
-		return fmt.Errorf("error deleting template: %w", err)
-	}
-	log.Printf("[DeleteTemplate] Successfully deleted template %s from subject %s", templateId, subjectId)
-	return nil
+	_, err = s.waitForVmManagerJob(resp)
+	return err
 }
 
 func (s *InstanceServiceImpl) GetTemplatesBySubjectId(subjectId string) ([]Template, error) {
@@ -685,12 +843,90 @@ func (s *InstanceServiceImpl) GetWireguardConfig(instanceId string) (string, err
 	if err != nil {
 		return "", fmt.Errorf("error getting WireGuard config: %w", err)
 	}
+
+	conf.PrivateKey, err = s.keyEncryptor.Decrypt(conf.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	return renderWireguardConfig(conf), nil
+}
+
+// RotateWireguardKey replaces the key pair of the instance and returns the new config,
+// the old key stops working as soon as the gateway swaps the peer
+func (s *InstanceServiceImpl) RotateWireguardKey(instanceId string, request RotateWireguardKeyRequest) (string, error) {
+	wgPrivateKey, wgPublicKey, err := s.getWireguardKeyPair(request.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	jsonData, err := json.Marshal(RotateWireguardKeyRequest{PublicKey: wgPublicKey})
+	if err != nil {
+		return "", fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	resp, err := http.Post(
+		fmt.Sprintf("%s/instances/wireguard-key/rotate/%s", s.vmManagerBaseUrl, instanceId),
+		"application/json",
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		return "", fmt.Errorf("error calling VM manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return "", fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	if err := s.db.UpdateInstanceWireguardKeys(instanceId, wgPrivateKey, wgPublicKey); err != nil {
+		// The gateway already has the new key, rotating again issues a config that works
+		log.Printf("Error storing rotated WireGuard keys of instance %s: %v", instanceId, err)
+		return "", err
+	}
+
+	log.Printf("WireGuard key of instance %s rotated", instanceId)
+
+	return s.GetWireguardConfig(instanceId)
+}
+
+// getWireguardKeyPair returns the encrypted private key to store and the public key of a device.
+// If the public key was generated client-side there's no private key to store
+func (s *InstanceServiceImpl) getWireguardKeyPair(clientPublicKey string) (string, string, error) {
+	if clientPublicKey != "" {
+		if !isValidWireguardKey(clientPublicKey) {
+			return "", "", NewHttpError(http.StatusBadRequest, fmt.Errorf("invalid WireGuard public key"))
+		}
+		return "", clientPublicKey, nil
+	}
+
+	wgPrivateKey, wgPublicKey, err := GenerateKeyPair()
+	if err != nil {
+		return "", "", fmt.Errorf("error generating WireGuard key pair: %w", err)
+	}
+
+	encryptedPrivateKey, err := s.keyEncryptor.Encrypt(wgPrivateKey)
+	if err != nil {
+		return "", "", fmt.Errorf("error encrypting WireGuard private key: %w", err)
+	}
+
+	return encryptedPrivateKey, wgPublicKey, nil
+}
+
+// renderWireguardConfig renders the config file of a device, every device of an instance has its own.
+// Devices with client-side keys get a placeholder for the private key they keep
+func renderWireguardConfig(conf wireguardConfig) string {
 	var endpoint = os.Getenv("ENDPOINT_URL")
 	// Join the AllowedIPs with commas and spaces
 	allowedIPs := strings.Join(conf.PeerAllowedIps, ", ")
-	wgConfig := fmt.Sprintf("[Interface]\nPrivateKey = %s\nAddress = %s\n\n[Peer]\nPublicKey = %s\nAllowedIPs = %s\nEndpoint = %s:%d",
-		conf.PrivateKey, conf.InterfaceIp, conf.PeerPublicKey, allowedIPs, endpoint, conf.PeerPort)
-	return wgConfig, nil
+	privateKey := conf.PrivateKey
+	if privateKey == "" {
+		privateKey = "<private key generated on your device>"
+	}
+	return fmt.Sprintf("[Interface]\nPrivateKey = %s\nAddress = %s\n\n[Peer]\nPublicKey = %s\nAllowedIPs = %s\nEndpoint = %s:%d",
+		privateKey, conf.InterfaceIp, conf.PeerPublicKey, allowedIPs, endpoint, conf.PeerPort)
 }
 
 func GenerateKeyPair() (string, string, error) {
@@ -716,6 +952,12 @@ func GenerateKeyPair() (string, string, error) {
 	return privB64, pubB64, nil
 }
 
+// isValidWireguardKey checks that a key is 32 bytes encoded in base64, as WireGuard keys are
+func isValidWireguardKey(key string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(decoded) == 32
+}
+
 func (s *InstanceServiceImpl) GetServerStatus() ([]ServerStatus, error) {
 
 	log.Printf("Fetching server status from VM manager at %s/servers/status", s.vmManagerBaseUrl)
@@ -769,3 +1011,334 @@ func (s *InstanceServiceImpl) GetServerStatus() ([]ServerStatus, error) {
 		}) */
 	return status, nil
 }
+
+func (s *InstanceServiceImpl) CreateSnapshot(request CreateSnapshotFrontendRequest) (CreateSnapshotFrontendResponse, error) {
+	log.Printf("Creating snapshot of instance %s for user %s", request.InstanceId, request.UserId)
+
+	info, err := s.db.GetInstanceInfo(request.InstanceId)
+	if err != nil {
+		return CreateSnapshotFrontendResponse{}, NewHttpError(http.StatusNotFound, fmt.Errorf("instance %s not found", request.InstanceId))
+	}
+
+	if info.UserId != request.UserId {
+		return CreateSnapshotFrontendResponse{}, NewHttpError(http.StatusForbidden, fmt.Errorf("instance %s does not belong to user %s", request.InstanceId, request.UserId))
+	}
+
+	// Every instance can keep up to the snapshot quota of its subject
+	quota, err := s.db.GetSubjectSnapshotQuota(info.SubjectId)
+	if err != nil {
+		return CreateSnapshotFrontendResponse{}, err
+	}
+
+	snapshots, err := s.db.GetSnapshotsByInstanceId(request.InstanceId)
+	if err != nil {
+		return CreateSnapshotFrontendResponse{}, err
+	}
+
+	if len(snapshots) >= quota {
+		return CreateSnapshotFrontendResponse{}, NewHttpError(http.StatusBadRequest, fmt.Errorf("snapshot quota of %d reached, delete a snapshot first", quota))
+	}
+
+	resp, err := http.Post(
+		fmt.Sprintf("%s/instances/snapshots/create/%s", s.vmManagerBaseUrl, request.InstanceId),
+		"application/json",
+		nil,
+	)
+	if err != nil {
+		log.Printf("Error calling VM manager: %v", err)
+		return CreateSnapshotFrontendResponse{}, fmt.Errorf("error calling VM manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return CreateSnapshotFrontendResponse{}, fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var response vmManagerSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		log.Printf("Error decoding VM manager response: %v", err)
+		return CreateSnapshotFrontendResponse{}, fmt.Errorf("error decoding VM manager response: %w", err)
+	}
+
+	if err := s.db.CreateSnapshot(response.SnapshotId, request.InstanceId, request.UserId, request.Description); err != nil {
+		log.Printf("Error creating snapshot record in database: %v", err)
+		return CreateSnapshotFrontendResponse{}, fmt.Errorf("error creating snapshot record: %w", err)
+	}
+
+	log.Printf("Snapshot %s of instance %s created successfully", response.SnapshotId, request.InstanceId)
+
+	return CreateSnapshotFrontendResponse{SnapshotId: response.SnapshotId}, nil
+}
+
+func (s *InstanceServiceImpl) ListSnapshots(instanceId string) ([]Snapshot, error) {
+	snapshots, err := s.db.GetSnapshotsByInstanceId(instanceId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting snapshots: %w", err)
+	}
+
+	var result []Snapshot
+	for _, snapshot := range snapshots {
+		result = append(result, Snapshot{
+			Id:          snapshot.ID,
+			InstanceId:  snapshot.InstanceId,
+			UserId:      snapshot.UserId,
+			Description: snapshot.Description,
+			CreatedAt:   snapshot.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	return result, nil
+}
+
+func (s *InstanceServiceImpl) RevertSnapshot(instanceId string, snapshotId string) error {
+	if err := s.checkIfSnapshotBelongsToInstance(instanceId, snapshotId); err != nil {
+		return err
+	}
+
+	resp, err := http.Post(
+		fmt.Sprintf("%s/instances/snapshots/revert/%s/%s", s.vmManagerBaseUrl, instanceId, snapshotId),
+		"application/json",
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	log.Printf("Instance %s reverted to snapshot %s", instanceId, snapshotId)
+	return nil
+}
+
+func (s *InstanceServiceImpl) DeleteSnapshot(instanceId string, snapshotId string) error {
+	if err := s.checkIfSnapshotBelongsToInstance(instanceId, snapshotId); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(
+		http.MethodDelete,
+		fmt.Sprintf("%s/instances/snapshots/delete/%s/%s", s.vmManagerBaseUrl, instanceId, snapshotId),
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager API: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// If the snapshot is already gone from the disk image we still want to forget about it
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	if err := s.db.DeleteSnapshot(snapshotId); err != nil {
+		return fmt.Errorf("error deleting snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func (s *InstanceServiceImpl) CreateConsoleTicket(request CreateConsoleTicketFrontendRequest) (CreateConsoleTicketFrontendResponse, error) {
+	info, err := s.db.GetInstanceInfo(request.InstanceId)
+	if err != nil {
+		return CreateConsoleTicketFrontendResponse{}, NewHttpError(http.StatusNotFound, fmt.Errorf("instance %s not found", request.InstanceId))
+	}
+
+	if info.UserId != request.UserId {
+		return CreateConsoleTicketFrontendResponse{}, NewHttpError(http.StatusForbidden, fmt.Errorf("instance %s does not belong to user %s", request.InstanceId, request.UserId))
+	}
+
+	resp, err := http.Post(
+		fmt.Sprintf("%s/instances/console/tickets/%s", s.vmManagerBaseUrl, request.InstanceId),
+		"application/json",
+		nil,
+	)
+	if err != nil {
+		log.Printf("Error calling VM manager: %v", err)
+		return CreateConsoleTicketFrontendResponse{}, fmt.Errorf("error calling VM manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return CreateConsoleTicketFrontendResponse{}, fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var response vmManagerConsoleTicket
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		log.Printf("Error decoding VM manager response: %v", err)
+		return CreateConsoleTicketFrontendResponse{}, fmt.Errorf("error decoding VM manager response: %w", err)
+	}
+
+	s.ticketsMutex.Lock()
+	defer s.ticketsMutex.Unlock()
+
+	// Forget the tickets that were never used
+	for ticket, consoleTicket := range s.consoleTickets {
+		if time.Now().After(consoleTicket.ExpiresAt) {
+			delete(s.consoleTickets, ticket)
+		}
+	}
+
+	ticket := uuid.New().String()
+	expiresAt := time.Now().Add(CONSOLE_TICKET_TTL)
+	s.consoleTickets[ticket] = ConsoleTicket{
+		UserId:          request.UserId,
+		InstanceId:      request.InstanceId,
+		VmManagerTicket: response.Ticket,
+		ExpiresAt:       expiresAt,
+	}
+
+	log.Printf("Console ticket issued for instance %s to user %s", request.InstanceId, request.UserId)
+
+	return CreateConsoleTicketFrontendResponse{
+		Ticket:    ticket,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (s *InstanceServiceImpl) OpenConsole(ticket string) (*websocket.Conn, error) {
+	s.ticketsMutex.Lock()
+	consoleTicket, ok := s.consoleTickets[ticket]
+	// Tickets can only be used once
+	delete(s.consoleTickets, ticket)
+	s.ticketsMutex.Unlock()
+
+	if !ok || time.Now().After(consoleTicket.ExpiresAt) {
+		return nil, NewHttpError(http.StatusUnauthorized, fmt.Errorf("invalid or expired console ticket"))
+	}
+
+	conn, resp, err := consoleDialer.Dial(
+		fmt.Sprintf("%s/instances/console/%s", toWebSocketUrl(s.vmManagerBaseUrl), consoleTicket.VmManagerTicket),
+		nil,
+	)
+	if err != nil {
+		if resp != nil {
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+			return nil, fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		}
+		log.Printf("Error opening console in VM manager: %v", err)
+		return nil, fmt.Errorf("error opening console in VM manager: %w", err)
+	}
+
+	log.Printf("User %s opened the console of instance %s", consoleTicket.UserId, consoleTicket.InstanceId)
+
+	return conn, nil
+}
+
+func (s *InstanceServiceImpl) checkIfSnapshotBelongsToInstance(instanceId string, snapshotId string) error {
+	snapshots, err := s.db.GetSnapshotsByInstanceId(instanceId)
+	if err != nil {
+		return fmt.Errorf("error getting snapshots: %w", err)
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.ID == snapshotId {
+			return nil
+		}
+	}
+
+	return NewHttpError(http.StatusNotFound, fmt.Errorf("snapshot %s not found for instance %s", snapshotId, instanceId))
+}
+
+// postIdempotentVmManagerRequest sends the request again when the connection to the VM manager fails or times out,
+// the idempotency key of the request makes the VM manager return the job of the first one instead of starting another
+func (s *InstanceServiceImpl) postIdempotentVmManagerRequest(url string, jsonData []byte) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	for attempt := 1; attempt <= IDEMPOTENT_VM_MANAGER_REQUEST_ATTEMPTS; attempt++ {
+		resp, err = http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+		if err == nil {
+			return resp, nil
+		}
+
+		log.Printf("Error calling VM manager at %s (attempt %d): %v", url, attempt, err)
+		if attempt < IDEMPOTENT_VM_MANAGER_REQUEST_ATTEMPTS {
+			time.Sleep(IDEMPOTENT_VM_MANAGER_REQUEST_RETRY_WAIT)
+		}
+	}
+
+	return nil, err
+}
+
+// waitForVmManagerJob takes the response of a request that started a job in the VM manager
+// and polls the job until it finishes, returning the job result when it succeeds
+func (s *InstanceServiceImpl) waitForVmManagerJob(resp *http.Response) (json.RawMessage, error) {
+	if resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var job vmManagerJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		log.Printf("Error decoding VM manager job: %v", err)
+		return nil, fmt.Errorf("error decoding VM manager job: %w", err)
+	}
+
+	log.Printf("Waiting for VM manager job %s", job.JobId)
+	deadline := time.Now().Add(VM_MANAGER_JOB_TIMEOUT)
+	for time.Now().Before(deadline) {
+		time.Sleep(VM_MANAGER_JOB_POLL_INTERVAL)
+
+		current, err := s.getVmManagerJob(job.JobId)
+		if err != nil {
+			// The VM manager might be restarting, keep polling until the deadline
+			log.Printf("Error getting VM manager job %s: %v", job.JobId, err)
+			continue
+		}
+
+		switch current.Status {
+		case "succeeded":
+			log.Printf("VM manager job %s succeeded", job.JobId)
+			return current.Result, nil
+		case "failed":
+			errorMessage := "unknown error"
+			if current.Error != nil {
+				errorMessage = *current.Error
+			}
+			log.Printf("VM manager job %s failed: %s", job.JobId, errorMessage)
+			return nil, fmt.Errorf("VM manager job %s failed: %s", job.JobId, errorMessage)
+		default:
+			log.Printf("VM manager job %s is %s: %s", job.JobId, current.Status, current.Step)
+		}
+	}
+
+	return nil, fmt.Errorf("timed out waiting for VM manager job %s", job.JobId)
+}
+
+func (s *InstanceServiceImpl) getVmManagerJob(jobId string) (vmManagerJob, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/jobs/%s", s.vmManagerBaseUrl, jobId))
+	if err != nil {
+		return vmManagerJob{}, fmt.Errorf("error calling VM manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return vmManagerJob{}, fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var job vmManagerJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return vmManagerJob{}, fmt.Errorf("error decoding VM manager job: %w", err)
+	}
+
+	return job, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Encrypted private keys are stored as the prefix followed by the nonce and the ciphertext in base64,
+// the version allows changing the scheme without losing the keys stored with the previous one
+const ENCRYPTED_KEY_PREFIX = "enc:v1:"
+
+// KeyEncryptor protects the WireGuard private keys stored in the database with a key-encryption key
+type KeyEncryptor interface {
+	Encrypt(privateKey string) (string, error)
+	Decrypt(storedKey string) (string, error)
+	IsEnabled() bool
+}
+
+type KeyEncryptorImpl struct {
+	aead cipher.AEAD
+}
+
+// NewKeyEncryptor reads the key-encryption key from WIREGUARD_KEY_ENCRYPTION_KEY, 32 bytes in base64 for AES-256-GCM.
+// Without it the keys are stored in plaintext
+func NewKeyEncryptor() (KeyEncryptor, error) {
+	encodedKey := os.Getenv("WIREGUARD_KEY_ENCRYPTION_KEY")
+	if encodedKey == "" {
+		log.Printf("WIREGUARD_KEY_ENCRYPTION_KEY is not set, WireGuard private keys will be stored in plaintext")
+		return &KeyEncryptorImpl{}, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("WIREGUARD_KEY_ENCRYPTION_KEY must be 32 bytes encoded in base64")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating key cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating key cipher: %w", err)
+	}
+
+	return &KeyEncryptorImpl{aead: aead}, nil
+}
+
+func (k *KeyEncryptorImpl) IsEnabled() bool {
+	return k.aead != nil
+}
+
+// Encrypt leaves empty keys as they are, devices with client-side keys have no private key stored
+func (k *KeyEncryptorImpl) Encrypt(privateKey string) (string, error) {
+	if !k.IsEnabled() || privateKey == "" {
+		return privateKey, nil
+	}
+
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("error generating nonce: %w", err)
+	}
+
+	sealed := k.aead.Seal(nonce, nonce, []byte(privateKey), nil)
+
+	return ENCRYPTED_KEY_PREFIX + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the keys stored in plaintext as they are
+func (k *KeyEncryptorImpl) Decrypt(storedKey string) (string, error) {
+	if !strings.HasPrefix(storedKey, ENCRYPTED_KEY_PREFIX) {
+		return storedKey, nil
+	}
+
+	if !k.IsEnabled() {
+		return "", fmt.Errorf("WireGuard private key is encrypted but WIREGUARD_KEY_ENCRYPTION_KEY is not set")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(storedKey, ENCRYPTED_KEY_PREFIX))
+	if err != nil || len(sealed) < k.aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted WireGuard private key")
+	}
+
+	nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+	privateKey, err := k.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting WireGuard private key: %w", err)
+	}
+
+	return string(privateKey), nil
+}
+
+// EncryptStoredWireguardKeys encrypts the private keys stored before the key-encryption key was configured
+func EncryptStoredWireguardKeys(db Database, keyEncryptor KeyEncryptor) error {
+	if !keyEncryptor.IsEnabled() {
+		return nil
+	}
+
+	storedKeys, err := db.GetPlaintextWireguardKeys(ENCRYPTED_KEY_PREFIX)
+	if err != nil {
+		return err
+	}
+
+	for _, storedKey := range storedKeys {
+		encryptedKey, err := keyEncryptor.Encrypt(storedKey.PrivateKey)
+		if err != nil {
+			return err
+		}
+
+		if err := db.UpdateWireguardPrivateKey(storedKey, encryptedKey); err != nil {
+			return err
+		}
+	}
+
+	if len(storedKeys) > 0 {
+		log.Printf("Encrypted %d stored WireGuard private keys", len(storedKeys))
+	}
+
+	return nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+type CreateLabRequest struct {
+	SubjectId       string           `json:"subjectId"`
+	SubjectIsolated bool             `json:"subjectIsolated,omitempty"`
+	OwnerId         string           `json:"ownerId,omitempty"`
+	Username        string           `json:"username"`
+	Password        string           `json:"password"`
+	PublicSshKeys   []string         `json:"publicSshKeys"`
+	Networks        []string         `json:"networks"`
+	Nodes           []LabNodeRequest `json:"nodes"`
+}
+
+type LabNodeRequest struct {
+	Name         string                 `json:"name"`
+	SourceVmId   string                 `json:"sourceVmId"`
+	SizeMB       int                    `json:"sizeMB"`
+	VcpuCount    int                    `json:"vcpuCount"`
+	VramMB       int                    `json:"vramMB"`
+	UserWgPubKey string                 `json:"userWgPubKey"`
+	Interfaces   []LabTopologyInterface `json:"interfaces"`
+}
+
+type CreateLabResponse struct {
+	LabId     string                 `json:"labId"`
+	Instances []vmManagerLabInstance `json:"instances"`
+}
+
+type vmManagerLabInstance struct {
+	Name string `json:"name"`
+	CreateInstanceResponse
+}
+
+func (s *InstanceServiceImpl) CreateLabTopology(request CreateLabTopologyRequest) (CreateLabTopologyResponse, error) {
+	if request.Name == "" || len(request.Definition.Nodes) == 0 {
+		return CreateLabTopologyResponse{}, NewHttpError(http.StatusBadRequest, fmt.Errorf("a lab topology needs a name and nodes"))
+	}
+
+	// The VM manager checks the rest of the topology when it's instantiated
+	for _, node := range request.Definition.Nodes {
+		if node.Name == "" || node.SourceVmId == "" {
+			return CreateLabTopologyResponse{}, NewHttpError(http.StatusBadRequest, fmt.Errorf("every node needs a name and a source VM"))
+		}
+	}
+
+	if err := s.db.SubjectExistsById(request.SubjectId); err != nil {
+		return CreateLabTopologyResponse{}, err
+	}
+
+	topology := LabTopologyDb{
+		ID:         uuid.New().String(),
+		SubjectId:  request.SubjectId,
+		Name:       request.Name,
+		Definition: request.Definition,
+	}
+	if err := s.db.CreateLabTopology(topology); err != nil {
+		return CreateLabTopologyResponse{}, err
+	}
+
+	return CreateLabTopologyResponse{TopologyId: topology.ID}, nil
+}
+
+func (s *InstanceServiceImpl) GetLabTopology(topologyId string) (LabTopologyResponse, error) {
+	topology, err := s.db.GetLabTopology(topologyId)
+	if err != nil {
+		return LabTopologyResponse{}, err
+	}
+
+	return topology.toLabTopologyResponse(), nil
+}
+
+func (s *InstanceServiceImpl) GetLabTopologiesBySubjectId(subjectId string) ([]LabTopologyResponse, error) {
+	topologies, err := s.db.GetLabTopologiesBySubjectId(subjectId)
+	if err != nil {
+		return nil, err
+	}
+
+	response := []LabTopologyResponse{}
+	for _, topology := range topologies {
+		response = append(response, topology.toLabTopologyResponse())
+	}
+
+	return response, nil
+}
+
+func (s *InstanceServiceImpl) DeleteLabTopology(topologyId string) error {
+	return s.db.DeleteLabTopology(topologyId)
+}
+
+func (s *InstanceServiceImpl) CreateLab(request CreateLabFrontendRequest) (LabResponse, error) {
+	log.Printf("Starting lab creation process for user %s and topology %s", request.UserId, request.TopologyId)
+
+	topology, err := s.db.GetLabTopology(request.TopologyId)
+	if err != nil {
+		return LabResponse{}, err
+	}
+
+	subject, err := s.db.GetSubjectById(topology.SubjectId)
+	if err != nil {
+		return LabResponse{}, fmt.Errorf("error fetching subject: %w", err)
+	}
+
+	bases, err := s.Bases()
+	if err != nil {
+		return LabResponse{}, fmt.Errorf("error checking if sources are bases: %w", err)
+	}
+
+	hashedPassword, err := HashPassword(request.Password)
+	if err != nil {
+		return LabResponse{}, fmt.Errorf("error hashing password: %w", err)
+	}
+
+	createLabRequest := CreateLabRequest{
+		SubjectId:       topology.SubjectId,
+		SubjectIsolated: subject.Isolated,
+		OwnerId:         request.UserId,
+		Username:        request.Username,
+		Password:        hashedPassword,
+		PublicSshKeys:   request.PublicSshKeys,
+		Networks:        topology.Definition.Networks,
+	}
+
+	// Every node is a VM with its own WireGuard peer
+	wgPrivateKeys := map[string]string{}
+	wgPublicKeys := map[string]string{}
+	templateIds := map[string]*string{}
+	for _, node := range topology.Definition.Nodes {
+		isBase := slices.ContainsFunc(bases, func(base Base) bool { return base.Id == node.SourceVmId })
+
+		templateConfig := TemplateConfig{SizeMB: node.SizeMB, VcpuCount: node.VcpuCount, VramMB: node.VramMB}
+		if !isBase {
+			templateConfig, err = s.db.GetTemplateConfig(node.SourceVmId, topology.SubjectId)
+			if err != nil {
+				return LabResponse{}, fmt.Errorf("error fetching template config of node %s: %w", node.Name, err)
+			}
+			templateId := node.SourceVmId
+			templateIds[node.Name] = &templateId
+		}
+
+		wgPrivateKey, wgPublicKey, err := s.getWireguardKeyPair("")
+		if err != nil {
+			return LabResponse{}, err
+		}
+		wgPrivateKeys[node.Name] = wgPrivateKey
+		wgPublicKeys[node.Name] = wgPublicKey
+
+		createLabRequest.Nodes = append(createLabRequest.Nodes, LabNodeRequest{
+			Name:         node.Name,
+			SourceVmId:   node.SourceVmId,
+			SizeMB:       templateConfig.SizeMB,
+			VcpuCount:    templateConfig.VcpuCount,
+			VramMB:       templateConfig.VramMB,
+			UserWgPubKey: wgPublicKey,
+			Interfaces:   node.Interfaces,
+		})
+	}
+
+	jsonData, err := json.Marshal(createLabRequest)
+	if err != nil {
+		return LabResponse{}, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	resp, err := http.Post(
+		fmt.Sprintf("%s/labs/create", s.vmManagerBaseUrl),
+		"application/json",
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		return LabResponse{}, fmt.Errorf("error calling VM manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	result, err := s.waitForVmManagerJob(resp)
+	if err != nil {
+		log.Printf("Error creating lab in VM manager: %v", err)
+		return LabResponse{}, err
+	}
+
+	var response CreateLabResponse
+	if err := json.Unmarshal(result, &response); err != nil {
+		return LabResponse{}, fmt.Errorf("error decoding VM manager response: %w", err)
+	}
+
+	if err := s.db.CreateLab(response.LabId, topology.ID, request.UserId, topology.SubjectId); err != nil {
+		return LabResponse{}, err
+	}
+
+	labResponse := LabResponse{
+		ID:           response.LabId,
+		TopologyId:   topology.ID,
+		TopologyName: topology.Name,
+		UserId:       request.UserId,
+		SubjectId:    topology.SubjectId,
+		Instances:    []LabInstanceResponse{},
+	}
+
+	for _, instance := range response.Instances {
+		err := s.db.CreateInstance(instance.InstanceId, request.UserId, topology.SubjectId, templateIds[instance.Name], wgPrivateKeys[instance.Name], wgPublicKeys[instance.Name], instance.InterfaceAddress, instance.PeerPublicKey, instance.PeerAllowedIps, instance.PeerEndpointPort)
+		if err != nil {
+			return LabResponse{}, fmt.Errorf("error creating instance record: %w", err)
+		}
+
+		if err := s.db.SetInstanceLab(instance.InstanceId, response.LabId, instance.Name); err != nil {
+			return LabResponse{}, err
+		}
+
+		labResponse.Instances = append(labResponse.Instances, LabInstanceResponse{
+			InstanceId: instance.InstanceId,
+			NodeName:   instance.Name,
+		})
+	}
+
+	log.Printf("Lab %s created successfully", response.LabId)
+
+	return labResponse, nil
+}
+
+func (s *InstanceServiceImpl) GetLabsByUserId(userId string) ([]LabResponse, error) {
+	labs, err := s.db.GetLabsByUserId(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	response := []LabResponse{}
+	for _, lab := range labs {
+		labResponse, err := s.toLabResponse(lab)
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, labResponse)
+	}
+
+	return response, nil
+}
+
+func (s *InstanceServiceImpl) StartLab(labId string) error {
+	resp, err := http.Post(
+		fmt.Sprintf("%s/labs/start/%s", s.vmManagerBaseUrl, labId),
+		"application/json",
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("VM manager returned status code %d", resp.StatusCode)
+	}
+
+	instances, err := s.db.GetLabInstances(labId)
+	if err != nil {
+		return err
+	}
+
+	// Every instance of the lab gets its session, like standalone instances
+	for _, instance := range instances {
+		if err := s.sessionManager.StartSession(instance.InstanceId); err != nil {
+			log.Printf("Error starting session: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *InstanceServiceImpl) StopLab(labId string) error {
+	instances, err := s.db.GetLabInstances(labId)
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		if err := s.sessionManager.StopSession(instance.InstanceId); err != nil {
+			log.Printf("Error stopping session: %v", err)
+		}
+	}
+
+	resp, err := http.Post(
+		fmt.Sprintf("%s/labs/stop/%s", s.vmManagerBaseUrl, labId),
+		"application/json",
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := s.waitForVmManagerJob(resp); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *InstanceServiceImpl) DeleteLab(labId string) error {
+	req, err := http.NewRequest(
+		http.MethodDelete,
+		fmt.Sprintf("%s/labs/delete/%s", s.vmManagerBaseUrl, labId),
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager API: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := s.waitForVmManagerJob(resp); err != nil {
+		return err
+	}
+
+	return s.db.DeleteLab(labId)
+}
+
+func (s *InstanceServiceImpl) toLabResponse(lab LabDb) (LabResponse, error) {
+	instances, err := s.db.GetLabInstances(lab.ID)
+	if err != nil {
+		return LabResponse{}, err
+	}
+
+	response := LabResponse{
+		ID:           lab.ID,
+		TopologyId:   lab.TopologyId,
+		TopologyName: lab.TopologyName,
+		UserId:       lab.UserId,
+		SubjectId:    lab.SubjectId,
+		CreatedAt:    lab.CreatedAt,
+		Instances:    []LabInstanceResponse{},
+	}
+	for _, instance := range instances {
+		response.Instances = append(response.Instances, LabInstanceResponse{
+			InstanceId: instance.InstanceId,
+			NodeName:   instance.NodeName,
+		})
+	}
+
+	return response, nil
+}
+
+func (topology *LabTopologyDb) toLabTopologyResponse() LabTopologyResponse {
+	return LabTopologyResponse{
+		ID:         topology.ID,
+		SubjectId:  topology.SubjectId,
+		Name:       topology.Name,
+		Definition: topology.Definition,
+		CreatedAt:  topology.CreatedAt,
+	}
+}
@@ -20,10 +20,18 @@ func main() {
 	defer db.Close()
 	vmManagerBaseUrl := os.Getenv("VM_MANAGER_BASE_URL")
 	frontendUrl := os.Getenv("FRONTEND_URL")
+	keyEncryptor, err := NewKeyEncryptor()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := EncryptStoredWireguardKeys(db, keyEncryptor); err != nil {
+		log.Fatal(err)
+	}
 	emailService := NewEmailService()
 	userService := NewUserService(db)
-	instanceService := NewInstanceService(db, vmManagerBaseUrl, emailService)
+	instanceService := NewInstanceService(db, vmManagerBaseUrl, emailService, keyEncryptor)
 	subjectService := NewSubjectService(db, instanceService)
+	authService := NewAuthService(db)
 
 	listenAddr := getListenAddr()
 	server := NewApiServer(
@@ -32,6 +40,7 @@ func main() {
 		subjectService,
 		emailService,
 		instanceService,
+		authService,
 		frontendUrl,
 	)
 
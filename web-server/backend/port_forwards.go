@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	PORT_FORWARD_STATUS_PENDING  = "pending"
+	PORT_FORWARD_STATUS_APPROVED = "approved"
+	PORT_FORWARD_STATUS_REJECTED = "rejected"
+	PORT_FORWARD_STATUS_EXPIRED  = "expired"
+)
+
+// Forwards are meant for showing projects for a while, not for hosting them
+const PORT_FORWARD_MAX_DURATION_HOURS = 24 * 30
+
+func (s *InstanceServiceImpl) RequestPortForward(request RequestPortForwardRequest) (RequestPortForwardResponse, error) {
+	if (request.Protocol != "tcp" && request.Protocol != "udp") ||
+		request.InternalPort <= 0 ||
+		request.InternalPort > 65535 ||
+		request.DurationHours <= 0 ||
+		request.DurationHours > PORT_FORWARD_MAX_DURATION_HOURS {
+		return RequestPortForwardResponse{}, NewHttpError(
+			http.StatusBadRequest,
+			fmt.Errorf(
+				"protocol must be tcp or udp, internalPort a valid port and durationHours between 1 and %d",
+				PORT_FORWARD_MAX_DURATION_HOURS,
+			),
+		)
+	}
+
+	if _, err := s.db.GetInstanceInfo(request.InstanceId); err != nil {
+		return RequestPortForwardResponse{}, NewHttpError(http.StatusNotFound, fmt.Errorf("instance %s not found", request.InstanceId))
+	}
+
+	requestId := uuid.New().String()
+	if err := s.db.CreatePortForwardRequest(PortForwardRequestDb{
+		ID:            requestId,
+		InstanceId:    request.InstanceId,
+		UserId:        request.UserId,
+		Protocol:      request.Protocol,
+		InternalPort:  request.InternalPort,
+		DurationHours: request.DurationHours,
+		Reason:        request.Reason,
+	}); err != nil {
+		return RequestPortForwardResponse{}, err
+	}
+
+	log.Printf("Port forward request %s created for port %s/%d of instance %s", requestId, request.Protocol, request.InternalPort, request.InstanceId)
+
+	return RequestPortForwardResponse{RequestId: requestId}, nil
+}
+
+func (s *InstanceServiceImpl) GetPortForwardRequest(requestId string) (PortForwardRequestResponse, error) {
+	request, err := s.db.GetPortForwardRequest(requestId)
+	if err != nil {
+		return PortForwardRequestResponse{}, err
+	}
+
+	return toPortForwardRequestResponse(request), nil
+}
+
+func (s *InstanceServiceImpl) GetPortForwardRequestsByInstanceId(instanceId string) ([]PortForwardRequestResponse, error) {
+	requests, err := s.db.GetPortForwardRequestsByInstanceId(instanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	return toPortForwardRequestResponses(requests), nil
+}
+
+func (s *InstanceServiceImpl) GetPortForwardRequestsBySubjectId(subjectId string) ([]PortForwardRequestResponse, error) {
+	requests, err := s.db.GetPortForwardRequestsBySubjectId(subjectId)
+	if err != nil {
+		return nil, err
+	}
+
+	return toPortForwardRequestResponses(requests), nil
+}
+
+// ApprovePortForwardRequest forwards the port in the VM manager until the requested duration elapses
+func (s *InstanceServiceImpl) ApprovePortForwardRequest(requestId string) (PortForwardRequestResponse, error) {
+	request, err := s.db.GetPortForwardRequest(requestId)
+	if err != nil {
+		return PortForwardRequestResponse{}, err
+	}
+
+	if request.Status != PORT_FORWARD_STATUS_PENDING {
+		return PortForwardRequestResponse{}, NewHttpError(http.StatusConflict, fmt.Errorf("port forward request %s is already %s", requestId, request.Status))
+	}
+
+	// Timestamps are stored without time zone, in UTC
+	expiresAt := time.Now().UTC().Add(time.Duration(request.DurationHours) * time.Hour)
+
+	jsonData, err := json.Marshal(CreatePortForwardRequest{
+		InstanceId:   request.InstanceId,
+		Protocol:     request.Protocol,
+		InternalPort: request.InternalPort,
+		ExpiresAt:    &expiresAt,
+	})
+	if err != nil {
+		return PortForwardRequestResponse{}, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	resp, err := http.Post(
+		fmt.Sprintf("%s/port-forwards/create", s.vmManagerBaseUrl),
+		"application/json",
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		return PortForwardRequestResponse{}, fmt.Errorf("error calling VM manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return PortForwardRequestResponse{}, fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var response CreatePortForwardResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return PortForwardRequestResponse{}, fmt.Errorf("error decoding VM manager response: %w", err)
+	}
+
+	approved, err := s.db.ApprovePortForwardRequest(requestId, response.PortForwardId, response.ExternalPort, expiresAt)
+	if err != nil || !approved {
+		// The request was decided in the meantime or couldn't be updated, nothing would track the forward
+		if deleteErr := s.deletePortForward(response.PortForwardId); deleteErr != nil {
+			log.Printf("Error deleting port forward %s: %v", response.PortForwardId, deleteErr)
+		}
+
+		if err != nil {
+			return PortForwardRequestResponse{}, err
+		}
+		return PortForwardRequestResponse{}, NewHttpError(http.StatusConflict, fmt.Errorf("port forward request %s is no longer pending", requestId))
+	}
+
+	log.Printf("Port forward request %s approved, external port %d until %s", requestId, response.ExternalPort, expiresAt)
+
+	return s.GetPortForwardRequest(requestId)
+}
+
+func (s *InstanceServiceImpl) RejectPortForwardRequest(requestId string) error {
+	rejected, err := s.db.RejectPortForwardRequest(requestId)
+	if err != nil {
+		return err
+	}
+
+	if !rejected {
+		return NewHttpError(http.StatusConflict, fmt.Errorf("port forward request %s is not pending", requestId))
+	}
+
+	log.Printf("Port forward request %s rejected", requestId)
+
+	return nil
+}
+
+// DeletePortForwardRequest closes the forward of the request, if any, before deleting it
+func (s *InstanceServiceImpl) DeletePortForwardRequest(requestId string) error {
+	request, err := s.db.GetPortForwardRequest(requestId)
+	if err != nil {
+		return err
+	}
+
+	if request.PortForwardId != nil {
+		if err := s.deletePortForward(*request.PortForwardId); err != nil {
+			return err
+		}
+	}
+
+	return s.db.DeletePortForwardRequest(requestId)
+}
+
+// deletePortForward deletes the forward in the VM manager, it's already gone once it expires
+func (s *InstanceServiceImpl) deletePortForward(portForwardId string) error {
+	req, err := http.NewRequest(
+		http.MethodDelete,
+		fmt.Sprintf("%s/port-forwards/delete/%s", s.vmManagerBaseUrl, portForwardId),
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager API: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+func toPortForwardRequestResponses(requests []PortForwardRequestDb) []PortForwardRequestResponse {
+	responses := []PortForwardRequestResponse{}
+	for _, request := range requests {
+		responses = append(responses, toPortForwardRequestResponse(request))
+	}
+
+	return responses
+}
+
+// toPortForwardRequestResponse reports approved requests whose forward elapsed as expired, the VM manager already removed it
+func toPortForwardRequestResponse(request PortForwardRequestDb) PortForwardRequestResponse {
+	response := PortForwardRequestResponse{
+		Id:            request.ID,
+		InstanceId:    request.InstanceId,
+		SubjectId:     request.SubjectId,
+		UserId:        request.UserId,
+		UserMail:      request.UserMail,
+		Protocol:      request.Protocol,
+		InternalPort:  request.InternalPort,
+		DurationHours: request.DurationHours,
+		Reason:        request.Reason,
+		Status:        request.Status,
+		ExpiresAt:     request.ExpiresAt,
+		CreatedAt:     request.CreatedAt,
+		DecidedAt:     request.DecidedAt,
+	}
+
+	if request.Status == PORT_FORWARD_STATUS_APPROVED && request.ExpiresAt != nil && request.ExternalPort != nil {
+		if !request.ExpiresAt.After(time.Now()) {
+			response.Status = PORT_FORWARD_STATUS_EXPIRED
+		} else {
+			publicAddress := fmt.Sprintf("%s:%d", os.Getenv("ENDPOINT_URL"), *request.ExternalPort)
+			response.PublicAddress = &publicAddress
+		}
+	}
+
+	return response
+}
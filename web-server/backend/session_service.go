@@ -144,7 +144,8 @@ func (s *SessionManagerImpl) monitorSessions() {
 						}
 						defer resp.Body.Close()
 
-						if resp.StatusCode != http.StatusOK {
+						// The VM manager answers with the ID of the job that stops the instance
+						if resp.StatusCode != http.StatusAccepted {
 							log.Printf("[SessionMonitor] VM manager returned error status %d", resp.StatusCode)
 							continue
 						}
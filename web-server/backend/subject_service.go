@@ -15,6 +15,7 @@ type SubjectService interface {
 	RemoveUserFromSubject(userEmail, subjectId string) error
 	DeleteSubject(subjectId string) error
 	GetSubjectById(subjectId string) (SubjectResponse, error)
+	SetSnapshotQuota(subjectId string, quota int) error
 }
 
 type SubjService struct {
@@ -148,12 +149,26 @@ func (s *SubjService) GetAllSubjects() ([]SubjectResponse, error) {
 	return subjectsResponse, nil
 }
 
+func (s *SubjService) SetSnapshotQuota(subjectId string, quota int) error {
+	if quota < 0 {
+		return NewHttpError(http.StatusBadRequest, fmt.Errorf("snapshot quota cannot be negative"))
+	}
+
+	// Check if subject exists
+	if err := s.db.SubjectExistsById(subjectId); err != nil {
+		return err
+	}
+
+	return s.db.SetSubjectSnapshotQuota(subjectId, quota)
+}
+
 func (createSubjReq *CreateSubjectRequest) toSubject() Subject {
 	return Subject{
 		ID:            uuid.New(),
 		Name:          createSubjReq.Name,
 		Code:          createSubjReq.Code,
 		ProfessorMail: createSubjReq.MainProfessor,
+		Isolated:      createSubjReq.Isolated,
 	}
 }
 
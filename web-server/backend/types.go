@@ -1,6 +1,10 @@
 package main
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type User struct {
 	ID            uuid.UUID
@@ -25,6 +29,7 @@ type Subject struct {
 	Code          string
 	ProfessorMail string
 	ProfessorName string // Added to store the professor's name
+	Isolated      bool   // Every student gets its own network segment
 }
 
 type UserResponse struct {
@@ -51,6 +56,7 @@ type CreateSubjectRequest struct {
 	Name          string `json:"name"`
 	Code          string `json:"code"`
 	MainProfessor string `json:"professorMail"`
+	Isolated      bool   `json:"isolated"`
 }
 
 type SubjectResponse struct {
@@ -59,6 +65,7 @@ type SubjectResponse struct {
 	Code          string    `json:"code"`
 	ProfessorMail string    `json:"professorMail"`
 	ProfessorName string    `json:"professorName"`
+	Isolated      bool      `json:"isolated"`
 }
 
 type ValidateUserRequest struct {
@@ -67,7 +74,10 @@ type ValidateUserRequest struct {
 }
 
 type ValidateUserResponse struct {
-	ID uuid.UUID `json:"id"`
+	ID        uuid.UUID `json:"id"`
+	Role      Role      `json:"role"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
 }
 
 type CreateInstanceFrontendRequest struct {
@@ -80,6 +90,8 @@ type CreateInstanceFrontendRequest struct {
 	SizeMB        int      `json:"sizeMB"`
 	VcpuCount     int      `json:"vcpuCount"`
 	VramMB        int      `json:"vramMB"`
+	// WgPublicKey is set when the key pair is generated client-side, the private key never leaves the device
+	WgPublicKey string `json:"wgPublicKey,omitempty"`
 }
 
 type CreateInstanceFrontendResponse struct {
@@ -100,6 +112,8 @@ type DefineTemplateRequest struct {
 	SubjectId        string `json:"subjectId"`
 	Description      string `json:"description"`
 	IsValidated      bool   `json:"isValidated"`
+	// Set to the VM manager operation id, so retried requests don't define the template twice
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 type UpdateUserRequest struct {
@@ -116,4 +130,241 @@ type ServerStatus struct {
 	TotalDiskMB      int      `json:"totalDiskMB"`
 	FreeDiskMB       int      `json:"freeDiskMB"`
 	RunningInstances []string `json:"runningInstances"`
-}
\ No newline at end of file
+}
+
+type CreateSnapshotFrontendRequest struct {
+	UserId      string `json:"userId"`
+	InstanceId  string `json:"instanceId"`
+	Description string `json:"description"`
+}
+
+type CreateSnapshotFrontendResponse struct {
+	SnapshotId string `json:"snapshotId"`
+}
+
+type CreateConsoleTicketFrontendRequest struct {
+	UserId     string `json:"userId"`
+	InstanceId string `json:"instanceId"`
+}
+
+type CreateConsoleTicketFrontendResponse struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type SetSnapshotQuotaRequest struct {
+	Quota int `json:"quota"`
+}
+
+// A lab topology is a set of VMs linked by internal networks, e.g. a router, a client and a server.
+// Every student instantiates it as a lab with its own VMs and networks
+type LabTopologyDefinition struct {
+	Networks []string          `json:"networks"`
+	Nodes    []LabTopologyNode `json:"nodes"`
+}
+
+type LabTopologyNode struct {
+	Name       string `json:"name"`
+	SourceVmId string `json:"sourceVmId"` // A template of the subject or a base
+	// Only used when the source is a base, templates have their own
+	SizeMB     int                    `json:"sizeMB,omitempty"`
+	VcpuCount  int                    `json:"vcpuCount,omitempty"`
+	VramMB     int                    `json:"vramMB,omitempty"`
+	Interfaces []LabTopologyInterface `json:"interfaces"`
+}
+
+type LabTopologyInterface struct {
+	Network         string `json:"network"`
+	IpAddWithSubnet string `json:"ipAddWithSubnet,omitempty"`
+}
+
+type CreateLabTopologyRequest struct {
+	SubjectId  string                `json:"subjectId"`
+	Name       string                `json:"name"`
+	Definition LabTopologyDefinition `json:"definition"`
+}
+
+type CreateLabTopologyResponse struct {
+	TopologyId string `json:"topologyId"`
+}
+
+type LabTopologyResponse struct {
+	ID         string                `json:"id"`
+	SubjectId  string                `json:"subjectId"`
+	Name       string                `json:"name"`
+	Definition LabTopologyDefinition `json:"definition"`
+	CreatedAt  time.Time             `json:"createdAt"`
+}
+
+type CreateLabFrontendRequest struct {
+	UserId        string   `json:"userId"`
+	TopologyId    string   `json:"topologyId"`
+	Username      string   `json:"username"`
+	Password      string   `json:"password"`
+	PublicSshKeys []string `json:"publicSshKeys"`
+}
+
+type LabResponse struct {
+	ID           string                `json:"id"`
+	TopologyId   string                `json:"topologyId"`
+	TopologyName string                `json:"topologyName"`
+	UserId       string                `json:"userId"`
+	SubjectId    string                `json:"subjectId"`
+	CreatedAt    time.Time             `json:"createdAt"`
+	Instances    []LabInstanceResponse `json:"instances"`
+}
+
+type LabInstanceResponse struct {
+	InstanceId string `json:"instanceId"`
+	NodeName   string `json:"nodeName"`
+}
+
+// FirewallRule filters the connections opened between an instance and the external network, the VM manager validates it
+type FirewallRule struct {
+	Direction string `json:"direction"` // egress or ingress
+	Action    string `json:"action"`    // accept or drop
+	Protocol  string `json:"protocol,omitempty"`
+	Ports     string `json:"ports,omitempty"`
+	Remote    string `json:"remote,omitempty"`
+}
+
+// CreateFirewallPolicyRequest applies to the instances of the subject, or only the ones of the template when it's set
+type CreateFirewallPolicyRequest struct {
+	Name       string         `json:"name"`
+	SubjectId  string         `json:"subjectId"`
+	TemplateId *string        `json:"templateId,omitempty"`
+	Rules      []FirewallRule `json:"rules"`
+}
+
+type CreateFirewallPolicyResponse struct {
+	PolicyId string `json:"policyId"`
+}
+
+type UpdateFirewallPolicyRequest struct {
+	Name  string         `json:"name"`
+	Rules []FirewallRule `json:"rules"`
+}
+
+type FirewallPolicyResponse struct {
+	Id         string         `json:"id"`
+	Name       string         `json:"name"`
+	SubjectId  string         `json:"subjectId"`
+	TemplateId *string        `json:"templateId,omitempty"`
+	Rules      []FirewallRule `json:"rules"`
+	CreatedAt  time.Time      `json:"createdAt"`
+}
+
+// RequestPortForwardRequest asks a professor of the subject to make a port of the instance public for a while
+type RequestPortForwardRequest struct {
+	UserId        string `json:"userId"`
+	InstanceId    string `json:"instanceId"`
+	Protocol      string `json:"protocol"` // tcp or udp
+	InternalPort  int    `json:"internalPort"`
+	DurationHours int    `json:"durationHours"`
+	Reason        string `json:"reason"`
+}
+
+type RequestPortForwardResponse struct {
+	RequestId string `json:"requestId"`
+}
+
+// PortForwardRequestResponse has the public address of the instance port while the forward is approved and not expired
+type PortForwardRequestResponse struct {
+	Id            string     `json:"id"`
+	InstanceId    string     `json:"instanceId"`
+	SubjectId     string     `json:"subjectId"`
+	UserId        string     `json:"userId"`
+	UserMail      string     `json:"userMail"`
+	Protocol      string     `json:"protocol"`
+	InternalPort  int        `json:"internalPort"`
+	DurationHours int        `json:"durationHours"`
+	Reason        string     `json:"reason"`
+	Status        string     `json:"status"` // pending, approved, rejected or expired
+	PublicAddress *string    `json:"publicAddress,omitempty"`
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	DecidedAt     *time.Time `json:"decidedAt,omitempty"`
+}
+
+type CreatePortForwardRequest struct {
+	InstanceId   string     `json:"instanceId"`
+	Protocol     string     `json:"protocol"`
+	InternalPort int        `json:"internalPort"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+}
+
+type CreatePortForwardResponse struct {
+	PortForwardId string `json:"portForwardId"`
+	ExternalPort  int    `json:"externalPort"`
+}
+
+// AddWireguardPeerRequest adds a device to connect to the instance from, e.g. a lab computer besides a laptop
+type AddWireguardPeerRequest struct {
+	InstanceId string `json:"instanceId"`
+	Name       string `json:"name"`
+	// PublicKey is set when the key pair is generated client-side
+	PublicKey string `json:"publicKey,omitempty"`
+}
+
+// WireguardPeer is a device of the owner of the instance, its config is downloaded separately
+type WireguardPeer struct {
+	Id          string    `json:"id"`
+	InstanceId  string    `json:"instanceId"`
+	Name        string    `json:"name"`
+	PublicKey   string    `json:"publicKey"`
+	InterfaceIp string    `json:"interfaceIp"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type CreateWireguardPeerRequest struct {
+	InstanceId string `json:"instanceId"`
+	Name       string `json:"name"`
+	PublicKey  string `json:"publicKey"`
+}
+
+// RotateWireguardKeyRequest issues a new key pair for an instance, or registers the public key of one generated client-side
+type RotateWireguardKeyRequest struct {
+	PublicKey string `json:"publicKey,omitempty"`
+}
+
+type CreateWireguardPeerResponse struct {
+	PeerId           string   `json:"peerId"`
+	InterfaceAddress string   `json:"interfaceAddress"`
+	PeerPublicKey    string   `json:"peerPublicKey"`
+	PeerAllowedIps   []string `json:"peerAllowedIps"`
+	PeerEndpointPort int      `json:"peerEndpointPort"`
+}
+
+// VmManagerVm is an instance or template known to the VM manager, templates have no subject there
+type VmManagerVm struct {
+	VmId       string `json:"vmId"`
+	SubjectId  string `json:"subjectId,omitempty"`
+	IsTemplate bool   `json:"isTemplate"`
+}
+
+// VmManagerSyncFinding is an instance or template only one of the web server and the VM manager knows about,
+// or an operation of the outbox that could not be finished
+type VmManagerSyncFinding struct {
+	Kind        string `json:"kind"`
+	VmId        string `json:"vmId"`
+	IsTemplate  bool   `json:"isTemplate"`
+	SubjectId   string `json:"subjectId,omitempty"`
+	Detail      string `json:"detail"`
+	Repaired    bool   `json:"repaired"`
+	RepairError string `json:"repairError,omitempty"`
+}
+
+type VmManagerSyncReport struct {
+	StartedAt     time.Time              `json:"startedAt"`
+	FinishedAt    time.Time              `json:"finishedAt"`
+	RepairEnabled bool                   `json:"repairEnabled"`
+	Findings      []VmManagerSyncFinding `json:"findings"`
+	// Parts that could not be checked
+	Warnings []string `json:"warnings"`
+}
+
+// InstanceEvent is streamed to the dashboards when the status of an instance changes
+type InstanceEvent struct {
+	InstanceId string `json:"instanceId"`
+	Status     string `json:"status"`
+}
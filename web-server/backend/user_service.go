@@ -169,7 +169,8 @@ func (user User) toUserResponse() UserResponse {
 
 func (user User) toValidateUserResponse() ValidateUserResponse {
 	return ValidateUserResponse{
-		ID: user.ID,
+		ID:   user.ID,
+		Role: user.Role,
 	}
 }
 
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const DEFAULT_VM_MANAGER_SYNC_INTERVAL_MINUTES = 10
+
+// Requests give up waiting for the VM manager after VM_MANAGER_JOB_TIMEOUT, so operations still pending
+// a while after that were abandoned and the sync job takes them over
+const VM_MANAGER_OPERATION_GRACE_PERIOD = VM_MANAGER_JOB_TIMEOUT + 5*time.Minute
+
+// Abandoned operations are given up and reported after failing this many times
+const VM_MANAGER_OPERATION_MAX_ATTEMPTS = 10
+
+const (
+	VM_MANAGER_OPERATION_CREATE_INSTANCE = "create_instance"
+	VM_MANAGER_OPERATION_DELETE_INSTANCE = "delete_instance"
+	VM_MANAGER_OPERATION_DEFINE_TEMPLATE = "define_template"
+	VM_MANAGER_OPERATION_DELETE_TEMPLATE = "delete_template"
+)
+
+const (
+	VM_MANAGER_OPERATION_PENDING = "pending"
+	VM_MANAGER_OPERATION_DONE    = "done"
+	// The VM created by the operation was deleted because the record of the web server could not be created
+	VM_MANAGER_OPERATION_COMPENSATED = "compensated"
+	VM_MANAGER_OPERATION_FAILED      = "failed"
+)
+
+const (
+	// Instance or template in the VM manager the web server doesn't know about
+	SYNC_FINDING_VM_MANAGER_ONLY = "vm_manager_only"
+	// Instance or template in the web server the VM manager doesn't have
+	SYNC_FINDING_WEB_SERVER_ONLY = "web_server_only"
+	// Abandoned operation given up after failing too many times
+	SYNC_FINDING_FAILED_OPERATION = "failed_operation"
+)
+
+// vmManagerSyncFinding is a finding and how to repair it, nil when it's only reported
+type vmManagerSyncFinding struct {
+	finding VmManagerSyncFinding
+	repair  func() error
+}
+
+// vmManagerSyncState is what both sides know about when the sync starts
+type vmManagerSyncState struct {
+	vms         []VmManagerVm
+	instanceIds []string
+	templates   []TemplateDb
+	hasVm       map[string]bool
+	hasInstance map[string]bool
+	hasTemplate map[string]bool
+}
+
+func getVmManagerSyncInterval() time.Duration {
+	intervalMinutes := DEFAULT_VM_MANAGER_SYNC_INTERVAL_MINUTES
+	if value := os.Getenv("VM_MANAGER_SYNC_INTERVAL_MINUTES"); value != "" {
+		minutes, err := strconv.Atoi(value)
+		if err != nil || minutes < 0 {
+			log.Printf("Invalid VM_MANAGER_SYNC_INTERVAL_MINUTES %q, using %d minutes", value, DEFAULT_VM_MANAGER_SYNC_INTERVAL_MINUTES)
+		} else {
+			intervalMinutes = minutes
+		}
+	}
+
+	return time.Duration(intervalMinutes) * time.Minute
+}
+
+// startVmManagerOperation records an operation in the outbox before calling the VM manager,
+// vmId is empty when the operation creates the VM
+func (s *InstanceServiceImpl) startVmManagerOperation(kind string, vmId string, subjectId string) (string, error) {
+	operation := VmManagerOperationDb{
+		ID:   uuid.New().String(),
+		Kind: kind,
+	}
+	if vmId != "" {
+		operation.VmId = &vmId
+	}
+	if subjectId != "" {
+		operation.SubjectId = &subjectId
+	}
+
+	if err := s.db.CreateVmManagerOperation(operation); err != nil {
+		return "", err
+	}
+
+	return operation.ID, nil
+}
+
+// The outbox is updated on a best-effort basis after the call, the sync job finishes what's left pending
+func (s *InstanceServiceImpl) setVmManagerOperationVmId(operationId string, vmId string) {
+	if err := s.db.SetVmManagerOperationVmId(operationId, vmId); err != nil {
+		log.Printf("Error recording VM %s of operation %s: %v", vmId, operationId, err)
+	}
+}
+
+func (s *InstanceServiceImpl) finishVmManagerOperation(operationId string, status string, operationErr error) {
+	lastError := ""
+	if operationErr != nil {
+		lastError = operationErr.Error()
+	}
+
+	if err := s.db.FinishVmManagerOperation(operationId, status, lastError); err != nil {
+		log.Printf("Error finishing VM manager operation %s: %v", operationId, err)
+	}
+}
+
+func (s *InstanceServiceImpl) recordVmManagerOperationError(operationId string, operationErr error) {
+	if err := s.db.RecordVmManagerOperationError(operationId, operationErr.Error()); err != nil {
+		log.Printf("Error updating VM manager operation %s: %v", operationId, err)
+	}
+}
+
+// compensateVmManagerOperation deletes the VM created by an operation whose record could not be created,
+// the operation is left pending for the sync job if the VM can't be deleted
+func (s *InstanceServiceImpl) compensateVmManagerOperation(operationId string, vmId string, isTemplate bool, cause error) {
+	deleteVm := s.deleteInstanceInVmManager
+	if isTemplate {
+		deleteVm = s.deleteTemplateInVmManager
+	}
+
+	if err := deleteVm(vmId); err != nil {
+		log.Printf("Error deleting VM %s left by operation %s: %v", vmId, operationId, err)
+		s.recordVmManagerOperationError(operationId, err)
+		return
+	}
+
+	log.Printf("VM %s left by operation %s deleted", vmId, operationId)
+	s.finishVmManagerOperation(operationId, VM_MANAGER_OPERATION_COMPENSATED, cause)
+}
+
+// GetVmManagerSyncReport returns the report of the last sync, empty if none ran yet
+func (s *InstanceServiceImpl) GetVmManagerSyncReport() (VmManagerSyncReport, error) {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+
+	if s.lastSyncReport == nil {
+		return VmManagerSyncReport{
+			RepairEnabled: s.syncRepair,
+			Findings:      []VmManagerSyncFinding{},
+			Warnings:      []string{},
+		}, nil
+	}
+
+	return *s.lastSyncReport, nil
+}
+
+// RunVmManagerSync compares the web server and the VM manager now
+func (s *InstanceServiceImpl) RunVmManagerSync() (VmManagerSyncReport, error) {
+	return s.syncWithVmManager(), nil
+}
+
+func (s *InstanceServiceImpl) runVmManagerSync() {
+	for {
+		time.Sleep(s.syncInterval)
+
+		report := s.syncWithVmManager()
+		if len(report.Findings) > 0 {
+			log.Printf("VM manager sync found %d inconsistencies", len(report.Findings))
+		}
+	}
+}
+
+// syncWithVmManager finishes the abandoned operations of the outbox and reports the instances and templates
+// only one side knows about. When repairing is enabled, the ones also found by the previous run are deleted
+// from the side that has them
+func (s *InstanceServiceImpl) syncWithVmManager() VmManagerSyncReport {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+
+	report := VmManagerSyncReport{
+		StartedAt:     time.Now(),
+		RepairEnabled: s.syncRepair,
+		Findings:      []VmManagerSyncFinding{},
+		Warnings:      []string{},
+	}
+
+	// Operations are read first, the VMs they create or delete afterwards are excluded or seen
+	// with their records
+	if err := s.db.DeleteFinishedVmManagerOperations(); err != nil {
+		report.Warnings = append(report.Warnings, err.Error())
+	}
+
+	operations, err := s.db.GetPendingVmManagerOperations(VM_MANAGER_OPERATION_GRACE_PERIOD)
+	if err != nil {
+		return s.finishVmManagerSyncReport(report, err)
+	}
+
+	state, err := s.getVmManagerSyncState()
+	if err != nil {
+		return s.finishVmManagerSyncReport(report, err)
+	}
+
+	operationInFlight := false
+	operationVmIds := map[string]bool{}
+	for _, operation := range operations {
+		if operation.VmId != nil {
+			operationVmIds[*operation.VmId] = true
+		}
+
+		if !operation.Abandoned {
+			operationInFlight = true
+			continue
+		}
+
+		if err := s.finishAbandonedOperation(operation, state); err != nil {
+			log.Printf("Error finishing VM manager operation %s: %v", operation.ID, err)
+			if operation.Attempts+1 < VM_MANAGER_OPERATION_MAX_ATTEMPTS {
+				s.recordVmManagerOperationError(operation.ID, err)
+				report.Warnings = append(report.Warnings, fmt.Sprintf("operation %s: %v", operation.ID, err))
+				continue
+			}
+
+			s.finishVmManagerOperation(operation.ID, VM_MANAGER_OPERATION_FAILED, err)
+			finding := VmManagerSyncFinding{
+				Kind:       SYNC_FINDING_FAILED_OPERATION,
+				IsTemplate: operation.Kind == VM_MANAGER_OPERATION_DEFINE_TEMPLATE || operation.Kind == VM_MANAGER_OPERATION_DELETE_TEMPLATE,
+				Detail:     fmt.Sprintf("%s operation %s given up: %v", operation.Kind, operation.ID, err),
+			}
+			if operation.VmId != nil {
+				finding.VmId = *operation.VmId
+			}
+			report.Findings = append(report.Findings, finding)
+		}
+	}
+
+	findings, warnings := s.findVmManagerSyncOrphans(state, operationVmIds)
+	report.Warnings = append(report.Warnings, warnings...)
+
+	foundFindings := map[string]bool{}
+	for _, finding := range findings {
+		key := getVmManagerSyncFindingKey(finding.finding)
+		foundFindings[key] = true
+
+		// VMs being created have no record yet and no ID in the outbox until the VM manager returns it
+		canRepair := finding.finding.Kind != SYNC_FINDING_VM_MANAGER_ONLY || !operationInFlight
+		if s.syncRepair && finding.repair != nil && s.previousSyncFindings[key] && canRepair {
+			if err := finding.repair(); err != nil {
+				log.Printf("Error repairing %s %s: %v", finding.finding.Kind, finding.finding.VmId, err)
+				finding.finding.RepairError = err.Error()
+			} else {
+				log.Printf("Repaired %s %s", finding.finding.Kind, finding.finding.VmId)
+				finding.finding.Repaired = true
+			}
+		}
+
+		report.Findings = append(report.Findings, finding.finding)
+	}
+
+	if s.syncRepair && operationInFlight {
+		report.Warnings = append(report.Warnings, "VMs only in the VM manager are not deleted while operations are in flight")
+	}
+
+	s.previousSyncFindings = foundFindings
+	return s.finishVmManagerSyncReport(report, nil)
+}
+
+func (s *InstanceServiceImpl) finishVmManagerSyncReport(report VmManagerSyncReport, err error) VmManagerSyncReport {
+	if err != nil {
+		log.Printf("Error syncing with the VM manager: %v", err)
+		report.Warnings = append(report.Warnings, err.Error())
+	}
+
+	report.FinishedAt = time.Now()
+	s.lastSyncReport = &report
+
+	return report
+}
+
+func (s *InstanceServiceImpl) getVmManagerSyncState() (vmManagerSyncState, error) {
+	state := vmManagerSyncState{
+		hasVm:       map[string]bool{},
+		hasInstance: map[string]bool{},
+		hasTemplate: map[string]bool{},
+	}
+
+	var err error
+	state.instanceIds, err = s.db.GetAllInstanceIds()
+	if err != nil {
+		return vmManagerSyncState{}, err
+	}
+	for _, instanceId := range state.instanceIds {
+		state.hasInstance[instanceId] = true
+	}
+
+	state.templates, err = s.db.GetAllTemplates()
+	if err != nil {
+		return vmManagerSyncState{}, err
+	}
+	for _, template := range state.templates {
+		state.hasTemplate[template.ID] = true
+	}
+
+	state.vms, err = s.listVmManagerVms()
+	if err != nil {
+		return vmManagerSyncState{}, err
+	}
+	for _, vm := range state.vms {
+		state.hasVm[vm.VmId] = true
+	}
+
+	return state, nil
+}
+
+// finishAbandonedOperation finishes what the request that started the operation left undone:
+// creations are completed if their record exists and undone otherwise, deletions are completed
+func (s *InstanceServiceImpl) finishAbandonedOperation(operation VmManagerOperationDb, state vmManagerSyncState) error {
+	if operation.VmId == nil {
+		// The VM manager never returned the VM, if it was created anyway it's found as only in the VM manager
+		s.finishVmManagerOperation(operation.ID, VM_MANAGER_OPERATION_FAILED, errors.New("the VM manager did not return the VM"))
+		return nil
+	}
+
+	vmId := *operation.VmId
+	inVmManager := state.hasVm[vmId]
+
+	switch operation.Kind {
+	case VM_MANAGER_OPERATION_CREATE_INSTANCE:
+		if state.hasInstance[vmId] {
+			s.finishVmManagerOperation(operation.ID, VM_MANAGER_OPERATION_DONE, nil)
+			return nil
+		}
+		if inVmManager {
+			if err := s.deleteInstanceInVmManager(vmId); err != nil {
+				return err
+			}
+		}
+		s.finishVmManagerOperation(operation.ID, VM_MANAGER_OPERATION_COMPENSATED, errors.New("the instance record was never created"))
+
+	case VM_MANAGER_OPERATION_DEFINE_TEMPLATE:
+		if state.hasTemplate[vmId] {
+			s.finishVmManagerOperation(operation.ID, VM_MANAGER_OPERATION_DONE, nil)
+			return nil
+		}
+		if inVmManager {
+			if err := s.deleteTemplateInVmManager(vmId); err != nil {
+				return err
+			}
+		}
+		s.finishVmManagerOperation(operation.ID, VM_MANAGER_OPERATION_COMPENSATED, errors.New("the template record was never created"))
+
+	case VM_MANAGER_OPERATION_DELETE_INSTANCE:
+		if inVmManager {
+			if err := s.deleteInstanceInVmManager(vmId); err != nil {
+				return err
+			}
+		}
+		if err := s.db.DeleteInstance(vmId); err != nil {
+			return err
+		}
+		s.finishVmManagerOperation(operation.ID, VM_MANAGER_OPERATION_DONE, nil)
+
+	case VM_MANAGER_OPERATION_DELETE_TEMPLATE:
+		if inVmManager {
+			if err := s.deleteTemplateInVmManager(vmId); err != nil {
+				return err
+			}
+		}
+		if operation.SubjectId != nil {
+			if err := s.db.DeleteTemplate(vmId, *operation.SubjectId); err != nil {
+				return err
+			}
+		}
+		s.finishVmManagerOperation(operation.ID, VM_MANAGER_OPERATION_DONE, nil)
+
+	default:
+		s.finishVmManagerOperation(operation.ID, VM_MANAGER_OPERATION_FAILED, fmt.Errorf("unknown operation kind %s", operation.Kind))
+	}
+
+	return nil
+}
+
+// findVmManagerSyncOrphans compares the instances and templates of both sides, skipping the ones
+// pending operations are working on
+func (s *InstanceServiceImpl) findVmManagerSyncOrphans(state vmManagerSyncState, operationVmIds map[string]bool) ([]vmManagerSyncFinding, []string) {
+	var findings []vmManagerSyncFinding
+	var warnings []string
+
+	for _, vm := range state.vms {
+		if operationVmIds[vm.VmId] {
+			continue
+		}
+
+		vmId := vm.VmId
+		if vm.IsTemplate && !state.hasTemplate[vmId] {
+			findings = append(findings, vmManagerSyncFinding{
+				finding: VmManagerSyncFinding{
+					Kind:       SYNC_FINDING_VM_MANAGER_ONLY,
+					VmId:       vmId,
+					IsTemplate: true,
+					Detail:     "template in the VM manager without a template record",
+				},
+				repair: func() error { return s.deleteTemplateInVmManager(vmId) },
+			})
+		} else if !vm.IsTemplate && !state.hasInstance[vmId] {
+			findings = append(findings, vmManagerSyncFinding{
+				finding: VmManagerSyncFinding{
+					Kind:      SYNC_FINDING_VM_MANAGER_ONLY,
+					VmId:      vmId,
+					SubjectId: vm.SubjectId,
+					Detail:    "instance in the VM manager without an instance record",
+				},
+				repair: func() error { return s.deleteInstanceInVmManager(vmId) },
+			})
+		}
+	}
+
+	for _, instanceId := range state.instanceIds {
+		if operationVmIds[instanceId] || state.hasVm[instanceId] {
+			continue
+		}
+
+		findings = append(findings, vmManagerSyncFinding{
+			finding: VmManagerSyncFinding{
+				Kind:   SYNC_FINDING_WEB_SERVER_ONLY,
+				VmId:   instanceId,
+				Detail: "instance record without an instance in the VM manager",
+			},
+			repair: func() error { return s.db.DeleteInstance(instanceId) },
+		})
+	}
+
+	// Templates made from a base take its ID and have no VM of their own
+	bases, err := s.Bases()
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("templates not checked, error getting bases: %v", err))
+		return findings, warnings
+	}
+
+	baseIds := map[string]bool{}
+	for _, base := range bases {
+		baseIds[base.Id] = true
+	}
+
+	for _, template := range state.templates {
+		if operationVmIds[template.ID] || baseIds[template.ID] || state.hasVm[template.ID] {
+			continue
+		}
+
+		templateId, subjectId := template.ID, template.SubjectId
+		findings = append(findings, vmManagerSyncFinding{
+			finding: VmManagerSyncFinding{
+				Kind:       SYNC_FINDING_WEB_SERVER_ONLY,
+				VmId:       templateId,
+				IsTemplate: true,
+				SubjectId:  subjectId,
+				Detail:     "template record without a template in the VM manager",
+			},
+			repair: func() error { return s.db.DeleteTemplate(templateId, subjectId) },
+		})
+	}
+
+	return findings, warnings
+}
+
+func getVmManagerSyncFindingKey(finding VmManagerSyncFinding) string {
+	return finding.Kind + "/" + finding.VmId + "/" + finding.SubjectId
+}
+
+// listVmManagerVms returns the instances and templates in the database of the VM manager
+func (s *InstanceServiceImpl) listVmManagerVms() ([]VmManagerVm, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/vms", s.vmManagerBaseUrl))
+	if err != nil {
+		return nil, fmt.Errorf("error calling VM manager API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var vms []VmManagerVm
+	if err := json.NewDecoder(resp.Body).Decode(&vms); err != nil {
+		return nil, fmt.Errorf("error decoding VM manager response: %w", err)
+	}
+
+	return vms, nil
+}
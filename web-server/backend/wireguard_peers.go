@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Every device takes an address of the subject network, so the devices of an instance are limited
+const MAX_WIREGUARD_PEERS_PER_INSTANCE = 5
+
+func (s *InstanceServiceImpl) AddWireguardPeer(request AddWireguardPeerRequest) (WireguardPeer, error) {
+	if request.Name == "" || len(request.Name) > 100 {
+		return WireguardPeer{}, NewHttpError(http.StatusBadRequest, fmt.Errorf("name must have between 1 and 100 characters"))
+	}
+
+	peers, err := s.db.GetWireguardPeersByInstanceId(request.InstanceId)
+	if err != nil {
+		return WireguardPeer{}, err
+	}
+
+	if len(peers) >= MAX_WIREGUARD_PEERS_PER_INSTANCE {
+		return WireguardPeer{}, NewHttpError(
+			http.StatusBadRequest,
+			fmt.Errorf("an instance can have up to %d extra devices, revoke one first", MAX_WIREGUARD_PEERS_PER_INSTANCE),
+		)
+	}
+
+	wgPrivateKey, wgPublicKey, err := s.getWireguardKeyPair(request.PublicKey)
+	if err != nil {
+		return WireguardPeer{}, err
+	}
+
+	jsonData, err := json.Marshal(CreateWireguardPeerRequest{
+		InstanceId: request.InstanceId,
+		Name:       request.Name,
+		PublicKey:  wgPublicKey,
+	})
+	if err != nil {
+		return WireguardPeer{}, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	resp, err := http.Post(
+		fmt.Sprintf("%s/instances/wireguard-peers/create", s.vmManagerBaseUrl),
+		"application/json",
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		return WireguardPeer{}, fmt.Errorf("error calling VM manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return WireguardPeer{}, fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var response CreateWireguardPeerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return WireguardPeer{}, fmt.Errorf("error decoding VM manager response: %w", err)
+	}
+
+	peer := WireguardPeerDb{
+		ID:               response.PeerId,
+		InstanceId:       request.InstanceId,
+		Name:             request.Name,
+		WgPrivateKey:     wgPrivateKey,
+		WgPublicKey:      wgPublicKey,
+		InterfaceIp:      response.InterfaceAddress,
+		PeerPublicKey:    response.PeerPublicKey,
+		PeerAllowedIps:   response.PeerAllowedIps,
+		PeerEndpointPort: response.PeerEndpointPort,
+	}
+	if err := s.db.CreateWireguardPeer(peer); err != nil {
+		// Without the private key the peer is useless, so it's revoked
+		if deleteErr := s.deleteWireguardPeerInVmManager(response.PeerId); deleteErr != nil {
+			log.Printf("Error deleting wireguard peer %s: %v", response.PeerId, deleteErr)
+		}
+		return WireguardPeer{}, err
+	}
+
+	log.Printf("Wireguard peer %s added to instance %s", peer.ID, peer.InstanceId)
+
+	return s.GetWireguardPeer(peer.ID)
+}
+
+func (s *InstanceServiceImpl) GetWireguardPeer(peerId string) (WireguardPeer, error) {
+	peer, err := s.db.GetWireguardPeer(peerId)
+	if err != nil {
+		return WireguardPeer{}, err
+	}
+
+	return toWireguardPeer(peer), nil
+}
+
+func (s *InstanceServiceImpl) GetWireguardPeersByInstanceId(instanceId string) ([]WireguardPeer, error) {
+	peers, err := s.db.GetWireguardPeersByInstanceId(instanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	response := []WireguardPeer{}
+	for _, peer := range peers {
+		response = append(response, toWireguardPeer(peer))
+	}
+
+	return response, nil
+}
+
+func (s *InstanceServiceImpl) GetWireguardPeerConfig(peerId string) (string, error) {
+	conf, err := s.db.GetWireguardPeerConfig(peerId)
+	if err != nil {
+		return "", fmt.Errorf("error getting WireGuard config: %w", err)
+	}
+
+	conf.PrivateKey, err = s.keyEncryptor.Decrypt(conf.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	return renderWireguardConfig(conf), nil
+}
+
+func (s *InstanceServiceImpl) DeleteWireguardPeer(peerId string) error {
+	if err := s.deleteWireguardPeerInVmManager(peerId); err != nil {
+		return err
+	}
+
+	if err := s.db.DeleteWireguardPeer(peerId); err != nil {
+		return err
+	}
+
+	log.Printf("Wireguard peer %s revoked", peerId)
+
+	return nil
+}
+
+// deleteWireguardPeerInVmManager removes the peer from the gateway, it's already gone if the VM manager doesn't know it
+func (s *InstanceServiceImpl) deleteWireguardPeerInVmManager(peerId string) error {
+	req, err := http.NewRequest(
+		http.MethodDelete,
+		fmt.Sprintf("%s/instances/wireguard-peers/delete/%s", s.vmManagerBaseUrl, peerId),
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager API: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling VM manager API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("VM manager returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+func toWireguardPeer(peer WireguardPeerDb) WireguardPeer {
+	return WireguardPeer{
+		Id:          peer.ID,
+		InstanceId:  peer.InstanceId,
+		Name:        peer.Name,
+		PublicKey:   peer.WgPublicKey,
+		InterfaceIp: peer.InterfaceIp,
+		CreatedAt:   peer.CreatedAt,
+	}
+}
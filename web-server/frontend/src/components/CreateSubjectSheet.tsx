@@ -40,6 +40,7 @@ const CreateSubjectSheet: React.FC = () => {
   const [error, setError] = React.useState('')
   const [codeError, setCodeError] = React.useState('')
   const [customizeVm, setCustomizeVm] = React.useState(false)
+  const [isolated, setIsolated] = React.useState(false)
   const [templateDescription, setTemplateDescription] = React.useState('')
   const [base, setBase] = React.useState('')
   const [vmRam, setVmRam] = React.useState('1')
@@ -193,6 +194,7 @@ const CreateSubjectSheet: React.FC = () => {
         vmStorage,
         templateDescription,
         customizeVm,
+        isolated,
         vmUsername,
         vmPassword,
       }
@@ -344,6 +346,19 @@ const CreateSubjectSheet: React.FC = () => {
                 )}
               </div>
 
+              <div>
+                <Checkbox
+                  id="isolated"
+                  checked={isolated}
+                  onChange={(e) => setIsolated(e.target.checked)}
+                  label="Isolate the virtual machines of each student"
+                />
+                <p className="mt-1 text-sm text-muted-foreground">
+                  If enabled, every student gets a private network for their
+                  virtual machines and can't reach the ones of other students.
+                </p>
+              </div>
+
               {/* VM Configuration Section */}
               <div className="border-t pt-4">
                 <h3 className="mb-4 text-lg font-semibold">
@@ -4,6 +4,7 @@ import { getEnv } from '@/utils/Env'
 import { useNavigate } from 'react-router-dom'
 import { AppRoutes } from '@/enums/AppRoutes'
 import { getUserIdFromCookie } from '@/utils/cookies'
+import { AUTH_TOKEN_COOKIE } from '@/lib/api'
 
 interface User {
   id: string
@@ -47,6 +48,7 @@ export const AuthProvider: React.FC<{ children: React.ReactNode }> = ({
           setUser(null)
           setIsLoggedIn(false)
           Cookies.remove('userId')
+          Cookies.remove(AUTH_TOKEN_COOKIE)
         })
         .finally(() => {
           setIsLoading(false)
@@ -79,8 +81,15 @@ export const AuthProvider: React.FC<{ children: React.ReactNode }> = ({
     }
   }
 
-  const handleSuccessfulAuth = async (userId: string) => {
-    Cookies.set('userId', userId, { expires: 7, sameSite: 'Lax' }) // Set cookie to expire in 7 days
+  const handleSuccessfulAuth = async (
+    userId: string,
+    token: string,
+    expiresAt: string
+  ) => {
+    // Both cookies expire with the session issued by the backend
+    const expires = new Date(expiresAt)
+    Cookies.set('userId', userId, { expires, sameSite: 'Lax' })
+    Cookies.set(AUTH_TOKEN_COOKIE, token, { expires, sameSite: 'Lax' })
     await fetchUserDetails(userId)
   }
 
@@ -98,7 +107,7 @@ export const AuthProvider: React.FC<{ children: React.ReactNode }> = ({
 
     if (response.ok) {
       const data = await response.json()
-      await handleSuccessfulAuth(data.id)
+      await handleSuccessfulAuth(data.id, data.token, data.expiresAt)
       navigate(AppRoutes.HOME)
       return {}
     } else {
@@ -132,9 +141,13 @@ export const AuthProvider: React.FC<{ children: React.ReactNode }> = ({
   }
 
   const logout = () => {
+    fetch(`${getEnv().API_BASE_URL}/auth/logout`, { method: 'POST' }).catch(
+      () => {}
+    )
     setUser(null)
     setIsLoggedIn(false)
     Cookies.remove('userId')
+    Cookies.remove(AUTH_TOKEN_COOKIE)
     navigate(AppRoutes.LOGIN)
   }
 
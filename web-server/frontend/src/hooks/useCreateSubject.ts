@@ -51,6 +51,7 @@ export interface CreateSubjectParams {
   vmStorage: string
   templateDescription: string
   customizeVm: boolean
+  isolated: boolean
   vmUsername: string
   vmPassword: string
 }
@@ -245,6 +246,7 @@ const useCreateSubject = (onSuccess: () => void) => {
       vmStorage,
       templateDescription,
       customizeVm,
+      isolated,
       vmUsername,
       vmPassword,
     } = params
@@ -280,6 +282,7 @@ const useCreateSubject = (onSuccess: () => void) => {
           name: subjectName,
           code: subjectCode,
           professorMail: user.mail,
+          isolated,
         }),
       })
       if (!subjectResponse.ok) {
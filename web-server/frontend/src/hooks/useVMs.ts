@@ -1,4 +1,4 @@
-import { useState, useEffect, useCallback } from 'react'
+import { useState, useEffect, useCallback, useRef } from 'react'
 import { useToast } from '@/hooks/use-toast'
 import { VMListItem } from '@/types/vm'
 import { useAuth } from '@/context/AuthContext'
@@ -6,6 +6,7 @@ import { getEnv } from '@/utils/Env'
 
 export const useVMs = () => {
   const [vms, setVms] = useState<VMListItem[]>([])
+  const vmsRef = useRef<VMListItem[]>([])
   const [loading, setLoading] = useState(true)
   const { toast } = useToast()
   const { user } = useAuth()
@@ -57,5 +58,42 @@ export const useVMs = () => {
     fetchVMs()
   }, [fetchVMs])
 
+  useEffect(() => {
+    vmsRef.current = vms
+  }, [vms])
+
+  // The backend streams the status changes of the user's instances, e.g. when one finishes
+  // booting. EventSource can't set headers, the session cookie authenticates it
+  useEffect(() => {
+    if (!user?.id) {
+      return
+    }
+
+    const events = new EventSource(
+      getEnv().API_INSTANCE_EVENTS.replace('{userId}', user.id),
+      { withCredentials: true }
+    )
+
+    events.onmessage = (message) => {
+      const event: { instanceId: string; status: string } = JSON.parse(
+        message.data
+      )
+      // An instance created in another tab
+      if (!vmsRef.current.some((vm) => vm.instanceId === event.instanceId)) {
+        fetchVMs()
+        return
+      }
+      setVms((current) =>
+        current.map((vm) =>
+          vm.instanceId === event.instanceId
+            ? { ...vm, status: event.status }
+            : vm
+        )
+      )
+    }
+
+    return () => events.close()
+  }, [user?.id, fetchVMs])
+
   return { vms, loading, refresh: fetchVMs }
 }
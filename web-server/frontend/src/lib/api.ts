@@ -1,19 +1,31 @@
-// This file previously used axios for API requests, but axios is no longer used in the project.
-// If you need to add API utilities, you can implement them here using fetch or another library.
-// import axios, { AxiosRequestConfig } from "axios";
+import Cookies from 'js-cookie'
+import { getEnv } from '@/utils/Env'
 
-// export const api = axios.create({
-//   baseURL: import.meta.env.VITE_API_URL || "http://localhost:8080",
-//   headers: {
-//     "Content-Type": "application/json",
-//   },
-// });
+export const AUTH_TOKEN_COOKIE = 'token'
 
-// // Add request interceptor to include auth token
-// api.interceptors.request.use((config: AxiosRequestConfig) => {
-//   const token = localStorage.getItem("token");
-//   if (token && config.headers) {
-//     config.headers.Authorization = `Bearer ${token}`;
-//   }
-//   return config;
-// });
\ No newline at end of file
+// Every request to the backend must carry the session issued at login, instead of
+// touching each fetch call the global fetch is wrapped once at startup
+export const installAuthenticatedFetch = () => {
+  const originalFetch = window.fetch.bind(window)
+
+  window.fetch = (input: RequestInfo | URL, init?: RequestInit) => {
+    const url =
+      typeof input === 'string'
+        ? input
+        : input instanceof URL
+          ? input.toString()
+          : input.url
+
+    if (!url.startsWith(getEnv().API_BASE_URL)) {
+      return originalFetch(input, init)
+    }
+
+    const headers = new Headers(init?.headers)
+    const token = Cookies.get(AUTH_TOKEN_COOKIE)
+    if (token && !headers.has('Authorization')) {
+      headers.set('Authorization', `Bearer ${token}`)
+    }
+
+    return originalFetch(input, { ...init, headers, credentials: 'include' })
+  }
+}
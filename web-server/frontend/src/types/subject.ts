@@ -4,6 +4,7 @@ export interface Subject {
   code: string
   professorName: string
   professorMail: string
+  isolated: boolean
 }
 
 export interface VM {
@@ -15,6 +15,7 @@ export const getEnv = () => {
     API_DELETE_SUBJECT: `${API_BASE_URL}/subjects/{id}`,
     API_DELETE_INSTANCE: `${API_BASE_URL}/instances/delete/{instanceId}`,
     API_GET_INSTANCE_STATUS: `${API_BASE_URL}/instances/status/{userId}`,
+    API_INSTANCE_EVENTS: `${API_BASE_URL}/instances/events/{userId}`,
     API_GET_INSTANCE: `${API_BASE_URL}/instances/{instanceId}`,
     API_START_INSTANCE: `${API_BASE_URL}/instances/start/{instanceId}`,
     API_STOP_INSTANCE: `${API_BASE_URL}/instances/stop/{instanceId}`,